@@ -4,8 +4,9 @@
 package main
 
 import (
+	"context"
 	_ "embed"
-	"html/template"
+	"fmt"
 	"io/fs"
 	"net"
 	"net/http"
@@ -15,10 +16,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	hydra "github.com/ory/hydra-client-go"
-	"github.com/sendgrid/sendgrid-go"
 	"github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
 
@@ -26,9 +27,11 @@ import (
 	"gopkg.hrry.dev/homelab/files"
 	frontend "gopkg.hrry.dev/homelab/frontend/legacy"
 	"gopkg.hrry.dev/homelab/pkg/app"
+	"gopkg.hrry.dev/homelab/pkg/app/chat"
 	"gopkg.hrry.dev/homelab/pkg/auth"
 	"gopkg.hrry.dev/homelab/pkg/db"
 	"gopkg.hrry.dev/homelab/pkg/email"
+	"gopkg.hrry.dev/homelab/pkg/email/templates"
 	"gopkg.hrry.dev/homelab/pkg/invite"
 	"gopkg.hrry.dev/homelab/pkg/log"
 	"gopkg.hrry.dev/homelab/pkg/web"
@@ -66,12 +69,14 @@ func main() {
 		env           []string
 		e             = echo.New()
 		runMigrations bool
+		inviteMode    = getenv("API_INVITE_MODE", "db")
 	)
 	flag.StringVarP(&port, "port", "p", port, "the port to run the server on")
 	flag.StringArrayVar(&env, "env", env, "environment files")
 	flag.StringVar(&cookieDomain, "token-cookie-domain", cookieDomain, "domain for cookies")
 	flag.BoolVarP(&app.Debug, "debug", "d", app.Debug, "run the app in debug mode")
 	flag.BoolVar(&runMigrations, "run-migrations", runMigrations, "run database migrations")
+	flag.StringVar(&inviteMode, "invite-mode", inviteMode, "invite storage mode (db or token)")
 	flag.Parse()
 
 	logger.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339})
@@ -116,12 +121,33 @@ func main() {
 	defer db.Close()
 	defer rd.Close()
 
+	jwtConf := app.NewTokenConfig()
 	userStore := app.NewUserStore(db)
-	mailer := SetupMailer()
-	invites := app.NewInvitations(rd, &InvitePathBuilder{"/invite"}, mailer)
+	var (
+		sender email.Sender
+		// Webhooks are queued in the outbox even when email is disabled.
+		outbox = email.NewOutbox(db, nil)
+	)
+	if s := setupEmail(); s != nil {
+		// Emails are queued and sent in the background so that requests don't
+		// fail when the email provider is down.
+		outbox.Sender = s
+		outbox.Suppressions = email.NewPGSuppressionList(db)
+		sender = outbox
+	}
+	emailTemplates := setupEmailTemplates()
+	mailer := SetupMailer(emailTemplates, sender)
+	// jobs is cancelled when the server shuts down.
+	jobs, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+	invites := app.NewInvitations(newInviteStore(jobs, inviteMode, db, rd, jwtConf), &InvitePathBuilder{"/invite"}, mailer)
+	invites.Notifier = newInviteNotifier(db, emailTemplates, sender, outbox)
+	go outbox.Run(jobs, outboxInterval)
+	chatStore := chat.NewStore(db)
+	invites.Rooms = chatStore
+	invites.DB = db
 	sessions := app.NewSessionManager(rd, cookieDomain)
 
-	jwtConf := app.NewTokenConfig()
 	guard := auth.GuardMiddleware(jwtConf)
 	e.Pre(echo.WrapMiddleware(web.AccessLog(logger)))
 	e.Use(
@@ -144,6 +170,7 @@ func main() {
 		Users:        userStore,
 		HydraAdmin:   hydra.NewAPIClient(app.HydraAdminConfig()).AdminApi,
 		CookieDomain: cookieDomain,
+		Sessions:     sessions,
 	}
 	api := e.Group("/api")
 	api.POST("/token", tokenSrv.Token)
@@ -165,16 +192,20 @@ func main() {
 	api.OPTIONS("/consent", func(c echo.Context) error { return nil })
 	api.OPTIONS("/login", func(c echo.Context) error { return nil })
 
-	//withUser := auth.ImplicitUser(jwtConf)
-	//chatStore := chat.NewStore(db)
-	//api.POST("/chat/room", app.CreateChatRoom(chatStore), guard)
-	//api.GET("/chat/:id/room", app.GetRoom(chatStore), withUser)
-	//api.GET("/chat/:id/connect", app.ChatRoomConnect(chatStore, rd), withUser)
-	//api.GET("/chat/:id/messages", app.ListMessages(chatStore), withUser)
+	app.RegisterChatRoutes(api, chatStore, rd, guard, auth.ImplicitUser(jwtConf))
 
 	api.POST("/invite/create", invites.Create(), guard)
 	api.DELETE("/invite/:id", invites.Delete(), guard)
-	api.GET("/invites", invites.List(), guard, auth.AdminOnly())
+	api.GET("/invites", invites.List(), guard)
+	api.GET("/me/sessions", app.ListMySessions(sessions), guard)
+	api.DELETE("/me/sessions", app.DeleteMySessions(sessions), guard)
+	api.DELETE("/me/sessions/:id", app.DeleteMySession(sessions), guard)
+	api.GET("/admin/users/:id/sessions", app.ListUserSessions(sessions), guard, auth.AdminOnly())
+	api.DELETE("/admin/users/:id/sessions", app.DeleteUserSessions(sessions), guard, auth.AdminOnly())
+	api.GET("/admin/email/templates", app.ListEmailTemplates(emailTemplates), guard, auth.AdminOnly())
+	api.GET("/admin/email/templates/:name/preview", app.PreviewEmailTemplate(emailTemplates), guard, auth.AdminOnly())
+	api.GET("/admin/outbox", app.ListOutbox(outbox), guard, auth.AdminOnly())
+	api.POST("/admin/outbox/:id/retry", app.RetryOutbox(outbox), guard, auth.AdminOnly())
 
 	logger.WithFields(logrus.Fields{"time": app.StartTime}).Info("server starting")
 	if web.SSLCertificateFileFlag != "" && web.SSLKeyFileFlag != "" {
@@ -216,12 +247,20 @@ func HandleCORS(w http.ResponseWriter, r *http.Request) {
 	)
 }
 
-func newInviteMailer(client *sendgrid.Client) invite.Mailer {
+const (
+	outboxInterval      = time.Second * 15
+	ledgerPruneInterval = time.Hour
+)
+
+func newInviteMailer(reg *templates.Registry, sender email.Sender) invite.Mailer {
+	t, err := reg.Get("invite")
+	if err != nil {
+		logger.Fatal(err)
+	}
 	m, err := invite.NewMailer(
 		email.Email{Name: "Harry Brown", Address: "admin@harrybrwn.com"},
-		"You're Invited!",
-		template.Must(template.New("email-invite").Parse(string(frontend.InviteEmailHTML))),
-		client,
+		t,
+		sender,
 	)
 	if err != nil {
 		logger.Fatal(err)
@@ -229,19 +268,79 @@ func newInviteMailer(client *sendgrid.Client) invite.Mailer {
 	return m
 }
 
+func newInviteNotifier(d db.DB, reg *templates.Registry, sender email.Sender, outbox *email.Outbox) invite.Notifier {
+	notifier := invite.RedemptionNotifier{
+		Prefs: invite.NewPGPreferenceStore(d),
+		Queue: outbox,
+	}
+	outbox.Handle(invite.WebhookKind, &notifier)
+	outbox.Handle(invite.MailKind, notifier.MailHandler())
+	if sender != nil {
+		t, err := reg.Get("invite_redeemed")
+		if err != nil {
+			logger.Fatal(err)
+		}
+		m, err := invite.NewEventMailer(
+			email.Email{Name: "Harry Brown", Address: "admin@harrybrwn.com"},
+			t,
+			sender,
+		)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		notifier.Mailer = m
+	}
+	return &notifier
+}
+
+func newInviteStore(ctx context.Context, mode string, d db.DB, rd redis.Cmdable, conf auth.TokenConfig) invite.Store {
+	switch mode {
+	case "token":
+		// Signed invite links that work when redis is down.
+		ledger := invite.NewPGLedger(d)
+		if p, ok := ledger.(invite.Pruner); ok {
+			go invite.RunPruner(ctx, p, ledgerPruneInterval)
+		}
+		return invite.NewTokenStore(conf, ledger)
+	case "db", "":
+		return invite.NewPGStore(d, rd)
+	default:
+		logger.Fatalf("unknown invite mode %q", mode)
+		return nil
+	}
+}
+
 func invitePageHandler(body []byte, contentType, debugFile string, invitations *app.Invitations) echo.HandlerFunc {
 	return invitations.Accept(body, contentType)
 }
 
-func SetupMailer() invite.Mailer {
-	var mailer invite.Mailer
-	if emailClient := app.SendgridClient(); emailClient != nil {
-		mailer = newInviteMailer(emailClient)
-		logger.Info("found sendgrid api key")
+func setupEmail() email.Sender {
+	sender, err := app.EmailSender()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if sender == nil {
+		logger.Info("emailing disabled: no email transport configured")
 	} else {
-		logger.Info("emailing disabled: no sendgrid api key")
+		logger.WithField("transport", fmt.Sprintf("%T", sender)).Info("email transport configured")
+	}
+	return sender
+}
+
+func SetupMailer(reg *templates.Registry, sender email.Sender) invite.Mailer {
+	if sender == nil {
+		return nil
+	}
+	return newInviteMailer(reg, sender)
+}
+
+func setupEmailTemplates() *templates.Registry {
+	// Templates in this directory replace the embedded defaults.
+	reg, err := templates.Load(os.Getenv("EMAIL_TEMPLATES_DIR"))
+	if err != nil {
+		logger.WithError(err).Fatal("failed to load email templates")
 	}
-	return mailer
+	return reg
 }
 
 func json(raw []byte) echo.HandlerFunc {
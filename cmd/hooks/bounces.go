@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.hrry.dev/homelab/pkg/email"
+)
+
+// maxBounceBody limits the size of bounce webhook requests.
+const maxBounceBody = 5 << 20
+
+// BounceHooks records email bounces and complaints so that the api stops
+// sending emails to those addresses.
+type BounceHooks struct {
+	Suppressions email.SuppressionList
+	// SendGridKey verifies signed SendGrid event webhooks.
+	SendGridKey *ecdsa.PublicKey
+	// DSNToken is the bearer token required to post delivery status
+	// notifications.
+	DSNToken string
+}
+
+// SendGrid handles SendGrid's event webhook.
+func (bh *BounceHooks) SendGrid(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBounceBody))
+	if err != nil {
+		SendError(w, http.StatusBadRequest, err, "could not read body")
+		return
+	}
+	err = email.VerifySendGridSignature(
+		bh.SendGridKey,
+		r.Header.Get(email.SendGridSignatureHeader),
+		r.Header.Get(email.SendGridTimestampHeader),
+		body,
+		time.Now(),
+	)
+	if err != nil {
+		SendError(w, http.StatusUnauthorized, err, "invalid signature")
+		return
+	}
+	events, err := email.ParseSendGridEvents(body)
+	if err != nil {
+		SendError(w, http.StatusBadRequest, err, "could not parse events")
+		return
+	}
+	bh.record(w, r, events)
+}
+
+// DSN handles raw delivery status notification and feedback report emails
+// forwarded by a mail server.
+func (bh *BounceHooks) DSN(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if len(bh.DSNToken) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(bh.DSNToken)) != 1 {
+		SendError(w, http.StatusUnauthorized, nil, "invalid token")
+		return
+	}
+	events, err := email.ParseDSN(io.LimitReader(r.Body, maxBounceBody))
+	if err != nil {
+		SendError(w, http.StatusBadRequest, err, "could not parse delivery status notification")
+		return
+	}
+	bh.record(w, r, events)
+}
+
+func (bh *BounceHooks) record(w http.ResponseWriter, r *http.Request, events []*email.DeliveryEvent) {
+	for _, ev := range events {
+		err := bh.Suppressions.Record(r.Context(), ev)
+		if errors.Is(err, email.ErrInvalid) {
+			logger.WithField("address", ev.Address).Warn("skipping delivery event for invalid address")
+			continue
+		}
+		if err != nil {
+			// Fail the request so that the sender retries.
+			SendError(w, http.StatusInternalServerError, err, "could not record delivery event")
+			return
+		}
+	}
+	logger.WithFields(logrus.Fields{
+		"events": len(events),
+		"path":   r.URL.Path,
+	}).Info("recorded delivery events")
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.hrry.dev/homelab/pkg/email"
+)
+
+type testSuppressions map[string]*email.DeliveryEvent
+
+func (ts testSuppressions) Record(_ context.Context, e *email.DeliveryEvent) error {
+	if !email.Valid(e.Address) {
+		return email.ErrInvalid
+	}
+	ts[e.Address] = e
+	return nil
+}
+
+func (ts testSuppressions) Suppressed(_ context.Context, address string) (bool, error) {
+	e, ok := ts[address]
+	return ok && e.Suppresses(), nil
+}
+
+func TestBounceHooks_SendGrid(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := testSuppressions{}
+	hooks := BounceHooks{Suppressions: list, SendGridKey: &key.PublicKey}
+	body := `[{"email":"a@example.com","timestamp":1,"event":"bounce","type":"bounce"},{"email":"bad","event":"spamreport"}]`
+
+	now := time.Now().Unix()
+	for _, tt := range []struct {
+		name      string
+		signed    int64
+		timestamp int64
+		status    int
+	}{
+		{"valid signature", now, now, http.StatusAccepted},
+		{"wrong timestamp", now, now + 1, http.StatusUnauthorized},
+		{"replayed", 100, 100, http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := sha256.Sum256([]byte(strconv.FormatInt(tt.signed, 10) + body))
+			sig, err := ecdsa.SignASN1(rand.Reader, key, h[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest("POST", "/hooks/email/sendgrid", strings.NewReader(body))
+			req.Header.Set(email.SendGridSignatureHeader, base64.StdEncoding.EncodeToString(sig))
+			req.Header.Set(email.SendGridTimestampHeader, strconv.FormatInt(tt.timestamp, 10))
+			rec := httptest.NewRecorder()
+			hooks.SendGrid(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, rec.Code)
+			}
+		})
+	}
+	if suppressed, _ := list.Suppressed(context.Background(), "a@example.com"); !suppressed {
+		t.Error("expected bounced address to be suppressed")
+	}
+	if len(list) != 1 {
+		t.Errorf("expected one recorded event, got %d", len(list))
+	}
+}
+
+func TestBounceHooks_DSN(t *testing.T) {
+	list := testSuppressions{}
+	hooks := BounceHooks{Suppressions: list, DSNToken: "secret"}
+	dsn := "Content-Type: multipart/report; report-type=delivery-status; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: message/delivery-status\r\n" +
+		"\r\n" +
+		"Reporting-MTA: dns; mx.example.com\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; gone@example.com\r\n" +
+		"Action: failed\r\n" +
+		"Status: 5.1.1\r\n" +
+		"--b--\r\n"
+
+	for _, tt := range []struct {
+		name   string
+		token  string
+		body   string
+		status int
+	}{
+		{"no token", "", dsn, http.StatusUnauthorized},
+		{"wrong token", "nope", dsn, http.StatusUnauthorized},
+		{"not a report", "secret", "Subject: hi\r\n\r\nhello", http.StatusBadRequest},
+		{"bounce", "secret", dsn, http.StatusAccepted},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/hooks/email/dsn", strings.NewReader(tt.body))
+			if len(tt.token) > 0 {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			hooks.DSN(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, rec.Code)
+			}
+		})
+	}
+	e, ok := list["gone@example.com"]
+	if !ok || e.Status != "5.1.1" || !e.Suppresses() {
+		t.Errorf("bounce not recorded: %+v", e)
+	}
+}
@@ -15,24 +15,26 @@ import (
 )
 
 type GithubAuthService struct {
-	Sessions    session.Store[ghSession]
-	AuthSession session.Store[oauthSession]
+	Sessions    *session.Manager[ghSession]
+	AuthSession *session.Manager[oauthSession]
 	Config      oauth2.Config
 }
 
+// oauthSession holds the oauth state parameter between the login redirect
+// and the authorization callback.
 type oauthSession struct {
-	state   string
-	user    string
-	code    string
-	expires time.Time
+	State string
 }
 
 type ghSession struct {
-	token    oauth2.Token
-	username string
+	Token    oauth2.Token
+	Username string
 }
 
-const ghSessionKey = "gh_s"
+const (
+	ghSessionKey    = "gh_s"
+	oauthSessionKey = "gh_oauth"
+)
 
 func GithubLoggedIn(r *http.Request) bool {
 	cookie, err := r.Cookie(ghSessionKey)
@@ -49,24 +51,16 @@ func (gs *GithubAuthService) client(ctx context.Context, tok *oauth2.Token) *git
 	return github.NewClient(gs.Config.Client(ctx, tok))
 }
 
-func (gs *GithubAuthService) session(ctx context.Context, r *http.Request) (*ghSession, error) {
-	cookie, err := r.Cookie(ghSessionKey)
-	if err != nil {
-		return nil, err
-	}
-	s, err := gs.Sessions.Get(ctx, cookie.Value)
-	if err != nil {
-		return nil, err
-	}
-	return s, nil
+func (gs *GithubAuthService) session(r *http.Request) (*ghSession, error) {
+	return gs.Sessions.GetValue(r)
 }
 
-func (gs *GithubAuthService) token(ctx context.Context, r *http.Request) (*oauth2.Token, error) {
-	s, err := gs.session(ctx, r)
+func (gs *GithubAuthService) token(r *http.Request) (*oauth2.Token, error) {
+	s, err := gs.session(r)
 	if err != nil {
 		return nil, err
 	}
-	return &s.token, nil
+	return &s.Token, nil
 }
 
 func (gs *GithubAuthService) Login(w http.ResponseWriter, r *http.Request) {
@@ -75,8 +69,8 @@ func (gs *GithubAuthService) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	username := r.FormValue("username")
-	session := oauthSession{state: getState()}
-	err := gs.AuthSession.Set(r.Context(), session.state, &session)
+	session := gs.AuthSession.NewSession(&oauthSession{State: getState()})
+	err := session.Save(r.Context(), w)
 	if err != nil {
 		SendError(w, http.StatusInternalServerError, err)
 		return
@@ -85,7 +79,7 @@ func (gs *GithubAuthService) Login(w http.ResponseWriter, r *http.Request) {
 	if len(username) > 0 {
 		opts = append(opts, oauth2.SetAuthURLParam("login", username))
 	}
-	loc := gs.Config.AuthCodeURL(session.state, opts...)
+	loc := gs.Config.AuthCodeURL(session.Value.State, opts...)
 	redirect(w, loc)
 }
 
@@ -106,15 +100,19 @@ func (gs *GithubAuthService) Authorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	ctx := r.Context()
-	authSess, err := gs.AuthSession.Get(ctx, state)
+	authSess, err := gs.AuthSession.Get(r)
 	if err != nil {
 		SendError(w, http.StatusNotFound, err, "could not find oauth session")
 		return
 	}
-	err = gs.AuthSession.Del(ctx, authSess.state)
+	err = authSess.Delete(ctx, w)
 	if err != nil {
 		logger.WithError(err).Warn("failed to delete oauth session")
 	}
+	if authSess.Value.State != state {
+		SendError(w, http.StatusUnauthorized, nil, "oauth state does not match")
+		return
+	}
 	token, err := gs.Config.Exchange(ctx, code)
 	if err != nil {
 		SendError(w, http.StatusUnauthorized, err)
@@ -137,36 +135,20 @@ func (gs *GithubAuthService) Authorize(w http.ResponseWriter, r *http.Request) {
 		"accepted-oauth-scopes": response.Header.Get("X-Accepted-OAuth-Scopes"),
 		"login":                 *user.Login,
 	}).Info("got user")
-	id := getState()
-	ghs := ghSession{token: *token, username: *user.Login}
-	if err = gs.Sessions.Set(ctx, id, &ghs); err != nil {
+	ghs := gs.Sessions.NewSession(&ghSession{Token: *token, Username: *user.Login})
+	if err = ghs.Save(ctx, w); err != nil {
 		SendError(w, http.StatusInternalServerError, err, "failed to store new session")
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     ghSessionKey,
-		Value:    id,
-		Path:     "/",
-		SameSite: http.SameSiteLaxMode,
-		HttpOnly: true,
-	})
 	redirect(w, "/")
 }
 
 func (gs *GithubAuthService) SignOut(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie(ghSessionKey)
-	if err != nil {
+	// Removes the cookie, there is nothing stored on the server.
+	if err := gs.Sessions.Delete(w, r); err != nil {
 		SendError(w, http.StatusNotFound, err, "session cookie not found")
 		return
 	}
-	// remove cookie
-	cookie.Expires = time.Unix(0, 0)
-	http.SetCookie(w, cookie)
-	err = gs.Sessions.Del(r.Context(), cookie.Value)
-	if err != nil {
-		SendError(w, http.StatusInternalServerError, err)
-		return
-	}
 	w.WriteHeader(http.StatusAccepted)
 }
 
@@ -174,15 +156,10 @@ func allowSignUp(val bool) oauth2.AuthCodeOption {
 	return oauth2.SetAuthURLParam("allow_signup", strconv.FormatBool(val))
 }
 
-func createHook(store session.Store[ghSession], host string) http.HandlerFunc {
+func createHook(sessions *session.Manager[ghSession], host string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("session")
-		if err != nil {
-			SendError(w, http.StatusUnauthorized, nil, "session cookie not found")
-			return
-		}
 		ctx := r.Context()
-		session, err := store.Get(ctx, cookie.Value)
+		session, err := sessions.GetValue(r)
 		if err != nil {
 			SendError(w, http.StatusUnauthorized, nil, "github session not found")
 			return
@@ -202,9 +179,9 @@ func createHook(store session.Store[ghSession], host string) http.HandlerFunc {
 			return
 		}
 
-		client := github.NewClient(oauth2.NewClient(ctx, oauth2.StaticTokenSource(&session.token)))
+		client := github.NewClient(oauth2.NewClient(ctx, oauth2.StaticTokenSource(&session.Token)))
 		active := true
-		hook, _, err := client.Repositories.CreateHook(ctx, session.username, repo, &github.Hook{
+		hook, _, err := client.Repositories.CreateHook(ctx, session.Username, repo, &github.Hook{
 			Config: map[string]any{
 				"url": (&url.URL{
 					Scheme: "https",
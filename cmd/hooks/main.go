@@ -26,6 +26,8 @@ import (
 	githuboauth "golang.org/x/oauth2/github"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"gopkg.hrry.dev/homelab/pkg/db"
+	"gopkg.hrry.dev/homelab/pkg/email"
 	"gopkg.hrry.dev/homelab/pkg/log"
 	"gopkg.hrry.dev/homelab/pkg/session"
 	"gopkg.hrry.dev/homelab/pkg/web"
@@ -67,9 +69,29 @@ func main() {
 		logger.Fatal("no server host given, set -host or $SERVER_HOST")
 	}
 
+	keys, err := sessionKeys(os.Getenv("HOOKS_SESSION_KEYS"))
+	if err != nil {
+		logger.WithError(err).Fatal("invalid session keys")
+	}
+	ghStore, err := session.NewCookieStore[ghSession](keys...)
+	if err != nil {
+		logger.WithError(err).Fatal("could not create session store")
+	}
+	ghStore.TTL = time.Minute
+	oauthStore, err := session.NewCookieStore[oauthSession](keys...)
+	if err != nil {
+		logger.WithError(err).Fatal("could not create session store")
+	}
+	oauthStore.TTL = time.Minute * 2
+	cookieOpts := []session.CookieOpt{
+		session.WithSameSite(http.SameSiteLaxMode),
+		session.WithHTTPOnly(true),
+		session.WithSecure(true),
+	}
+
 	gh := GithubAuthService{
-		Sessions:    session.NewMemStore[ghSession](time.Minute),
-		AuthSession: session.NewMemStore[oauthSession](time.Minute * 2),
+		Sessions:    session.NewManager[ghSession](ghSessionKey, ghStore, cookieOpts...),
+		AuthSession: session.NewManager[oauthSession](oauthSessionKey, oauthStore, cookieOpts...),
 		Config: oauth2.Config{
 			ClientID:     os.Getenv("GITHUB_CLIENT_ID"),
 			ClientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
@@ -127,6 +149,30 @@ func main() {
 	r.Post("/hooks/minio/audit", minioLoggingHookHandler[*MinioAuditEntry](pusher))
 	r.Handle("/metrics", web.MetricsHandler())
 
+	bounces := BounceHooks{DSNToken: os.Getenv("DSN_HOOK_TOKEN")}
+	if key := os.Getenv("SENDGRID_WEBHOOK_KEY"); len(key) > 0 {
+		bounces.SendGridKey, err = email.ParseSendGridVerificationKey(key)
+		if err != nil {
+			logger.WithError(err).Fatal("invalid sendgrid webhook verification key")
+		}
+	}
+	if bounces.SendGridKey != nil || len(bounces.DSNToken) > 0 {
+		database, err := db.Connect(logger)
+		if err != nil {
+			logger.WithError(err).Fatal("could not connect to database")
+		}
+		defer database.Close()
+		bounces.Suppressions = email.NewPGSuppressionList(database)
+		if bounces.SendGridKey != nil {
+			r.Post("/hooks/email/sendgrid", bounces.SendGrid)
+		}
+		if len(bounces.DSNToken) > 0 {
+			r.Post("/hooks/email/dsn", bounces.DSN)
+		}
+	} else {
+		logger.Info("email bounce hooks disabled")
+	}
+
 	addr := fmt.Sprintf(":%d", port)
 	if err = web.ListenAndServe(addr, r); err != nil {
 		logger.WithError(err).Fatal("listen and serve failed")
@@ -275,6 +321,29 @@ func validateEnv() error {
 	return nil
 }
 
+// sessionKeys parses a comma separated list of hex encoded session keys. The
+// first key is used for new sessions. A random key is generated if there are
+// no keys which logs everyone out when the server restarts.
+func sessionKeys(s string) ([][]byte, error) {
+	if len(s) == 0 {
+		logger.Warn("no session keys, generating a temporary key")
+		key := make([]byte, session.KeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		return [][]byte{key}, nil
+	}
+	var keys [][]byte
+	for _, k := range strings.Split(s, ",") {
+		key, err := hex.DecodeString(strings.TrimSpace(k))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
 func getenv(name, defaultValue string) string {
 	v, ok := os.LookupEnv(name)
 	if !ok {
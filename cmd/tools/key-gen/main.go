@@ -1,8 +1,10 @@
 package main
 
 import (
+	"crypto"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/pem"
@@ -11,6 +13,11 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.hrry.dev/homelab/pkg/certutil"
+	"gopkg.hrry.dev/homelab/pkg/email"
 )
 
 func main() {
@@ -26,11 +33,20 @@ func run() error {
 		genSeed bool
 		genHex  bool
 		length  = 32
+
+		dkim     bool
+		rsaKey   bool
+		selector = "mail"
+		domain   = "hrry.me"
 	)
 	flag.StringVar(&out, "o", out, "output the keypair")
 	flag.BoolVar(&genSeed, "seed", genSeed, "generate a seed instead of an ed25519 key pair")
 	flag.BoolVar(&genHex, "hex", genHex, "generate some random hex values")
 	flag.IntVar(&length, "len", length, "length of generated values")
+	flag.BoolVar(&dkim, "dkim", dkim, "generate a dkim key pair and print its dns TXT record, prints the record for an existing key")
+	flag.BoolVar(&rsaKey, "rsa", rsaKey, "generate an rsa key instead of ed25519")
+	flag.StringVar(&selector, "selector", selector, "dkim selector used for the dns record name")
+	flag.StringVar(&domain, "domain", domain, "dkim signing domain used for the dns record name")
 	flag.Parse()
 
 	if genHex {
@@ -66,7 +82,11 @@ func run() error {
 		return errors.New("no output file")
 	}
 
-	keys, err := genKeyPair()
+	if dkim {
+		return genDKIM(out, selector, domain, rsaKey)
+	}
+
+	keys, err := genKeyPair(rsaKey)
 	if err != nil {
 		return err
 	}
@@ -136,7 +156,14 @@ func run() error {
 	// return nil
 }
 
-func genKeyPair() (*pair, error) {
+func genKeyPair(useRSA bool) (*pair, error) {
+	if useRSA {
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return &pair{private: priv, public: priv.Public()}, nil
+	}
 	pub, priv, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
 		return nil, err
@@ -145,8 +172,57 @@ func genKeyPair() (*pair, error) {
 }
 
 type pair struct {
-	private ed25519.PrivateKey
-	public  ed25519.PublicKey
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// genDKIM creates a key pair if one does not exist and prints the DNS record
+// that publishes the public key.
+func genDKIM(out, selector, domain string, useRSA bool) error {
+	var (
+		key     crypto.Signer
+		keyFile = fmt.Sprintf("%s.key", out)
+	)
+	pems, err := openPemPair(out)
+	switch err {
+	case nil:
+		defer pems.Close()
+		keys, err := genKeyPair(useRSA)
+		if err != nil {
+			return err
+		}
+		if err = keys.writeToPem(pems); err != nil {
+			return err
+		}
+		key = keys.private
+	case errFilesExist:
+		key, err = certutil.OpenKey(keyFile)
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	record, err := email.DKIMRecord(key.Public())
+	if err != nil {
+		return err
+	}
+	d := email.DKIM{Selector: selector}
+	fmt.Printf("%s. IN TXT %s\n", d.RecordName(domain), txtStrings(record))
+	return nil
+}
+
+// txtStrings quotes a TXT record, long records are split into multiple
+// strings because each one is limited to 255 bytes.
+func txtStrings(record string) string {
+	const max = 255
+	var parts []string
+	for len(record) > max {
+		parts = append(parts, strconv.Quote(record[:max]))
+		record = record[max:]
+	}
+	parts = append(parts, strconv.Quote(record))
+	return strings.Join(parts, " ")
 }
 
 func (p *pair) writeToPem(pems *pemPair) error {
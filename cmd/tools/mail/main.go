@@ -5,17 +5,14 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"strconv"
 	"strings"
 
 	"github.com/joho/godotenv"
 	"github.com/sendgrid/sendgrid-go"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
-	"gopkg.in/gomail.v2"
+	"gopkg.hrry.dev/homelab/pkg/email"
 )
 
 func main() {
@@ -39,31 +36,21 @@ func main() {
 }
 
 func runAhasend(from, to string) error {
-	email := gomail.NewMessage()
-	email.SetAddressHeader("From", from, "Bluesky PDS Admin")
-	email.SetAddressHeader("To", to, "PDS User")
-	email.SetHeader("Subject", "Sample email test")
+	sender, err := email.ParseSMTPURL(os.Getenv("SMTP_URL"))
+	if err != nil {
+		return err
+	}
 	plainTextContent := "This is a testing email, please disregard its contents."
 	htmlContent := `<div>Hi ` + "PDS User" +
 		`,<br><br>This is a testing email, please disregard its contents.` +
 		`<br><br>Thank you for you patience.<br><br>Harry</div>`
-	email.SetBody("text/plain", plainTextContent)
-	email.SetBody("text/html", htmlContent)
-	u, err := url.Parse(os.Getenv("SMTP_URL"))
-	if err != nil {
-		return err
-	}
-	host, portStr, err := net.SplitHostPort(u.Host)
-	if err != nil {
-		return err
-	}
-	port, err := strconv.ParseInt(portStr, 10, 32)
-	if err != nil {
-		return err
-	}
-	pw, _ := u.User.Password()
-	d := gomail.NewDialer(host, int(port), u.User.Username(), pw)
-	return d.DialAndSend(email)
+	return sender.Send(context.Background(), email.NewMessage(
+		&email.Email{Name: "Bluesky PDS Admin", Address: from},
+		&email.Email{Name: "PDS User", Address: to},
+		"Sample email test",
+		plainTextContent,
+		htmlContent,
+	))
 }
 
 func runSendgrid(to, apikey string) error {
@@ -0,0 +1,11 @@
+BEGIN;
+
+DROP INDEX IF EXISTS ux_user_username_lower;
+DROP INDEX IF EXISTS ux_user_email_lower;
+
+ALTER TABLE "user"
+DROP CONSTRAINT IF EXISTS unique_email;
+ALTER TABLE "user"
+ADD CONSTRAINT unique_email UNIQUE (email);
+
+COMMIT;
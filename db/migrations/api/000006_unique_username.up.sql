@@ -0,0 +1,49 @@
+BEGIN;
+
+-- Users that only differ by the case of their email or username have to be
+-- merged by hand before the case-insensitive indexes below can be created.
+-- Check first so that nothing is changed when there are duplicates.
+DO $$
+DECLARE
+	emails    TEXT;
+	usernames TEXT;
+BEGIN
+	SELECT string_agg(e, ', ') INTO emails FROM (
+		SELECT lower(trim(email)) AS e
+		FROM "user"
+		WHERE email IS NOT NULL
+		GROUP BY 1 HAVING COUNT(*) > 1
+	) d;
+	SELECT string_agg(u, ', ') INTO usernames FROM (
+		SELECT lower(username) AS u
+		FROM "user"
+		WHERE username IS NOT NULL AND username <> ''
+		GROUP BY 1 HAVING COUNT(*) > 1
+	) d;
+	IF emails IS NOT NULL OR usernames IS NOT NULL THEN
+		RAISE EXCEPTION 'users differ only by case: emails [%] usernames [%]',
+			COALESCE(emails, ''), COALESCE(usernames, '')
+		USING HINT = 'merge or rename the duplicate users and run the migration again';
+	END IF;
+END
+$$;
+
+-- Normalize existing emails so that the case-insensitive index below does
+-- not see "A@Example.com" and "a@example.com" as different addresses.
+UPDATE "user"
+   SET email = split_part(trim(email), '@', 1) || '@' || lower(split_part(trim(email), '@', 2))
+ WHERE email LIKE '%@%';
+
+ALTER TABLE "user"
+DROP CONSTRAINT IF EXISTS unique_email;
+
+CREATE UNIQUE INDEX IF NOT EXISTS
+	ux_user_email_lower
+	ON "user" (lower(email));
+
+CREATE UNIQUE INDEX IF NOT EXISTS
+	ux_user_username_lower
+	ON "user" (lower(username))
+	WHERE username IS NOT NULL AND username <> '';
+
+COMMIT;
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS invite (
+	-- Random url-safe key used in the invite link
+	id            VARCHAR(64) PRIMARY KEY,
+	-- UUID of the user that created the invite
+	created_by    UUID NOT NULL,
+	email         VARCHAR(256),
+	receiver_name VARCHAR(256),
+	roles         INT[],
+	-- Number of sign-up attempts left. Negative means unlimited.
+	ttl           INT,
+	status        VARCHAR(16) NOT NULL DEFAULT 'pending'
+		CHECK (status IN ('pending', 'redeemed', 'expired', 'revoked')),
+	-- UUID of the user created with this invite
+	redeemed_by   UUID,
+	expires_at    TIMESTAMPTZ NOT NULL,
+	redeemed_at   TIMESTAMPTZ,
+	created_at    TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at    TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS
+	ix_invite_created_by
+	ON invite (created_by, created_at DESC);
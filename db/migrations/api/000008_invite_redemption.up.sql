@@ -0,0 +1,12 @@
+-- Ledger of signed invite tokens that have been used or revoked.
+CREATE TABLE IF NOT EXISTS invite_redemption (
+	-- Token ID (jti claim)
+	id          VARCHAR(64) PRIMARY KEY,
+	-- Expiration of the token. Rows can be removed after this time.
+	expires_at  TIMESTAMPTZ NOT NULL,
+	redeemed_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS
+	ix_invite_redemption_expires_at
+	ON invite_redemption (expires_at);
@@ -0,0 +1,11 @@
+-- Per-user notification settings. Users without a row get the defaults.
+CREATE TABLE IF NOT EXISTS notification_preferences (
+	user_id        UUID PRIMARY KEY,
+	-- Email the user when one of their invites is redeemed.
+	invite_email   BOOLEAN NOT NULL DEFAULT TRUE,
+	-- Endpoint that receives signed invite events.
+	webhook_url    TEXT,
+	webhook_secret TEXT,
+	created_at     TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at     TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,10 @@
+ALTER TABLE invite_redemption
+	DROP COLUMN IF EXISTS uses,
+	DROP COLUMN IF EXISTS revoked;
+
+DROP TABLE IF EXISTS invite_redeemer;
+
+ALTER TABLE invite
+	DROP COLUMN IF EXISTS max_uses,
+	DROP COLUMN IF EXISTS uses,
+	DROP COLUMN IF EXISTS rooms;
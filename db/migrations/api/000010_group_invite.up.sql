@@ -0,0 +1,29 @@
+ALTER TABLE invite
+	-- Number of accounts that can be created with the invite
+	ADD COLUMN IF NOT EXISTS max_uses INT NOT NULL DEFAULT 1,
+	-- Number of accounts created with the invite
+	ADD COLUMN IF NOT EXISTS uses     INT NOT NULL DEFAULT 0,
+	-- Chat rooms that new users are added to
+	ADD COLUMN IF NOT EXISTS rooms    INT[];
+
+UPDATE invite SET uses = 1 WHERE status = 'redeemed';
+
+-- Every account created with an invite. invite.redeemed_by only holds the
+-- most recent one.
+CREATE TABLE IF NOT EXISTS invite_redeemer (
+	invite_id   VARCHAR(64) NOT NULL,
+	user_id     UUID NOT NULL,
+	redeemed_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (invite_id, user_id)
+);
+
+INSERT INTO invite_redeemer (invite_id, user_id, redeemed_at)
+SELECT id, redeemed_by, redeemed_at
+FROM invite
+WHERE redeemed_by IS NOT NULL
+ON CONFLICT DO NOTHING;
+
+-- Signed invite tokens can also be used more than once.
+ALTER TABLE invite_redemption
+	ADD COLUMN IF NOT EXISTS uses    INT NOT NULL DEFAULT 1,
+	ADD COLUMN IF NOT EXISTS revoked BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,27 @@
+-- Emails waiting to be sent by the outbox worker.
+CREATE TABLE IF NOT EXISTS email_outbox (
+	id              BIGSERIAL PRIMARY KEY,
+	-- JSON encoded message
+	message         JSONB NOT NULL,
+	status          VARCHAR(16) NOT NULL DEFAULT 'pending'
+		CHECK (status IN ('pending', 'sent', 'dead')),
+	attempts        INT NOT NULL DEFAULT 0,
+	-- When the worker should try sending the message next. Workers push this
+	-- forward while sending so that other workers skip the message.
+	next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_error      TEXT,
+	-- Response from the email provider for the last attempt
+	response        TEXT,
+	sent_at         TIMESTAMPTZ,
+	created_at      TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at      TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS
+	ix_email_outbox_pending
+	ON email_outbox (next_attempt_at)
+	WHERE status = 'pending';
+
+CREATE INDEX IF NOT EXISTS
+	ix_email_outbox_status
+	ON email_outbox (status, created_at DESC);
@@ -0,0 +1,19 @@
+-- Bounces and complaints reported for email addresses. Emails are not sent to
+-- suppressed addresses.
+CREATE TABLE IF NOT EXISTS email_suppression (
+	-- lowercased email address
+	address       TEXT PRIMARY KEY,
+	bounces       INT NOT NULL DEFAULT 0,
+	complaints    INT NOT NULL DEFAULT 0,
+	-- Set after a hard bounce or a complaint
+	suppressed    BOOLEAN NOT NULL DEFAULT FALSE,
+	last_event    VARCHAR(16) NOT NULL,
+	-- Enhanced SMTP status code of the last bounce
+	last_status   VARCHAR(16),
+	last_reason   TEXT,
+	-- Where the last event came from, "sendgrid" or "dsn"
+	source        VARCHAR(16) NOT NULL,
+	last_event_at TIMESTAMPTZ NOT NULL,
+	created_at    TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at    TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
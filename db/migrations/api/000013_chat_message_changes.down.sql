@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS chatroom_message_reactions;
+DROP TABLE IF EXISTS chatroom_message_edits;
+
+ALTER TABLE chatroom_messages
+	DROP COLUMN IF EXISTS edited_at,
+	DROP COLUMN IF EXISTS deleted_at,
+	DROP COLUMN IF EXISTS deleted_by;
@@ -0,0 +1,27 @@
+ALTER TABLE chatroom_messages
+	ADD COLUMN IF NOT EXISTS edited_at  TIMESTAMPTZ,
+	-- Deleted messages are kept as tombstones with an empty body.
+	ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ,
+	ADD COLUMN IF NOT EXISTS deleted_by INT;
+
+-- Previous versions of edited messages.
+CREATE TABLE IF NOT EXISTS chatroom_message_edits (
+	id         BIGSERIAL PRIMARY KEY,
+	message_id BIGINT NOT NULL REFERENCES chatroom_messages (id) ON DELETE CASCADE,
+	-- The body before the edit
+	body       TEXT,
+	edited_by  INT,
+	edited_at  TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS
+	ix_chatroom_message_edits_message_id
+	ON chatroom_message_edits (message_id);
+
+CREATE TABLE IF NOT EXISTS chatroom_message_reactions (
+	message_id BIGINT NOT NULL REFERENCES chatroom_messages (id) ON DELETE CASCADE,
+	user_id    INT NOT NULL,
+	emoji      VARCHAR(64) NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (message_id, user_id, emoji)
+);
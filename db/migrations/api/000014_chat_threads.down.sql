@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS chatroom_thread_reads;
+DROP INDEX IF EXISTS ix_chatroom_messages_parent_id;
+ALTER TABLE chatroom_messages DROP COLUMN IF EXISTS parent_id;
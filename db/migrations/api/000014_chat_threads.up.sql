@@ -0,0 +1,17 @@
+-- Replies reference the first message of their thread.
+ALTER TABLE chatroom_messages
+	ADD COLUMN IF NOT EXISTS parent_id BIGINT REFERENCES chatroom_messages (id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS
+	ix_chatroom_messages_parent_id
+	ON chatroom_messages (parent_id)
+	WHERE parent_id IS NOT NULL;
+
+-- The last reply that a user has read in each thread. Replies are not
+-- counted by chatroom_members.last_seen.
+CREATE TABLE IF NOT EXISTS chatroom_thread_reads (
+	parent_id BIGINT NOT NULL REFERENCES chatroom_messages (id) ON DELETE CASCADE,
+	user_id   INT NOT NULL,
+	last_seen BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (parent_id, user_id)
+);
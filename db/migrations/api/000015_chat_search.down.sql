@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS ix_chatroom_messages_search;
+ALTER TABLE chatroom_messages DROP COLUMN IF EXISTS search;
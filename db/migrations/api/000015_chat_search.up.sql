@@ -0,0 +1,9 @@
+-- Full-text search over message bodies. Tombstones have an empty body so
+-- deleted messages are never matched.
+ALTER TABLE chatroom_messages
+	ADD COLUMN IF NOT EXISTS search TSVECTOR
+	GENERATED ALWAYS AS (to_tsvector('english', COALESCE(body, ''))) STORED;
+
+CREATE INDEX IF NOT EXISTS
+	ix_chatroom_messages_search
+	ON chatroom_messages USING GIN (search);
@@ -0,0 +1,2 @@
+DELETE FROM email_outbox WHERE kind <> 'email';
+ALTER TABLE email_outbox DROP COLUMN IF EXISTS kind;
@@ -0,0 +1,3 @@
+-- The outbox also queues deliveries that are not emails, like webhooks.
+ALTER TABLE email_outbox
+	ADD COLUMN IF NOT EXISTS kind VARCHAR(32) NOT NULL DEFAULT 'email';
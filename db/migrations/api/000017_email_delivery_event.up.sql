@@ -0,0 +1,10 @@
+-- Provider event ids that were already recorded in email_suppression so that
+-- webhook batches sent more than once are only counted once.
+CREATE TABLE IF NOT EXISTS email_delivery_event (
+	-- Where the event came from, "sendgrid" or "dsn"
+	source     VARCHAR(16) NOT NULL,
+	-- The provider's id for the event, sg_event_id for sendgrid
+	id         TEXT NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (source, id)
+);
@@ -7,8 +7,121 @@ export interface Message {
   user_id: number;
   body: string;
   created_at: Date;
+  edited_at?: Date;
+  // deleted_at is set on the tombstones of deleted messages.
+  deleted_at?: Date;
+  reactions?: Reaction[];
+  // parent_id is the first message of the thread that a reply belongs to.
+  parent_id?: number;
+  replies?: number;
 }
 
+export interface Reaction {
+  emoji: string;
+  count: number;
+  users: number[];
+}
+
+export interface ReactionEvent {
+  room: number;
+  message_id: number;
+  user_id: number;
+  emoji: string;
+  added: boolean;
+}
+
+export interface MessageEdit {
+  id: number;
+  message_id: number;
+  body: string;
+  edited_by: number;
+  edited_at: Date;
+}
+
+export const PROTOCOL_VERSION = 1;
+
+export type MsgType =
+  | ""
+  | "chat"
+  | "ack"
+  | "typing"
+  | "presence"
+  | "read_receipt"
+  | "error"
+  | "ping"
+  | "member"
+  | "edit"
+  | "delete"
+  | "reaction";
+
+// Envelope wraps every frame sent over the chat websocket.
+export interface Envelope<T = any> {
+  v: number;
+  type: MsgType;
+  // id is generated by the client and echoed back in replies.
+  id?: string;
+  from?: number;
+  payload?: T;
+}
+
+export enum DeliveryStatus {
+  Sent = 0,
+  Stored = 1,
+  Failed = 2,
+}
+
+export interface Ack {
+  id: number;
+  status: DeliveryStatus;
+}
+
+export interface ErrorPayload {
+  code: string;
+  message: string;
+}
+
+export interface MemberEvent {
+  action: "joined" | "left" | "added" | "removed" | "owner";
+  room: number;
+  user_id: number;
+  by: number;
+}
+
+export interface ReadReceipt {
+  room: number;
+  user_id: number;
+  message_id: number;
+  thread?: number;
+}
+
+export interface UnreadCount {
+  room: number;
+  last_seen: number;
+  unread: number;
+  threads: number;
+}
+
+export interface PresenceEvent {
+  room: number;
+  user_id: number;
+  online: boolean;
+}
+
+export interface Typing {
+  room: number;
+  user_id: number;
+  active: boolean;
+}
+
+export const envelope = <T>(type: MsgType, payload?: T): Envelope<T> => {
+  return {
+    v: PROTOCOL_VERSION,
+    type,
+    id: `${Date.now().toString(36)}-${Math.random().toString(36).slice(2)}`,
+    payload,
+  };
+};
+
 export interface Room {
   id: number;
   owner_id: number;
@@ -32,12 +145,14 @@ export interface MessagesResponse {
 
 export const messages = async (
   room: number,
-  page?: PageParams
+  page?: PageParams,
+  thread?: number
 ): Promise<MessagesResponse> => {
   let p: PageParams = page || { limit: 10, offset: 0 };
   let query = `limit=${p.limit}`;
   if (p.offset) query += `&offset=${p.offset}`;
   else if (p.prev) query += `&prev=${p.prev}`;
+  if (thread) query += `&thread=${thread}`;
 
   return fetch(`/api/chat/${room}/messages?${query}`, {
     headers: {
@@ -70,3 +185,51 @@ export const getRoom = async (roomID: number): Promise<Room> => {
     return resp.json();
   });
 };
+
+export interface SearchParams {
+  q: string;
+  room?: number;
+  author?: number;
+  since?: Date;
+  until?: Date;
+  cursor?: number;
+  limit?: number;
+}
+
+export interface SearchResult extends Message {
+  // highlight is escaped html with the matches wrapped in <mark> tags.
+  highlight: string;
+  rank: number;
+}
+
+export interface SearchResponse {
+  results: SearchResult[];
+  // next is the cursor for the next page. It is zero on the last page.
+  next: number;
+}
+
+export const search = async (params: SearchParams): Promise<SearchResponse> => {
+  let query = new URLSearchParams({ q: params.q });
+  if (params.room) query.set("room", params.room.toString());
+  if (params.author) query.set("author", params.author.toString());
+  if (params.since) query.set("since", params.since.toISOString());
+  if (params.until) query.set("until", params.until.toISOString());
+  if (params.cursor) query.set("cursor", params.cursor.toString());
+  if (params.limit) query.set("limit", params.limit.toString());
+  return fetch(`/api/chat/search?${query}`, {
+    headers: {
+      Accept: "application/json",
+      Authorization: authHeader(),
+    },
+  }).then(async (resp) => {
+    if (!resp.ok) {
+      const msg = await resp.json();
+      throw new Error(msg);
+    }
+    let res: SearchResponse = await resp.json();
+    for (let r of res.results) {
+      r.created_at = new Date(r.created_at);
+    }
+    return res;
+  });
+};
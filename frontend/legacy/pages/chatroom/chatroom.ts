@@ -2,7 +2,18 @@ import "./styles.css";
 import "~/frontend/components/toggle.css";
 import { websocketURL } from "~/frontend/util/websocket";
 import { SECOND } from "~/frontend/constants";
-import { Message, Room, MessagesResponse, messages } from "@hrry.me/api/chat";
+import {
+  Ack,
+  DeliveryStatus,
+  Envelope,
+  ErrorPayload,
+  Message,
+  Room,
+  MessagesResponse,
+  ReadReceipt,
+  envelope,
+  messages,
+} from "@hrry.me/api/chat";
 import { ThemeManager } from "~/frontend/components/theme";
 import {
   TOKEN_KEY,
@@ -57,9 +68,37 @@ const main = () => {
 
   let conn = new ChatSocket({ roomID, userID });
   conn.onmessage = (ev: MessageEvent) => {
-    console.log("received message:", ev.data, ev.origin);
-    let msg: Message = JSON.parse(ev.data);
-    chatBody.append(msg);
+    let env: Envelope = JSON.parse(ev.data);
+    switch (env.type) {
+      case "chat": {
+        let msg = env.payload as Message;
+        // There is no thread view yet so replies are left out of the room.
+        if (msg.parent_id) break;
+        chatBody.append(msg);
+        if (document.visibilityState == "visible" && conn.open) {
+          let receipt: ReadReceipt = {
+            room: roomID,
+            user_id: userID,
+            message_id: msg.id,
+          };
+          conn.send(JSON.stringify(envelope("read_receipt", receipt)));
+        }
+        break;
+      }
+      case "ack": {
+        let ack = env.payload as Ack;
+        if (ack.status == DeliveryStatus.Failed) {
+          // TODO put an error in front of the user
+          console.error("message was not sent:", env.id);
+        }
+        break;
+      }
+      case "error": {
+        let err = env.payload as ErrorPayload;
+        console.error(`chat error (${err.code}): ${err.message}`);
+        break;
+      }
+    }
   };
   conn.onerror = (ev: Event) => {
     console.error("websocket error:", ev);
@@ -70,9 +109,7 @@ const main = () => {
       console.error("websocket is closed. cannot send message");
       return;
     }
-    console.log("sending message:", msg);
-    let message = JSON.stringify(msg);
-    conn.send(message);
+    conn.send(JSON.stringify(envelope("chat", msg)));
     chatBody.append(msg);
   });
   let chat = new Chat({
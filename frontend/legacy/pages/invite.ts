@@ -70,6 +70,7 @@ const handleFormActions = (form: HTMLFormElement) => {
       method: target.method,
       headers: {
         "Content-Type": "application/json",
+        "X-CSRF-Token": data.get("csrf_token") as string,
       },
       body: JSON.stringify(body),
     }).then(async (res) => {
@@ -90,10 +90,5 @@ module.exports = {
       ...common,
       robots: false,
     },
-    invite_email: {
-      title: "You're Invited!",
-      ...common,
-      robots: false,
-    },
   },
 };
@@ -173,7 +173,6 @@ module.exports = function (webpackEnv) {
     builder.html("50x", { noChunks: true, filename: "50x.html" }),
     builder.html("invite"),
     builder.html("chatroom"),
-    builder.html("invite_email", { noChunks: true }),
     builder.html("bookmarks"),
     builder.html("login")
   );
@@ -14,18 +14,13 @@ import (
 	"github.com/go-redis/redis/v8"
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
-	"github.com/sendgrid/rest"
-	"github.com/sendgrid/sendgrid-go/helpers/mail"
 	"github.com/sirupsen/logrus"
 
 	"gopkg.hrry.dev/homelab/pkg/db"
+	"gopkg.hrry.dev/homelab/pkg/email"
 )
 
-type EmailClient interface {
-	SendWithContext(ctx context.Context, email *mail.SGMailV3) (*rest.Response, error)
-}
-
-func SendMail(client EmailClient) echo.HandlerFunc {
+func SendMail(sender email.Sender) echo.HandlerFunc {
 	type addr struct {
 		Name    string `json:"name"`
 		Address string `json:"address"`
@@ -45,14 +40,20 @@ func SendMail(client EmailClient) echo.HandlerFunc {
 		if err = c.Bind(&b); err != nil {
 			return err
 		}
-		from := mail.NewEmail(b.From.Name, b.From.Address)
-		to := mail.NewEmail(b.To.Name, b.To.Address)
-		message := mail.NewSingleEmail(from, b.Subject, to, "", b.Content)
-		response, err := client.SendWithContext(ctx, message)
-		if err != nil {
+		message := email.NewMessage(
+			&email.Email{Name: b.From.Name, Address: b.From.Address},
+			&email.Email{Name: b.To.Name, Address: b.To.Address},
+			b.Subject,
+			"",
+			b.Content,
+		)
+		if err = message.Validate(); err != nil {
+			return echo.ErrBadRequest.SetInternal(err)
+		}
+		if err = sender.Send(ctx, message); err != nil {
 			return err
 		}
-		return c.JSON(200, response)
+		return c.NoContent(http.StatusOK)
 	}
 }
 
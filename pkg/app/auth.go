@@ -52,6 +52,8 @@ type TokenService struct {
 	Config       auth.TokenConfig
 	HydraAdmin   hydra.AdminApi
 	CookieDomain string
+	// Sessions links browser sessions to users when they log in.
+	Sessions *SessionManager
 }
 
 type tokenLoginBody struct {
@@ -132,6 +134,11 @@ func (ts *TokenService) Login(c echo.Context) error {
 		return err
 	}
 	ts.setTokenCookie(c.Response(), resp, claims)
+	if ts.Sessions != nil {
+		if err = loginSession(c, ts.Sessions, u); err != nil {
+			logger.WithError(err).Error("failed to link session to user")
+		}
+	}
 	return c.JSON(200, map[string]any{
 		"redirect_to": redirectTo,
 	})
@@ -160,10 +160,12 @@ func TestTokenHandler(t *testing.T) {
 			req.Header.Set(echo.HeaderContentType, "application/json")
 			req.URL.RawQuery = tt.query.Encode()
 
+			tokens := auth.NewInMemoryTokenStore(time.Minute)
+			defer tokens.Close()
 			service := TokenService{
 				Config: tt.cfg,
 				Users:  NewUserStore(db),
-				Tokens: auth.NewInMemoryTokenStore(time.Minute),
+				Tokens: tokens,
 			}
 			tt.prep(db, rows)
 			c := e.NewContext(req, rec)
@@ -232,6 +234,7 @@ func TestRefreshTokenHandler_Err(t *testing.T) {
 			refreshToken, err := jwt.NewWithClaims(tokenCfg.Type(), claims).SignedString(tokenCfg.Private())
 			is.NoErr(err)
 			store := auth.NewInMemoryTokenStore(time.Minute)
+			defer store.Close()
 			is.NoErr(store.Set(context.Background(), claims.ID, refreshToken))
 			e := echo.New()
 			rec := httptest.NewRecorder()
@@ -267,6 +270,7 @@ func TestRefreshTokenHandler(t *testing.T) {
 	refreshToken, err := jwt.NewWithClaims(tokenCfg.Type(), claims).SignedString(tokenCfg.Private())
 	is.NoErr(err)
 	store := auth.NewInMemoryTokenStore(time.Minute)
+	defer store.Close()
 	is.NoErr(store.Set(context.Background(), claims.ID, refreshToken))
 	e := echo.New()
 	req := httptest.NewRequest(
@@ -2,10 +2,16 @@ package app
 
 import (
 	"context"
+	"net/http"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"gopkg.hrry.dev/homelab/pkg/app/chat"
 	"gopkg.hrry.dev/homelab/pkg/auth"
@@ -15,6 +21,30 @@ import (
 	"nhooyr.io/websocket"
 )
 
+// RegisterChatRoutes adds the chat endpoints to a group. guard must require a
+// logged in user and withUser should only add the user when there is one.
+func RegisterChatRoutes(g *echo.Group, store chat.Store, rdb redis.UniversalClient, guard, withUser echo.MiddlewareFunc) {
+	g.POST("/chat/room", CreateChatRoom(store), guard)
+	g.GET("/chat/:id/room", GetRoom(store), withUser)
+	g.GET("/chat/:id/connect", ChatRoomConnect(store, rdb), withUser)
+	g.GET("/chat/:id/messages", ListMessages(store), withUser)
+	g.GET("/chat/rooms", ListMyChatRooms(store), guard)
+	g.POST("/chat/:id/join", JoinChatRoom(store, rdb), guard)
+	g.POST("/chat/:id/leave", LeaveChatRoom(store, rdb), guard)
+	g.POST("/chat/:id/members", AddChatMember(store, rdb), guard)
+	g.DELETE("/chat/:id/members/:user", RemoveChatMember(store, rdb), guard)
+	g.PUT("/chat/:id/owner", TransferChatRoom(store, rdb), guard)
+	g.POST("/chat/:id/read", MarkChatRead(store, rdb), guard)
+	g.GET("/chat/unread", ListUnreadChats(store), guard)
+	g.GET("/chat/:id/presence", ChatPresence(store, rdb), guard)
+	g.PUT("/chat/:id/messages/:msg", EditChatMessage(store, rdb), guard)
+	g.DELETE("/chat/:id/messages/:msg", DeleteChatMessage(store, rdb), guard)
+	g.GET("/chat/:id/messages/:msg/edits", ListChatMessageEdits(store), guard)
+	g.POST("/chat/:id/messages/:msg/reactions", AddChatReaction(store, rdb), guard)
+	g.DELETE("/chat/:id/messages/:msg/reactions", RemoveChatReaction(store, rdb), guard)
+	g.GET("/chat/search", SearchChat(store), guard)
+}
+
 func CreateChatRoom(store chat.Store) func(c echo.Context) error {
 	return func(c echo.Context) error {
 		claims := auth.GetClaims(c)
@@ -78,11 +108,25 @@ func ChatRoomConnect(store chat.Store, rdb redis.UniversalClient) func(c echo.Co
 		logger.Info("websocket connected")
 
 		var (
-			ps = chat.NewPubSub(rdb, params.ID, params.User)
-			s  = chat.NewSocket(conn)
+			ps       = chat.NewPubSub(rdb, params.ID, params.User)
+			s        = chat.NewSocket(conn)
+			presence = chat.NewPresence(rdb)
+			connID   = chat.NewConnID()
 		)
+		if err = presence.Connect(ctx, params.ID, params.User, connID); err != nil {
+			logger.WithError(err).Warn("failed to mark user as online")
+		}
+		defer func() {
+			// The request's context may already be done.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := presence.Disconnect(ctx, params.ID, params.User, connID); err != nil {
+				logger.WithError(err).Warn("failed to mark user as offline")
+			}
+		}()
 		ctx, cancel := context.WithCancel(ctx)
 		defer cancel()
+		go presence.Keepalive(ctx, params.ID, params.User, connID)
 
 		if err = room.Start(ctx, ps, s); err != nil {
 			return err
@@ -98,6 +142,8 @@ func ListMessages(store chat.Store) echo.HandlerFunc {
 			Prev   int `query:"prev"`
 			Offset int `query:"offset"`
 			Limit  int `query:"limit"`
+			// Thread lists the replies to a message instead.
+			Thread int `query:"thread"`
 		}{
 			Limit: 10,
 		}
@@ -105,12 +151,20 @@ func ListMessages(store chat.Store) echo.HandlerFunc {
 		if err != nil {
 			return err
 		}
-		ctx := c.Request().Context()
-		msgs, err := store.Messages(ctx, p.ID, db.PaginationOpts{
-			Prev:   p.Prev,
-			Offset: p.Offset,
-			Limit:  p.Limit,
-		})
+		var (
+			ctx  = c.Request().Context()
+			msgs []*chat.Message
+			opts = db.PaginationOpts{
+				Prev:   p.Prev,
+				Offset: p.Offset,
+				Limit:  p.Limit,
+			}
+		)
+		if p.Thread != 0 {
+			msgs, err = store.Replies(ctx, p.ID, p.Thread, opts)
+		} else {
+			msgs, err = store.Messages(ctx, p.ID, opts)
+		}
 		if err != nil {
 			return echo.ErrNotFound.SetInternal(err)
 		}
@@ -137,3 +191,516 @@ func GetRoom(store chat.Store) echo.HandlerFunc {
 		return c.JSON(200, room)
 	}
 }
+
+var (
+	ErrNotRoomMember  = &echo.HTTPError{Code: http.StatusNotFound, Message: "user is not a member of this room"}
+	ErrRoomOwnerLeave = &echo.HTTPError{
+		Code:    http.StatusConflict,
+		Message: "room owner must transfer ownership before leaving",
+	}
+	ErrRemoveRoomOwner = &echo.HTTPError{Code: http.StatusConflict, Message: "cannot remove the room owner"}
+)
+
+type memberParams struct {
+	Room int `param:"id"`
+	User int `param:"user" json:"user_id"`
+}
+
+// JoinChatRoom adds the caller to a public room.
+func JoinChatRoom(store chat.Store, rdb redis.UniversalClient) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims, room, _, err := memberRequest(c, store)
+		if err != nil {
+			return err
+		}
+		if _, ok := room.Members[claims.ID]; ok {
+			return c.NoContent(http.StatusNoContent)
+		}
+		if !room.Public {
+			return echo.ErrForbidden
+		}
+		return changeMembers(c, store.AddMember, rdb, room, claims.ID, &chat.MemberEvent{
+			Action: chat.MemberJoined,
+			UserID: claims.ID,
+		})
+	}
+}
+
+// LeaveChatRoom removes the caller from a room. Owners have to give the room
+// to someone else before they can leave.
+func LeaveChatRoom(store chat.Store, rdb redis.UniversalClient) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims, room, _, err := memberRequest(c, store)
+		if err != nil {
+			return err
+		}
+		if _, ok := room.Members[claims.ID]; !ok {
+			return ErrNotRoomMember
+		}
+		if room.OwnerID == claims.ID {
+			return ErrRoomOwnerLeave
+		}
+		return changeMembers(c, store.RemoveMember, rdb, room, claims.ID, &chat.MemberEvent{
+			Action: chat.MemberLeft,
+			UserID: claims.ID,
+		})
+	}
+}
+
+// AddChatMember lets a room's owner or an admin add someone to the room.
+func AddChatMember(store chat.Store, rdb redis.UniversalClient) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims, room, p, err := managedRoom(c, store)
+		if err != nil {
+			return err
+		}
+		if p.User <= 0 {
+			return echo.ErrBadRequest
+		}
+		if _, ok := room.Members[p.User]; ok {
+			return c.NoContent(http.StatusNoContent)
+		}
+		return changeMembers(c, store.AddMember, rdb, room, claims.ID, &chat.MemberEvent{
+			Action: chat.MemberAdded,
+			UserID: p.User,
+		})
+	}
+}
+
+// RemoveChatMember lets a room's owner or an admin remove someone from the
+// room.
+func RemoveChatMember(store chat.Store, rdb redis.UniversalClient) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims, room, p, err := managedRoom(c, store)
+		if err != nil {
+			return err
+		}
+		if p.User == room.OwnerID {
+			return ErrRemoveRoomOwner
+		}
+		if _, ok := room.Members[p.User]; !ok {
+			return ErrNotRoomMember
+		}
+		return changeMembers(c, store.RemoveMember, rdb, room, claims.ID, &chat.MemberEvent{
+			Action: chat.MemberRemoved,
+			UserID: p.User,
+		})
+	}
+}
+
+// TransferChatRoom gives a room to another one of its members.
+func TransferChatRoom(store chat.Store, rdb redis.UniversalClient) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims, room, p, err := managedRoom(c, store)
+		if err != nil {
+			return err
+		}
+		if _, ok := room.Members[p.User]; !ok {
+			return ErrNotRoomMember
+		}
+		if p.User == room.OwnerID {
+			return c.NoContent(http.StatusNoContent)
+		}
+		return changeMembers(c, store.SetOwner, rdb, room, claims.ID, &chat.MemberEvent{
+			Action: chat.MemberOwner,
+			UserID: p.User,
+		})
+	}
+}
+
+// ListMyChatRooms lists the rooms that the caller is a member of.
+func ListMyChatRooms(store chat.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := auth.GetClaims(c)
+		if claims == nil {
+			return echo.ErrUnauthorized.SetInternal(auth.ErrNoClaims)
+		}
+		rooms, err := store.UserRooms(c.Request().Context(), claims.ID)
+		if err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		return c.JSON(200, map[string]interface{}{"rooms": rooms})
+	}
+}
+
+func memberRequest(c echo.Context, store chat.Store) (*auth.Claims, *chat.Room, *memberParams, error) {
+	claims := auth.GetClaims(c)
+	if claims == nil {
+		return nil, nil, nil, echo.ErrUnauthorized.SetInternal(auth.ErrNoClaims)
+	}
+	var p memberParams
+	if err := c.Bind(&p); err != nil {
+		return nil, nil, nil, err
+	}
+	room, err := store.GetRoom(c.Request().Context(), p.Room)
+	if err != nil {
+		return nil, nil, nil, echo.ErrNotFound.SetInternal(err)
+	}
+	return claims, room, &p, nil
+}
+
+// managedRoom gets the room for a request made by the room's owner or an
+// admin.
+func managedRoom(c echo.Context, store chat.Store) (*auth.Claims, *chat.Room, *memberParams, error) {
+	claims, room, p, err := memberRequest(c, store)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if room.OwnerID != claims.ID && !auth.IsAdmin(claims) {
+		return nil, nil, nil, echo.ErrForbidden
+	}
+	return claims, room, p, nil
+}
+
+// changeMembers applies a membership change and broadcasts it to the room.
+func changeMembers(
+	c echo.Context,
+	change func(ctx context.Context, room, user int) error,
+	rdb redis.UniversalClient,
+	room *chat.Room,
+	by int,
+	ev *chat.MemberEvent,
+) error {
+	ctx := c.Request().Context()
+	err := change(ctx, room.ID, ev.UserID)
+	if errors.Is(err, chat.ErrNotMember) {
+		return ErrNotRoomMember
+	} else if err != nil {
+		return echo.ErrInternalServerError.SetInternal(err)
+	}
+	ev.Room, ev.By = room.ID, by
+	if err = chat.Broadcast(ctx, rdb, room.ID, chat.MsgMember, ev); err != nil {
+		logger.WithError(err).Error("failed to broadcast membership change")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ChatPresence lists the users that are connected to a room.
+func ChatPresence(store chat.Store, rdb redis.UniversalClient) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims, room, _, err := memberRequest(c, store)
+		if err != nil {
+			return err
+		}
+		if _, ok := room.Members[claims.ID]; !ok && !room.Public {
+			return ErrNotRoomMember
+		}
+		online, err := chat.NewPresence(rdb).Online(c.Request().Context(), room.ID)
+		if err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		return c.JSON(200, map[string]interface{}{"online": online})
+	}
+}
+
+// MarkChatRead saves the last message that the caller has read in a room and
+// broadcasts a read receipt. Connected clients should send read receipts over
+// the websocket instead.
+func MarkChatRead(store chat.Store, rdb redis.UniversalClient) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := auth.GetClaims(c)
+		if claims == nil {
+			return echo.ErrUnauthorized.SetInternal(auth.ErrNoClaims)
+		}
+		var p struct {
+			Room      int `param:"id"`
+			MessageID int `json:"message_id"`
+			Thread    int `json:"thread"`
+		}
+		if err := c.Bind(&p); err != nil {
+			return err
+		}
+		if p.MessageID <= 0 || p.Thread < 0 {
+			return echo.ErrBadRequest
+		}
+		var (
+			ctx  = c.Request().Context()
+			seen int
+			err  error
+		)
+		if p.Thread != 0 {
+			seen, err = store.MarkThreadSeen(ctx, p.Room, claims.ID, p.Thread, p.MessageID)
+		} else {
+			seen, err = store.MarkSeen(ctx, p.Room, claims.ID, p.MessageID)
+		}
+		if errors.Is(err, chat.ErrNotMember) {
+			return ErrNotRoomMember
+		} else if err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		receipt := chat.ReadReceipt{Room: p.Room, UserID: claims.ID, MessageID: seen, Thread: p.Thread}
+		if err = chat.Broadcast(ctx, rdb, p.Room, chat.MsgReadReceipt, &receipt); err != nil {
+			logger.WithError(err).Error("failed to broadcast read receipt")
+		}
+		return c.JSON(200, &receipt)
+	}
+}
+
+// ListUnreadChats counts the unread messages in each of the caller's rooms.
+func ListUnreadChats(store chat.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := auth.GetClaims(c)
+		if claims == nil {
+			return echo.ErrUnauthorized.SetInternal(auth.ErrNoClaims)
+		}
+		counts, err := store.Unread(c.Request().Context(), claims.ID)
+		if err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		return c.JSON(200, map[string]interface{}{"rooms": counts})
+	}
+}
+
+// maxEmojiLen is the size of the reactions table's emoji column.
+const maxEmojiLen = 64
+
+type messageParams struct {
+	Room    int    `param:"id"`
+	Message int    `param:"msg"`
+	Body    string `json:"body"`
+	Emoji   string `json:"emoji" query:"emoji"`
+}
+
+// EditChatMessage lets the author of a message change its body. The old body
+// is kept in the message's edit history.
+func EditChatMessage(store chat.Store, rdb redis.UniversalClient) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims, _, msg, p, err := writeMessageRequest(c, store)
+		if err != nil {
+			return err
+		}
+		if msg.DeletedAt != nil {
+			return withInternal(echo.ErrNotFound, chat.ErrMessageNotFound)
+		}
+		if msg.UserID != claims.ID {
+			return echo.ErrForbidden
+		}
+		if len(p.Body) == 0 {
+			return echo.ErrBadRequest.SetInternal(chat.ErrEmptyBody)
+		}
+		ctx := c.Request().Context()
+		edited, err := store.EditMessage(ctx, msg.ID, claims.ID, p.Body)
+		if errors.Is(err, chat.ErrMessageNotFound) {
+			return echo.ErrNotFound.SetInternal(err)
+		} else if err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		if err = chat.Broadcast(ctx, rdb, msg.Room, chat.MsgEdit, edited); err != nil {
+			logger.WithError(err).Error("failed to broadcast message edit")
+		}
+		return c.JSON(200, edited)
+	}
+}
+
+// DeleteChatMessage replaces a message with a tombstone. Messages can be
+// deleted by their author, the room's owner or an admin.
+func DeleteChatMessage(store chat.Store, rdb redis.UniversalClient) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims, room, msg, _, err := writeMessageRequest(c, store)
+		if err != nil {
+			return err
+		}
+		if msg.UserID != claims.ID && room.OwnerID != claims.ID && !auth.IsAdmin(claims) {
+			return echo.ErrForbidden
+		}
+		ctx := c.Request().Context()
+		tombstone, err := store.DeleteMessage(ctx, msg.ID, claims.ID)
+		if errors.Is(err, chat.ErrMessageNotFound) {
+			return echo.ErrNotFound.SetInternal(err)
+		} else if err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		if err = chat.Broadcast(ctx, rdb, msg.Room, chat.MsgDelete, tombstone); err != nil {
+			logger.WithError(err).Error("failed to broadcast message deletion")
+		}
+		return c.JSON(200, tombstone)
+	}
+}
+
+// ListChatMessageEdits lists the previous versions of a message.
+func ListChatMessageEdits(store chat.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, _, msg, _, err := messageRequest(c, store)
+		if err != nil {
+			return err
+		}
+		edits, err := store.MessageEdits(c.Request().Context(), msg.ID)
+		if err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		return c.JSON(200, map[string]interface{}{"edits": edits})
+	}
+}
+
+// AddChatReaction adds the caller's reaction to a message.
+func AddChatReaction(store chat.Store, rdb redis.UniversalClient) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return react(c, store, rdb, true)
+	}
+}
+
+// RemoveChatReaction removes one of the caller's reactions from a message.
+func RemoveChatReaction(store chat.Store, rdb redis.UniversalClient) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return react(c, store, rdb, false)
+	}
+}
+
+func react(c echo.Context, store chat.Store, rdb redis.UniversalClient, add bool) error {
+	claims, _, msg, p, err := writeMessageRequest(c, store)
+	if err != nil {
+		return err
+	}
+	if !validEmoji(p.Emoji) {
+		return echo.ErrBadRequest
+	}
+	if msg.DeletedAt != nil {
+		return echo.ErrNotFound.SetInternal(chat.ErrMessageNotFound)
+	}
+	ctx := c.Request().Context()
+	if add {
+		err = store.React(ctx, msg.ID, claims.ID, p.Emoji)
+	} else {
+		err = store.Unreact(ctx, msg.ID, claims.ID, p.Emoji)
+	}
+	if err != nil {
+		return echo.ErrInternalServerError.SetInternal(err)
+	}
+	ev := chat.ReactionEvent{
+		Room:      msg.Room,
+		MessageID: msg.ID,
+		UserID:    claims.ID,
+		Emoji:     p.Emoji,
+		Added:     add,
+	}
+	if err = chat.Broadcast(ctx, rdb, msg.Room, chat.MsgReaction, &ev); err != nil {
+		logger.WithError(err).Error("failed to broadcast reaction")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// messageRequest gets the message for a request made by someone that can see
+// the message's room.
+func messageRequest(c echo.Context, store chat.Store) (*auth.Claims, *chat.Room, *chat.Message, *messageParams, error) {
+	claims := auth.GetClaims(c)
+	if claims == nil {
+		return nil, nil, nil, nil, echo.ErrUnauthorized.SetInternal(auth.ErrNoClaims)
+	}
+	var p messageParams
+	if err := c.Bind(&p); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	ctx := c.Request().Context()
+	room, err := store.GetRoom(ctx, p.Room)
+	if err != nil {
+		return nil, nil, nil, nil, echo.ErrNotFound.SetInternal(err)
+	}
+	if _, ok := room.Members[claims.ID]; !ok && !room.Public {
+		return nil, nil, nil, nil, ErrNotRoomMember
+	}
+	msg, err := store.Message(ctx, room.ID, p.Message)
+	if err != nil {
+		return nil, nil, nil, nil, echo.ErrNotFound.SetInternal(err)
+	}
+	return claims, room, msg, &p, nil
+}
+
+// writeMessageRequest gets the message for a request that changes it. Like
+// sending messages, only the room's members and admins can change them, even
+// in public rooms.
+func writeMessageRequest(c echo.Context, store chat.Store) (*auth.Claims, *chat.Room, *chat.Message, *messageParams, error) {
+	claims, room, msg, p, err := messageRequest(c, store)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if _, ok := room.Members[claims.ID]; !ok && !auth.IsAdmin(claims) {
+		return nil, nil, nil, nil, ErrNotRoomMember
+	}
+	return claims, room, msg, p, nil
+}
+
+func validEmoji(s string) bool {
+	if len(s) == 0 || len(s) > maxEmojiLen || !utf8.ValidString(s) {
+		return false
+	}
+	return strings.IndexFunc(s, unicode.IsSpace) < 0
+}
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// SearchChat searches the messages in the caller's rooms. Results are sorted
+// newest first and the next page is requested by passing the "next" cursor
+// from the response as the "cursor" query parameter.
+func SearchChat(store chat.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := auth.GetClaims(c)
+		if claims == nil {
+			return echo.ErrUnauthorized.SetInternal(auth.ErrNoClaims)
+		}
+		var p struct {
+			Query  string `query:"q"`
+			Room   int    `query:"room"`
+			Author int    `query:"author"`
+			Since  string `query:"since"`
+			Until  string `query:"until"`
+			Cursor int    `query:"cursor"`
+			Limit  int    `query:"limit"`
+		}
+		if err := c.Bind(&p); err != nil {
+			return err
+		}
+		p.Query = strings.TrimSpace(p.Query)
+		if len(p.Query) == 0 || p.Cursor < 0 || p.Limit < 0 {
+			return echo.ErrBadRequest
+		}
+		if p.Limit == 0 {
+			p.Limit = defaultSearchLimit
+		} else if p.Limit > maxSearchLimit {
+			p.Limit = maxSearchLimit
+		}
+		q := chat.SearchQuery{
+			Text:   p.Query,
+			Room:   p.Room,
+			Author: p.Author,
+			Before: p.Cursor,
+			Limit:  p.Limit,
+		}
+		var err error
+		if q.Since, err = parseTimeParam(p.Since); err != nil {
+			return echo.ErrBadRequest.SetInternal(err)
+		}
+		if q.Until, err = parseTimeParam(p.Until); err != nil {
+			return echo.ErrBadRequest.SetInternal(err)
+		}
+		results, err := store.Search(c.Request().Context(), claims.ID, &q)
+		if err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		var next int
+		if len(results) == q.Limit {
+			next = results[len(results)-1].ID
+		}
+		return c.JSON(200, map[string]interface{}{
+			"results": results,
+			"next":    next,
+		})
+	}
+}
+
+// parseTimeParam parses an RFC 3339 timestamp or a date.
+func parseTimeParam(s string) (*time.Time, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -2,6 +2,8 @@ package chat
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -16,6 +18,10 @@ var logger logrus.FieldLogger = log.GetLogger()
 
 func SetLogger(l logrus.FieldLogger) { logger = l }
 
+var (
+	ErrNotMember = errors.New("user is not a member of this room")
+)
+
 type MsgDeviveryStatus int
 
 const (
@@ -36,6 +42,27 @@ const (
 	MsgEmpty MsgType = iota
 	// MsgChat is a message with a chat body
 	MsgChat
+	// MsgAck is the server's reply to a chat message.
+	MsgAck
+	// MsgTyping means that a user is typing.
+	MsgTyping
+	// MsgPresence means that a user has come online or gone offline.
+	MsgPresence
+	// MsgReadReceipt marks the last message a user has read.
+	MsgReadReceipt
+	// MsgError is sent when the server could not handle a frame.
+	MsgError
+	// MsgPing checks that the connection is alive. The server replies with a
+	// ping that has the same id.
+	MsgPing
+	// MsgMember is sent when someone joins or leaves a room.
+	MsgMember
+	// MsgEdit carries a message that has been edited.
+	MsgEdit
+	// MsgDelete carries the tombstone of a deleted message.
+	MsgDelete
+	// MsgReaction is sent when a reaction is added or removed.
+	MsgReaction
 )
 
 type Room struct {
@@ -57,11 +84,19 @@ type ChatRoomMember struct {
 }
 
 type Message struct {
-	ID        int       `json:"id"`
-	Room      int       `json:"room"`
-	UserID    int       `json:"user_id"`
-	Body      string    `json:"body"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        int        `json:"id"`
+	Room      int        `json:"room"`
+	UserID    int        `json:"user_id"`
+	Body      string     `json:"body"`
+	CreatedAt time.Time  `json:"created_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	// DeletedAt is set on tombstones left by deleted messages.
+	DeletedAt *time.Time  `json:"deleted_at,omitempty"`
+	Reactions []*Reaction `json:"reactions,omitempty"`
+	// ParentID is the first message of the thread that a reply belongs to.
+	ParentID int `json:"parent_id,omitempty"`
+	// Replies is the number of replies in a message's thread.
+	Replies int `json:"replies,omitempty"`
 }
 
 func NewStore(db db.DB) Store {
@@ -71,8 +106,54 @@ func NewStore(db db.DB) Store {
 type Store interface {
 	CreateRoom(ctx context.Context, owner int, name string, public bool) (*Room, error)
 	GetRoom(ctx context.Context, roomID int) (*Room, error)
+	// AddMember adds a user to a room. Adding an existing member does nothing.
+	AddMember(ctx context.Context, room, user int) error
+	// RemoveMember removes a user from a room. ErrNotMember is returned if
+	// the user isn't in the room.
+	RemoveMember(ctx context.Context, room, user int) error
+	// SetOwner gives a room to one of its members. ErrNotMember is returned
+	// if the new owner isn't in the room.
+	SetOwner(ctx context.Context, room, owner int) error
+	// UserRooms lists the rooms that a user is a member of.
+	UserRooms(ctx context.Context, user int) ([]*Room, error)
+	// MarkSeen moves a member's last seen message forward and returns the
+	// new last seen message. It never moves backwards or past the room's
+	// newest message. Thread replies are not counted. ErrNotMember is
+	// returned if the user isn't in the room.
+	MarkSeen(ctx context.Context, room, user, msg int) (int, error)
+	// LatestMessage returns the id of a room's newest message, not counting
+	// thread replies, or zero if the room has no messages.
+	LatestMessage(ctx context.Context, room int) (int, error)
+	// MarkThreadSeen is MarkSeen for the replies of a thread. ErrNotMember is
+	// returned if the user isn't in the room or the thread doesn't exist.
+	MarkThreadSeen(ctx context.Context, room, user, thread, msg int) (int, error)
+	// Unread counts the messages from other users that a user hasn't seen
+	// in each of their rooms.
+	Unread(ctx context.Context, user int) ([]*UnreadCount, error)
 	SaveMessage(ctx context.Context, msg *Message) error
+	// Messages lists a room's messages with their reactions and reply counts,
+	// newest first. Thread replies are not included.
 	Messages(ctx context.Context, room int, opts db.PaginationOpts) ([]*Message, error)
+	// Replies lists the replies in a thread, newest first.
+	Replies(ctx context.Context, room, thread int, opts db.PaginationOpts) ([]*Message, error)
+	// Search finds messages in the rooms that a user is a member of, newest
+	// first.
+	Search(ctx context.Context, user int, q *SearchQuery) ([]*SearchResult, error)
+	// Message gets one of a room's messages.
+	Message(ctx context.Context, room, id int) (*Message, error)
+	// EditMessage replaces a message's body and keeps the old body in the
+	// message's edit history.
+	EditMessage(ctx context.Context, id, editor int, body string) (*Message, error)
+	// MessageEdits lists the previous bodies of a message, oldest first.
+	MessageEdits(ctx context.Context, id int) ([]*MessageEdit, error)
+	// DeleteMessage replaces a message with a tombstone. The message's body,
+	// edit history and reactions are removed.
+	DeleteMessage(ctx context.Context, id, by int) (*Message, error)
+	// React adds a user's reaction to a message. Adding the same reaction
+	// twice does nothing.
+	React(ctx context.Context, id, user int, emoji string) error
+	// Unreact removes a user's reaction from a message.
+	Unreact(ctx context.Context, id, user int, emoji string) error
 }
 
 type store struct {
@@ -86,7 +167,7 @@ const roomMembersQuery = `
 	WHERE m.room = $1`
 
 func (rs *store) GetRoom(ctx context.Context, id int) (*Room, error) {
-	const query = `SELECT owner_id, name FROM chatroom WHERE id = $1`
+	const query = `SELECT owner_id, name, COALESCE(public, false), created_at FROM chatroom WHERE id = $1`
 	var r = Room{
 		ID:      id,
 		Members: make(map[int]*ChatRoomMember),
@@ -96,7 +177,7 @@ func (rs *store) GetRoom(ctx context.Context, id int) (*Room, error) {
 		return nil, err
 	}
 	defer rows.Close()
-	err = db.ScanOne(rows, &r.OwnerID, &r.Name)
+	err = db.ScanOne(rows, &r.OwnerID, &r.Name, &r.Public, &r.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -119,12 +200,12 @@ func (rs *store) GetRoom(ctx context.Context, id int) (*Room, error) {
 }
 
 func (rs *store) SaveMessage(ctx context.Context, msg *Message) error {
-	const query = `INSERT INTO chatroom_messages (room, user_id, body, created_at) ` +
-		`VALUES ($1, $2, $3, $4) RETURNING id`
+	const query = `INSERT INTO chatroom_messages (room, user_id, body, created_at, parent_id) ` +
+		`VALUES ($1, $2, $3, $4, NULLIF($5, 0)) RETURNING id`
 	if msg == nil {
 		return errors.New("cannot save nil message")
 	}
-	rows, err := rs.db.QueryContext(ctx, query, msg.Room, msg.UserID, msg.Body, msg.CreatedAt)
+	rows, err := rs.db.QueryContext(ctx, query, msg.Room, msg.UserID, msg.Body, msg.CreatedAt, msg.ParentID)
 	if err != nil {
 		return err
 	}
@@ -156,50 +237,260 @@ func (rs *store) CreateRoom(ctx context.Context, owner int, name string, public
 	return &room, nil
 }
 
+func (rs *store) AddMember(ctx context.Context, room, user int) error {
+	const query = `INSERT INTO chatroom_members (room,user_id) VALUES ($1,$2) ON CONFLICT DO NOTHING`
+	_, err := rs.db.ExecContext(ctx, query, room, user)
+	return err
+}
+
+func (rs *store) RemoveMember(ctx context.Context, room, user int) error {
+	const query = `DELETE FROM chatroom_members WHERE room = $1 AND user_id = $2`
+	res, err := rs.db.ExecContext(ctx, query, room, user)
+	if err != nil {
+		return err
+	}
+	return expectRows(res, ErrNotMember)
+}
+
+func (rs *store) SetOwner(ctx context.Context, room, owner int) error {
+	const query = `
+	UPDATE chatroom SET owner_id = $2
+	WHERE id = $1 AND EXISTS (
+		SELECT 1 FROM chatroom_members WHERE room = $1 AND user_id = $2
+	)`
+	res, err := rs.db.ExecContext(ctx, query, room, owner)
+	if err != nil {
+		return err
+	}
+	return expectRows(res, ErrNotMember)
+}
+
+func (rs *store) UserRooms(ctx context.Context, user int) ([]*Room, error) {
+	const query = `
+	SELECT c.id, c.owner_id, c.name, COALESCE(c.public, false), c.created_at
+	FROM chatroom c
+	JOIN chatroom_members m ON (m.room = c.id)
+	WHERE m.user_id = $1
+	ORDER BY c.id`
+	rows, err := rs.db.QueryContext(ctx, query, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rooms := make([]*Room, 0)
+	for rows.Next() {
+		var r Room
+		err = rows.Scan(&r.ID, &r.OwnerID, &r.Name, &r.Public, &r.CreatedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan room from database")
+		}
+		rooms = append(rooms, &r)
+	}
+	return rooms, rows.Err()
+}
+
+func (rs *store) MarkSeen(ctx context.Context, room, user, msg int) (int, error) {
+	const query = `
+	UPDATE chatroom_members SET last_seen = GREATEST(last_seen, (
+		SELECT COALESCE(MAX(id), 0) FROM chatroom_messages
+		WHERE room = $1 AND parent_id IS NULL AND id <= $3
+	))
+	WHERE room = $1 AND user_id = $2
+	RETURNING last_seen`
+	rows, err := rs.db.QueryContext(ctx, query, room, user, msg)
+	if err != nil {
+		return 0, err
+	}
+	var seen int
+	err = db.ScanOne(rows, &seen)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotMember
+	}
+	return seen, err
+}
+
+func (rs *store) LatestMessage(ctx context.Context, room int) (int, error) {
+	const query = `
+	SELECT COALESCE(MAX(id), 0) FROM chatroom_messages
+	WHERE room = $1 AND parent_id IS NULL`
+	rows, err := rs.db.QueryContext(ctx, query, room)
+	if err != nil {
+		return 0, err
+	}
+	var id int
+	return id, db.ScanOne(rows, &id)
+}
+
+func (rs *store) MarkThreadSeen(ctx context.Context, room, user, thread, msg int) (int, error) {
+	const query = `
+	INSERT INTO chatroom_thread_reads (parent_id, user_id, last_seen)
+	SELECT p.id, m.user_id, (
+		SELECT COALESCE(MAX(id), 0) FROM chatroom_messages WHERE parent_id = p.id AND id <= $4
+	)
+	FROM chatroom_messages p
+	JOIN chatroom_members m ON (m.room = p.room AND m.user_id = $2)
+	WHERE p.id = $3 AND p.room = $1 AND p.parent_id IS NULL
+	ON CONFLICT (parent_id, user_id) DO UPDATE
+	SET last_seen = GREATEST(chatroom_thread_reads.last_seen, EXCLUDED.last_seen)
+	RETURNING last_seen`
+	rows, err := rs.db.QueryContext(ctx, query, room, user, thread, msg)
+	if err != nil {
+		return 0, err
+	}
+	var seen int
+	err = db.ScanOne(rows, &seen)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotMember
+	}
+	return seen, err
+}
+
+// UnreadCount is the number of unread messages in a room.
+type UnreadCount struct {
+	Room     int `json:"room"`
+	LastSeen int `json:"last_seen"`
+	Unread   int `json:"unread"`
+	// Threads is the number of unread replies in threads that the user has
+	// started, replied to or read.
+	Threads int `json:"threads"`
+}
+
+func (rs *store) Unread(ctx context.Context, user int) ([]*UnreadCount, error) {
+	const query = `
+	SELECT m.room, m.last_seen, (
+		SELECT COUNT(*) FROM chatroom_messages msg
+		WHERE msg.room = m.room AND msg.parent_id IS NULL
+		  AND msg.id > m.last_seen AND msg.user_id <> m.user_id
+	), (
+		SELECT COUNT(*) FROM chatroom_messages r
+		LEFT JOIN chatroom_thread_reads tr ON (tr.parent_id = r.parent_id AND tr.user_id = m.user_id)
+		WHERE r.room = m.room AND r.parent_id IS NOT NULL
+		  AND r.id > COALESCE(tr.last_seen, 0) AND r.user_id <> m.user_id
+		  AND (tr.user_id IS NOT NULL OR EXISTS (
+			SELECT 1 FROM chatroom_messages t
+			WHERE (t.id = r.parent_id OR t.parent_id = r.parent_id) AND t.user_id = m.user_id
+		  ))
+	)
+	FROM chatroom_members m
+	WHERE m.user_id = $1
+	ORDER BY m.room`
+	rows, err := rs.db.QueryContext(ctx, query, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make([]*UnreadCount, 0)
+	for rows.Next() {
+		var c UnreadCount
+		if err = rows.Scan(&c.Room, &c.LastSeen, &c.Unread, &c.Threads); err != nil {
+			return nil, errors.Wrap(err, "failed to scan unread count from database")
+		}
+		counts = append(counts, &c)
+	}
+	return counts, rows.Err()
+}
+
+// expectRows returns err if a statement didn't change anything.
+func expectRows(res sql.Result, err error) error {
+	n, e := res.RowsAffected()
+	if e != nil {
+		return e
+	}
+	if n == 0 {
+		return err
+	}
+	return nil
+}
+
 const (
 	listMessagesQueryHead = `
-	SELECT id, room, user_id, body, created_at
-	FROM   chatroom_messages`
+	SELECT m.id, m.room, m.user_id, m.body, m.created_at, m.edited_at, m.deleted_at,
+	       COALESCE(m.parent_id, 0), (
+	           SELECT COUNT(*) FROM chatroom_messages r
+	           WHERE  r.parent_id = m.id AND r.deleted_at IS NULL
+	       )
+	FROM   chatroom_messages m`
 	listMessagesQueryOffset = listMessagesQueryHead + `
-	WHERE  room = $1
-	ORDER  BY created_at DESC
+	WHERE  m.room = $1 AND m.parent_id IS NULL
+	ORDER  BY m.created_at DESC
 	LIMIT  $2 OFFSET $3`
 	listMessagesQueryIDs = listMessagesQueryHead + `
-	WHERE  room = $1 AND id < $2
-	ORDER  BY created_at DESC
+	WHERE  m.room = $1 AND m.parent_id IS NULL AND m.id < $2
+	ORDER  BY m.created_at DESC
+	LIMIT  $3`
+	listRepliesQueryOffset = listMessagesQueryHead + `
+	WHERE  m.room = $1 AND m.parent_id = $4
+	ORDER  BY m.created_at DESC
+	LIMIT  $2 OFFSET $3`
+	listRepliesQueryIDs = listMessagesQueryHead + `
+	WHERE  m.room = $1 AND m.parent_id = $4 AND m.id < $2
+	ORDER  BY m.created_at DESC
 	LIMIT  $3`
 )
 
 func (rs *store) Messages(ctx context.Context, room int, opts db.PaginationOpts) ([]*Message, error) {
+	return rs.listMessages(ctx, listMessagesQueryIDs, listMessagesQueryOffset, opts, room)
+}
+
+func (rs *store) Replies(ctx context.Context, room, thread int, opts db.PaginationOpts) ([]*Message, error) {
+	return rs.listMessages(ctx, listRepliesQueryIDs, listRepliesQueryOffset, opts, room, thread)
+}
+
+// listMessages runs one of the message listing queries. The extra arguments
+// come after the room and pagination arguments.
+func (rs *store) listMessages(
+	ctx context.Context,
+	byID, byOffset string,
+	opts db.PaginationOpts,
+	room int,
+	extra ...interface{},
+) ([]*Message, error) {
 	var (
 		err  error
 		rows db.Rows
 	)
 	if opts.Offset == 0 && opts.Prev != 0 {
-		rows, err = rs.db.QueryContext(ctx, listMessagesQueryIDs, room, opts.Prev, opts.Limit)
+		args := append([]interface{}{room, opts.Prev, opts.Limit}, extra...)
+		rows, err = rs.db.QueryContext(ctx, byID, args...)
 	} else {
-		rows, err = rs.db.QueryContext(ctx, listMessagesQueryOffset, room, opts.Limit, opts.Offset)
+		args := append([]interface{}{room, opts.Limit, opts.Offset}, extra...)
+		rows, err = rs.db.QueryContext(ctx, byOffset, args...)
 	}
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to execute query")
 	}
+	msgs, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err = rs.attachReactions(ctx, msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func scanMessages(rows db.Rows) ([]*Message, error) {
 	defer rows.Close()
 	msgs := make([]*Message, 0)
 	for rows.Next() {
 		var msg Message
-		err = rows.Scan(
+		err := rows.Scan(
 			&msg.ID,
 			&msg.Room,
 			&msg.UserID,
 			&msg.Body,
 			&msg.CreatedAt,
+			&msg.EditedAt,
+			&msg.DeletedAt,
+			&msg.ParentID,
+			&msg.Replies,
 		)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to scan message from database")
 		}
 		msgs = append(msgs, &msg)
 	}
-	return msgs, nil
+	return msgs, rows.Err()
 }
 
 type ChatRoom struct {
@@ -212,6 +503,8 @@ type ChatRoom struct {
 	s      Socket
 	stop   chan struct{}
 	logger logrus.FieldLogger
+	read   readMarker
+	typing typingLimiter
 }
 
 func OpenRoom(
@@ -240,7 +533,7 @@ func (cr *ChatRoom) Exists(ctx context.Context) error {
 		return nil
 	}
 	if _, ok := room.Members[cr.UserID]; !ok {
-		return errors.New("user is not a member of this room")
+		return ErrNotMember
 	}
 	return nil
 }
@@ -251,38 +544,234 @@ func (cr *ChatRoom) Start(ctx context.Context, pubsub PubSub, socket Socket) err
 	cr.stop = make(chan struct{})
 	cr.logger = log.FromContext(ctx)
 	go cr.readLoop(ctx)
-	return cr.writeLoop(ctx)
+	err := cr.writeLoop(ctx)
+	// The request's context is usually done by now.
+	flushCtx, cancel := context.WithTimeout(context.Background(), readFlushTimeout)
+	defer cancel()
+	cr.flushRead(flushCtx)
+	return err
 }
 
 func (cr *ChatRoom) readLoop(ctx context.Context) {
 	for {
-		msg, err := cr.s.Recv(ctx)
-		if err != nil {
+		env, err := cr.s.Recv(ctx)
+		if err != nil && !isFrameError(err) {
 			_ = cr.handleSocketError(err, "failed to receive from websocket")
 			return
 		}
-		err = cr.Store.SaveMessage(ctx, msg)
-		if err != nil {
-			cr.logger.WithError(err).Error("could not write new message to database")
-			continue
+		if err == nil {
+			err = cr.handle(ctx, env)
+		}
+		switch {
+		case err == nil:
+		case isFrameError(err):
+			cr.sendError(ctx, frameID(env), err)
+		default:
+			cr.logger.WithError(err).Error("failed to handle chat frame")
 		}
-		err = cr.ps.Pub(ctx, msg)
+	}
+}
+
+// handle a frame received from the websocket. Errors from bad frames are
+// sent back to the client.
+func (cr *ChatRoom) handle(ctx context.Context, env *Envelope) error {
+	switch env.Type {
+	case MsgEmpty:
+		return nil
+	case MsgPing:
+		return cr.s.Send(ctx, &Envelope{Version: ProtocolVersion, Type: MsgPing, ID: env.ID})
+	case MsgChat:
+		return cr.handleChat(ctx, env)
+	case MsgReadReceipt:
+		return cr.handleRead(ctx, env)
+	case MsgTyping:
+		return cr.handleTyping(ctx, env)
+	default:
+		return errors.Wrapf(ErrUnsupported, "cannot handle %q frames", env.Type)
+	}
+}
+
+// handleChat saves and publishes a new message then acks it. Messages that
+// were already saved under the same client ID are acked without being saved
+// again.
+func (cr *ChatRoom) handleChat(ctx context.Context, env *Envelope) error {
+	var in Message
+	if err := env.Decode(&in); err != nil {
+		return err
+	}
+	if len(in.Body) == 0 {
+		return ErrEmptyBody
+	}
+	// Only the body and thread come from the client.
+	msg := Message{
+		Room:      cr.RoomID,
+		UserID:    cr.UserID,
+		Body:      in.Body,
+		CreatedAt: time.Now(),
+	}
+	if in.ParentID != 0 {
+		parent, err := cr.thread(ctx, in.ParentID)
 		if err != nil {
-			cr.logger.WithError(err).Error("could not publish message")
-			continue
+			return err
+		}
+		msg.ParentID = parent
+	}
+
+	id, dup, err := cr.claim(ctx, env.ID)
+	if err != nil {
+		cr.logger.WithError(err).Warn("could not check for duplicate message")
+	} else if dup {
+		if id == 0 {
+			// The first copy is still being saved and will be acked.
+			return nil
 		}
+		return cr.ack(ctx, env.ID, &Ack{ID: id, Status: StatusStored})
+	}
+
+	if err = cr.Store.SaveMessage(ctx, &msg); err != nil {
+		cr.logger.WithError(err).Error("could not write new message to database")
+		cr.release(ctx, env.ID)
+		return cr.ack(ctx, env.ID, &Ack{Status: StatusFailed})
+	}
+	cr.remember(ctx, env.ID, msg.ID)
+	status := StatusSent
+	out, err := NewEnvelope(MsgChat, env.ID, &msg)
+	if err == nil {
+		err = cr.ps.Pub(ctx, out)
+	}
+	if err != nil {
+		cr.logger.WithError(err).Error("could not publish message")
+		status = StatusStored
+	}
+	return cr.ack(ctx, env.ID, &Ack{ID: msg.ID, Status: status})
+}
+
+// thread finds the thread that a reply belongs to. Replies to replies are
+// added to the same thread.
+func (cr *ChatRoom) thread(ctx context.Context, parent int) (int, error) {
+	p, err := cr.Store.Message(ctx, cr.RoomID, parent)
+	if errors.Is(err, ErrMessageNotFound) {
+		return 0, ErrUnknownParent
+	} else if err != nil {
+		return 0, err
+	}
+	if p.ParentID != 0 {
+		return p.ParentID, nil
+	}
+	if p.DeletedAt != nil {
+		return 0, ErrUnknownParent
+	}
+	return p.ID, nil
+}
+
+func (cr *ChatRoom) ack(ctx context.Context, id string, ack *Ack) error {
+	env, err := NewEnvelope(MsgAck, id, ack)
+	if err != nil {
+		return err
+	}
+	return cr.s.Send(ctx, env)
+}
+
+func (cr *ChatRoom) sendError(ctx context.Context, id string, e error) {
+	p := ErrorPayload{Code: errorCode(e), Message: e.Error()}
+	if p.Code == CodeInternal {
+		p.Message = "internal error"
+	}
+	env, err := NewEnvelope(MsgError, id, &p)
+	if err == nil {
+		err = cr.s.Send(ctx, env)
+	}
+	if err != nil {
+		cr.logger.WithError(err).Warn("failed to send error frame")
+	}
+}
+
+func isFrameError(err error) bool {
+	return errorCode(err) != CodeInternal
+}
+
+// frameID is the id used to reply to a frame.
+func frameID(env *Envelope) string {
+	if env == nil || len(env.ID) > maxClientIDLen {
+		return ""
+	}
+	return env.ID
+}
+
+const (
+	// dedupTTL is how long client message ids are remembered.
+	dedupTTL = 24 * time.Hour
+	// claimTTL is how long a client message id is held while the message is
+	// saved. It is short so that the client can retry if the server dies
+	// before the message id is remembered.
+	claimTTL = 10 * time.Second
+)
+
+func (cr *ChatRoom) dedupKey(clientID string) string {
+	return fmt.Sprintf("chat:dedup:room:%d:user:%d:%s", cr.RoomID, cr.UserID, clientID)
+}
+
+// claim marks a client message id as being saved. It returns the stored
+// message's ID when the client ID has been seen before, or zero when the
+// first copy is still being saved.
+func (cr *ChatRoom) claim(ctx context.Context, clientID string) (int, bool, error) {
+	if len(clientID) == 0 || cr.RDB == nil {
+		return 0, false, nil
+	}
+	key := cr.dedupKey(clientID)
+	ok, err := cr.RDB.SetNX(ctx, key, 0, claimTTL).Result()
+	if err != nil {
+		return 0, false, err
+	}
+	if ok {
+		return 0, false, nil
+	}
+	id, err := cr.RDB.Get(ctx, key).Int()
+	if err == redis.Nil {
+		// The claim expired before the first copy was saved.
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return id, true, nil
+}
+
+// remember the stored message ID for a client message id.
+func (cr *ChatRoom) remember(ctx context.Context, clientID string, id int) {
+	if len(clientID) == 0 || cr.RDB == nil {
+		return
+	}
+	if err := cr.RDB.Set(ctx, cr.dedupKey(clientID), id, dedupTTL).Err(); err != nil {
+		cr.logger.WithError(err).Warn("could not remember message id")
+	}
+}
+
+// release a claimed client message id so that the client can retry.
+func (cr *ChatRoom) release(ctx context.Context, clientID string) {
+	if len(clientID) == 0 || cr.RDB == nil {
+		return
+	}
+	if err := cr.RDB.Del(ctx, cr.dedupKey(clientID)).Err(); err != nil {
+		cr.logger.WithError(err).Warn("could not release message id")
 	}
 }
 
 func (cr *ChatRoom) writeLoop(ctx context.Context) error {
-	messages := cr.ps.Sub(ctx)
+	frames := cr.ps.Sub(ctx)
 	for {
 		select {
-		case msg := <-messages:
-			err := cr.s.Send(ctx, &msg)
+		case env, ok := <-frames:
+			if !ok {
+				return nil
+			}
+			err := cr.s.Send(ctx, &env)
 			if e := cr.handleSocketError(err, "failed to send through websocket"); e != nil {
 				return e
 			}
+			if cr.removed(&env) {
+				cr.logger.Info("removed from room")
+				return nil
+			}
 		case <-ctx.Done():
 			cr.logger.WithError(ctx.Err()).Warn("context cancelled")
 			close(cr.stop)
@@ -294,6 +783,18 @@ func (cr *ChatRoom) writeLoop(ctx context.Context) error {
 	}
 }
 
+// removed reports whether a frame removes the connected user from the room.
+func (cr *ChatRoom) removed(env *Envelope) bool {
+	if env.Type != MsgMember {
+		return false
+	}
+	var ev MemberEvent
+	if err := env.Decode(&ev); err != nil {
+		return false
+	}
+	return ev.UserID == cr.UserID && (ev.Action == MemberRemoved || ev.Action == MemberLeft)
+}
+
 func (cr *ChatRoom) handleSocketError(e error, message string) error {
 	switch ws.CloseStatus(e) {
 	case ws.StatusGoingAway, ws.StatusNormalClosure:
@@ -1,7 +1,20 @@
 package chat
 
 import (
+	"context"
+	"io"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang/mock/gomock"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+	"gopkg.hrry.dev/homelab/pkg/db"
+	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockdb"
+	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockredis"
+	"gopkg.hrry.dev/homelab/pkg/internal/mockutil"
 )
 
 func Test(t *testing.T) {
@@ -14,3 +27,534 @@ func TestStore_SaveMessage(t *testing.T) {}
 func TestStore_CreateRoom(t *testing.T) {}
 
 func TestStore_Messages(t *testing.T) {}
+
+type fakeSocket struct {
+	mu   sync.Mutex
+	recv []fakeFrame
+	sent []*Envelope
+}
+
+type fakeFrame struct {
+	env *Envelope
+	err error
+}
+
+func (s *fakeSocket) Send(_ context.Context, env *Envelope) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, env)
+	return nil
+}
+
+func (s *fakeSocket) Recv(context.Context) (*Envelope, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.recv) == 0 {
+		return nil, io.EOF
+	}
+	f := s.recv[0]
+	s.recv = s.recv[1:]
+	return f.env, f.err
+}
+
+type fakePubSub struct {
+	published []*Envelope
+	frames    chan Envelope
+}
+
+func (ps *fakePubSub) Pub(_ context.Context, env *Envelope) error {
+	ps.published = append(ps.published, env)
+	return nil
+}
+
+func (ps *fakePubSub) Sub(context.Context) <-chan Envelope { return ps.frames }
+
+type fakeStore struct {
+	Store
+	err      error
+	saved    []*Message
+	seen     []int
+	messages map[int]*Message
+	threads  map[int]int
+	latest   int
+	lookups  int
+}
+
+func (fs *fakeStore) LatestMessage(context.Context, int) (int, error) {
+	fs.lookups++
+	return fs.latest, nil
+}
+
+func (fs *fakeStore) Message(_ context.Context, room, id int) (*Message, error) {
+	m, ok := fs.messages[id]
+	if !ok || m.Room != room {
+		return nil, ErrMessageNotFound
+	}
+	return m, nil
+}
+
+func (fs *fakeStore) MarkThreadSeen(_ context.Context, _, _, thread, msg int) (int, error) {
+	if _, ok := fs.messages[thread]; !ok {
+		return 0, ErrNotMember
+	}
+	if fs.threads == nil {
+		fs.threads = make(map[int]int)
+	}
+	if msg > fs.threads[thread] {
+		fs.threads[thread] = msg
+	}
+	return fs.threads[thread], nil
+}
+
+func (fs *fakeStore) MarkSeen(_ context.Context, _, _, msg int) (int, error) {
+	if fs.err != nil {
+		return 0, fs.err
+	}
+	fs.seen = append(fs.seen, msg)
+	return msg, nil
+}
+
+func (fs *fakeStore) SaveMessage(_ context.Context, msg *Message) error {
+	if fs.err != nil {
+		return fs.err
+	}
+	fs.saved = append(fs.saved, msg)
+	msg.ID = len(fs.saved) + 6
+	return nil
+}
+
+func testRoom(store Store, rdb redis.UniversalClient) (*ChatRoom, *fakeSocket, *fakePubSub) {
+	var (
+		cr = OpenRoom(store, rdb, 1, 2)
+		s  = &fakeSocket{}
+		ps = &fakePubSub{}
+	)
+	cr.s, cr.ps, cr.logger = s, ps, logger
+	return cr, s, ps
+}
+
+func envelope(t *testing.T, typ MsgType, id string, payload any) *Envelope {
+	t.Helper()
+	env, err := NewEnvelope(typ, id, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func decodeAck(t *testing.T, env *Envelope) Ack {
+	t.Helper()
+	if env.Type != MsgAck {
+		t.Fatalf("expected an ack, got %q", env.Type)
+	}
+	var ack Ack
+	if err := env.Decode(&ack); err != nil {
+		t.Fatal(err)
+	}
+	return ack
+}
+
+func TestChatRoom_handle(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	store := &fakeStore{}
+	cr, s, ps := testRoom(store, nil)
+
+	is.NoErr(cr.handle(ctx, envelope(t, MsgEmpty, "", nil)))
+	is.Equal(len(s.sent), 0)
+	is.NoErr(cr.handle(ctx, envelope(t, MsgPing, "p1", nil)))
+	is.Equal(s.sent[0], &Envelope{Version: ProtocolVersion, Type: MsgPing, ID: "p1"})
+
+	is.NoErr(cr.handle(ctx, envelope(t, MsgChat, "m1", &Message{ID: 99, Room: 5, UserID: 5, Body: "hi"})))
+	is.Equal(len(store.saved), 1)
+	saved := store.saved[0]
+	is.Equal(saved.Room, 1)
+	is.Equal(saved.UserID, 2)
+	is.True(!saved.CreatedAt.IsZero())
+	is.Equal(len(ps.published), 1)
+	is.Equal(ps.published[0].Type, MsgChat)
+	is.Equal(ps.published[0].ID, "m1")
+	is.Equal(decodeAck(t, s.sent[1]), Ack{ID: 7, Status: StatusSent})
+	is.Equal(s.sent[1].ID, "m1")
+
+	err := cr.handle(ctx, envelope(t, MsgChat, "m2", &Message{}))
+	is.True(errors.Is(err, ErrEmptyBody))
+	err = cr.handle(ctx, &Envelope{Version: ProtocolVersion, Type: MsgChat, ID: "m3"})
+	is.True(errors.Is(err, ErrBadFrame))
+	err = cr.handle(ctx, envelope(t, MsgAck, "m4", &Ack{}))
+	is.True(errors.Is(err, ErrUnsupported))
+
+	store.err = errors.New("database is down")
+	is.NoErr(cr.handle(ctx, envelope(t, MsgChat, "m5", &Message{Body: "hi"})))
+	is.Equal(decodeAck(t, s.sent[2]), Ack{Status: StatusFailed})
+	is.Equal(len(ps.published), 1)
+}
+
+func TestChatRoom_dedup(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rdb := mockredis.NewMockUniversalClient(ctrl)
+	store := &fakeStore{}
+	cr, s, ps := testRoom(store, rdb)
+	const key = "chat:dedup:room:1:user:2:m1"
+	msg := envelope(t, MsgChat, "m1", &Message{Body: "hi"})
+
+	gomock.InOrder(
+		rdb.EXPECT().SetNX(ctx, key, 0, claimTTL).Return(redis.NewBoolResult(true, nil)),
+		rdb.EXPECT().Set(ctx, key, 7, dedupTTL).Return(redis.NewStatusResult("OK", nil)),
+	)
+	is.NoErr(cr.handle(ctx, msg))
+	is.Equal(decodeAck(t, s.sent[0]), Ack{ID: 7, Status: StatusSent})
+
+	// resent after a reconnect
+	gomock.InOrder(
+		rdb.EXPECT().SetNX(ctx, key, 0, claimTTL).Return(redis.NewBoolResult(false, nil)),
+		rdb.EXPECT().Get(ctx, key).Return(redis.NewStringResult("7", nil)),
+	)
+	is.NoErr(cr.handle(ctx, msg))
+	is.Equal(decodeAck(t, s.sent[1]), Ack{ID: 7, Status: StatusStored})
+	is.Equal(len(store.saved), 1)
+	is.Equal(len(ps.published), 1)
+
+	// the first copy hasn't been saved yet
+	gomock.InOrder(
+		rdb.EXPECT().SetNX(ctx, key, 0, claimTTL).Return(redis.NewBoolResult(false, nil)),
+		rdb.EXPECT().Get(ctx, key).Return(redis.NewStringResult("0", nil)),
+	)
+	is.NoErr(cr.handle(ctx, msg))
+	is.Equal(len(s.sent), 2)
+
+	// failed saves can be retried
+	store.err = errors.New("database is down")
+	gomock.InOrder(
+		rdb.EXPECT().SetNX(ctx, "chat:dedup:room:1:user:2:m2", 0, claimTTL).Return(redis.NewBoolResult(true, nil)),
+		rdb.EXPECT().Del(ctx, "chat:dedup:room:1:user:2:m2").Return(redis.NewIntResult(1, nil)),
+	)
+	is.NoErr(cr.handle(ctx, envelope(t, MsgChat, "m2", &Message{Body: "hi"})))
+	is.Equal(decodeAck(t, s.sent[2]), Ack{Status: StatusFailed})
+
+	// the claim expired because the server died before remembering the id
+	store.err = nil
+	gomock.InOrder(
+		rdb.EXPECT().SetNX(ctx, "chat:dedup:room:1:user:2:m3", 0, claimTTL).Return(redis.NewBoolResult(false, nil)),
+		rdb.EXPECT().Get(ctx, "chat:dedup:room:1:user:2:m3").Return(redis.NewStringResult("", redis.Nil)),
+		rdb.EXPECT().Set(ctx, "chat:dedup:room:1:user:2:m3", 8, dedupTTL).Return(redis.NewStatusResult("OK", nil)),
+	)
+	is.NoErr(cr.handle(ctx, envelope(t, MsgChat, "m3", &Message{Body: "hi"})))
+	is.Equal(decodeAck(t, s.sent[3]), Ack{ID: 8, Status: StatusSent})
+}
+
+func TestChatRoom_readLoop(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	cr, s, _ := testRoom(&fakeStore{}, nil)
+	s.recv = []fakeFrame{
+		{err: errors.Wrap(ErrBadFrame, "unexpected EOF")},
+		{env: &Envelope{Version: 2, ID: "x"}, err: ErrBadVersion},
+		{env: envelope(t, MsgAck, "t1", nil)},
+		{env: envelope(t, MsgPing, "p1", nil)},
+	}
+	// returns once the socket is closed
+	cr.readLoop(ctx)
+	is.Equal(len(s.sent), 4)
+	for i, code := range []string{CodeBadFrame, CodeBadFrame, CodeUnsupported} {
+		is.Equal(s.sent[i].Type, MsgError)
+		var p ErrorPayload
+		is.NoErr(s.sent[i].Decode(&p))
+		is.Equal(p.Code, code)
+	}
+	is.Equal(s.sent[0].ID, "")
+	is.Equal(s.sent[1].ID, "x")
+	is.Equal(s.sent[2].ID, "t1")
+	is.Equal(s.sent[3].Type, MsgPing)
+}
+
+type testResult int64
+
+func (r testResult) LastInsertId() (int64, error) { return 0, nil }
+func (r testResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+func TestStore_RemoveMember(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	s := NewStore(d)
+	d.EXPECT().ExecContext(ctx, mockutil.HasPrefix("DELETE FROM chatroom_members"), 1, 2).Return(testResult(1), nil)
+	is.NoErr(s.RemoveMember(ctx, 1, 2))
+	d.EXPECT().ExecContext(ctx, gomock.Any(), 1, 3).Return(testResult(0), nil)
+	is.Equal(s.RemoveMember(ctx, 1, 3), ErrNotMember)
+}
+
+func TestStore_SetOwner(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	s := NewStore(d)
+	d.EXPECT().ExecContext(ctx, gomock.Any(), 1, 2).Return(testResult(1), nil)
+	is.NoErr(s.SetOwner(ctx, 1, 2))
+	d.EXPECT().ExecContext(ctx, gomock.Any(), 1, 3).Return(testResult(0), nil)
+	is.Equal(s.SetOwner(ctx, 1, 3), ErrNotMember)
+	testErr := errors.New("test error")
+	d.EXPECT().ExecContext(ctx, gomock.Any(), 1, 4).Return(nil, testErr)
+	is.Equal(s.SetOwner(ctx, 1, 4), testErr)
+}
+
+func TestChatRoom_removed(t *testing.T) {
+	is := is.New(t)
+	cr, _, _ := testRoom(&fakeStore{}, nil)
+	for _, tt := range []struct {
+		ev      MemberEvent
+		removed bool
+	}{
+		{MemberEvent{Action: MemberRemoved, UserID: 2}, true},
+		{MemberEvent{Action: MemberLeft, UserID: 2}, true},
+		{MemberEvent{Action: MemberRemoved, UserID: 3}, false},
+		{MemberEvent{Action: MemberJoined, UserID: 2}, false},
+	} {
+		is.Equal(cr.removed(envelope(t, MsgMember, "", &tt.ev)), tt.removed)
+	}
+	is.True(!cr.removed(envelope(t, MsgChat, "", &Message{UserID: 2})))
+}
+
+func TestChatRoom_writeLoop_left(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	cr, s, ps := testRoom(&fakeStore{}, nil)
+	ps.frames = make(chan Envelope, 2)
+	// The user left the room from another tab so the event is from the server.
+	ps.frames <- *envelope(t, MsgChat, "", &Message{UserID: 3, Body: "bye"})
+	ps.frames <- *envelope(t, MsgMember, "", &MemberEvent{Action: MemberLeft, Room: 1, UserID: 2, By: 2})
+	done := make(chan error)
+	go func() { done <- cr.writeLoop(ctx) }()
+	select {
+	case err := <-done:
+		is.NoErr(err)
+	case <-time.After(time.Second):
+		t.Fatal("the connection was not closed after leaving the room")
+	}
+	is.Equal(len(s.sent), 2)
+	is.Equal(s.sent[1].Type, MsgMember)
+}
+
+func TestStore_MarkSeen(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	rows := mockdb.NewMockRows(ctrl)
+	s := NewStore(d)
+	gomock.InOrder(
+		d.EXPECT().QueryContext(ctx, mockutil.HasPrefix("\n\tUPDATE chatroom_members"), 1, 2, 50).Return(rows, nil),
+		rows.EXPECT().Next().Return(true),
+		rows.EXPECT().Scan(gomock.Any()).DoAndReturn(func(dest ...interface{}) error {
+			*dest[0].(*int) = 42
+			return nil
+		}),
+		rows.EXPECT().Close().Return(nil),
+	)
+	seen, err := s.MarkSeen(ctx, 1, 2, 50)
+	is.NoErr(err)
+	is.Equal(seen, 42)
+
+	gomock.InOrder(
+		d.EXPECT().QueryContext(ctx, gomock.Any(), 1, 3, 50).Return(rows, nil),
+		rows.EXPECT().Next().Return(false),
+		rows.EXPECT().Err().Return(nil),
+		rows.EXPECT().Close().Return(nil),
+	)
+	_, err = s.MarkSeen(ctx, 1, 3, 50)
+	is.Equal(err, ErrNotMember)
+}
+
+func TestStore_LatestMessage(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	rows := mockdb.NewMockRows(ctrl)
+	s := NewStore(d)
+	gomock.InOrder(
+		d.EXPECT().QueryContext(ctx, mockutil.HasPrefix("\n\tSELECT COALESCE(MAX(id), 0) FROM chatroom_messages"), 1).Return(rows, nil),
+		rows.EXPECT().Next().Return(true),
+		rows.EXPECT().Scan(gomock.Any()).DoAndReturn(func(dest ...interface{}) error {
+			*dest[0].(*int) = 42
+			return nil
+		}),
+		rows.EXPECT().Close().Return(nil),
+	)
+	id, err := s.LatestMessage(ctx, 1)
+	is.NoErr(err)
+	is.Equal(id, 42)
+}
+
+func TestChatRoom_handleRead(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	store := &fakeStore{latest: 8}
+	cr, _, ps := testRoom(store, nil)
+	receipt := func(id int) *Envelope {
+		return envelope(t, MsgReadReceipt, "", &ReadReceipt{MessageID: id, UserID: 99})
+	}
+
+	// the first receipt is saved right away
+	is.NoErr(cr.handle(ctx, receipt(5)))
+	is.Equal(store.seen, []int{5})
+	is.Equal(len(ps.published), 1)
+	var r ReadReceipt
+	is.NoErr(ps.published[0].Decode(&r))
+	is.Equal(r, ReadReceipt{Room: 1, UserID: 2, MessageID: 5})
+
+	// later receipts are coalesced
+	is.NoErr(cr.handle(ctx, receipt(6)))
+	is.NoErr(cr.handle(ctx, receipt(8)))
+	is.Equal(store.seen, []int{5})
+	is.Equal(len(ps.published), 3)
+	// old receipts are ignored
+	is.NoErr(cr.handle(ctx, receipt(7)))
+	is.Equal(len(ps.published), 3)
+	err := cr.handle(ctx, receipt(0))
+	is.True(errors.Is(err, ErrBadFrame))
+
+	cr.flushRead(ctx)
+	is.Equal(store.seen, []int{5, 8})
+	cr.flushRead(ctx)
+	is.Equal(store.seen, []int{5, 8})
+	is.Equal(store.lookups, 1)
+}
+
+func TestChatRoom_handleRead_future(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	store := &fakeStore{latest: 4}
+	cr, _, ps := testRoom(store, nil)
+	receipt := func(id int) *Envelope {
+		return envelope(t, MsgReadReceipt, "", &ReadReceipt{MessageID: id})
+	}
+
+	// receipts for messages that don't exist yet are clamped
+	is.NoErr(cr.handle(ctx, receipt(1<<30)))
+	is.Equal(len(ps.published), 1)
+	var r ReadReceipt
+	is.NoErr(ps.published[0].Decode(&r))
+	is.Equal(r.MessageID, 4)
+	is.Equal(store.seen, []int{4})
+
+	// and don't block receipts for real messages that arrive later
+	store.latest = 6
+	is.NoErr(cr.handle(ctx, receipt(1<<30)))
+	is.NoErr(cr.handle(ctx, receipt(5)))
+	is.Equal(len(ps.published), 2)
+	is.NoErr(ps.published[1].Decode(&r))
+	is.Equal(r.MessageID, 6)
+
+	// nothing to read in an empty room
+	cr, _, ps = testRoom(&fakeStore{}, nil)
+	is.NoErr(cr.handle(ctx, receipt(3)))
+	is.Equal(len(ps.published), 0)
+}
+
+func TestReadMarker(t *testing.T) {
+	is := is.New(t)
+	var rm readMarker
+	now := time.Unix(1000, 0)
+	_, ok := rm.pending(now, true)
+	is.True(!ok)
+	is.True(rm.mark(3))
+	id, ok := rm.pending(now, false)
+	is.True(ok)
+	is.Equal(id, 3)
+	rm.done(3, now)
+	is.True(rm.mark(4))
+	_, ok = rm.pending(now.Add(time.Second), false)
+	is.True(!ok)
+	id, ok = rm.pending(now.Add(readFlushInterval), false)
+	is.True(ok)
+	is.Equal(id, 4)
+}
+
+func TestChatRoom_handleReply(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	now := time.Now()
+	store := &fakeStore{messages: map[int]*Message{
+		3: {ID: 3, Room: 1},
+		4: {ID: 4, Room: 1, ParentID: 3},
+		5: {ID: 5, Room: 2},
+		6: {ID: 6, Room: 1, DeletedAt: &now},
+	}}
+	cr, s, ps := testRoom(store, nil)
+
+	is.NoErr(cr.handle(ctx, envelope(t, MsgChat, "r1", &Message{Body: "reply", ParentID: 3})))
+	is.Equal(store.saved[0].ParentID, 3)
+	// replies to replies go in the same thread
+	is.NoErr(cr.handle(ctx, envelope(t, MsgChat, "r2", &Message{Body: "reply", ParentID: 4})))
+	is.Equal(store.saved[1].ParentID, 3)
+	is.Equal(len(ps.published), 2)
+	var published Message
+	is.NoErr(ps.published[1].Decode(&published))
+	is.Equal(published.ParentID, 3)
+	is.Equal(len(s.sent), 2)
+
+	for _, parent := range []int{5, 6, 100} {
+		err := cr.handle(ctx, envelope(t, MsgChat, "", &Message{Body: "reply", ParentID: parent}))
+		is.True(errors.Is(err, ErrUnknownParent))
+		is.Equal(errorCode(err), CodeBadParent)
+	}
+	is.Equal(len(store.saved), 2)
+}
+
+func TestChatRoom_handleThreadRead(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	store := &fakeStore{messages: map[int]*Message{3: {ID: 3, Room: 1}}}
+	cr, _, ps := testRoom(store, nil)
+
+	is.NoErr(cr.handle(ctx, envelope(t, MsgReadReceipt, "", &ReadReceipt{MessageID: 9, Thread: 3})))
+	is.NoErr(cr.handle(ctx, envelope(t, MsgReadReceipt, "", &ReadReceipt{MessageID: 8, Thread: 3})))
+	is.Equal(store.threads[3], 9)
+	// thread receipts don't move the room's marker
+	is.Equal(len(store.seen), 0)
+	is.Equal(len(ps.published), 2)
+	var r ReadReceipt
+	is.NoErr(ps.published[1].Decode(&r))
+	is.Equal(r, ReadReceipt{Room: 1, UserID: 2, MessageID: 9, Thread: 3})
+
+	err := cr.handle(ctx, envelope(t, MsgReadReceipt, "", &ReadReceipt{MessageID: 9, Thread: 4}))
+	is.Equal(err, ErrUnknownParent)
+}
+
+func TestStore_Replies(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	rows := mockdb.NewMockRows(ctrl)
+	s := NewStore(d)
+	for _, tt := range []struct {
+		opts  db.PaginationOpts
+		query string
+		args  []interface{}
+	}{
+		{db.PaginationOpts{Limit: 10, Offset: 20}, listRepliesQueryOffset, []interface{}{1, 10, 20, 3}},
+		{db.PaginationOpts{Limit: 10, Prev: 50}, listRepliesQueryIDs, []interface{}{1, 50, 10, 3}},
+	} {
+		gomock.InOrder(
+			d.EXPECT().QueryContext(ctx, tt.query, tt.args...).Return(rows, nil),
+			rows.EXPECT().Next().Return(false),
+			rows.EXPECT().Err().Return(nil),
+			rows.EXPECT().Close().Return(nil),
+		)
+		msgs, err := s.Replies(ctx, 1, 3, tt.opts)
+		is.NoErr(err)
+		is.Equal(len(msgs), 0)
+	}
+}
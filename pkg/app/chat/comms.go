@@ -4,7 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"time"
+	"io"
+	"sync"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
@@ -15,10 +16,10 @@ import (
 var ErrEmptyBody = errors.New("empty message body")
 
 type PubSub interface {
-	// Publish a message on the message queue
-	Pub(context.Context, *Message) error
-	// Subscribe to messages being published by other connections
-	Sub(context.Context) <-chan Message
+	// Publish a frame on the message queue
+	Pub(context.Context, *Envelope) error
+	// Subscribe to frames being published by other connections
+	Sub(context.Context) <-chan Envelope
 }
 
 func NewPubSub(rd redis.UniversalClient, room, user int) *pubsub {
@@ -34,21 +35,23 @@ type pubsub struct {
 	Room, User int
 }
 
-// Pub publishes a message to the channel
-func (c *pubsub) Pub(ctx context.Context, msg *Message) error {
+// Pub publishes a frame to the channel
+func (c *pubsub) Pub(ctx context.Context, env *Envelope) error {
 	key := fmt.Sprintf("room:%d:user:%d", c.Room, c.User)
-	msg.Room = c.Room
-	msg.UserID = c.User
-	raw, err := json.Marshal(msg)
+	env.From = c.User
+	if env.Version == 0 {
+		env.Version = ProtocolVersion
+	}
+	raw, err := json.Marshal(env)
 	if err != nil {
 		return err
 	}
 	return c.RDB.Publish(ctx, key, raw).Err()
 }
 
-// Sub subscribes to a channel to listen to new messages
-func (c *pubsub) Sub(ctx context.Context) <-chan Message {
-	msgs := make(chan Message)
+// Sub subscribes to a channel to listen to new frames
+func (c *pubsub) Sub(ctx context.Context) <-chan Envelope {
+	msgs := make(chan Envelope)
 	pubsub := c.RDB.PSubscribe(ctx, fmt.Sprintf("room:%d:user:*", c.Room))
 	ch := pubsub.Channel()
 	go func() {
@@ -59,18 +62,18 @@ func (c *pubsub) Sub(ctx context.Context) <-chan Message {
 			close(msgs)
 		}()
 		for message := range ch {
-			var msg Message
-			err := json.Unmarshal([]byte(message.Payload), &msg)
+			var env Envelope
+			err := json.Unmarshal([]byte(message.Payload), &env)
 			if err != nil {
-				logger.WithError(err).Error("failed to unmarshal chat message from pubsub")
+				logger.WithError(err).Error("failed to unmarshal chat frame from pubsub")
 				continue
 			}
-			if msg.UserID == c.User {
-				// Ignore messages from ourselfs
+			if c.own(&env) {
+				// Ignore frames from ourselfs
 				continue
 			}
 			select {
-			case msgs <- msg:
+			case msgs <- env:
 			case <-ctx.Done():
 				logger.WithError(ctx.Err()).Warn("stopping chat subscription")
 				return
@@ -80,11 +83,21 @@ func (c *pubsub) Sub(ctx context.Context) <-chan Message {
 	return msgs
 }
 
+// own reports whether a frame was published by the subscribed user. Server
+// events have no user and go to everyone.
+func (c *pubsub) own(env *Envelope) bool {
+	return env.From != 0 && env.From == c.User
+}
+
 type Socket interface {
-	// Send a message down the connection
-	Send(context.Context, *Message) error
-	// Listen for new messages from the connection
-	Recv(context.Context) (*Message, error)
+	// Send a frame down the connection
+	Send(context.Context, *Envelope) error
+	// Listen for new frames from the connection. Invalid frames return an
+	// error wrapping ErrBadFrame, ErrBadVersion or ErrClientIDTooLong and
+	// the connection can still be used. Frames that decode but fail
+	// validation are returned with the error so that replies can use the
+	// frame's id.
+	Recv(context.Context) (*Envelope, error)
 }
 
 func NewSocket(conn ws.Connection) Socket {
@@ -93,17 +106,22 @@ func NewSocket(conn ws.Connection) Socket {
 
 type socket struct {
 	conn ws.Connection
+	// mu stops replies from the read loop and frames from the write loop
+	// being written at the same time.
+	mu sync.Mutex
 }
 
-func (s *socket) Send(ctx context.Context, msg *Message) error {
-	if msg == nil {
-		return errors.New("cannot send nil message")
+func (s *socket) Send(ctx context.Context, env *Envelope) error {
+	if env == nil {
+		return errors.New("cannot send nil frame")
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	w, err := s.conn.Writer(ctx, websocket.MessageText)
 	if err != nil {
 		return errors.Wrap(err, "failed to get writer")
 	}
-	err = json.NewEncoder(w).Encode(msg)
+	err = json.NewEncoder(w).Encode(env)
 	if err != nil {
 		w.Close()
 		return err
@@ -114,19 +132,21 @@ func (s *socket) Send(ctx context.Context, msg *Message) error {
 	return nil
 }
 
-func (s *socket) Recv(ctx context.Context) (*Message, error) {
+func (s *socket) Recv(ctx context.Context) (*Envelope, error) {
 	_, r, err := s.conn.Reader(ctx)
 	if err != nil {
 		return nil, err
 	}
-	var msg Message
-	err = json.NewDecoder(r).Decode(&msg)
+	raw, err := io.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
-	if len(msg.Body) == 0 {
-		return nil, ErrEmptyBody
+	var env Envelope
+	if err = json.Unmarshal(raw, &env); err != nil {
+		return nil, errors.Wrap(ErrBadFrame, err.Error())
+	}
+	if err = env.validate(); err != nil {
+		return &env, err
 	}
-	msg.CreatedAt = time.Now()
-	return &msg, nil
+	return &env, nil
 }
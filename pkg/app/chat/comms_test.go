@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -36,6 +37,15 @@ func TestPubSub_Sub(t *testing.T) {
 	}
 }
 
+func TestPubSub_own(t *testing.T) {
+	is := is.New(t)
+	ps := pubsub{Room: 1, User: 2}
+	is.True(ps.own(&Envelope{From: 2}))
+	is.True(!ps.own(&Envelope{From: 3}))
+	// server events go to every connection
+	is.True(!ps.own(&Envelope{From: 0}))
+}
+
 func TestPubSub_Pub(t *testing.T) {
 	type table struct {
 		room     int
@@ -63,7 +73,11 @@ func TestPubSub_Pub(t *testing.T) {
 			)
 			defer ctrl.Finish()
 			is.True(ps.RDB != nil && tt != nil)
-			raw, err := json.Marshal(tt.msg)
+			env, err := NewEnvelope(MsgChat, "abc", tt.msg)
+			is.NoErr(err)
+			expected := *env
+			expected.From = tt.user
+			raw, err := json.Marshal(&expected)
 			is.True(errors.Is(err, tt.expected))
 			if tt.expected != nil {
 				return
@@ -71,8 +85,9 @@ func TestPubSub_Pub(t *testing.T) {
 			rdb.EXPECT().
 				Publish(ctx, fmt.Sprintf("room:%d:user:%d", tt.room, tt.user), raw).
 				Return(redis.NewIntResult(0, nil))
-			err = ps.Pub(ctx, tt.msg)
+			err = ps.Pub(ctx, env)
 			is.NoErr(err)
+			is.Equal(env.From, tt.user)
 		})
 	}
 }
@@ -103,16 +118,22 @@ func TestSocket_Send(t *testing.T) {
 			conn.EXPECT().
 				Writer(ctx, ws.MessageText).
 				Return(&buf, tt.writeError)
-			err := s.Send(ctx, tt.msg)
+			env, err := NewEnvelope(MsgChat, fmt.Sprint(i), tt.msg)
+			is.NoErr(err)
+			err = s.Send(ctx, env)
 			is.True(errors.Is(err, tt.expected))
 			if tt.expected != nil {
 				return
 			}
 			is.True(buf.Len() > 0)
-			var msg Message
 			b := buf.Bytes()
-			is.Equal(b, msgBuf(tt.msg).Bytes())
-			is.NoErr(json.Unmarshal(b, &msg))
+			is.Equal(b, frameBuf(env).Bytes())
+			var got Envelope
+			is.NoErr(json.Unmarshal(b, &got))
+			is.Equal(got.Type, MsgChat)
+			is.Equal(got.ID, env.ID)
+			var msg Message
+			is.NoErr(got.Decode(&msg))
 			is.Equal(msg.ID, tt.msg.ID)
 			is.Equal(msg.Room, tt.msg.Room)
 			is.Equal(msg.UserID, tt.msg.UserID)
@@ -123,14 +144,23 @@ func TestSocket_Send(t *testing.T) {
 
 func TestSocket_Recv(t *testing.T) {
 	type table struct {
-		msg       Message
+		frame     string
+		typ       MsgType
+		id        string
 		expected  error
 		readError error
 	}
+	testErr := errors.New("this is a test error")
 	for i, tt := range []table{
-		{msg: Message{ID: 1, Body: "what?"}, expected: nil},
-		{msg: Message{}, expected: ErrEmptyBody},
-		{msg: Message{Body: "test"}, expected: ErrEmptyBody, readError: ErrEmptyBody},
+		{frame: `{"v":1,"type":"chat","id":"a","payload":{"body":"what?"}}`, typ: MsgChat, id: "a"},
+		{frame: `{"v":1,"type":"ping","id":"b"}`, typ: MsgPing, id: "b"},
+		{frame: `{"v":1}`, typ: MsgEmpty},
+		{frame: `{"v":1,"type":"chat"`, expected: ErrBadFrame},
+		{frame: `{"v":1,"type":"shout"}`, expected: ErrBadFrame},
+		{frame: `{"body":"legacy message"}`, expected: ErrBadVersion},
+		{frame: `{"v":2,"type":"chat"}`, typ: MsgChat, expected: ErrBadVersion},
+		{frame: `{"v":1,"type":"chat","id":"` + strings.Repeat("x", 65) + `"}`, expected: ErrClientIDTooLong},
+		{frame: `{"v":1}`, readError: testErr, expected: testErr},
 	} {
 		t.Run(fmt.Sprintf("%s_%d", t.Name(), i), func(t *testing.T) {
 			is := is.New(t)
@@ -141,25 +171,23 @@ func TestSocket_Recv(t *testing.T) {
 			ctx := context.Background()
 			conn.EXPECT().
 				Reader(ctx).
-				Return(ws.MessageText, msgBuf(&tt.msg), tt.readError)
-			msg, err := s.Recv(ctx)
+				Return(ws.MessageText, strings.NewReader(tt.frame), tt.readError)
+			env, err := s.Recv(ctx)
 			is.True(errors.Is(err, tt.expected))
+			is.Equal(isFrameError(err), tt.expected != nil && tt.expected != testErr)
 			if tt.expected != nil {
 				return
 			}
-			is.True(msg != nil)
-			is.True(!msg.CreatedAt.IsZero())
-			is.Equal(msg.ID, tt.msg.ID)
-			is.Equal(msg.Body, tt.msg.Body)
-			is.Equal(msg.Room, tt.msg.Room)
-			is.Equal(msg.UserID, tt.msg.UserID)
+			is.True(env != nil)
+			is.Equal(env.Type, tt.typ)
+			is.Equal(env.ID, tt.id)
 		})
 	}
 }
 
-func msgBuf(msg *Message) *bytes.Buffer {
+func frameBuf(env *Envelope) *bytes.Buffer {
 	var b bytes.Buffer
-	err := json.NewEncoder(&b).Encode(msg)
+	err := json.NewEncoder(&b).Encode(env)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,185 @@
+package chat
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"gopkg.hrry.dev/homelab/pkg/db"
+)
+
+var ErrMessageNotFound = errors.New("message not found")
+
+// MessageEdit is a previous version of an edited message.
+type MessageEdit struct {
+	ID        int       `json:"id"`
+	MessageID int       `json:"message_id"`
+	Body      string    `json:"body"`
+	EditedBy  int       `json:"edited_by"`
+	EditedAt  time.Time `json:"edited_at"`
+}
+
+// Reaction summarizes the reactions to a message that use the same emoji.
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	// Users that reacted, in the order that they reacted.
+	Users []int64 `json:"users"`
+}
+
+// ReactionEvent is broadcast to a room when a reaction is added or removed.
+type ReactionEvent struct {
+	Room      int    `json:"room"`
+	MessageID int    `json:"message_id"`
+	UserID    int    `json:"user_id"`
+	Emoji     string `json:"emoji"`
+	Added     bool   `json:"added"`
+}
+
+const messageColumns = `id, room, user_id, body, created_at, edited_at, deleted_at, COALESCE(parent_id, 0)`
+
+func scanMessage(rows db.Rows) (*Message, error) {
+	var msg Message
+	err := db.ScanOne(rows,
+		&msg.ID,
+		&msg.Room,
+		&msg.UserID,
+		&msg.Body,
+		&msg.CreatedAt,
+		&msg.EditedAt,
+		&msg.DeletedAt,
+		&msg.ParentID,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (rs *store) Message(ctx context.Context, room, id int) (*Message, error) {
+	const query = `SELECT ` + messageColumns + ` FROM chatroom_messages WHERE room = $1 AND id = $2`
+	rows, err := rs.db.QueryContext(ctx, query, room, id)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessage(rows)
+}
+
+func (rs *store) EditMessage(ctx context.Context, id, editor int, body string) (*Message, error) {
+	const query = `
+	WITH old AS (
+		SELECT id, body FROM chatroom_messages
+		WHERE id = $1 AND deleted_at IS NULL
+		FOR UPDATE
+	), edit AS (
+		INSERT INTO chatroom_message_edits (message_id, body, edited_by)
+		SELECT id, body, $2 FROM old
+	)
+	UPDATE chatroom_messages m SET body = $3, edited_at = CURRENT_TIMESTAMP
+	FROM old
+	WHERE m.id = old.id
+	RETURNING m.id, m.room, m.user_id, m.body, m.created_at, m.edited_at, m.deleted_at,
+	          COALESCE(m.parent_id, 0)`
+	rows, err := rs.db.QueryContext(ctx, query, id, editor, body)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessage(rows)
+}
+
+func (rs *store) MessageEdits(ctx context.Context, id int) ([]*MessageEdit, error) {
+	const query = `
+	SELECT id, message_id, COALESCE(body, ''), COALESCE(edited_by, 0), edited_at
+	FROM chatroom_message_edits
+	WHERE message_id = $1
+	ORDER BY id`
+	rows, err := rs.db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	edits := make([]*MessageEdit, 0)
+	for rows.Next() {
+		var e MessageEdit
+		if err = rows.Scan(&e.ID, &e.MessageID, &e.Body, &e.EditedBy, &e.EditedAt); err != nil {
+			return nil, errors.Wrap(err, "failed to scan message edit from database")
+		}
+		edits = append(edits, &e)
+	}
+	return edits, rows.Err()
+}
+
+func (rs *store) DeleteMessage(ctx context.Context, id, by int) (*Message, error) {
+	const query = `
+	WITH edits AS (
+		DELETE FROM chatroom_message_edits WHERE message_id = $1
+	), reactions AS (
+		DELETE FROM chatroom_message_reactions WHERE message_id = $1
+	)
+	UPDATE chatroom_messages
+	SET body = '', deleted_at = CURRENT_TIMESTAMP, deleted_by = $2
+	WHERE id = $1 AND deleted_at IS NULL
+	RETURNING ` + messageColumns
+	rows, err := rs.db.QueryContext(ctx, query, id, by)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessage(rows)
+}
+
+func (rs *store) React(ctx context.Context, id, user int, emoji string) error {
+	const query = `INSERT INTO chatroom_message_reactions (message_id, user_id, emoji) ` +
+		`VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`
+	_, err := rs.db.ExecContext(ctx, query, id, user, emoji)
+	return err
+}
+
+func (rs *store) Unreact(ctx context.Context, id, user int, emoji string) error {
+	const query = `DELETE FROM chatroom_message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3`
+	_, err := rs.db.ExecContext(ctx, query, id, user, emoji)
+	return err
+}
+
+// attachReactions fills in the reactions of a page of messages.
+func (rs *store) attachReactions(ctx context.Context, msgs []*Message) error {
+	const query = `
+	SELECT message_id, emoji, COUNT(*), array_agg(user_id ORDER BY created_at)
+	FROM chatroom_message_reactions
+	WHERE message_id = ANY($1)
+	GROUP BY message_id, emoji
+	ORDER BY message_id, MIN(created_at)`
+	if len(msgs) == 0 {
+		return nil
+	}
+	var (
+		ids   = make([]int64, len(msgs))
+		index = make(map[int]*Message, len(msgs))
+	)
+	for i, m := range msgs {
+		ids[i] = int64(m.ID)
+		index[m.ID] = m
+	}
+	rows, err := rs.db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return errors.Wrap(err, "failed to query reactions")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id int
+			r  Reaction
+		)
+		if err = rows.Scan(&id, &r.Emoji, &r.Count, pq.Array(&r.Users)); err != nil {
+			return errors.Wrap(err, "failed to scan reaction from database")
+		}
+		if m, ok := index[id]; ok {
+			m.Reactions = append(m.Reactions, &r)
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/lib/pq"
+	"github.com/matryer/is"
+	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockdb"
+	"gopkg.hrry.dev/homelab/pkg/internal/mockutil"
+)
+
+func TestStore_EditMessage(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	rows := mockdb.NewMockRows(ctrl)
+	s := NewStore(d)
+	now := time.Now()
+	gomock.InOrder(
+		d.EXPECT().QueryContext(ctx, mockutil.HasPrefix("\n\tWITH old AS"), 5, 2, "hello").Return(rows, nil),
+		rows.EXPECT().Next().Return(true),
+		rows.EXPECT().Scan(gomock.Any()).DoAndReturn(func(dest ...interface{}) error {
+			*dest[0].(*int) = 5
+			*dest[1].(*int) = 1
+			*dest[2].(*int) = 2
+			*dest[3].(*string) = "hello"
+			*dest[5].(**time.Time) = &now
+			return nil
+		}),
+		rows.EXPECT().Close().Return(nil),
+	)
+	msg, err := s.EditMessage(ctx, 5, 2, "hello")
+	is.NoErr(err)
+	is.Equal(msg.Body, "hello")
+	is.Equal(*msg.EditedAt, now)
+
+	// deleted or missing messages
+	gomock.InOrder(
+		d.EXPECT().QueryContext(ctx, gomock.Any(), 6, 2, "hello").Return(rows, nil),
+		rows.EXPECT().Next().Return(false),
+		rows.EXPECT().Err().Return(nil),
+		rows.EXPECT().Close().Return(nil),
+	)
+	_, err = s.EditMessage(ctx, 6, 2, "hello")
+	is.Equal(err, ErrMessageNotFound)
+}
+
+func TestStore_DeleteMessage(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	rows := mockdb.NewMockRows(ctrl)
+	s := NewStore(d)
+	now := time.Now()
+	gomock.InOrder(
+		d.EXPECT().QueryContext(ctx, mockutil.HasPrefix("\n\tWITH edits AS"), 5, 10).Return(rows, nil),
+		rows.EXPECT().Next().Return(true),
+		rows.EXPECT().Scan(gomock.Any()).DoAndReturn(func(dest ...interface{}) error {
+			*dest[0].(*int) = 5
+			*dest[6].(**time.Time) = &now
+			return nil
+		}),
+		rows.EXPECT().Close().Return(nil),
+	)
+	msg, err := s.DeleteMessage(ctx, 5, 10)
+	is.NoErr(err)
+	is.Equal(msg.ID, 5)
+	is.Equal(msg.Body, "")
+	is.Equal(*msg.DeletedAt, now)
+}
+
+func TestStore_attachReactions(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	rows := mockdb.NewMockRows(ctrl)
+	s := &store{db: d}
+	// no messages, no query
+	is.NoErr(s.attachReactions(ctx, nil))
+
+	msgs := []*Message{{ID: 1}, {ID: 2}}
+	scan := func(id int, emoji string, users ...int64) func(dest ...interface{}) error {
+		return func(dest ...interface{}) error {
+			*dest[0].(*int) = id
+			*dest[1].(*string) = emoji
+			*dest[2].(*int) = len(users)
+			*dest[3].(*pq.Int64Array) = users
+			return nil
+		}
+	}
+	gomock.InOrder(
+		d.EXPECT().QueryContext(ctx, gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, _ string, ids driver.Valuer) (*mockdb.MockRows, error) {
+				v, err := ids.Value()
+				is.NoErr(err)
+				is.Equal(v, "{1,2}")
+				return rows, nil
+			}),
+		rows.EXPECT().Next().Return(true),
+		rows.EXPECT().Scan(gomock.Any()).DoAndReturn(scan(2, "👍", 3, 4)),
+		rows.EXPECT().Next().Return(true),
+		rows.EXPECT().Scan(gomock.Any()).DoAndReturn(scan(2, "🎉", 4)),
+		rows.EXPECT().Next().Return(false),
+		rows.EXPECT().Err().Return(nil),
+		rows.EXPECT().Close().Return(nil),
+	)
+	is.NoErr(s.attachReactions(ctx, msgs))
+	is.Equal(len(msgs[0].Reactions), 0)
+	is.Equal(len(msgs[1].Reactions), 2)
+	is.Equal(*msgs[1].Reactions[0], Reaction{Emoji: "👍", Count: 2, Users: []int64{3, 4}})
+	is.Equal(msgs[1].Reactions[1].Emoji, "🎉")
+}
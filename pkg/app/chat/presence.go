@@ -0,0 +1,327 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// DefaultPresenceTTL is how long a connection is considered online without a
+// heartbeat.
+const DefaultPresenceTTL = 30 * time.Second
+
+// PresenceEvent is broadcast to a room when a user comes online or goes
+// offline.
+type PresenceEvent struct {
+	Room   int  `json:"room"`
+	UserID int  `json:"user_id"`
+	Online bool `json:"online"`
+}
+
+// Presence tracks which users are connected to a room. Each connection is
+// kept in a sorted set scored by the time it expires so that connections
+// from servers that died without cleaning up stop counting once they miss
+// their heartbeats. A user is online while any of their connections are.
+//
+// Expired connections are removed the next time someone connects or the
+// room's presence is read, and that is when the room is told that their
+// users went offline.
+type Presence struct {
+	rdb redis.UniversalClient
+	TTL time.Duration
+	Now func() time.Time
+}
+
+func NewPresence(rdb redis.UniversalClient) *Presence {
+	return &Presence{rdb: rdb, TTL: DefaultPresenceTTL, Now: time.Now}
+}
+
+// NewConnID generates an id for a connection.
+func NewConnID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Join marks a connection as online and reports whether the user was offline
+// before.
+func (p *Presence) Join(ctx context.Context, room, user int, conn string) (bool, error) {
+	now := p.Now()
+	online, err := p.rdb.Eval(
+		ctx,
+		joinPresenceScript,
+		[]string{p.key(room)},
+		now.Unix(),
+		now.Add(p.TTL).Unix(),
+		member(user, conn),
+		member(user, ""),
+		int64((2 * p.TTL).Seconds()),
+	).Int()
+	if err != nil {
+		return false, err
+	}
+	return online == 0, nil
+}
+
+// joinPresenceScript adds a connection and reports whether the user already
+// had a live connection.
+//
+//	KEYS: presence set
+//	ARGV: now, expiry of the connection, connection member, user prefix, TTL of the set in seconds
+const joinPresenceScript = `
+local online = 0
+for _, m in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[1], '+inf')) do
+	if string.sub(m, 1, #ARGV[4]) == ARGV[4] then
+		online = 1
+		break
+	end
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+redis.call('EXPIRE', KEYS[1], ARGV[5])
+return online`
+
+// Heartbeat keeps a connection online for another TTL. A connection that
+// missed its heartbeats was already announced as offline when it was pruned,
+// so it connects again to tell the room that the user is back.
+func (p *Presence) Heartbeat(ctx context.Context, room, user int, conn string) error {
+	key := p.key(room)
+	n, err := p.rdb.ZAddArgs(ctx, key, redis.ZAddArgs{
+		XX: true,
+		Ch: true,
+		Members: []redis.Z{{
+			Score:  float64(p.Now().Add(p.TTL).Unix()),
+			Member: member(user, conn),
+		}},
+	}).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// Also happens when the score didn't change, joining again is
+		// harmless then since the user is still online.
+		return p.Connect(ctx, room, user, conn)
+	}
+	// Rooms that everyone has left are removed eventually.
+	return p.rdb.Expire(ctx, key, 2*p.TTL).Err()
+}
+
+// Leave marks a connection as offline and reports whether the user has no
+// connections left. Connections that already expired were reported when they
+// were removed.
+func (p *Presence) Leave(ctx context.Context, room, user int, conn string) (bool, error) {
+	last, err := p.rdb.Eval(
+		ctx,
+		leavePresenceScript,
+		[]string{p.key(room)},
+		p.Now().Unix(),
+		member(user, conn),
+		member(user, ""),
+	).Int()
+	if err != nil {
+		return false, err
+	}
+	return last == 1, nil
+}
+
+// leavePresenceScript removes a connection and reports whether it was the
+// user's last live connection.
+//
+//	KEYS: presence set
+//	ARGV: now, connection member, user prefix
+const leavePresenceScript = `
+if redis.call('ZREM', KEYS[1], ARGV[2]) == 0 then
+	return 0
+end
+for _, m in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[1], '+inf')) do
+	if string.sub(m, 1, #ARGV[3]) == ARGV[3] then
+		return 0
+	end
+end
+return 1`
+
+// prune removes expired connections and tells the room about users that have
+// no live connections left.
+func (p *Presence) prune(ctx context.Context, room int) error {
+	offline, err := p.rdb.Eval(
+		ctx,
+		prunePresenceScript,
+		[]string{p.key(room)},
+		p.Now().Unix(),
+	).StringSlice()
+	if err != nil {
+		return err
+	}
+	for _, u := range offline {
+		user, err := strconv.Atoi(u)
+		if err != nil {
+			continue
+		}
+		err = Broadcast(ctx, p.rdb, room, MsgPresence, &PresenceEvent{Room: room, UserID: user})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prunePresenceScript removes expired connections and returns the users that
+// went offline with them.
+//
+//	KEYS: presence set
+//	ARGV: now
+const prunePresenceScript = `
+local expired = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[1])
+if #expired == 0 then
+	return {}
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[1])
+local online = {}
+for _, m in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[1], '+inf')) do
+	local u = string.match(m, '^([^:]*):')
+	if u then
+		online[u] = true
+	end
+end
+local offline = {}
+for _, m in ipairs(expired) do
+	local u = string.match(m, '^([^:]*):')
+	if u and not online[u] then
+		online[u] = true
+		table.insert(offline, u)
+	end
+end
+return offline`
+
+// Online lists the users that are connected to a room.
+func (p *Presence) Online(ctx context.Context, room int) ([]int, error) {
+	var (
+		key = p.key(room)
+		n   = strconv.FormatInt(p.Now().Unix(), 10)
+	)
+	if err := p.prune(ctx, room); err != nil {
+		return nil, err
+	}
+	members, err := p.rdb.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: n, Max: "+inf"}).Result()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int]struct{}, len(members))
+	users := make([]int, 0, len(members))
+	for _, m := range members {
+		i := strings.IndexByte(m, ':')
+		if i < 0 {
+			continue
+		}
+		user, err := strconv.Atoi(m[:i])
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[user]; ok {
+			continue
+		}
+		seen[user] = struct{}{}
+		users = append(users, user)
+	}
+	sort.Ints(users)
+	return users, nil
+}
+
+// Connect marks a connection as online and tells the room when the user has
+// just come online.
+func (p *Presence) Connect(ctx context.Context, room, user int, conn string) error {
+	if err := p.prune(ctx, room); err != nil {
+		logger.WithError(err).Warn("failed to remove expired connections")
+	}
+	first, err := p.Join(ctx, room, user, conn)
+	if err != nil || !first {
+		return err
+	}
+	return Broadcast(ctx, p.rdb, room, MsgPresence, &PresenceEvent{Room: room, UserID: user, Online: true})
+}
+
+// Disconnect marks a connection as offline and tells the room when the user
+// has no connections left.
+func (p *Presence) Disconnect(ctx context.Context, room, user int, conn string) error {
+	last, err := p.Leave(ctx, room, user, conn)
+	if err != nil || !last {
+		return err
+	}
+	return Broadcast(ctx, p.rdb, room, MsgPresence, &PresenceEvent{Room: room, UserID: user})
+}
+
+// Keepalive sends heartbeats for a connection until the context is done.
+func (p *Presence) Keepalive(ctx context.Context, room, user int, conn string) {
+	ticker := time.NewTicker(p.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.Heartbeat(ctx, room, user, conn); err != nil && ctx.Err() == nil {
+				logger.WithError(err).Warn("failed to send presence heartbeat")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *Presence) key(room int) string {
+	return fmt.Sprintf("chat:presence:room:%d", room)
+}
+
+func member(user int, conn string) string {
+	return fmt.Sprintf("%d:%s", user, conn)
+}
+
+// typingInterval limits how often a connection can send typing events.
+const typingInterval = 2 * time.Second
+
+// Typing is broadcast while a user is typing. Typing events are never
+// stored.
+type Typing struct {
+	Room   int  `json:"room"`
+	UserID int  `json:"user_id"`
+	Active bool `json:"active"`
+}
+
+// typingLimiter lets through at most one typing event per interval. The
+// first stop after a start is always let through so that the room doesn't
+// keep showing the user as typing.
+type typingLimiter struct {
+	last   time.Time
+	active bool
+}
+
+func (tl *typingLimiter) allow(active bool, now time.Time) bool {
+	stopped := tl.active && !active
+	if !stopped && !tl.last.IsZero() && now.Sub(tl.last) < typingInterval {
+		return false
+	}
+	tl.last, tl.active = now, active
+	return true
+}
+
+// handleTyping fans a typing event out to the room.
+func (cr *ChatRoom) handleTyping(ctx context.Context, env *Envelope) error {
+	var t Typing
+	if err := env.Decode(&t); err != nil {
+		return err
+	}
+	// Only the read loop calls this so the limiter doesn't need a lock.
+	if !cr.typing.allow(t.Active, time.Now()) {
+		return nil
+	}
+	t.Room, t.UserID = cr.RoomID, cr.UserID
+	out, err := NewEnvelope(MsgTyping, "", &t)
+	if err != nil {
+		return err
+	}
+	return cr.ps.Pub(ctx, out)
+}
@@ -0,0 +1,200 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang/mock/gomock"
+	"github.com/matryer/is"
+	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockredis"
+)
+
+const presenceKey = "chat:presence:room:1"
+
+func expectPrune(rdb *mockredis.MockUniversalClient, ctx context.Context, offline ...interface{}) *gomock.Call {
+	return rdb.EXPECT().
+		Eval(ctx, prunePresenceScript, []string{presenceKey}, int64(1000)).
+		Return(redis.NewCmdResult(append([]interface{}{}, offline...), nil))
+}
+
+func expectOnline(rdb *mockredis.MockUniversalClient, ctx context.Context, members ...string) *gomock.Call {
+	cmd := redis.NewStringSliceCmd(ctx)
+	cmd.SetVal(members)
+	return rdb.EXPECT().
+		ZRangeByScore(ctx, presenceKey, &redis.ZRangeBy{Min: "1000", Max: "+inf"}).
+		After(expectPrune(rdb, ctx)).
+		Return(cmd)
+}
+
+func expectJoin(rdb *mockredis.MockUniversalClient, ctx context.Context, conn string, online int64) *gomock.Call {
+	return rdb.EXPECT().
+		Eval(ctx, joinPresenceScript, []string{presenceKey}, int64(1000), int64(1030), "2:"+conn, "2:", int64(60)).
+		Return(redis.NewCmdResult(online, nil))
+}
+
+func expectLeave(rdb *mockredis.MockUniversalClient, ctx context.Context, conn string, last int64) *gomock.Call {
+	return rdb.EXPECT().
+		Eval(ctx, leavePresenceScript, []string{presenceKey}, int64(1000), "2:"+conn, "2:").
+		Return(redis.NewCmdResult(last, nil))
+}
+
+func expectPresence(t *testing.T, rdb *mockredis.MockUniversalClient, ctx context.Context, expected PresenceEvent) *gomock.Call {
+	return rdb.EXPECT().
+		Publish(ctx, "room:1:user:0", gomock.Any()).
+		DoAndReturn(func(_ context.Context, _ string, raw []byte) *redis.IntCmd {
+			var (
+				env Envelope
+				ev  PresenceEvent
+			)
+			if err := json.Unmarshal(raw, &env); err != nil {
+				t.Fatal(err)
+			}
+			if err := env.Decode(&ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev != expected {
+				t.Errorf("expected %+v, got %+v", expected, ev)
+			}
+			return redis.NewIntResult(1, nil)
+		})
+}
+
+func testPresence(rdb redis.UniversalClient) *Presence {
+	p := NewPresence(rdb)
+	p.Now = func() time.Time { return time.Unix(1000, 0) }
+	return p
+}
+
+func TestPresence_Online(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rdb := mockredis.NewMockUniversalClient(ctrl)
+	p := testPresence(rdb)
+	expectOnline(rdb, ctx, "3:a", "2:b", "3:c", "bad", "x:y")
+	users, err := p.Online(ctx, 1)
+	is.NoErr(err)
+	is.Equal(users, []int{2, 3})
+
+	// connections from a server that crashed expired
+	cmd := redis.NewStringSliceCmd(ctx)
+	cmd.SetVal([]string{"3:a"})
+	gomock.InOrder(
+		expectPrune(rdb, ctx, "4", "x"),
+		expectPresence(t, rdb, ctx, PresenceEvent{Room: 1, UserID: 4}),
+		rdb.EXPECT().ZRangeByScore(ctx, presenceKey, &redis.ZRangeBy{Min: "1000", Max: "+inf"}).Return(cmd),
+	)
+	users, err = p.Online(ctx, 1)
+	is.NoErr(err)
+	is.Equal(users, []int{3})
+}
+
+func TestPresence_ConnectDisconnect(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rdb := mockredis.NewMockUniversalClient(ctrl)
+	p := testPresence(rdb)
+
+	// first connection tells the room
+	gomock.InOrder(
+		expectPrune(rdb, ctx),
+		expectJoin(rdb, ctx, "conn1", 0),
+		expectPresence(t, rdb, ctx, PresenceEvent{Room: 1, UserID: 2, Online: true}),
+	)
+	is.NoErr(p.Connect(ctx, 1, 2, "conn1"))
+
+	// a second tab doesn't
+	gomock.InOrder(
+		expectPrune(rdb, ctx),
+		expectJoin(rdb, ctx, "conn2", 1),
+	)
+	is.NoErr(p.Connect(ctx, 1, 2, "conn2"))
+
+	expectLeave(rdb, ctx, "conn1", 0)
+	is.NoErr(p.Disconnect(ctx, 1, 2, "conn1"))
+
+	gomock.InOrder(
+		expectLeave(rdb, ctx, "conn2", 1),
+		expectPresence(t, rdb, ctx, PresenceEvent{Room: 1, UserID: 2}),
+	)
+	is.NoErr(p.Disconnect(ctx, 1, 2, "conn2"))
+}
+
+func TestPresence_Heartbeat(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rdb := mockredis.NewMockUniversalClient(ctrl)
+	p := testPresence(rdb)
+	expectHeartbeat := func(updated int64) *gomock.Call {
+		return rdb.EXPECT().ZAddArgs(ctx, presenceKey, redis.ZAddArgs{
+			XX:      true,
+			Ch:      true,
+			Members: []redis.Z{{Score: 1030, Member: "2:conn1"}},
+		}).Return(redis.NewIntResult(updated, nil))
+	}
+
+	gomock.InOrder(
+		expectHeartbeat(1),
+		rdb.EXPECT().Expire(ctx, presenceKey, 60*time.Second).Return(redis.NewBoolResult(true, nil)),
+	)
+	is.NoErr(p.Heartbeat(ctx, 1, 2, "conn1"))
+
+	// the connection was pruned and the room was told the user went offline
+	gomock.InOrder(
+		expectHeartbeat(0),
+		expectPrune(rdb, ctx),
+		expectJoin(rdb, ctx, "conn1", 0),
+		expectPresence(t, rdb, ctx, PresenceEvent{Room: 1, UserID: 2, Online: true}),
+	)
+	is.NoErr(p.Heartbeat(ctx, 1, 2, "conn1"))
+}
+
+func TestTypingLimiter(t *testing.T) {
+	is := is.New(t)
+	var tl typingLimiter
+	now := time.Unix(1000, 0)
+	is.True(tl.allow(true, now))
+	is.True(!tl.allow(true, now.Add(time.Second)))
+	is.True(tl.allow(false, now.Add(time.Second)))
+	is.True(!tl.allow(true, now.Add(time.Second)))
+	is.True(!tl.allow(false, now.Add(time.Second)))
+	is.True(tl.allow(true, now.Add(time.Second+typingInterval)))
+}
+
+func TestTypingLimiter_alternating(t *testing.T) {
+	is := is.New(t)
+	var tl typingLimiter
+	now := time.Unix(1000, 0)
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if tl.allow(i%2 == 0, now.Add(time.Duration(i)*10*time.Millisecond)) {
+			allowed++
+		}
+	}
+	// one start and the stop that follows it
+	is.Equal(allowed, 2)
+}
+
+func TestChatRoom_handleTyping(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	store := &fakeStore{}
+	cr, s, ps := testRoom(store, nil)
+	typing := envelope(t, MsgTyping, "", &Typing{Active: true, UserID: 99})
+	is.NoErr(cr.handle(ctx, typing))
+	is.NoErr(cr.handle(ctx, typing))
+	is.Equal(len(ps.published), 1)
+	var got Typing
+	is.NoErr(ps.published[0].Decode(&got))
+	is.Equal(got, Typing{Room: 1, UserID: 2, Active: true})
+	is.Equal(len(s.sent), 0)
+	is.Equal(len(store.saved), 0)
+}
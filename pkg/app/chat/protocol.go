@@ -0,0 +1,181 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// ProtocolVersion is the version of the envelope sent over chat websockets.
+const ProtocolVersion = 1
+
+// maxClientIDLen limits the size of client generated envelope ids.
+const maxClientIDLen = 64
+
+var (
+	ErrBadFrame        = errors.New("malformed chat frame")
+	ErrBadVersion      = errors.New("unsupported protocol version")
+	ErrClientIDTooLong = errors.New("client id is too long")
+	ErrUnsupported     = errors.New("unsupported message type")
+	ErrUnknownParent   = errors.New("parent message not found")
+)
+
+var msgTypeNames = [...]string{
+	MsgEmpty:       "",
+	MsgChat:        "chat",
+	MsgAck:         "ack",
+	MsgTyping:      "typing",
+	MsgPresence:    "presence",
+	MsgReadReceipt: "read_receipt",
+	MsgError:       "error",
+	MsgPing:        "ping",
+	MsgMember:      "member",
+	MsgEdit:        "edit",
+	MsgDelete:      "delete",
+	MsgReaction:    "reaction",
+}
+
+func (t MsgType) String() string {
+	if t < 0 || int(t) >= len(msgTypeNames) {
+		return fmt.Sprintf("MsgType(%d)", int(t))
+	}
+	return msgTypeNames[t]
+}
+
+func (t MsgType) MarshalText() ([]byte, error) {
+	if t < 0 || int(t) >= len(msgTypeNames) {
+		return nil, fmt.Errorf("unknown message type %d", int(t))
+	}
+	return []byte(msgTypeNames[t]), nil
+}
+
+func (t *MsgType) UnmarshalText(b []byte) error {
+	for i, name := range msgTypeNames {
+		if name == string(b) {
+			*t = MsgType(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown message type %q", b)
+}
+
+// Envelope wraps every frame sent over a chat websocket and through a room's
+// pubsub.
+type Envelope struct {
+	Version int     `json:"v"`
+	Type    MsgType `json:"type"`
+	// ID is generated by the client. Chat messages with an ID that was
+	// already saved are not saved again, and replies to a frame carry the
+	// frame's ID.
+	ID string `json:"id,omitempty"`
+	// From is the user that caused the frame. It is set by the server.
+	From    int             `json:"from,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// NewEnvelope creates an envelope with an encoded payload.
+func NewEnvelope(t MsgType, id string, payload any) (*Envelope, error) {
+	env := Envelope{Version: ProtocolVersion, Type: t, ID: id}
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = raw
+	}
+	return &env, nil
+}
+
+// Decode the envelope's payload.
+func (e *Envelope) Decode(v any) error {
+	if len(e.Payload) == 0 {
+		return errors.Wrap(ErrBadFrame, "missing payload")
+	}
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return errors.Wrap(ErrBadFrame, err.Error())
+	}
+	return nil
+}
+
+func (e *Envelope) validate() error {
+	if e.Version != ProtocolVersion {
+		return ErrBadVersion
+	}
+	if len(e.ID) > maxClientIDLen {
+		return ErrClientIDTooLong
+	}
+	return nil
+}
+
+// Ack is sent in reply to a chat message once the server has handled it.
+type Ack struct {
+	// ID is the ID of the stored message. It is zero when the message
+	// could not be stored.
+	ID     int               `json:"id"`
+	Status MsgDeviveryStatus `json:"status"`
+}
+
+// MemberAction is a change to a room's members.
+type MemberAction string
+
+const (
+	MemberJoined  MemberAction = "joined"
+	MemberLeft    MemberAction = "left"
+	MemberAdded   MemberAction = "added"
+	MemberRemoved MemberAction = "removed"
+	MemberOwner   MemberAction = "owner"
+)
+
+// MemberEvent is broadcast to a room when its members change.
+type MemberEvent struct {
+	Action MemberAction `json:"action"`
+	Room   int          `json:"room"`
+	// UserID is the member that changed.
+	UserID int `json:"user_id"`
+	// By is the user that made the change.
+	By int `json:"by"`
+}
+
+// Broadcast publishes a server event to everyone connected to a room. Events
+// are not from a user so the connections of the user that caused the event get
+// it too.
+func Broadcast(ctx context.Context, rdb redis.UniversalClient, room int, t MsgType, payload any) error {
+	env, err := NewEnvelope(t, "", payload)
+	if err != nil {
+		return err
+	}
+	return NewPubSub(rdb, room, 0).Pub(ctx, env)
+}
+
+// Error codes sent in error frames.
+const (
+	CodeBadFrame    = "bad_frame"
+	CodeEmptyBody   = "empty_body"
+	CodeUnsupported = "unsupported"
+	CodeBadParent   = "bad_parent"
+	CodeInternal    = "internal"
+)
+
+// ErrorPayload is sent in reply to a frame that could not be handled.
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrEmptyBody):
+		return CodeEmptyBody
+	case errors.Is(err, ErrUnsupported):
+		return CodeUnsupported
+	case errors.Is(err, ErrUnknownParent):
+		return CodeBadParent
+	case errors.Is(err, ErrBadFrame), errors.Is(err, ErrBadVersion), errors.Is(err, ErrClientIDTooLong):
+		return CodeBadFrame
+	default:
+		return CodeInternal
+	}
+}
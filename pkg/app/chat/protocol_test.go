@@ -0,0 +1,43 @@
+package chat
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestMsgType_Text(t *testing.T) {
+	is := is.New(t)
+	for typ := MsgEmpty; typ <= MsgReaction; typ++ {
+		b, err := typ.MarshalText()
+		is.NoErr(err)
+		var got MsgType
+		is.NoErr(got.UnmarshalText(b))
+		is.Equal(got, typ)
+	}
+	_, err := MsgType(100).MarshalText()
+	is.True(err != nil)
+	is.Equal(MsgType(100).String(), "MsgType(100)")
+	var typ MsgType
+	is.True(typ.UnmarshalText([]byte("shout")) != nil)
+}
+
+func TestEnvelope(t *testing.T) {
+	is := is.New(t)
+	env, err := NewEnvelope(MsgAck, "abc", &Ack{ID: 3, Status: StatusStored})
+	is.NoErr(err)
+	raw, err := json.Marshal(env)
+	is.NoErr(err)
+	is.Equal(string(raw), `{"v":1,"type":"ack","id":"abc","payload":{"id":3,"status":1}}`)
+
+	var got Envelope
+	is.NoErr(json.Unmarshal(raw, &got))
+	var ack Ack
+	is.NoErr(got.Decode(&ack))
+	is.Equal(ack, Ack{ID: 3, Status: StatusStored})
+
+	env, err = NewEnvelope(MsgPing, "", nil)
+	is.NoErr(err)
+	is.True(env.Decode(&ack) != nil)
+}
@@ -0,0 +1,175 @@
+package chat
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// readFlushInterval is how often a connection writes its read receipts
+	// to the database. Receipts are still broadcast as soon as they arrive.
+	readFlushInterval = 5 * time.Second
+	// readFlushTimeout limits the final write when a connection closes.
+	readFlushTimeout = 5 * time.Second
+)
+
+// ReadReceipt marks the last message that a user has read in a room, or the
+// last reply they have read in a thread.
+type ReadReceipt struct {
+	Room      int `json:"room"`
+	UserID    int `json:"user_id"`
+	MessageID int `json:"message_id"`
+	Thread    int `json:"thread,omitempty"`
+}
+
+// readMarker coalesces the read receipts of a connection so that last_seen
+// is not written for every message.
+type readMarker struct {
+	mu    sync.Mutex
+	seen  int
+	saved int
+	last  time.Time
+	// latest is the newest message in the room that the marker knows about.
+	latest int
+}
+
+// clamp limits a receipt to the newest message that the marker knows about
+// and reports whether the room may have newer messages.
+func (rm *readMarker) clamp(id int) (int, bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if id <= rm.latest {
+		return id, false
+	}
+	return rm.latest, true
+}
+
+func (rm *readMarker) setLatest(id int) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if id > rm.latest {
+		rm.latest = id
+	}
+}
+
+// mark records a receipt and reports whether it moved the marker forward.
+func (rm *readMarker) mark(id int) bool {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if id <= rm.seen {
+		return false
+	}
+	rm.seen = id
+	return true
+}
+
+// pending returns the receipt that needs to be saved, if any. Unless force
+// is set nothing is returned until the flush interval has passed since the
+// last save.
+func (rm *readMarker) pending(now time.Time, force bool) (int, bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.seen <= rm.saved || (!force && now.Sub(rm.last) < readFlushInterval) {
+		return 0, false
+	}
+	return rm.seen, true
+}
+
+func (rm *readMarker) done(id int, now time.Time) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if id > rm.saved {
+		rm.saved = id
+	}
+	rm.last = now
+}
+
+// handleRead broadcasts a read receipt to the room and saves it once the
+// flush interval has passed.
+func (cr *ChatRoom) handleRead(ctx context.Context, env *Envelope) error {
+	var r ReadReceipt
+	if err := env.Decode(&r); err != nil {
+		return err
+	}
+	if r.MessageID <= 0 || r.Thread < 0 {
+		return errors.Wrap(ErrBadFrame, "invalid message id")
+	}
+	if r.Thread != 0 {
+		return cr.handleThreadRead(ctx, &r)
+	}
+	id, err := cr.readUpTo(ctx, r.MessageID)
+	if err != nil {
+		return err
+	}
+	if !cr.read.mark(id) {
+		return nil
+	}
+	r.Room, r.UserID, r.MessageID = cr.RoomID, cr.UserID, id
+	out, err := NewEnvelope(MsgReadReceipt, "", &r)
+	if err == nil {
+		err = cr.ps.Pub(ctx, out)
+	}
+	if err != nil {
+		cr.logger.WithError(err).Error("could not publish read receipt")
+	}
+	if id, ok := cr.read.pending(time.Now(), false); ok {
+		cr.saveRead(ctx, id)
+	}
+	return nil
+}
+
+// readUpTo limits a read receipt to the room's newest message so that
+// clients can't mark messages that don't exist as read. The newest message is
+// only looked up when a receipt is past the last one that was seen.
+func (cr *ChatRoom) readUpTo(ctx context.Context, id int) (int, error) {
+	clamped, stale := cr.read.clamp(id)
+	if !stale {
+		return clamped, nil
+	}
+	latest, err := cr.Store.LatestMessage(ctx, cr.RoomID)
+	if err != nil {
+		return 0, err
+	}
+	cr.read.setLatest(latest)
+	clamped, _ = cr.read.clamp(id)
+	return clamped, nil
+}
+
+// flushRead saves the last read receipt if it hasn't been saved yet.
+func (cr *ChatRoom) flushRead(ctx context.Context) {
+	if id, ok := cr.read.pending(time.Now(), true); ok {
+		cr.saveRead(ctx, id)
+	}
+}
+
+func (cr *ChatRoom) saveRead(ctx context.Context, id int) {
+	if _, err := cr.Store.MarkSeen(ctx, cr.RoomID, cr.UserID, id); err != nil {
+		cr.logger.WithError(err).Error("could not save read receipt")
+		return
+	}
+	cr.read.done(id, time.Now())
+}
+
+// handleThreadRead saves a thread's read receipt right away and broadcasts
+// it. Threads are read far less often than rooms so receipts for them are not
+// coalesced.
+func (cr *ChatRoom) handleThreadRead(ctx context.Context, r *ReadReceipt) error {
+	seen, err := cr.Store.MarkThreadSeen(ctx, cr.RoomID, cr.UserID, r.Thread, r.MessageID)
+	if errors.Is(err, ErrNotMember) {
+		return ErrUnknownParent
+	} else if err != nil {
+		return err
+	}
+	r.Room, r.UserID, r.MessageID = cr.RoomID, cr.UserID, seen
+	out, err := NewEnvelope(MsgReadReceipt, "", r)
+	if err == nil {
+		err = cr.ps.Pub(ctx, out)
+	}
+	if err != nil {
+		cr.logger.WithError(err).Error("could not publish read receipt")
+	}
+	return nil
+}
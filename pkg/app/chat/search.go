@@ -0,0 +1,120 @@
+package chat
+
+import (
+	"context"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// highlightStart and highlightStop mark matches in the headlines made by
+	// postgres. They are private use characters so they are swapped for html
+	// tags after the headline has been escaped.
+	highlightStart = "\ue000"
+	highlightStop  = "\ue001"
+	headlineOpts   = "StartSel=" + highlightStart + ", StopSel=" + highlightStop +
+		", MaxFragments=2, MaxWords=24, MinWords=8"
+)
+
+// SearchQuery is a full-text search over the messages in a user's rooms.
+// Zero values are not used as filters.
+type SearchQuery struct {
+	// Text is parsed as a web search so quoted phrases, "or" and "-word"
+	// are supported.
+	Text   string
+	Room   int
+	Author int
+	Since  *time.Time
+	Until  *time.Time
+	// Before is a cursor. Only messages older than this message id are
+	// returned.
+	Before int
+	Limit  int
+}
+
+// SearchResult is a message that matched a search.
+type SearchResult struct {
+	*Message
+	// Highlight is an html escaped excerpt of the message with the matches
+	// wrapped in <mark> tags.
+	Highlight string  `json:"highlight"`
+	Rank      float64 `json:"rank"`
+}
+
+const searchQuery = `
+	SELECT m.id, m.room, m.user_id, m.body, m.created_at, m.edited_at,
+	       COALESCE(m.parent_id, 0),
+	       ts_headline('english', translate(m.body, $10, ''), q, $9),
+	       ts_rank(m.search, q)
+	FROM   chatroom_messages m
+	JOIN   chatroom_members mem ON (mem.room = m.room AND mem.user_id = $1),
+	       websearch_to_tsquery('english', $2) q
+	WHERE  m.search @@ q
+	  AND  m.deleted_at IS NULL
+	  AND  ($3 = 0 OR m.room = $3)
+	  AND  ($4 = 0 OR m.user_id = $4)
+	  AND  ($5::TIMESTAMPTZ IS NULL OR m.created_at >= $5)
+	  AND  ($6::TIMESTAMPTZ IS NULL OR m.created_at < $6)
+	  AND  ($7 = 0 OR m.id < $7)
+	ORDER  BY m.id DESC
+	LIMIT  $8`
+
+func (rs *store) Search(ctx context.Context, user int, q *SearchQuery) ([]*SearchResult, error) {
+	rows, err := rs.db.QueryContext(
+		ctx,
+		searchQuery,
+		user,
+		q.Text,
+		q.Room,
+		q.Author,
+		q.Since,
+		q.Until,
+		q.Before,
+		q.Limit,
+		headlineOpts,
+		// Messages that contain the markers would break the highlighting.
+		highlightStart+highlightStop,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to search messages")
+	}
+	defer rows.Close()
+	results := make([]*SearchResult, 0)
+	for rows.Next() {
+		var (
+			msg Message
+			res = SearchResult{Message: &msg}
+		)
+		err = rows.Scan(
+			&msg.ID,
+			&msg.Room,
+			&msg.UserID,
+			&msg.Body,
+			&msg.CreatedAt,
+			&msg.EditedAt,
+			&msg.ParentID,
+			&res.Highlight,
+			&res.Rank,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan search result from database")
+		}
+		res.Highlight = highlight(res.Highlight)
+		results = append(results, &res)
+	}
+	return results, rows.Err()
+}
+
+var highlightReplacer = strings.NewReplacer(
+	highlightStart, "<mark>",
+	highlightStop, "</mark>",
+)
+
+// highlight escapes a headline and marks its matches. Messages are user
+// input so only the tags added here are left unescaped.
+func highlight(headline string) string {
+	return highlightReplacer.Replace(html.EscapeString(headline))
+}
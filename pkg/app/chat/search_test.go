@@ -0,0 +1,60 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/matryer/is"
+	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockdb"
+)
+
+func TestHighlight(t *testing.T) {
+	is := is.New(t)
+	for _, tt := range []struct {
+		in, out string
+	}{
+		{"no matches", "no matches"},
+		{"a \ue000match\ue001 here", "a <mark>match</mark> here"},
+		{"<b>\ue000bold\ue001</b> & co", "&lt;b&gt;<mark>bold</mark>&lt;/b&gt; &amp; co"},
+	} {
+		is.Equal(highlight(tt.in), tt.out)
+	}
+}
+
+func TestStore_Search(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	rows := mockdb.NewMockRows(ctrl)
+	s := NewStore(d)
+	since := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := SearchQuery{Text: `"hello world"`, Room: 1, Since: &since, Before: 50, Limit: 10}
+	gomock.InOrder(
+		d.EXPECT().QueryContext(
+			ctx, searchQuery,
+			2, q.Text, 1, 0, &since, (*time.Time)(nil), 50, 10,
+			headlineOpts, "\ue000\ue001",
+		).Return(rows, nil),
+		rows.EXPECT().Next().Return(true),
+		rows.EXPECT().Scan(gomock.Any()).DoAndReturn(func(dest ...interface{}) error {
+			*dest[0].(*int) = 7
+			*dest[3].(*string) = "hello world"
+			*dest[7].(*string) = "\ue000hello\ue001 \ue000world\ue001"
+			*dest[8].(*float64) = 0.5
+			return nil
+		}),
+		rows.EXPECT().Next().Return(false),
+		rows.EXPECT().Err().Return(nil),
+		rows.EXPECT().Close().Return(nil),
+	)
+	results, err := s.Search(ctx, 2, &q)
+	is.NoErr(err)
+	is.Equal(len(results), 1)
+	is.Equal(results[0].ID, 7)
+	is.Equal(results[0].Highlight, "<mark>hello</mark> <mark>world</mark>")
+	is.Equal(results[0].Rank, 0.5)
+}
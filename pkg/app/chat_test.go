@@ -0,0 +1,696 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang/mock/gomock"
+	"github.com/labstack/echo/v4"
+	"github.com/matryer/is"
+	"gopkg.hrry.dev/homelab/pkg/app/chat"
+	"gopkg.hrry.dev/homelab/pkg/auth"
+	"gopkg.hrry.dev/homelab/pkg/db"
+	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockredis"
+)
+
+// memChatStore keeps rooms in memory.
+type memChatStore struct {
+	chat.Store
+	rooms     map[int]*chat.Room
+	messages  map[int]*chat.Message
+	edits     map[int][]*chat.MessageEdit
+	reactions map[int][]string
+	search    *chat.SearchQuery
+}
+
+func newMemChatStore(rooms ...*chat.Room) *memChatStore {
+	s := memChatStore{
+		rooms:     make(map[int]*chat.Room),
+		messages:  make(map[int]*chat.Message),
+		edits:     make(map[int][]*chat.MessageEdit),
+		reactions: make(map[int][]string),
+	}
+	for _, r := range rooms {
+		if r.Members == nil {
+			r.Members = make(map[int]*chat.ChatRoomMember)
+		}
+		r.Members[r.OwnerID] = &chat.ChatRoomMember{Room: r.ID, UserID: r.OwnerID}
+		s.rooms[r.ID] = r
+	}
+	return &s
+}
+
+func (s *memChatStore) GetRoom(_ context.Context, id int) (*chat.Room, error) {
+	r, ok := s.rooms[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	cp := *r
+	cp.Members = make(map[int]*chat.ChatRoomMember, len(r.Members))
+	for k, v := range r.Members {
+		cp.Members[k] = v
+	}
+	return &cp, nil
+}
+
+func (s *memChatStore) AddMember(_ context.Context, room, user int) error {
+	s.rooms[room].Members[user] = &chat.ChatRoomMember{Room: room, UserID: user}
+	return nil
+}
+
+func (s *memChatStore) RemoveMember(_ context.Context, room, user int) error {
+	if _, ok := s.rooms[room].Members[user]; !ok {
+		return chat.ErrNotMember
+	}
+	delete(s.rooms[room].Members, user)
+	return nil
+}
+
+func (s *memChatStore) SetOwner(_ context.Context, room, owner int) error {
+	if _, ok := s.rooms[room].Members[owner]; !ok {
+		return chat.ErrNotMember
+	}
+	s.rooms[room].OwnerID = owner
+	return nil
+}
+
+func (s *memChatStore) UserRooms(_ context.Context, user int) ([]*chat.Room, error) {
+	rooms := make([]*chat.Room, 0)
+	for _, r := range s.rooms {
+		if _, ok := r.Members[user]; ok {
+			rooms = append(rooms, r)
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+	return rooms, nil
+}
+
+func (s *memChatStore) MarkSeen(_ context.Context, room, user, msg int) (int, error) {
+	m, ok := s.rooms[room].Members[user]
+	if !ok {
+		return 0, chat.ErrNotMember
+	}
+	if int64(msg) > m.LastSeen {
+		m.LastSeen = int64(msg)
+	}
+	return int(m.LastSeen), nil
+}
+
+func (s *memChatStore) Unread(_ context.Context, user int) ([]*chat.UnreadCount, error) {
+	counts := make([]*chat.UnreadCount, 0)
+	for _, r := range s.rooms {
+		if m, ok := r.Members[user]; ok {
+			counts = append(counts, &chat.UnreadCount{Room: r.ID, LastSeen: int(m.LastSeen)})
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Room < counts[j].Room })
+	return counts, nil
+}
+
+func (s *memChatStore) MarkThreadSeen(_ context.Context, room, user, thread, msg int) (int, error) {
+	if _, ok := s.rooms[room].Members[user]; !ok {
+		return 0, chat.ErrNotMember
+	}
+	if _, ok := s.messages[thread]; !ok {
+		return 0, chat.ErrNotMember
+	}
+	return msg, nil
+}
+
+func (s *memChatStore) Messages(_ context.Context, room int, _ db.PaginationOpts) ([]*chat.Message, error) {
+	return s.list(func(m *chat.Message) bool { return m.Room == room && m.ParentID == 0 }), nil
+}
+
+func (s *memChatStore) Replies(_ context.Context, room, thread int, _ db.PaginationOpts) ([]*chat.Message, error) {
+	return s.list(func(m *chat.Message) bool { return m.Room == room && m.ParentID == thread }), nil
+}
+
+func (s *memChatStore) list(keep func(*chat.Message) bool) []*chat.Message {
+	msgs := make([]*chat.Message, 0)
+	for _, m := range s.messages {
+		if keep(m) {
+			msgs = append(msgs, m)
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].ID > msgs[j].ID })
+	return msgs
+}
+
+func (s *memChatStore) Search(_ context.Context, user int, q *chat.SearchQuery) ([]*chat.SearchResult, error) {
+	s.search = q
+	results := make([]*chat.SearchResult, 0)
+	for _, m := range s.list(func(m *chat.Message) bool {
+		_, member := s.rooms[m.Room].Members[user]
+		return member && strings.Contains(m.Body, q.Text) && (q.Before == 0 || m.ID < q.Before)
+	}) {
+		if len(results) == q.Limit {
+			break
+		}
+		results = append(results, &chat.SearchResult{Message: m, Highlight: m.Body})
+	}
+	return results, nil
+}
+
+func (s *memChatStore) Message(_ context.Context, room, id int) (*chat.Message, error) {
+	m, ok := s.messages[id]
+	if !ok || m.Room != room {
+		return nil, chat.ErrMessageNotFound
+	}
+	cp := *m
+	return &cp, nil
+}
+
+func (s *memChatStore) EditMessage(_ context.Context, id, editor int, body string) (*chat.Message, error) {
+	m, ok := s.messages[id]
+	if !ok || m.DeletedAt != nil {
+		return nil, chat.ErrMessageNotFound
+	}
+	s.edits[id] = append(s.edits[id], &chat.MessageEdit{MessageID: id, Body: m.Body, EditedBy: editor})
+	now := time.Now()
+	m.Body, m.EditedAt = body, &now
+	cp := *m
+	return &cp, nil
+}
+
+func (s *memChatStore) MessageEdits(_ context.Context, id int) ([]*chat.MessageEdit, error) {
+	return append(make([]*chat.MessageEdit, 0), s.edits[id]...), nil
+}
+
+func (s *memChatStore) DeleteMessage(_ context.Context, id, _ int) (*chat.Message, error) {
+	m, ok := s.messages[id]
+	if !ok || m.DeletedAt != nil {
+		return nil, chat.ErrMessageNotFound
+	}
+	now := time.Now()
+	m.Body, m.DeletedAt = "", &now
+	delete(s.edits, id)
+	delete(s.reactions, id)
+	cp := *m
+	return &cp, nil
+}
+
+func (s *memChatStore) React(_ context.Context, id, user int, emoji string) error {
+	s.reactions[id] = append(s.reactions[id], fmt.Sprintf("%d:%s", user, emoji))
+	return nil
+}
+
+func (s *memChatStore) Unreact(_ context.Context, id, user int, emoji string) error {
+	key := fmt.Sprintf("%d:%s", user, emoji)
+	for i, r := range s.reactions[id] {
+		if r == key {
+			s.reactions[id] = append(s.reactions[id][:i], s.reactions[id][i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func memberContext(method, body string, claims *auth.Claims, room, user string) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(method, "/", strings.NewReader(body))
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c, rec := sessionContext(req, claims, nil)
+	names, values := []string{"id"}, []string{room}
+	if len(user) > 0 {
+		names, values = append(names, "user"), append(values, user)
+	}
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+	return c, rec
+}
+
+func messageContext(method, target, body string, claims *auth.Claims, room, msg string) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c, rec := sessionContext(req, claims, nil)
+	c.SetParamNames("id", "msg")
+	c.SetParamValues(room, msg)
+	return c, rec
+}
+
+// expectEvent expects a frame to be published to a room and decodes its
+// payload.
+func expectEvent(t *testing.T, rdb *mockredis.MockUniversalClient, room int, typ chat.MsgType, payload any) {
+	t.Helper()
+	rdb.EXPECT().
+		Publish(gomock.Any(), fmt.Sprintf("room:%d:user:0", room), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _ string, raw []byte) *redis.IntCmd {
+			var env chat.Envelope
+			if err := json.Unmarshal(raw, &env); err != nil {
+				t.Fatal(err)
+			}
+			if env.Type != typ {
+				t.Errorf("expected a %q event, got %q", typ, env.Type)
+			}
+			if err := env.Decode(payload); err != nil {
+				t.Fatal(err)
+			}
+			return redis.NewIntResult(1, nil)
+		})
+}
+
+// expectMemberEvent expects a membership change to be published to a room.
+func expectMemberEvent(t *testing.T, rdb *mockredis.MockUniversalClient, room int, expected chat.MemberEvent) {
+	t.Helper()
+	rdb.EXPECT().
+		Publish(gomock.Any(), fmt.Sprintf("room:%d:user:0", room), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _ string, raw []byte) *redis.IntCmd {
+			var (
+				env chat.Envelope
+				ev  chat.MemberEvent
+			)
+			if err := json.Unmarshal(raw, &env); err != nil {
+				t.Fatal(err)
+			}
+			if env.Type != chat.MsgMember {
+				t.Errorf("expected a member event, got %q", env.Type)
+			}
+			if err := env.Decode(&ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev != expected {
+				t.Errorf("expected %+v, got %+v", expected, ev)
+			}
+			return redis.NewIntResult(1, nil)
+		})
+}
+
+func TestJoinLeaveChatRoom(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rdb := mockredis.NewMockUniversalClient(ctrl)
+	store := newMemChatStore(
+		&chat.Room{ID: 1, OwnerID: 10, Public: true},
+		&chat.Room{ID: 2, OwnerID: 10},
+	)
+	user := &auth.Claims{ID: 20}
+
+	c, _ := memberContext("POST", "", nil, "1", "")
+	is.Equal(httpCode(JoinChatRoom(store, rdb)(c)), http.StatusUnauthorized)
+	c, _ = memberContext("POST", "", user, "2", "")
+	is.Equal(httpCode(JoinChatRoom(store, rdb)(c)), http.StatusForbidden)
+	c, _ = memberContext("POST", "", user, "3", "")
+	is.Equal(httpCode(JoinChatRoom(store, rdb)(c)), http.StatusNotFound)
+
+	expectMemberEvent(t, rdb, 1, chat.MemberEvent{Action: chat.MemberJoined, Room: 1, UserID: 20, By: 20})
+	c, rec := memberContext("POST", "", user, "1", "")
+	is.NoErr(JoinChatRoom(store, rdb)(c))
+	is.Equal(rec.Code, http.StatusNoContent)
+	is.True(store.rooms[1].Members[20] != nil)
+	// joining again does nothing
+	c, _ = memberContext("POST", "", user, "1", "")
+	is.NoErr(JoinChatRoom(store, rdb)(c))
+
+	c, _ = memberContext("POST", "", &auth.Claims{ID: 10}, "1", "")
+	is.Equal(LeaveChatRoom(store, rdb)(c), ErrRoomOwnerLeave)
+	expectMemberEvent(t, rdb, 1, chat.MemberEvent{Action: chat.MemberLeft, Room: 1, UserID: 20, By: 20})
+	c, _ = memberContext("POST", "", user, "1", "")
+	is.NoErr(LeaveChatRoom(store, rdb)(c))
+	is.True(store.rooms[1].Members[20] == nil)
+	c, _ = memberContext("POST", "", user, "1", "")
+	is.Equal(LeaveChatRoom(store, rdb)(c), ErrNotRoomMember)
+}
+
+func TestManageChatMembers(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rdb := mockredis.NewMockUniversalClient(ctrl)
+	store := newMemChatStore(&chat.Room{ID: 1, OwnerID: 10})
+	owner := &auth.Claims{ID: 10}
+	admin := &auth.Claims{ID: 99, Roles: []auth.Role{auth.RoleAdmin}}
+
+	c, _ := memberContext("POST", `{"user_id":20}`, &auth.Claims{ID: 30}, "1", "")
+	is.Equal(httpCode(AddChatMember(store, rdb)(c)), http.StatusForbidden)
+
+	expectMemberEvent(t, rdb, 1, chat.MemberEvent{Action: chat.MemberAdded, Room: 1, UserID: 20, By: 10})
+	c, _ = memberContext("POST", `{"user_id":20}`, owner, "1", "")
+	is.NoErr(AddChatMember(store, rdb)(c))
+	is.True(store.rooms[1].Members[20] != nil)
+
+	expectMemberEvent(t, rdb, 1, chat.MemberEvent{Action: chat.MemberAdded, Room: 1, UserID: 30, By: 99})
+	c, _ = memberContext("POST", `{"user_id":30}`, admin, "1", "")
+	is.NoErr(AddChatMember(store, rdb)(c))
+
+	c, _ = memberContext("DELETE", "", owner, "1", "10")
+	is.Equal(RemoveChatMember(store, rdb)(c), ErrRemoveRoomOwner)
+	c, _ = memberContext("DELETE", "", owner, "1", "40")
+	is.Equal(RemoveChatMember(store, rdb)(c), ErrNotRoomMember)
+	expectMemberEvent(t, rdb, 1, chat.MemberEvent{Action: chat.MemberRemoved, Room: 1, UserID: 30, By: 10})
+	c, _ = memberContext("DELETE", "", owner, "1", "30")
+	is.NoErr(RemoveChatMember(store, rdb)(c))
+	is.True(store.rooms[1].Members[30] == nil)
+
+	c, _ = memberContext("PUT", `{"user_id":40}`, owner, "1", "")
+	is.Equal(TransferChatRoom(store, rdb)(c), ErrNotRoomMember)
+	expectMemberEvent(t, rdb, 1, chat.MemberEvent{Action: chat.MemberOwner, Room: 1, UserID: 20, By: 10})
+	c, _ = memberContext("PUT", `{"user_id":20}`, owner, "1", "")
+	is.NoErr(TransferChatRoom(store, rdb)(c))
+	is.Equal(store.rooms[1].OwnerID, 20)
+	// the old owner can't manage the room anymore
+	c, _ = memberContext("DELETE", "", owner, "1", "20")
+	is.Equal(httpCode(RemoveChatMember(store, rdb)(c)), http.StatusForbidden)
+}
+
+func TestListMyChatRooms(t *testing.T) {
+	is := is.New(t)
+	store := newMemChatStore(
+		&chat.Room{ID: 1, OwnerID: 10, Name: "one"},
+		&chat.Room{ID: 2, OwnerID: 20, Name: "two"},
+		&chat.Room{ID: 3, OwnerID: 10, Name: "three"},
+	)
+	c, rec := memberContext("GET", "", &auth.Claims{ID: 10}, "", "")
+	is.NoErr(ListMyChatRooms(store)(c))
+	var res struct {
+		Rooms []chat.Room `json:"rooms"`
+	}
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&res))
+	is.Equal(len(res.Rooms), 2)
+	is.Equal(res.Rooms[0].Name, "one")
+	is.Equal(res.Rooms[1].Name, "three")
+}
+
+func TestMarkChatRead(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rdb := mockredis.NewMockUniversalClient(ctrl)
+	store := newMemChatStore(&chat.Room{ID: 1, OwnerID: 10}, &chat.Room{ID: 2, OwnerID: 20})
+	owner := &auth.Claims{ID: 10}
+
+	c, _ := memberContext("POST", `{"message_id":0}`, owner, "1", "")
+	is.Equal(httpCode(MarkChatRead(store, rdb)(c)), http.StatusBadRequest)
+	c, _ = memberContext("POST", `{"message_id":3}`, owner, "2", "")
+	is.Equal(MarkChatRead(store, rdb)(c), ErrNotRoomMember)
+
+	rdb.EXPECT().Publish(gomock.Any(), "room:1:user:0", gomock.Any()).Return(redis.NewIntResult(1, nil))
+	c, rec := memberContext("POST", `{"message_id":3}`, owner, "1", "")
+	is.NoErr(MarkChatRead(store, rdb)(c))
+	var receipt chat.ReadReceipt
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&receipt))
+	is.Equal(receipt, chat.ReadReceipt{Room: 1, UserID: 10, MessageID: 3})
+
+	c, rec = memberContext("GET", "", owner, "", "")
+	is.NoErr(ListUnreadChats(store)(c))
+	var res struct {
+		Rooms []chat.UnreadCount `json:"rooms"`
+	}
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&res))
+	is.Equal(res.Rooms, []chat.UnreadCount{{Room: 1, LastSeen: 3}})
+}
+
+func TestChatPresence(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rdb := mockredis.NewMockUniversalClient(ctrl)
+	store := newMemChatStore(&chat.Room{ID: 1, OwnerID: 10})
+
+	c, _ := memberContext("GET", "", &auth.Claims{ID: 20}, "1", "")
+	is.Equal(ChatPresence(store, rdb)(c), ErrNotRoomMember)
+
+	cmd := redis.NewStringSliceCmd(context.Background())
+	cmd.SetVal([]string{"10:a", "30:b"})
+	rdb.EXPECT().Eval(gomock.Any(), gomock.Any(), []string{"chat:presence:room:1"}, gomock.Any()).Return(redis.NewCmdResult([]interface{}{}, nil))
+	rdb.EXPECT().ZRangeByScore(gomock.Any(), "chat:presence:room:1", gomock.Any()).Return(cmd)
+	c, rec := memberContext("GET", "", &auth.Claims{ID: 10}, "1", "")
+	is.NoErr(ChatPresence(store, rdb)(c))
+	var res struct {
+		Online []int `json:"online"`
+	}
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&res))
+	is.Equal(res.Online, []int{10, 30})
+}
+
+func TestEditDeleteChatMessage(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rdb := mockredis.NewMockUniversalClient(ctrl)
+	store := newMemChatStore(&chat.Room{ID: 1, OwnerID: 10}, &chat.Room{ID: 2, OwnerID: 10})
+	store.rooms[1].Members[20] = &chat.ChatRoomMember{Room: 1, UserID: 20}
+	store.messages[5] = &chat.Message{ID: 5, Room: 1, UserID: 20, Body: "helo"}
+	author, owner := &auth.Claims{ID: 20}, &auth.Claims{ID: 10}
+
+	c, _ := messageContext("PUT", "/", `{"body":"hello"}`, owner, "1", "5")
+	is.Equal(httpCode(EditChatMessage(store, rdb)(c)), http.StatusForbidden)
+	c, _ = messageContext("PUT", "/", `{"body":""}`, author, "1", "5")
+	is.Equal(httpCode(EditChatMessage(store, rdb)(c)), http.StatusBadRequest)
+	c, _ = messageContext("PUT", "/", `{"body":"hello"}`, author, "2", "5")
+	is.Equal(EditChatMessage(store, rdb)(c), ErrNotRoomMember)
+	c, _ = messageContext("PUT", "/", `{"body":"hello"}`, owner, "2", "5")
+	is.Equal(httpCode(EditChatMessage(store, rdb)(c)), http.StatusNotFound)
+
+	var edited chat.Message
+	expectEvent(t, rdb, 1, chat.MsgEdit, &edited)
+	c, _ = messageContext("PUT", "/", `{"body":"hello"}`, author, "1", "5")
+	is.NoErr(EditChatMessage(store, rdb)(c))
+	is.Equal(edited.Body, "hello")
+	is.True(edited.EditedAt != nil)
+
+	c, rec := messageContext("GET", "/", "", owner, "1", "5")
+	is.NoErr(ListChatMessageEdits(store)(c))
+	var res struct {
+		Edits []chat.MessageEdit `json:"edits"`
+	}
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&res))
+	is.Equal(len(res.Edits), 1)
+	is.Equal(res.Edits[0].Body, "helo")
+	is.Equal(res.Edits[0].EditedBy, 20)
+
+	c, _ = messageContext("DELETE", "/", "", &auth.Claims{ID: 30}, "1", "5")
+	is.Equal(DeleteChatMessage(store, rdb)(c), ErrNotRoomMember)
+	// public rooms can be read by anyone but only changed by members
+	store.rooms[1].Public = true
+	c, _ = messageContext("DELETE", "/", "", &auth.Claims{ID: 30}, "1", "5")
+	is.Equal(DeleteChatMessage(store, rdb)(c), ErrNotRoomMember)
+	store.rooms[1].Public = false
+	var tombstone chat.Message
+	expectEvent(t, rdb, 1, chat.MsgDelete, &tombstone)
+	c, _ = messageContext("DELETE", "/", "", owner, "1", "5")
+	is.NoErr(DeleteChatMessage(store, rdb)(c))
+	is.Equal(tombstone.ID, 5)
+	is.Equal(tombstone.Body, "")
+	is.True(tombstone.DeletedAt != nil)
+	is.Equal(len(store.edits[5]), 0)
+
+	// deleted messages can't be edited or deleted again
+	c, _ = messageContext("PUT", "/", `{"body":"again"}`, author, "1", "5")
+	is.Equal(httpCode(EditChatMessage(store, rdb)(c)), http.StatusNotFound)
+	c, _ = messageContext("PUT", "/", `{"body":""}`, author, "1", "5")
+	is.Equal(httpCode(EditChatMessage(store, rdb)(c)), http.StatusNotFound)
+	c, _ = messageContext("PUT", "/", `{"body":"again"}`, owner, "1", "5")
+	is.Equal(httpCode(EditChatMessage(store, rdb)(c)), http.StatusNotFound)
+	c, _ = messageContext("DELETE", "/", "", author, "1", "5")
+	is.Equal(httpCode(DeleteChatMessage(store, rdb)(c)), http.StatusNotFound)
+}
+
+func TestChatReactions(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rdb := mockredis.NewMockUniversalClient(ctrl)
+	store := newMemChatStore(&chat.Room{ID: 1, OwnerID: 10})
+	store.messages[5] = &chat.Message{ID: 5, Room: 1, UserID: 10, Body: "hi"}
+	user := &auth.Claims{ID: 10}
+
+	for _, emoji := range []string{"", " ", "a b", strings.Repeat("x", 65)} {
+		body, _ := json.Marshal(map[string]string{"emoji": emoji})
+		c, _ := messageContext("POST", "/", string(body), user, "1", "5")
+		is.Equal(httpCode(AddChatReaction(store, rdb)(c)), http.StatusBadRequest)
+	}
+
+	var ev chat.ReactionEvent
+	expectEvent(t, rdb, 1, chat.MsgReaction, &ev)
+	c, rec := messageContext("POST", "/", `{"emoji":"👍"}`, user, "1", "5")
+	is.NoErr(AddChatReaction(store, rdb)(c))
+	is.Equal(rec.Code, http.StatusNoContent)
+	is.Equal(ev, chat.ReactionEvent{Room: 1, MessageID: 5, UserID: 10, Emoji: "👍", Added: true})
+	is.Equal(store.reactions[5], []string{"10:👍"})
+
+	expectEvent(t, rdb, 1, chat.MsgReaction, &ev)
+	c, _ = messageContext("DELETE", "/?emoji=%F0%9F%91%8D", "", user, "1", "5")
+	is.NoErr(RemoveChatReaction(store, rdb)(c))
+	is.Equal(ev, chat.ReactionEvent{Room: 1, MessageID: 5, UserID: 10, Emoji: "👍"})
+	is.Equal(len(store.reactions[5]), 0)
+
+	c, _ = messageContext("POST", "/", `{"emoji":"👍"}`, user, "1", "6")
+	is.Equal(httpCode(AddChatReaction(store, rdb)(c)), http.StatusNotFound)
+
+	// anyone can read a public room but only members can react
+	store.rooms[1].Public = true
+	c, _ = messageContext("POST", "/", `{"emoji":"👍"}`, &auth.Claims{ID: 30}, "1", "5")
+	is.Equal(AddChatReaction(store, rdb)(c), ErrNotRoomMember)
+	c, _ = messageContext("GET", "/", "", &auth.Claims{ID: 30}, "1", "5")
+	is.NoErr(ListChatMessageEdits(store)(c))
+}
+
+func TestListMessagesThread(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rdb := mockredis.NewMockUniversalClient(ctrl)
+	store := newMemChatStore(&chat.Room{ID: 1, OwnerID: 10})
+	store.messages[1] = &chat.Message{ID: 1, Room: 1, Replies: 2}
+	store.messages[2] = &chat.Message{ID: 2, Room: 1, ParentID: 1}
+	store.messages[3] = &chat.Message{ID: 3, Room: 1}
+	store.messages[4] = &chat.Message{ID: 4, Room: 1, ParentID: 1}
+	owner := &auth.Claims{ID: 10}
+
+	var res struct {
+		Messages []chat.Message `json:"messages"`
+	}
+	c, rec := messageContext("GET", "/", "", owner, "1", "")
+	is.NoErr(ListMessages(store)(c))
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&res))
+	is.Equal(len(res.Messages), 2)
+	is.Equal(res.Messages[1].Replies, 2)
+
+	c, rec = messageContext("GET", "/?thread=1", "", owner, "1", "")
+	is.NoErr(ListMessages(store)(c))
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&res))
+	is.Equal(len(res.Messages), 2)
+	is.Equal(res.Messages[0].ID, 4)
+	is.Equal(res.Messages[1].ID, 2)
+
+	var receipt chat.ReadReceipt
+	expectEvent(t, rdb, 1, chat.MsgReadReceipt, &receipt)
+	c, _ = memberContext("POST", `{"message_id":4,"thread":1}`, owner, "1", "")
+	is.NoErr(MarkChatRead(store, rdb)(c))
+	is.Equal(receipt, chat.ReadReceipt{Room: 1, UserID: 10, MessageID: 4, Thread: 1})
+	c, _ = memberContext("POST", `{"message_id":4,"thread":9}`, owner, "1", "")
+	is.Equal(MarkChatRead(store, rdb)(c), ErrNotRoomMember)
+}
+
+func TestSearchChat(t *testing.T) {
+	is := is.New(t)
+	store := newMemChatStore(&chat.Room{ID: 1, OwnerID: 10}, &chat.Room{ID: 2, OwnerID: 20})
+	store.messages[1] = &chat.Message{ID: 1, Room: 1, Body: "hello there"}
+	store.messages[2] = &chat.Message{ID: 2, Room: 2, Body: "hello from another room"}
+	store.messages[3] = &chat.Message{ID: 3, Room: 1, Body: "hello again"}
+	store.messages[4] = &chat.Message{ID: 4, Room: 1, Body: "goodbye"}
+	user := &auth.Claims{ID: 10}
+
+	for _, target := range []string{
+		"/",
+		"/?q=%20",
+		"/?q=hello&since=yesterday",
+		"/?q=hello&until=2022-13-01",
+		"/?q=hello&cursor=-1",
+	} {
+		c, _ := messageContext("GET", target, "", user, "", "")
+		is.Equal(httpCode(SearchChat(store)(c)), http.StatusBadRequest)
+	}
+
+	type response struct {
+		Results []chat.SearchResult `json:"results"`
+		Next    int                 `json:"next"`
+	}
+	c, rec := messageContext("GET", "/?q=hello&limit=1&since=2022-01-02&room=1", "", user, "", "")
+	is.NoErr(SearchChat(store)(c))
+	var res response
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&res))
+	is.Equal(len(res.Results), 1)
+	is.Equal(res.Results[0].ID, 3)
+	is.Equal(res.Next, 3)
+	is.Equal(store.search.Room, 1)
+	is.Equal(*store.search.Since, time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC))
+	is.True(store.search.Until == nil)
+
+	c, rec = messageContext("GET", "/?q=hello&limit=1&cursor=3", "", user, "", "")
+	is.NoErr(SearchChat(store)(c))
+	res = response{}
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&res))
+	is.Equal(len(res.Results), 1)
+	is.Equal(res.Results[0].ID, 1)
+
+	c, rec = messageContext("GET", "/?q=hello&cursor=1", "", user, "", "")
+	is.NoErr(SearchChat(store)(c))
+	res = response{}
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&res))
+	is.Equal(len(res.Results), 0)
+	is.Equal(res.Next, 0)
+	is.Equal(store.search.Limit, defaultSearchLimit)
+}
+
+func TestRegisterChatRoutes(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rdb := mockredis.NewMockUniversalClient(ctrl)
+	store := newMemChatStore(&chat.Room{ID: 1, OwnerID: 10}, &chat.Room{ID: 2, OwnerID: 20})
+	store.messages[3] = &chat.Message{ID: 3, Room: 1, UserID: 10, Body: "hello"}
+	// guard logs in the user from the test's header
+	guard := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			id, err := strconv.Atoi(c.Request().Header.Get("X-User"))
+			if err != nil {
+				return echo.ErrUnauthorized
+			}
+			c.Set(string(auth.ClaimsContextKey), &auth.Claims{ID: id})
+			return next(c)
+		}
+	}
+	e := echo.New()
+	RegisterChatRoutes(e.Group("/api"), store, rdb, guard, guard)
+
+	type response struct {
+		Message string `json:"message"`
+	}
+	serve := func(method, target, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader("{}"))
+		req.Header.Set("Content-Type", "application/json")
+		if len(user) > 0 {
+			req.Header.Set("X-User", user)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tt := range []struct {
+		method, target, user string
+		code                 int
+		message              string
+	}{
+		{method: "GET", target: "/api/chat/unread", code: http.StatusUnauthorized},
+		{method: "GET", target: "/api/chat/unread", user: "10", code: http.StatusOK},
+		{method: "GET", target: "/api/chat/search?q=hello", user: "10", code: http.StatusOK},
+		{method: "GET", target: "/api/chat/search", user: "10", code: http.StatusBadRequest},
+		{method: "GET", target: "/api/chat/1/messages/3/edits", user: "10", code: http.StatusOK},
+		{method: "GET", target: "/api/chat/2/messages/3/edits", user: "10", code: http.StatusNotFound, message: ErrNotRoomMember.Message.(string)},
+		{method: "GET", target: "/api/chat/1/messages/4/edits", user: "10", code: http.StatusNotFound, message: http.StatusText(http.StatusNotFound)},
+		{method: "PUT", target: "/api/chat/2/messages/3", user: "10", code: http.StatusNotFound, message: ErrNotRoomMember.Message.(string)},
+		{method: "DELETE", target: "/api/chat/2/messages/3", user: "10", code: http.StatusNotFound, message: ErrNotRoomMember.Message.(string)},
+		{method: "POST", target: "/api/chat/2/messages/3/reactions", user: "10", code: http.StatusNotFound, message: ErrNotRoomMember.Message.(string)},
+		{method: "DELETE", target: "/api/chat/2/messages/3/reactions", user: "10", code: http.StatusNotFound, message: ErrNotRoomMember.Message.(string)},
+		{method: "POST", target: "/api/chat/2/read", user: "10", code: http.StatusBadRequest},
+		{method: "GET", target: "/api/chat/2/presence", user: "10", code: http.StatusNotFound, message: ErrNotRoomMember.Message.(string)},
+		{method: "GET", target: "/api/chat/1/presence", code: http.StatusUnauthorized},
+	} {
+		rec := serve(tt.method, tt.target, tt.user)
+		if rec.Code != tt.code {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.target, rec.Code, tt.code)
+			continue
+		}
+		if len(tt.message) > 0 {
+			var res response
+			is.NoErr(json.NewDecoder(rec.Body).Decode(&res))
+			is.Equal(res.Message, tt.message)
+		}
+	}
+}
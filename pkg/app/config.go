@@ -1,16 +1,26 @@
 package app
 
 import (
+	"fmt"
 	"os"
 
 	hydra "github.com/ory/hydra-client-go"
-	"github.com/sendgrid/sendgrid-go"
+	"github.com/pkg/errors"
+	"gopkg.hrry.dev/homelab/pkg/certutil"
+	"gopkg.hrry.dev/homelab/pkg/email"
 )
 
 const (
 	envHydraAdminURL = "HYDRA_ADMIN_URL"
 	//envHydraPublicURL = "HYDRA_PUBLIC_URL"
 	envSendgridAPIKey = "SENDGRID_API_KEY"
+	envEmailTransport = "EMAIL_TRANSPORT"
+	envSMTPURL        = "SMTP_URL"
+	envEmailDir       = "EMAIL_DIR"
+	defaultEmailDir   = "./tmp/mail"
+	envDKIMSelector   = "DKIM_SELECTOR"
+	envDKIMKeyFile    = "DKIM_KEY_FILE"
+	envDKIMDomain     = "DKIM_DOMAIN"
 )
 
 func HydraAdminConfig() *hydra.Configuration {
@@ -24,12 +34,59 @@ func HydraAdminConfig() *hydra.Configuration {
 	}
 }
 
-func SendgridClient() *sendgrid.Client {
-	key, ok := os.LookupEnv(envSendgridAPIKey)
-	if !ok {
-		return nil
+// EmailSender creates an email sender based on the EMAIL_TRANSPORT
+// environment variable which can be "sendgrid", "smtp" or "file". When it is
+// not set the transport is picked based on which of SENDGRID_API_KEY or
+// SMTP_URL is set. A nil sender is returned if email is not configured.
+func EmailSender() (email.Sender, error) {
+	transport := getenv(envEmailTransport)
+	if len(transport) == 0 {
+		if _, ok := os.LookupEnv(envSendgridAPIKey); ok {
+			transport = "sendgrid"
+		} else if _, ok := os.LookupEnv(envSMTPURL); ok {
+			transport = "smtp"
+		} else {
+			return nil, nil
+		}
+	}
+	switch transport {
+	case "sendgrid":
+		key := getenv(envSendgridAPIKey)
+		if len(key) == 0 {
+			return nil, fmt.Errorf("%s is required for sendgrid email", envSendgridAPIKey)
+		}
+		return email.NewSendGridKey(key), nil
+	case "smtp":
+		s, err := email.ParseSMTPURL(getenv(envSMTPURL))
+		if err != nil {
+			return nil, err
+		}
+		s.DKIM, err = DKIMSigner()
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "file":
+		return email.NewFileSink(getenv(envEmailDir, defaultEmailDir)), nil
+	default:
+		return nil, fmt.Errorf("unknown email transport %q", transport)
+	}
+}
+
+// DKIMSigner loads the DKIM signing key from DKIM_KEY_FILE. DKIM_SELECTOR is
+// required when a key is given and DKIM_DOMAIN is optional, messages are
+// signed for the domain of their From address by default. No signer is
+// returned if there is no key file.
+func DKIMSigner() (*email.DKIM, error) {
+	keyfile := getenv(envDKIMKeyFile)
+	if len(keyfile) == 0 {
+		return nil, nil
+	}
+	key, err := certutil.OpenKey(keyfile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open dkim key")
 	}
-	return sendgrid.NewSendClient(key)
+	return email.NewDKIM(getenv(envDKIMDomain), getenv(envDKIMSelector), key)
 }
 
 func getenv(key string, defaultValue ...string) string {
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"gopkg.hrry.dev/homelab/pkg/email/templates"
+	"gopkg.hrry.dev/homelab/pkg/invite"
+)
+
+// ListEmailTemplates lists the names of all the email templates.
+func ListEmailTemplates(reg *templates.Registry) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(200, reg.Names())
+	}
+}
+
+// PreviewEmailTemplate renders an email template with its sample data. The
+// format query parameter selects the "html" (default), "text" or "json"
+// output.
+func PreviewEmailTemplate(reg *templates.Registry) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		t, err := reg.Get(c.Param("name"))
+		if err != nil {
+			if errors.Is(err, templates.ErrNotFound) {
+				return echo.ErrNotFound.SetInternal(err)
+			}
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		data := sampleData(t.Name)
+		if err = t.Sample(data); err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		rendered, err := t.Render(data)
+		if err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		switch c.QueryParam("format") {
+		case "html", "":
+			return c.HTML(200, rendered.HTML)
+		case "text":
+			return c.String(200, rendered.Text)
+		case "json":
+			return c.JSON(200, rendered)
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid preview format")
+		}
+	}
+}
+
+// sampleData returns the value that a template is executed with so that
+// previews render the same way as real emails.
+func sampleData(name string) interface{} {
+	switch name {
+	case "invite":
+		return &invite.Invitation{Domain: Domain}
+	case "invite_redeemed":
+		return &invite.Event{}
+	default:
+		var m map[string]interface{}
+		return &m
+	}
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+	"gopkg.hrry.dev/homelab/pkg/email/templates"
+)
+
+func TestPreviewEmailTemplate(t *testing.T) {
+	is := is.New(t)
+	reg, err := templates.Default()
+	is.NoErr(err)
+	h := PreviewEmailTemplate(reg)
+
+	preview := func(name, format string) (*httptest.ResponseRecorder, error) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest("GET", "/?format="+format, nil), rec)
+		c.SetParamNames("name")
+		c.SetParamValues(name)
+		return rec, h(c)
+	}
+
+	rec, err := preview("invite", "")
+	is.NoErr(err)
+	is.True(strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html"))
+	is.True(strings.Contains(rec.Body.String(), "https://"+Domain+"/invite/sample"))
+
+	rec, err = preview("invite_redeemed", "text")
+	is.NoErr(err)
+	is.True(strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain"))
+	is.True(strings.Contains(rec.Body.String(), "jane (jane@example.com)"))
+
+	rec, err = preview("invite_redeemed", "json")
+	is.NoErr(err)
+	var r templates.Rendered
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&r))
+	is.Equal(r.Subject, "Your Invite Was Accepted")
+
+	var httpErr *echo.HTTPError
+	_, err = preview("invite", "pdf")
+	is.True(errors.As(err, &httpErr))
+	is.Equal(httpErr.Code, http.StatusBadRequest)
+	_, err = preview("unknown", "")
+	is.True(errors.As(err, &httpErr))
+	is.Equal(httpErr.Code, http.StatusNotFound)
+}
@@ -1,7 +1,8 @@
 package app
 
 import (
-	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -11,17 +12,27 @@ import (
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"gopkg.hrry.dev/homelab/pkg/app/chat"
 	"gopkg.hrry.dev/homelab/pkg/auth"
+	"gopkg.hrry.dev/homelab/pkg/db"
 	"gopkg.hrry.dev/homelab/pkg/email"
 	"gopkg.hrry.dev/homelab/pkg/invite"
+	"gopkg.hrry.dev/homelab/pkg/session"
 )
 
 var (
 	ErrEmptyLogin           = &echo.HTTPError{Code: http.StatusBadRequest, Message: "empty login information"}
 	ErrInviteEmailMissmatch = &echo.HTTPError{Code: http.StatusForbidden, Message: "email does not match invitation"}
-	ErrInvalidTimeout       = &echo.HTTPError{Code: http.StatusBadRequest, Message: "invalid invite timeout"}
+	// ErrInviteEmailSuppressed is returned when the invite's email address
+	// has bounced or marked our emails as spam.
+	ErrInviteEmailSuppressed = &echo.HTTPError{Code: http.StatusUnprocessableEntity, Message: "email address cannot receive invites"}
+	ErrInvalidTimeout        = &echo.HTTPError{Code: http.StatusBadRequest, Message: "invalid invite timeout"}
+	ErrUserConflict          = &echo.HTTPError{Code: http.StatusConflict, Message: "user already exists"}
+	ErrInvalidUses           = &echo.HTTPError{Code: http.StatusBadRequest, Message: "invalid invite uses"}
 )
 
 type StrEncoder interface {
@@ -34,16 +45,29 @@ type PathBuilder interface {
 	GetID(*http.Request) string
 }
 
+// RoomJoiner adds users to chat rooms.
+type RoomJoiner interface {
+	GetRoom(ctx context.Context, id int) (*chat.Room, error)
+	AddMember(ctx context.Context, room, user int) error
+}
+
 type Invitations struct {
 	Path   PathBuilder
 	Mailer invite.Mailer
-	store  invite.Store
+	// Notifier is optional and is told when an invite is redeemed.
+	Notifier invite.Notifier
+	// Rooms is optional and used to add new users to the invite's chat rooms.
+	Rooms RoomJoiner
+	// DB is optional. When set, invites are created in a transaction with
+	// their queued emails.
+	DB    db.DB
+	store invite.Store
 }
 
-func NewInvitations(rdb redis.Cmdable, path PathBuilder, mailer invite.Mailer) *Invitations {
+func NewInvitations(store invite.Store, path PathBuilder, mailer invite.Mailer) *Invitations {
 	return &Invitations{
 		Path:   path,
-		store:  invite.NewStore(rdb, "invite"),
+		store:  store,
 		Mailer: mailer,
 	}
 }
@@ -51,6 +75,7 @@ func NewInvitations(rdb redis.Cmdable, path PathBuilder, mailer invite.Mailer) *
 const (
 	defaultInviteTTL     = 5
 	defaultInviteTimeout = time.Minute * 10
+	notifyTimeout        = time.Second * 10
 )
 
 // Create is the handler for people with accounts to create temporary invite links
@@ -65,7 +90,7 @@ func (iv *Invitations) Create() echo.HandlerFunc {
 		)
 
 		if claims == nil {
-			return echo.ErrUnauthorized.SetInternal(auth.ErrNoClaims)
+			return withInternal(echo.ErrUnauthorized, auth.ErrNoClaims)
 		}
 
 		// Read the params
@@ -79,58 +104,81 @@ func (iv *Invitations) Create() echo.HandlerFunc {
 
 		if !auth.IsAdmin(claims) {
 			// Disallow these parameters if the user is not an admin.
-			if p.TTL != 0 || p.Timeout != 0 || len(p.Roles) > 0 {
-				return echo.ErrUnauthorized.SetInternal(auth.ErrAdminRequired)
+			if p.TTL != 0 || p.Timeout != 0 || len(p.Roles) > 0 || p.Uses > 1 || len(p.Rooms) > 0 {
+				return withInternal(echo.ErrUnauthorized, auth.ErrAdminRequired)
 			}
 		} else {
 			if p.Timeout < 0 {
 				return ErrInvalidTimeout
 			}
+			if p.Uses < 0 {
+				return ErrInvalidUses
+			}
 			logger.WithFields(logrus.Fields{
 				"ttl":     p.TTL,
 				"timeout": fmt.Sprintf("%v", p.Timeout),
+				"uses":    p.Uses,
+				"rooms":   p.Rooms,
 			}).Debug("admin creating invite")
 		}
 
-		session, key, err := iv.store.Create(ctx, claims.UUID, &p)
+		var inv invite.Invitation
+		// When the mailer queues emails in the same database the invite is only
+		// created if its email was queued.
+		err = db.InTx(ctx, iv.DB, func(ctx context.Context) error {
+			return iv.create(ctx, claims, &p, &inv)
+		})
 		if err != nil {
-			return echo.ErrInternalServerError.SetInternal(err)
-		}
-		inv := invite.Invitation{
-			Path:         filepath.Join("/", iv.Path.Path(key)),
-			ExpiresAt:    time.UnixMilli(session.ExpiresAt),
-			CreatedBy:    claims.UUID,
-			TTL:          session.TTL,
-			Roles:        session.Roles,
-			Email:        session.Email,
-			ReceiverName: p.ReceiverName,
-			Domain:       Domain,
+			return err
 		}
+		return c.JSON(200, &inv)
+	}
+}
 
-		validEmail := email.Valid(inv.Email)
-		logger := logger.WithFields(logrus.Fields{
-			"path":          inv.Path,
-			"expires_at":    inv.ExpiresAt,
-			"email":         inv.Email,
-			"receiver_name": inv.ReceiverName,
-			"has_mailer":    iv.Mailer != nil,
-			"valid_email":   validEmail,
-		})
-		if iv.Mailer != nil && validEmail {
-			err = iv.Mailer.Send(ctx, &inv)
-			if err != nil {
-				return &echo.HTTPError{
-					Code:     http.StatusInternalServerError,
-					Message:  "failed to send email invite",
-					Internal: err,
-				}
+func (iv *Invitations) create(ctx context.Context, claims *auth.Claims, p *invite.CreateInviteRequest, inv *invite.Invitation) error {
+	session, key, err := iv.store.Create(ctx, claims.UUID, p)
+	if err != nil {
+		return withInternal(echo.ErrInternalServerError, err)
+	}
+	*inv = invite.Invitation{
+		Path:         filepath.Join("/", iv.Path.Path(key)),
+		ExpiresAt:    time.UnixMilli(session.ExpiresAt),
+		CreatedBy:    claims.UUID,
+		TTL:          session.TTL,
+		Roles:        session.Roles,
+		Email:        session.Email,
+		ReceiverName: p.ReceiverName,
+		MaxUses:      session.MaxUses,
+		Rooms:        session.Rooms,
+		Domain:       Domain,
+	}
+
+	validEmail := email.Valid(inv.Email)
+	logger := logger.WithFields(logrus.Fields{
+		"path":          inv.Path,
+		"expires_at":    inv.ExpiresAt,
+		"email":         inv.Email,
+		"receiver_name": inv.ReceiverName,
+		"has_mailer":    iv.Mailer != nil,
+		"valid_email":   validEmail,
+	})
+	if iv.Mailer != nil && validEmail {
+		err = iv.Mailer.Send(ctx, inv)
+		if errors.Is(err, email.ErrSuppressed) {
+			return withInternal(ErrInviteEmailSuppressed, err)
+		}
+		if err != nil {
+			return &echo.HTTPError{
+				Code:     http.StatusInternalServerError,
+				Message:  "failed to send email invite",
+				Internal: err,
 			}
-			logger.Info("emailing invitation")
-		} else {
-			logger.Info("not emailing invitation")
 		}
-		return c.JSON(200, &inv)
+		logger.Info("emailing invitation")
+	} else {
+		logger.Info("not emailing invitation")
 	}
+	return nil
 }
 
 func (iv *Invitations) Accept(body []byte, contentType string) echo.HandlerFunc {
@@ -147,6 +195,9 @@ func (iv *Invitations) Accept(body []byte, contentType string) echo.HandlerFunc
 		ExpiresAt int64
 		Path      string
 		TriesLeft int
+		// Flashes are one-shot messages left by the previous request.
+		Flashes   []session.Flash
+		CSRFToken string
 	}
 	return func(c echo.Context) error {
 		var (
@@ -156,12 +207,16 @@ func (iv *Invitations) Accept(body []byte, contentType string) echo.HandlerFunc
 		)
 		session, err := iv.store.View(ctx, id)
 		if err != nil {
-			return echo.ErrNotFound.SetInternal(err)
+			return withInternal(echo.ErrNotFound, err)
 		}
 		if session.ExpiresAt < 0 {
 			return echo.ErrForbidden
 		}
 		resp := c.Response()
+		flashes, token, err := pageSession(ctx, resp)
+		if err != nil {
+			return withInternal(echo.ErrInternalServerError, err)
+		}
 		resp.Header().Set("Content-Type", contentType)
 		resp.WriteHeader(200)
 		err = template.Execute(resp, &TemplateData{
@@ -169,9 +224,11 @@ func (iv *Invitations) Accept(body []byte, contentType string) echo.HandlerFunc
 			ExpiresAt: session.ExpiresAt,
 			Path:      iv.Path.Path(id),
 			TriesLeft: session.TTL,
+			Flashes:   flashes,
+			CSRFToken: token,
 		})
 		if err != nil {
-			return echo.ErrInternalServerError.SetInternal(err)
+			return withInternal(echo.ErrInternalServerError, err)
 		}
 		return nil
 	}
@@ -185,34 +242,64 @@ func (iv *Invitations) SignUp(users UserStore) echo.HandlerFunc {
 			key   = iv.Path.GetID(req)
 			login Login
 		)
+		// Checked before Get so that forged requests don't use up the
+		// invite's attempts.
+		if err := checkCSRF(c); err != nil {
+			return err
+		}
 		session, err := iv.store.Get(ctx, key)
 		if err != nil {
-			switch err {
-			case invite.ErrInviteTTL:
-				return echo.ErrForbidden.SetInternal(err)
-			case redis.Nil:
-				return echo.ErrNotFound.SetInternal(err)
+			switch {
+			case errors.Is(err, invite.ErrInviteTTL), errors.Is(err, invite.ErrInviteClosed):
+				return withInternal(echo.ErrForbidden, err)
+			case err == redis.Nil, err == sql.ErrNoRows, errors.Is(err, invite.ErrInviteNotFound):
+				return withInternal(echo.ErrNotFound, err)
 			}
-			return echo.ErrInternalServerError.SetInternal(err)
+			return withInternal(echo.ErrInternalServerError, err)
 		}
 
 		err = c.Bind(&login)
 		if err != nil {
-			return echo.ErrBadRequest.SetInternal(err)
+			return withInternal(echo.ErrBadRequest, err)
 		}
 		if len(login.Email) == 0 || len(login.Password) == 0 {
 			return ErrEmptyLogin
 		}
-		if len(session.Email) > 0 && session.Email != login.Email {
+		if len(session.Email) > 0 && email.Normalize(session.Email) != email.Normalize(login.Email) {
 			return ErrInviteEmailMissmatch
 		}
-		_, err = users.Create(ctx, login.Password, &User{
-			Email:    login.Email,
-			Username: login.Username,
-			Roles:    session.Roles,
+		var (
+			u        *User
+			redeemer = uuid.New()
+		)
+		// Claim one of the invite's uses before creating the account so that
+		// concurrent sign-ups cannot create more accounts than the invite
+		// allows. Stores that share the database are rolled back along with
+		// the new user.
+		err = db.InTx(ctx, iv.DB, func(ctx context.Context) error {
+			if err := iv.store.Redeem(ctx, key, redeemer); err != nil {
+				return err
+			}
+			var err error
+			u, err = users.Create(ctx, login.Password, &User{
+				UUID:     redeemer,
+				Email:    login.Email,
+				Username: login.Username,
+				Roles:    session.Roles,
+			})
+			if err != nil {
+				iv.release(ctx, key)
+			}
+			return err
 		})
 		if err != nil {
-			return echo.ErrInternalServerError.SetInternal(err)
+			switch {
+			case errors.Is(err, invite.ErrInviteClosed), errors.Is(err, invite.ErrInviteTTL):
+				return withInternal(echo.ErrForbidden, err)
+			case errors.Is(err, ErrUserExists):
+				return withInternal(ErrUserConflict, err)
+			}
+			return withInternal(echo.ErrInternalServerError, err)
 		}
 		logger.WithFields(logrus.Fields{
 			"email":     login.Email,
@@ -220,50 +307,137 @@ func (iv *Invitations) SignUp(users UserStore) echo.HandlerFunc {
 			"roles":     session.Roles,
 			"invite_id": key,
 		}).Info("invite account creation success")
-		// Cleanup on success
-		err = iv.store.Del(ctx, key)
-		if err != nil {
-			logger.WithError(err).Error("failed to destroy invite session")
+		iv.joinRooms(ctx, users, session.CreatedBy, u, session.Rooms)
+		if iv.Notifier != nil {
+			iv.notify(ctx, &invite.Event{
+				Type:      invite.EventRedeemed,
+				CreatedBy: session.CreatedBy,
+				Redeemer:  u.UUID,
+				Email:     u.Email,
+				Username:  u.Username,
+				Time:      time.Now(),
+			})
 		}
 		return nil
 	}
 }
 
+// release gives back the invite use claimed for an account that could not be
+// created. Stores in the same database are rolled back instead.
+func (iv *Invitations) release(ctx context.Context, key string) {
+	r, ok := iv.store.(invite.Releaser)
+	if !ok {
+		return
+	}
+	if err := r.Release(ctx, key); err != nil {
+		logger.WithError(err).Warn("failed to give back invite use")
+	}
+}
+
+// joinRooms adds a new user to the invite's chat rooms. Only rooms that the
+// invite's creator owns are joined unless the creator is an admin.
+func (iv *Invitations) joinRooms(ctx context.Context, users UserStore, creator uuid.UUID, u *User, rooms []int) {
+	if iv.Rooms == nil || len(rooms) == 0 {
+		return
+	}
+	owner, err := users.Get(ctx, creator)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error":   err,
+			"creator": creator,
+		}).Warn("failed to look up invite creator, not joining chat rooms")
+		return
+	}
+	admin := auth.IsAdmin(&auth.Claims{Roles: owner.Roles})
+	for _, room := range rooms {
+		if !admin {
+			r, err := iv.Rooms.GetRoom(ctx, room)
+			if err != nil || r.OwnerID != owner.ID {
+				logger.WithFields(logrus.Fields{
+					"error":   err,
+					"room":    room,
+					"creator": creator,
+				}).Warn("invite creator does not own chat room")
+				continue
+			}
+		}
+		err := iv.Rooms.AddMember(ctx, room, u.ID)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error": err,
+				"room":  room,
+				"user":  u.UUID,
+			}).Warn("failed to add invited user to chat room")
+		}
+	}
+}
+
+// notify tells the invite's creator about the new account. Notifiers should
+// queue deliveries instead of sending them so that sign-up is not held up.
+// Failures are logged because the account has already been created.
+func (iv *Invitations) notify(ctx context.Context, event *invite.Event) {
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	err := iv.Notifier.Notify(ctx, event)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error":      err,
+			"created_by": event.CreatedBy,
+			"redeemer":   event.Redeemer,
+		}).Warn("failed to send invite notifications")
+	}
+}
+
 type inviteList struct {
 	Invites []invite.Invitation `json:"invites"`
+	// Next is the cursor for the next page of invites.
+	Next string `json:"next,omitempty"`
 }
 
 func (iv *Invitations) List() echo.HandlerFunc {
+	type listQuery struct {
+		Cursor string `query:"cursor"`
+		Limit  int    `query:"limit"`
+		// optional filter for invite history
+		Status invite.Status `query:"status"`
+	}
 	return func(c echo.Context) error {
 		var (
-			resp   inviteList
-			ctx    = c.Request().Context()
-			claims = auth.GetClaims(c)
+			q        listQuery
+			resp     inviteList
+			sessions []*invite.Session
+			ctx      = c.Request().Context()
+			claims   = auth.GetClaims(c)
 		)
 		if claims == nil {
 			return echo.ErrUnauthorized
 		}
-		sessions, err := iv.store.List(ctx)
+		err := c.Bind(&q)
 		if err != nil {
-			return echo.ErrInternalServerError.SetInternal(err)
+			return withInternal(echo.ErrBadRequest, err)
 		}
-
-		resp.Invites = make([]invite.Invitation, 0, len(sessions))
+		switch q.Status {
+		case "", invite.StatusPending, invite.StatusRedeemed, invite.StatusExpired, invite.StatusRevoked:
+		default:
+			return echo.ErrBadRequest
+		}
+		opts := invite.ListOptions{Cursor: q.Cursor, Limit: q.Limit, Status: q.Status}
 		if auth.IsAdmin(claims) {
-			for _, s := range sessions {
-				inv := invite.Invitation{Path: iv.Path.Path(s.ID)}
-				setInviteFromSession(&inv, s)
-				resp.Invites = append(resp.Invites, inv)
-			}
+			sessions, resp.Next, err = iv.store.List(ctx, &opts)
 		} else {
-			for _, s := range sessions {
-				if !bytes.Equal(s.CreatedBy[:], claims.UUID[:]) {
-					continue
-				}
-				inv := invite.Invitation{Path: iv.Path.Path(s.ID)}
-				setInviteFromSession(&inv, s)
-				resp.Invites = append(resp.Invites, inv)
-			}
+			sessions, resp.Next, err = iv.store.ListByCreator(ctx, claims.UUID, &opts)
+		}
+		if err == invite.ErrInvalidCursor {
+			return withInternal(echo.ErrBadRequest, err)
+		} else if err != nil {
+			return withInternal(echo.ErrInternalServerError, err)
+		}
+
+		resp.Invites = make([]invite.Invitation, 0, len(sessions))
+		for _, s := range sessions {
+			inv := invite.Invitation{Path: iv.Path.Path(s.ID)}
+			setInviteFromSession(&inv, s)
+			resp.Invites = append(resp.Invites, inv)
 		}
 		return c.JSON(200, resp)
 	}
@@ -275,6 +449,27 @@ func setInviteFromSession(inv *invite.Invitation, s *invite.Session) {
 	inv.ExpiresAt = time.UnixMilli(s.ExpiresAt)
 	inv.Roles = s.Roles
 	inv.TTL = s.TTL
+	inv.ReceiverName = s.ReceiverName
+	inv.MaxUses = s.MaxUses
+	inv.Uses = s.Uses
+	inv.Rooms = s.Rooms
+	inv.Status = sessionStatus(s)
+	if s.RedeemedBy != uuid.Nil {
+		redeemedBy := s.RedeemedBy
+		inv.RedeemedBy = &redeemedBy
+	}
+	if !s.RedeemedAt.IsZero() {
+		redeemedAt := s.RedeemedAt
+		inv.RedeemedAt = &redeemedAt
+	}
+}
+
+func sessionStatus(s *invite.Session) invite.Status {
+	if len(s.Status) == 0 {
+		// Stores without history only ever hold pending invites.
+		return invite.StatusPending
+	}
+	return s.Status
 }
 
 func (iv *Invitations) Delete() echo.HandlerFunc {
@@ -290,3 +485,9 @@ func (iv *Invitations) Delete() echo.HandlerFunc {
 		return iv.store.OwnerDel(ctx, id, claims.UUID)
 	}
 }
+
+// withInternal copies a shared HTTP error before attaching the internal
+// error so that concurrent requests never write to the same error value.
+func withInternal(he *echo.HTTPError, err error) *echo.HTTPError {
+	return &echo.HTTPError{Code: he.Code, Message: he.Message, Internal: err}
+}
@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"net/http/httptest"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -19,13 +21,14 @@ import (
 	"github.com/lib/pq"
 	"github.com/matryer/is"
 	"github.com/pkg/errors"
+	"gopkg.hrry.dev/homelab/pkg/app/chat"
 	"gopkg.hrry.dev/homelab/pkg/auth"
 	"gopkg.hrry.dev/homelab/pkg/email"
 	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockdb"
 	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockinvite"
 	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockredis"
-	"gopkg.hrry.dev/homelab/pkg/internal/mockutil"
 	"gopkg.hrry.dev/homelab/pkg/invite"
+	"gopkg.hrry.dev/homelab/pkg/session"
 )
 
 type testPath struct {
@@ -54,6 +57,7 @@ func TestInviteCreate(t *testing.T) {
 		body     invite.CreateInviteRequest
 		expected error
 		internal error
+		mailErr  error
 	}
 
 	for i, tt := range []table{
@@ -123,6 +127,43 @@ func TestInviteCreate(t *testing.T) {
 			expected: ErrInvalidTimeout,
 			internal: nil,
 		},
+		{
+			// Admin can create group invites
+			id:     "6",
+			claims: &auth.Claims{Roles: []auth.Role{auth.RoleAdmin}},
+			body:   invite.CreateInviteRequest{Uses: 4, Rooms: []int{1, 2}},
+		},
+		{
+			id:       "61",
+			claims:   &auth.Claims{Roles: []auth.Role{auth.RoleAdmin}},
+			body:     invite.CreateInviteRequest{Uses: -1},
+			expected: ErrInvalidUses,
+		},
+		{
+			// Regular user not allowed to create group invites
+			id:       "62",
+			claims:   &auth.Claims{Roles: []auth.Role{auth.RoleDefault}},
+			body:     invite.CreateInviteRequest{Uses: 2},
+			expected: echo.ErrUnauthorized,
+			internal: auth.ErrAdminRequired,
+		},
+		{
+			// Regular user not allowed to add chat rooms
+			id:       "63",
+			claims:   &auth.Claims{Roles: []auth.Role{auth.RoleDefault}},
+			body:     invite.CreateInviteRequest{Rooms: []int{1}},
+			expected: echo.ErrUnauthorized,
+			internal: auth.ErrAdminRequired,
+		},
+		{
+			// Address has bounced before
+			id:       "7",
+			claims:   &auth.Claims{Roles: []auth.Role{auth.RoleAdmin}},
+			body:     invite.CreateInviteRequest{Email: "bounced@t.com"},
+			expected: ErrInviteEmailSuppressed,
+			internal: email.ErrSuppressed,
+			mailErr:  email.ErrSuppressed,
+		},
 	} {
 		tt := tt
 		i := i
@@ -159,14 +200,18 @@ func TestInviteCreate(t *testing.T) {
 			if tt.body.Timeout == 0 {
 				tt.body.Timeout = defaultInviteTimeout
 			}
+			maxUses := tt.body.Uses
+			if maxUses <= 0 {
+				maxUses = 1
+			}
 			if tt.body.TTL == 0 {
-				tt.body.TTL = defaultInviteTTL
+				tt.body.TTL = defaultInviteTTL * maxUses
 			}
 			roles := make([]auth.Role, len(tt.body.Roles))
 			for i, r := range tt.body.Roles {
 				roles[i] = auth.ParseRole(r)
 			}
-			if tt.expected == nil {
+			if tt.expected == nil || tt.mailErr != nil {
 				expires := tm.Add(tt.body.Timeout).UnixMilli()
 				expectedSession, err := json.Marshal(&invite.Session{
 					CreatedBy: tt.claims.UUID,
@@ -174,11 +219,16 @@ func TestInviteCreate(t *testing.T) {
 					ExpiresAt: expires,
 					Email:     tt.body.Email,
 					Roles:     roles,
+					MaxUses:   maxUses,
+					Rooms:     tt.body.Rooms,
 				})
 				is.NoErr(err)
 				rdb.EXPECT().
-					Set(ctx, mockutil.HasPrefix("invite:"), expectedSession, tt.body.Timeout).
-					Return(redis.NewStatusResult("", nil))
+					Eval(ctx, gomock.Any(),
+						[]string{"invite:" + tt.id, "invite-index", "invite-index:" + tt.claims.UUID.String()},
+						expectedSession, tt.body.Timeout.Milliseconds(), tt.id,
+					).
+					Return(redis.NewCmdResult(int64(1), nil))
 				if email.Valid(tt.body.Email) {
 					mailer.EXPECT().Send(ctx, &invite.Invitation{
 						Path:         "/invite/" + tt.id,
@@ -188,12 +238,13 @@ func TestInviteCreate(t *testing.T) {
 						CreatedBy:    tt.claims.UUID,
 						TTL:          tt.body.TTL,
 						Roles:        roles,
+						MaxUses:      maxUses,
 						Domain:       Domain,
-					}).Return(nil)
+					}).Return(tt.mailErr)
 				}
 			}
 			err := invites.Create()(c)
-			is.True(errors.Is(err, tt.expected))
+			is.True(isHTTPError(err, tt.expected))
 			if httpErr, ok := err.(*echo.HTTPError); ok && tt.internal != nil {
 				is.True(errors.Is(httpErr.Internal, tt.internal))
 			}
@@ -303,7 +354,7 @@ func TestInviteAccept(t *testing.T) {
 				tt.mocks(t, rdb, tt.session)
 			}
 			err := handler(c)
-			is.True(errors.Is(tt.expected, err))
+			is.True(isHTTPError(err, tt.expected))
 			if httpErr, ok := err.(*echo.HTTPError); ok && tt.internal != nil {
 				is.True(errors.Is(httpErr.Internal, tt.internal))
 			}
@@ -334,25 +385,79 @@ func TestInviteSignUp(t *testing.T) {
 		session            *invite.Session
 		mocks              func(t *testing.T, tt *table, mocks *mocks)
 		login              *Login
+		// creator is the user that made the invite
+		creator *User
+		joined  []int
+		// browser sends a session cookie without the session's CSRF token
+		browser bool
 	}
 
+	// mockSessionUpdate expects the invite that was read to be saved with
+	// one less view.
 	mockSessionUpdate := func(t *testing.T, rdb *mockredis.MockCmdable, session *invite.Session) *gomock.Call {
+		raw, err := json.Marshal(session)
+		if err != nil {
+			t.Fatal(err)
+		}
 		s := *session
 		s.TTL--
-		raw, err := json.Marshal(s)
+		updated, err := json.Marshal(&s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rdb.EXPECT().Eval(context.Background(), gomock.Any(), []string{"invite:444"}, string(raw), updated)
+	}
+	// mockSessionUses expects the invite to be read and saved with a
+	// different number of uses.
+	mockSessionUses := func(t *testing.T, rdb *mockredis.MockCmdable, session *invite.Session, delta int) {
+		raw, err := json.Marshal(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := *session
+		s.Uses += delta
+		updated, err := json.Marshal(&s)
 		if err != nil {
 			t.Fatal(err)
 		}
-		return rdb.EXPECT().Set(
-			context.Background(),
-			"invite:444",
-			raw,
-			time.Duration(redis.KeepTTL),
+		gomock.InOrder(
+			rdb.EXPECT().Get(context.Background(), "invite:444").Return(redis.NewStringResult(string(raw), nil)),
+			rdb.EXPECT().Eval(context.Background(), gomock.Any(), []string{"invite:444"}, string(raw), updated).
+				Return(redis.NewCmdResult(int64(1), nil)),
+		)
+	}
+	mockSignUp := func(t *testing.T, tt *table, mocks *mocks) {
+		ctx := context.Background()
+		mockSessionGet(t, mocks.rdb, gomock.Eq("invite:444"), tt.session)
+		mockSessionUses(t, mocks.rdb, tt.session, 1)
+		gomock.InOrder(
+			mocks.db.EXPECT().QueryContext(
+				ctx, createUserQuery,
+				gomock.Any(), // uuid
+				tt.login.Username,
+				tt.login.Email,
+				gomock.Any(), // password hash
+				pq.Array(tt.session.Roles),
+				gomock.Any(), // totp secret
+			).Return(mocks.rows, nil),
+			mocks.rows.EXPECT().Next().Return(true),
+			mocks.rows.EXPECT().Scan(
+				gomock.AssignableToTypeOf(intptr),
+				gomock.AssignableToTypeOf(&time.Time{}),
+				gomock.AssignableToTypeOf(&time.Time{}),
+			).Return(nil),
+			mocks.rows.EXPECT().Close().Return(nil),
 		)
 	}
 	randomError := errors.New("this is some random error")
 
 	for i, tt := range []table{
+		{
+			name:     "missing csrf token",
+			expected: ErrInvalidCSRF,
+			login:    &Login{Email: "a@a.it", Password: "123"},
+			browser:  true,
+		},
 		{
 			name:     "session not found",
 			expected: echo.ErrNotFound,
@@ -381,7 +486,7 @@ func TestInviteSignUp(t *testing.T) {
 			internal: redis.Nil,
 			mocks: func(t *testing.T, tt *table, mocks *mocks) {
 				mockSessionGet(t, mocks.rdb, gomock.Eq("invite:444"), tt.session)
-				mockSessionUpdate(t, mocks.rdb, tt.session).Return(redis.NewStatusResult("", redis.Nil))
+				mockSessionUpdate(t, mocks.rdb, tt.session).Return(redis.NewCmdResult(nil, redis.Nil))
 			},
 		},
 		{
@@ -390,7 +495,7 @@ func TestInviteSignUp(t *testing.T) {
 			expected: echo.ErrBadRequest,
 			mocks: func(t *testing.T, tt *table, mocks *mocks) {
 				mockSessionGet(t, mocks.rdb, gomock.Eq("invite:444"), tt.session)
-				mockSessionUpdate(t, mocks.rdb, tt.session).Return(redis.NewStatusResult("", nil))
+				mockSessionUpdate(t, mocks.rdb, tt.session).Return(redis.NewCmdResult(int64(1), nil))
 			},
 		},
 		{
@@ -400,7 +505,7 @@ func TestInviteSignUp(t *testing.T) {
 			expected: ErrEmptyLogin,
 			mocks: func(t *testing.T, tt *table, mocks *mocks) {
 				mockSessionGet(t, mocks.rdb, gomock.Eq("invite:444"), tt.session)
-				mockSessionUpdate(t, mocks.rdb, tt.session).Return(redis.NewStatusResult("", nil))
+				mockSessionUpdate(t, mocks.rdb, tt.session).Return(redis.NewCmdResult(int64(1), nil))
 			},
 		},
 		{
@@ -419,7 +524,17 @@ func TestInviteSignUp(t *testing.T) {
 			expected: ErrInviteEmailMissmatch,
 			mocks: func(t *testing.T, tt *table, mocks *mocks) {
 				mockSessionGet(t, mocks.rdb, gomock.Eq("invite:444"), tt.session)
-				mockSessionUpdate(t, mocks.rdb, tt.session).Return(redis.NewStatusResult("", nil))
+				mockSessionUpdate(t, mocks.rdb, tt.session).Return(redis.NewCmdResult(int64(1), nil))
+			},
+		},
+		{
+			name:     "invite used up by another sign-up",
+			session:  &invite.Session{TTL: -1},
+			login:    &Login{Email: "a@a.it", Password: "123", Username: "test-user"},
+			expected: echo.ErrForbidden, internal: invite.ErrInviteClosed,
+			mocks: func(t *testing.T, tt *table, mocks *mocks) {
+				mockSessionGet(t, mocks.rdb, gomock.Eq("invite:444"), tt.session)
+				mocks.rdb.EXPECT().Get(context.Background(), "invite:444").Return(redis.NewStringResult("", redis.Nil))
 			},
 		},
 		{
@@ -429,6 +544,11 @@ func TestInviteSignUp(t *testing.T) {
 			expected: echo.ErrInternalServerError, internal: randomError,
 			mocks: func(t *testing.T, tt *table, mocks *mocks) {
 				mockSessionGet(t, mocks.rdb, gomock.Eq("invite:444"), tt.session)
+				mockSessionUses(t, mocks.rdb, tt.session, 1)
+				// The use is given back
+				used := *tt.session
+				used.Uses++
+				mockSessionUses(t, mocks.rdb, &used, -1)
 				mocks.db.EXPECT().QueryContext(
 					context.Background(), createUserQuery,
 					gomock.Any(),
@@ -439,33 +559,42 @@ func TestInviteSignUp(t *testing.T) {
 			},
 		},
 		{
-			name:    "success",
-			session: &invite.Session{TTL: -1, Roles: []auth.Role{auth.RoleAdmin, auth.RoleDefault}},
-			login:   &Login{Email: "a@a.it", Password: "123", Username: "test-user"},
+			name:     "username taken",
+			session:  &invite.Session{TTL: -1},
+			login:    &Login{Email: "a@a.it", Password: "123", Username: "Test-User"},
+			expected: ErrUserConflict, internal: ErrUserExists,
 			mocks: func(t *testing.T, tt *table, mocks *mocks) {
-				ctx := context.Background()
-				gomock.InOrder(
-					mockSessionGet(t, mocks.rdb, gomock.Eq("invite:444"), tt.session),
-					mocks.db.EXPECT().QueryContext(
-						ctx, createUserQuery,
-						gomock.Any(), // uuid
-						tt.login.Username,
-						tt.login.Email,
-						gomock.Any(), // password hash
-						pq.Array(tt.session.Roles),
-						gomock.Any(), // totp secret
-					).Return(mocks.rows, nil),
-					mocks.rows.EXPECT().Next().Return(true),
-					mocks.rows.EXPECT().Scan(
-						gomock.AssignableToTypeOf(intptr),
-						gomock.AssignableToTypeOf(&time.Time{}),
-						gomock.AssignableToTypeOf(&time.Time{}),
-					).Return(nil),
-					mocks.rows.EXPECT().Close().Return(nil),
-					mocks.rdb.EXPECT().Del(ctx, gomock.Eq("invite:444")).Return(redis.NewIntResult(1, nil)),
-				)
+				mockSessionGet(t, mocks.rdb, gomock.Eq("invite:444"), tt.session)
+				mockSessionUses(t, mocks.rdb, tt.session, 1)
+				// The use is given back
+				used := *tt.session
+				used.Uses++
+				mockSessionUses(t, mocks.rdb, &used, -1)
+				mocks.db.EXPECT().QueryContext(
+					context.Background(), createUserQuery,
+					gomock.Any(),
+					tt.login.Username,
+					tt.login.Email,
+					gomock.Any(), gomock.Any(), gomock.Any(),
+				).Return(nil, &pq.Error{Code: pqUniqueViolation, Constraint: "ux_user_username_lower"})
 			},
 		},
+		{
+			name:    "success",
+			session: &invite.Session{TTL: -1, Roles: []auth.Role{auth.RoleAdmin, auth.RoleDefault}, Rooms: []int{3, 9}},
+			login:   &Login{Email: "a@a.it", Password: "123", Username: "test-user"},
+			creator: &User{ID: 1, Roles: []auth.Role{auth.RoleAdmin}},
+			joined:  []int{3, 9},
+			mocks:   mockSignUp,
+		},
+		{
+			name:    "creator does not own every room",
+			session: &invite.Session{TTL: -1, Roles: []auth.Role{auth.RoleDefault}, Rooms: []int{3, 9}},
+			login:   &Login{Email: "a@a.it", Password: "123", Username: "test-user"},
+			creator: &User{ID: 2, Roles: []auth.Role{auth.RoleDefault}},
+			joined:  []int{9},
+			mocks:   mockSignUp,
+		},
 	} {
 		t.Run(fmt.Sprintf("%s_%d_%s", t.Name(), i, tt.name), func(t *testing.T) {
 			ctx := context.Background()
@@ -475,9 +604,11 @@ func TestInviteSignUp(t *testing.T) {
 			db := mockdb.NewMockDB(ctrl)
 			mailer := mockinvite.NewMockMailer(ctrl)
 			rows := mockdb.NewMockRows(ctrl)
+			rooms := &testRooms{owners: map[int]int{3: 1, 9: 2}}
 			invites := Invitations{
 				Path:   &testPath{p: "invite"},
 				Mailer: mailer,
+				Rooms:  rooms,
 				store: &invite.SessionStore{
 					RDB:    rdb,
 					Prefix: "invite",
@@ -485,6 +616,12 @@ func TestInviteSignUp(t *testing.T) {
 			}
 			defer ctrl.Finish()
 
+			if tt.browser {
+				ss := testSessionManager().NewSession(&SessionData{})
+				_, err := ss.CSRFToken()
+				is.NoErr(err)
+				ctx = session.StashInContext(ctx, ss)
+			}
 			req := httptest.NewRequest("POST", "/invite/444", body(tt.login)).WithContext(ctx)
 			if tt.login != nil {
 				req.Header.Set("Content-Type", "application/json")
@@ -495,8 +632,8 @@ func TestInviteSignUp(t *testing.T) {
 			if tt.mocks != nil {
 				tt.mocks(t, &tt, &mocks{rdb: rdb, db: db, rows: rows})
 			}
-			err := invites.SignUp(NewUserStore(db))(c)
-			is.True(errors.Is(tt.expected, err))
+			err := invites.SignUp(&testUsers{UserStore: NewUserStore(db), creator: tt.creator})(c)
+			is.True(isHTTPError(err, tt.expected))
 			if httpErr, ok := err.(*echo.HTTPError); ok && tt.internal != nil {
 				is.True(errors.Is(httpErr.Internal, tt.internal))
 			}
@@ -507,10 +644,152 @@ func TestInviteSignUp(t *testing.T) {
 			// is.Equal(rec.Code, http.StatusPermanentRedirect)
 			// is.Equal(rec.Header().Get("location"), "/")
 			is.Equal(rec.Code, http.StatusOK)
+			is.Equal(rooms.joined, tt.joined)
 		})
 	}
 }
 
+func TestInviteSignUpConcurrent(t *testing.T) {
+	const signups = 8
+	is := is.New(t)
+	store := &testInviteStore{session: invite.Session{TTL: -1, MaxUses: 1, Roles: []auth.Role{auth.RoleAdmin}}}
+	// Every sign-up sees the invite as unused before any of them redeem it.
+	store.ready.Add(signups)
+	users := &testUsers{}
+	notifier := &testNotifier{}
+	invites := Invitations{Path: &testPath{p: "invite"}, store: store, Notifier: notifier}
+
+	var (
+		wg    sync.WaitGroup
+		codes = make(chan int, signups)
+	)
+	for i := 0; i < signups; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			login := &Login{Email: fmt.Sprintf("user%d@example.com", i), Password: "password1"}
+			req := httptest.NewRequest("POST", "/invite/444", body(login))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			err := invites.SignUp(users)(echo.New().NewContext(req, rec))
+			if err != nil {
+				var httpErr *echo.HTTPError
+				if errors.As(err, &httpErr) {
+					codes <- httpErr.Code
+					return
+				}
+				t.Error(err)
+				return
+			}
+			codes <- rec.Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+	var ok, forbidden int
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			ok++
+		case http.StatusForbidden:
+			forbidden++
+		}
+	}
+	is.Equal(ok, 1)
+	is.Equal(forbidden, signups-1)
+	is.Equal(len(users.created), 1)
+	is.Equal(store.session.Uses, 1)
+	// The creator is notified before the request finishes.
+	is.Equal(len(notifier.events), 1)
+	is.Equal(notifier.events[0].Email, users.created[0].Email)
+}
+
+type testNotifier struct {
+	mu     sync.Mutex
+	events []*invite.Event
+}
+
+func (tn *testNotifier) Notify(_ context.Context, event *invite.Event) error {
+	tn.mu.Lock()
+	defer tn.mu.Unlock()
+	tn.events = append(tn.events, event)
+	return nil
+}
+
+// testInviteStore counts uses the same way that the database stores do.
+type testInviteStore struct {
+	invite.Store
+	ready   sync.WaitGroup
+	mu      sync.Mutex
+	session invite.Session
+}
+
+func (ts *testInviteStore) Get(context.Context, string) (*invite.Session, error) {
+	ts.mu.Lock()
+	s := ts.session
+	ts.mu.Unlock()
+	ts.ready.Done()
+	ts.ready.Wait()
+	if s.Uses >= s.MaxUses {
+		return nil, invite.ErrInviteClosed
+	}
+	return &s, nil
+}
+
+func (ts *testInviteStore) Redeem(context.Context, string, uuid.UUID) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.session.Uses >= ts.session.MaxUses {
+		return invite.ErrInviteClosed
+	}
+	ts.session.Uses++
+	return nil
+}
+
+type testUsers struct {
+	UserStore
+	mu      sync.Mutex
+	created []*User
+	creator *User
+}
+
+func (tu *testUsers) Get(context.Context, uuid.UUID) (*User, error) {
+	if tu.creator == nil {
+		return nil, ErrUserNotFound
+	}
+	return tu.creator, nil
+}
+
+func (tu *testUsers) Create(ctx context.Context, password string, u *User) (*User, error) {
+	if tu.UserStore != nil {
+		return tu.UserStore.Create(ctx, password, u)
+	}
+	tu.mu.Lock()
+	defer tu.mu.Unlock()
+	u.ID = len(tu.created) + 1
+	tu.created = append(tu.created, u)
+	return u, nil
+}
+
+type testRooms struct {
+	// owners maps room IDs to the user that owns the room.
+	owners map[int]int
+	joined []int
+}
+
+func (tr *testRooms) GetRoom(_ context.Context, id int) (*chat.Room, error) {
+	owner, ok := tr.owners[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &chat.Room{ID: id, OwnerID: owner}, nil
+}
+
+func (tr *testRooms) AddMember(_ context.Context, room, _ int) error {
+	tr.joined = append(tr.joined, room)
+	return nil
+}
+
 func TestInviteDelete(t *testing.T) {
 	type table struct {
 		name               string
@@ -533,7 +812,6 @@ func TestInviteDelete(t *testing.T) {
 			claims:   &auth.Claims{UUID: uuid.MustParse("c310417d-4d00-458d-927d-d4416d10c68f")},
 			session:  &invite.Session{CreatedBy: uuid.MustParse("c310417d-4d00-458d-927d-d4416d10c68f")},
 			expected: echo.ErrNotFound,
-			internal: redis.Nil,
 			mocks: func(t *testing.T, rdb *mockredis.MockCmdable, tt *table) {
 				rdb.EXPECT().Get(
 					context.Background(),
@@ -599,7 +877,7 @@ func TestInviteDelete(t *testing.T) {
 				tt.mocks(t, rdb, &tt)
 			}
 			err := invites.Delete()(c)
-			is.True(errors.Is(tt.expected, err)) // should have expected error
+			is.True(isHTTPError(err, tt.expected)) // should have expected error
 			if httpErr, ok := err.(*echo.HTTPError); ok && tt.internal != nil {
 				is.True(errors.Is(httpErr.Internal, tt.internal))
 			}
@@ -617,6 +895,7 @@ func TestInviteList(t *testing.T) {
 		claims             *auth.Claims
 		inviteList         *inviteList
 		sessions           []invite.Session
+		query              string
 		mock               func(rdb *mockredis.MockCmdable, tt *table, sessions []invite.Session)
 	}
 	for i, tt := range []table{
@@ -625,26 +904,34 @@ func TestInviteList(t *testing.T) {
 			expected: echo.ErrUnauthorized,
 		},
 		{
-			name:     "failed getting keys",
+			name:     "failed scanning index",
 			expected: echo.ErrInternalServerError,
 			internal: redis.Nil,
 			claims:   new(auth.Claims),
 			mock: func(rdb *mockredis.MockCmdable, tt *table, sessions []invite.Session) {
-				rdb.EXPECT().Keys(context.Background(), "invite:*").
-					Return(redis.NewStringSliceResult(nil, redis.Nil))
+				rdb.EXPECT().SScan(context.Background(), "invite-index:"+uuid.Nil.String(), uint64(0), "", int64(50)).
+					Return(redis.NewScanCmdResult(nil, 0, redis.Nil))
 			},
 		},
+		{
+			name:     "bad cursor",
+			expected: echo.ErrBadRequest,
+			internal: invite.ErrInvalidCursor,
+			claims:   new(auth.Claims),
+			query:    "?cursor=abc",
+		},
 		{
 			name:       "no sessions",
 			inviteList: &inviteList{},
 			claims:     &auth.Claims{},
 			mock: func(rdb *mockredis.MockCmdable, tt *table, sessions []invite.Session) {
-				rdb.EXPECT().Keys(context.Background(), "invite:*").
-					Return(redis.NewStringSliceResult([]string{}, nil))
+				rdb.EXPECT().SScan(context.Background(), "invite-index:"+uuid.Nil.String(), uint64(0), "", int64(50)).
+					Return(redis.NewScanCmdResult([]string{}, 0, nil))
 			},
 		},
 		{
-			name: "list as admin",
+			name:  "list as admin",
+			query: "?cursor=5&limit=2",
 			claims: &auth.Claims{
 				UUID:  uuid.MustParse("e5ccb6f1-816f-4d67-821b-64be606af220"),
 				Roles: []auth.Role{auth.RoleAdmin},
@@ -662,6 +949,7 @@ func TestInviteList(t *testing.T) {
 						ExpiresAt: time.UnixMilli(1000000),
 					},
 				},
+				Next: "7",
 			},
 			sessions: []invite.Session{
 				{
@@ -679,8 +967,8 @@ func TestInviteList(t *testing.T) {
 					"invite:1",
 					"invite:2",
 				}
-				rdb.EXPECT().Keys(ctx, "invite:*").
-					Return(redis.NewStringSliceResult(keys, nil))
+				rdb.EXPECT().SScan(ctx, "invite-index", uint64(5), "", int64(2)).
+					Return(redis.NewScanCmdResult([]string{"1", "2"}, 7, nil))
 				raw := make([]interface{}, len(tt.sessions))
 				for i, s := range tt.sessions {
 					b, err := json.Marshal(s)
@@ -709,14 +997,6 @@ func TestInviteList(t *testing.T) {
 				},
 			},
 			sessions: []invite.Session{
-				{
-					CreatedBy: uuid.MustParse("aabbccdd-816f-4d67-821b-64be606af220"),
-					ExpiresAt: 1,
-				},
-				{
-					CreatedBy: uuid.MustParse("eeff1122-816f-4d67-821b-64be606af220"),
-					ExpiresAt: 1,
-				},
 				{
 					CreatedBy: uuid.MustParse("e5ccb6f1-816f-4d67-821b-64be606af220"),
 					ExpiresAt: 123,
@@ -724,9 +1004,9 @@ func TestInviteList(t *testing.T) {
 			},
 			mock: func(rdb *mockredis.MockCmdable, tt *table, sessions []invite.Session) {
 				ctx := context.Background()
-				keys := []string{"invite:1", "invite:2", "invite:3"}
-				rdb.EXPECT().Keys(ctx, "invite:*").
-					Return(redis.NewStringSliceResult(keys, nil))
+				keys := []string{"invite:3"}
+				rdb.EXPECT().SScan(ctx, "invite-index:"+tt.claims.UUID.String(), uint64(0), "", int64(50)).
+					Return(redis.NewScanCmdResult([]string{"3"}, 0, nil))
 				raw := make([]interface{}, len(tt.sessions))
 				for i, s := range tt.sessions {
 					b, err := json.Marshal(s)
@@ -735,7 +1015,7 @@ func TestInviteList(t *testing.T) {
 					}
 					raw[i] = string(b)
 				}
-				rdb.EXPECT().MGet(ctx, keys[0], keys[1], keys[2]).
+				rdb.EXPECT().MGet(ctx, keys[0]).
 					Return(redis.NewSliceResult(raw, nil))
 			},
 		},
@@ -753,7 +1033,7 @@ func TestInviteList(t *testing.T) {
 			}
 			defer ctrl.Finish()
 
-			req := httptest.NewRequest("GET", "/invite/list", nil).WithContext(ctx)
+			req := httptest.NewRequest("GET", "/invite/list"+tt.query, nil).WithContext(ctx)
 			rec := httptest.NewRecorder()
 			c := echo.New().NewContext(req, rec)
 			c.Set(string(auth.ClaimsContextKey), tt.claims)
@@ -761,7 +1041,7 @@ func TestInviteList(t *testing.T) {
 				tt.mock(rdb, &tt, nil)
 			}
 			err := invites.List()(c)
-			is.True(errors.Is(tt.expected, err))
+			is.True(isHTTPError(err, tt.expected))
 			if httpErr, ok := err.(*echo.HTTPError); ok && tt.internal != nil {
 				is.True(errors.Is(httpErr.Internal, tt.internal))
 			}
@@ -772,6 +1052,7 @@ func TestInviteList(t *testing.T) {
 			err = json.Unmarshal(rec.Body.Bytes(), &list)
 			is.NoErr(err)
 			is.Equal(len(list.Invites), len(tt.inviteList.Invites))
+			is.Equal(list.Next, tt.inviteList.Next)
 			for i := range list.Invites {
 				is.Equal(list.Invites[i].CreatedBy, tt.inviteList.Invites[i].CreatedBy)
 				is.Equal(list.Invites[i].Path, tt.inviteList.Invites[i].Path)
@@ -781,6 +1062,71 @@ func TestInviteList(t *testing.T) {
 	}
 }
 
+func TestInviteList_creators(t *testing.T) {
+	var (
+		mine   = uuid.MustParse("e5ccb6f1-816f-4d67-821b-64be606af220")
+		theirs = uuid.MustParse("aabbccdd-816f-4d67-821b-64be606af220")
+		store  = &listInviteStore{sessions: []*invite.Session{
+			{ID: "1", CreatedBy: mine},
+			{ID: "2", CreatedBy: theirs},
+			{ID: "3", CreatedBy: mine},
+		}}
+		invites = Invitations{Path: &testPath{p: "invite"}, store: store}
+	)
+	list := func(t *testing.T, claims *auth.Claims) []string {
+		t.Helper()
+		is := is.New(t)
+		req := httptest.NewRequest("GET", "/api/invites", nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.Set(string(auth.ClaimsContextKey), claims)
+		is.NoErr(invites.List()(c))
+		is.Equal(rec.Code, http.StatusOK)
+		var resp inviteList
+		is.NoErr(json.Unmarshal(rec.Body.Bytes(), &resp))
+		paths := make([]string, len(resp.Invites))
+		for i, inv := range resp.Invites {
+			paths[i] = inv.Path
+		}
+		return paths
+	}
+	is := is.New(t)
+	is.Equal(list(t, &auth.Claims{UUID: mine, Roles: []auth.Role{auth.RoleDefault}}), []string{"/invite/1", "/invite/3"})
+	is.Equal(list(t, &auth.Claims{UUID: theirs, Roles: []auth.Role{auth.RoleFamily}}), []string{"/invite/2"})
+	is.Equal(list(t, &auth.Claims{UUID: uuid.New(), Roles: []auth.Role{auth.RoleAdmin}}), []string{"/invite/1", "/invite/2", "/invite/3"})
+}
+
+// listInviteStore lists invites from memory.
+type listInviteStore struct {
+	invite.Store
+	sessions []*invite.Session
+}
+
+func (ls *listInviteStore) List(context.Context, *invite.ListOptions) ([]*invite.Session, string, error) {
+	return ls.sessions, "", nil
+}
+
+func (ls *listInviteStore) ListByCreator(_ context.Context, creator uuid.UUID, _ *invite.ListOptions) ([]*invite.Session, string, error) {
+	var sessions []*invite.Session
+	for _, s := range ls.sessions {
+		if s.CreatedBy == creator {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, "", nil
+}
+
+// isHTTPError reports whether err is expected. Handlers copy shared HTTP
+// errors before attaching an internal error, so those match by code and
+// message.
+func isHTTPError(err, expected error) bool {
+	var got, want *echo.HTTPError
+	if errors.As(err, &got) && errors.As(expected, &want) {
+		return got.Code == want.Code && got.Message == want.Message
+	}
+	return errors.Is(err, expected)
+}
+
 func mockSessionGet(t *testing.T, rdb *mockredis.MockCmdable, key gomock.Matcher, s *invite.Session) *gomock.Call {
 	t.Helper()
 	raw, err := json.Marshal(s)
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"gopkg.hrry.dev/homelab/pkg/db"
+	"gopkg.hrry.dev/homelab/pkg/email"
+)
+
+// EmailOutbox is a queue of emails that can be inspected and re-sent.
+type EmailOutbox interface {
+	List(ctx context.Context, status email.OutboxStatus, opts db.PaginationOpts) ([]*email.OutboxEntry, error)
+	Retry(ctx context.Context, id int64) error
+}
+
+// ListOutbox lists queued emails and webhooks with a status. Dead entries are
+// listed by default.
+func ListOutbox(outbox EmailOutbox) echo.HandlerFunc {
+	type listquery struct {
+		Status string `query:"status"`
+		Limit  int    `query:"limit"`
+		Offset int    `query:"offset"`
+	}
+	return func(c echo.Context) error {
+		var q listquery
+		if err := c.Bind(&q); err != nil {
+			return err
+		}
+		status := email.OutboxStatus(q.Status)
+		switch status {
+		case "":
+			status = email.OutboxDead
+		case email.OutboxPending, email.OutboxSent, email.OutboxDead:
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid outbox status")
+		}
+		if q.Limit <= 0 {
+			q.Limit = 20
+		}
+		entries, err := outbox.List(c.Request().Context(), status, db.PaginationOpts{
+			Limit:  q.Limit,
+			Offset: q.Offset,
+		})
+		if err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		return c.JSON(200, entries)
+	}
+}
+
+// RetryOutbox puts an email back into the outbox queue.
+func RetryOutbox(outbox EmailOutbox) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return echo.ErrBadRequest.SetInternal(err)
+		}
+		err = outbox.Retry(c.Request().Context(), id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.ErrNotFound.SetInternal(err)
+			}
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		return c.NoContent(http.StatusAccepted)
+	}
+}
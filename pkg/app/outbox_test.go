@@ -0,0 +1,89 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+	"gopkg.hrry.dev/homelab/pkg/db"
+	"gopkg.hrry.dev/homelab/pkg/email"
+)
+
+type testOutbox struct {
+	status  email.OutboxStatus
+	opts    db.PaginationOpts
+	retried []int64
+}
+
+func (to *testOutbox) List(_ context.Context, status email.OutboxStatus, opts db.PaginationOpts) ([]*email.OutboxEntry, error) {
+	to.status, to.opts = status, opts
+	return []*email.OutboxEntry{{ID: 1, Status: status}}, nil
+}
+
+func (to *testOutbox) Retry(_ context.Context, id int64) error {
+	if id != 1 {
+		return sql.ErrNoRows
+	}
+	to.retried = append(to.retried, id)
+	return nil
+}
+
+func TestListOutbox(t *testing.T) {
+	is := is.New(t)
+	outbox := &testOutbox{}
+	h := ListOutbox(outbox)
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest("GET", "/outbox", nil), rec)
+	is.NoErr(h(c))
+	is.Equal(outbox.status, email.OutboxDead)
+	is.Equal(outbox.opts.Limit, 20)
+	var entries []email.OutboxEntry
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&entries))
+	is.Equal(len(entries), 1)
+
+	c = echo.New().NewContext(httptest.NewRequest("GET", "/outbox?status=sent&limit=5&offset=10", nil), httptest.NewRecorder())
+	is.NoErr(h(c))
+	is.Equal(outbox.status, email.OutboxSent)
+	is.Equal(outbox.opts, db.PaginationOpts{Limit: 5, Offset: 10})
+
+	c = echo.New().NewContext(httptest.NewRequest("GET", "/outbox?status=nope", nil), httptest.NewRecorder())
+	err := h(c)
+	var httpErr *echo.HTTPError
+	is.True(errors.As(err, &httpErr))
+	is.Equal(httpErr.Code, http.StatusBadRequest)
+}
+
+func TestRetryOutbox(t *testing.T) {
+	is := is.New(t)
+	outbox := &testOutbox{}
+	h := RetryOutbox(outbox)
+	for _, tt := range []struct {
+		id   string
+		code int
+	}{
+		{"1", http.StatusAccepted},
+		{"2", http.StatusNotFound},
+		{"abc", http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest("POST", "/", nil), rec)
+		c.SetParamNames("id")
+		c.SetParamValues(tt.id)
+		err := h(c)
+		if err != nil {
+			var httpErr *echo.HTTPError
+			is.True(errors.As(err, &httpErr))
+			is.Equal(httpErr.Code, tt.code)
+		} else {
+			is.Equal(rec.Code, tt.code)
+		}
+	}
+	is.Equal(outbox.retried, []int64{1})
+}
@@ -1,30 +1,113 @@
 package app
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gopkg.hrry.dev/homelab/pkg/auth"
 	"gopkg.hrry.dev/homelab/pkg/session"
 	"gopkg.hrry.dev/homelab/pkg/web"
 )
 
 type SessionData struct {
+	// Extras holds flash messages and the CSRF token for server rendered
+	// pages.
+	session.Extras
 	// User *User
-	Hits int
+	Hits int `json:"hits"`
+	// UserID is set when the browser holding the session logs in.
+	UserID    string    `json:"user_id,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	LoginAt   time.Time `json:"login_at,omitempty"`
 }
 
 type SessionManager = session.Manager[SessionData]
 
+const (
+	// sessionIdleTimeout logs out browsers that have not been used for a
+	// while. The redis store expires sessions once they go idle.
+	sessionIdleTimeout     = 14 * 24 * time.Hour
+	sessionAbsoluteTimeout = 90 * 24 * time.Hour
+	sessionTouchInterval   = time.Hour
+)
+
 func NewSessionManager(rd redis.UniversalClient, cookieDomain string) *SessionManager {
-	return session.NewManager(
+	m := session.NewManager(
 		"session",
-		session.NewStore[SessionData](rd, time.Hour*24*365),
+		// JSON lets services written in other languages read the
+		// session. Older gob encoded sessions are still readable.
+		session.NewStore[SessionData](rd, time.Hour*24*365, session.WithCodec(session.JSONCodec)),
 		session.WithDomain(cookieDomain),
 		session.WithPath("/"),
 		session.WithSameSite(http.SameSiteNoneMode),
 		session.WithSecure(true),
+		session.WithIdleTimeout(sessionIdleTimeout),
+		session.WithAbsoluteTimeout(sessionAbsoluteTimeout),
+		session.WithTouchInterval(sessionTouchInterval),
 	)
+	m.Index = session.NewRedisIndex(rd, "session:owner:")
+	m.Owner = sessionOwner
+	return m
+}
+
+func sessionOwner(d *SessionData) string { return d.UserID }
+
+// pageSession pops the flash messages of the request's session and gets its
+// CSRF token so they can be rendered in a template. The session is saved when
+// it changes. Requests without a session get no flashes and no token.
+func pageSession(ctx context.Context, w http.ResponseWriter) ([]session.Flash, string, error) {
+	ss := session.FromContext[SessionData](ctx)
+	if ss == nil {
+		return nil, "", nil
+	}
+	flashes := ss.PopFlashes()
+	had := len(ss.Value.CSRFToken) > 0
+	token, err := ss.CSRFToken()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(flashes) > 0 || !had {
+		if err = ss.Save(ctx, w); err != nil {
+			return nil, "", err
+		}
+	}
+	return flashes, token, nil
+}
+
+const (
+	// CSRFHeader and CSRFField carry the CSRF token from a page rendered with
+	// pageSession back to the server.
+	CSRFHeader = "X-CSRF-Token"
+	CSRFField  = "csrf_token"
+)
+
+// ErrInvalidCSRF is returned when a request's session was sent without a
+// matching CSRF token.
+var ErrInvalidCSRF = &echo.HTTPError{Code: http.StatusForbidden, Message: "invalid csrf token"}
+
+// checkCSRF makes sure that a request sent with a session cookie also has the
+// session's CSRF token, either in the CSRFHeader header or the CSRFField form
+// field. Requests without a session are not checked because a cross-site
+// request has no session to ride on.
+func checkCSRF(c echo.Context) error {
+	ss := session.FromContext[SessionData](c.Request().Context())
+	if ss == nil {
+		return nil
+	}
+	token := c.Request().Header.Get(CSRFHeader)
+	if len(token) == 0 {
+		token = c.FormValue(CSRFField)
+	}
+	if !ss.ValidCSRFToken(token) {
+		return ErrInvalidCSRF
+	}
+	return nil
 }
 
 func Session(m *SessionManager) http.HandlerFunc {
@@ -53,10 +136,29 @@ func CollectSession(m *SessionManager) func(http.Handler) http.Handler {
 				next.ServeHTTP(w, r)
 				return
 			}
+			// Keep the idle timeout sliding while the browser is in use. The
+			// cookie and expiry are only refreshed once every touch interval.
+			err = ss.Touch(r.Context(), w)
+			if err == session.ErrSessionNotFound {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err != nil {
+				logger.WithError(err).Error("failed to touch session")
+			}
 			ctx := session.StashInContext(r.Context(), ss)
 			next.ServeHTTP(w, r.WithContext(ctx))
-			ss.Value.Hits++
-			err = ss.Save(r.Context(), w)
+			// The session is updated in place so that concurrent requests
+			// don't lose hits. The handler may have rotated the session so
+			// the stashed session is used instead of the request's cookie.
+			err = ss.Update(r.Context(), func(d *SessionData) error {
+				d.Hits++
+				return nil
+			})
+			if err == session.ErrSessionNotFound {
+				// The handler deleted the session.
+				return
+			}
 			if err != nil {
 				logger.WithError(err).Error("failed to save session data")
 				return
@@ -64,3 +166,166 @@ func CollectSession(m *SessionManager) func(http.Handler) http.Handler {
 		})
 	}
 }
+
+// loginSession links the browser's session to a user. An existing session is
+// given a new id so that an id set before logging in can't be used to take
+// over the session afterwards.
+func loginSession(c echo.Context, m *SessionManager, u *User) error {
+	var (
+		req    = c.Request()
+		ctx    = req.Context()
+		ss     = session.FromContext[SessionData](ctx)
+		rotate = ss != nil
+	)
+	if ss == nil {
+		ss = m.NewSession(&SessionData{})
+	}
+	ss.Value.UserID = u.UUID.String()
+	ss.Value.UserAgent = req.UserAgent()
+	ss.Value.LoginAt = time.Now()
+	if rotate {
+		return ss.Rotate(ctx, c.Response())
+	}
+	return ss.Save(ctx, c.Response())
+}
+
+// SessionInfo describes one of a user's browser sessions. The session ID is
+// never exposed, sessions are identified by a hash of it instead.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	Current   bool      `json:"current"`
+	Hits      int       `json:"hits"`
+	UserAgent string    `json:"user_agent"`
+	LoginAt   time.Time `json:"login_at"`
+}
+
+// ListMySessions lists the sessions of the logged in user.
+func ListMySessions(m *SessionManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := auth.GetClaims(c)
+		if claims == nil {
+			return echo.ErrUnauthorized
+		}
+		ctx := c.Request().Context()
+		sessions, err := listSessions(ctx, m, claims.UUID.String())
+		if err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		return c.JSON(200, sessions)
+	}
+}
+
+// DeleteMySession logs the user out of one of their sessions.
+func DeleteMySession(m *SessionManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := auth.GetClaims(c)
+		if claims == nil {
+			return echo.ErrUnauthorized
+		}
+		var (
+			ctx   = c.Request().Context()
+			owner = claims.UUID.String()
+		)
+		sessions, err := m.ListByOwner(ctx, owner)
+		if err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		for _, s := range sessions {
+			if sessionHandle(s.ID()) != c.Param("id") {
+				continue
+			}
+			if err = m.DeleteByOwner(ctx, owner, s.ID()); err != nil {
+				return echo.ErrInternalServerError.SetInternal(err)
+			}
+			return c.NoContent(http.StatusNoContent)
+		}
+		return echo.ErrNotFound
+	}
+}
+
+// DeleteMySessions logs the user out of every session except the one making
+// the request.
+func DeleteMySessions(m *SessionManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := auth.GetClaims(c)
+		if claims == nil {
+			return echo.ErrUnauthorized
+		}
+		var (
+			ctx     = c.Request().Context()
+			owner   = claims.UUID.String()
+			current = session.FromContext[SessionData](ctx)
+		)
+		sessions, err := m.ListByOwner(ctx, owner)
+		if err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		ids := make([]string, 0, len(sessions))
+		for _, s := range sessions {
+			if current != nil && current.ID() == s.ID() {
+				continue
+			}
+			ids = append(ids, s.ID())
+		}
+		if len(ids) > 0 {
+			if err = m.DeleteByOwner(ctx, owner, ids...); err != nil {
+				return echo.ErrInternalServerError.SetInternal(err)
+			}
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// ListUserSessions lists the sessions of any user.
+func ListUserSessions(m *SessionManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return echo.ErrBadRequest.SetInternal(err)
+		}
+		sessions, err := listSessions(c.Request().Context(), m, id.String())
+		if err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		return c.JSON(200, sessions)
+	}
+}
+
+// DeleteUserSessions logs a user out of all of their sessions.
+func DeleteUserSessions(m *SessionManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return echo.ErrBadRequest.SetInternal(err)
+		}
+		if err = m.DeleteByOwner(c.Request().Context(), id.String()); err != nil {
+			return echo.ErrInternalServerError.SetInternal(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func listSessions(ctx context.Context, m *SessionManager, owner string) ([]*SessionInfo, error) {
+	sessions, err := m.ListByOwner(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	current := session.FromContext[SessionData](ctx)
+	infos := make([]*SessionInfo, len(sessions))
+	for i, s := range sessions {
+		infos[i] = &SessionInfo{
+			ID:        sessionHandle(s.ID()),
+			Current:   current != nil && current.ID() == s.ID(),
+			Hits:      s.Value.Hits,
+			UserAgent: s.Value.UserAgent,
+			LoginAt:   s.Value.LoginAt,
+		}
+	}
+	return infos, nil
+}
+
+// sessionHandle identifies a session without giving away its ID.
+func sessionHandle(id string) string {
+	h := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(h[:8])
+}
@@ -0,0 +1,346 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+	"gopkg.hrry.dev/homelab/pkg/auth"
+	"gopkg.hrry.dev/homelab/pkg/session"
+)
+
+func testSessionManager() *SessionManager {
+	m := session.NewManager[SessionData]("session", session.NewMemStore[SessionData](session.Forever))
+	m.Index = session.NewMemIndex()
+	m.Owner = sessionOwner
+	return m
+}
+
+func userSessions(t *testing.T, m *SessionManager, owner uuid.UUID, n int) []*session.Session[SessionData] {
+	t.Helper()
+	sessions := make([]*session.Session[SessionData], n)
+	for i := range sessions {
+		s := m.NewSession(&SessionData{UserID: owner.String(), Hits: i})
+		if err := s.Save(context.Background(), httptest.NewRecorder()); err != nil {
+			t.Fatal(err)
+		}
+		sessions[i] = s
+	}
+	return sessions
+}
+
+func sessionContext(req *http.Request, claims *auth.Claims, current *session.Session[SessionData]) (echo.Context, *httptest.ResponseRecorder) {
+	if current != nil {
+		req = req.WithContext(session.StashInContext(req.Context(), current))
+	}
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	if claims != nil {
+		c.Set(string(auth.ClaimsContextKey), claims)
+	}
+	return c, rec
+}
+
+func httpCode(err error) int {
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code
+	}
+	return 0
+}
+
+func TestListMySessions(t *testing.T) {
+	is := is.New(t)
+	m := testSessionManager()
+	user := uuid.New()
+	sessions := userSessions(t, m, user, 3)
+	userSessions(t, m, uuid.New(), 2)
+	h := ListMySessions(m)
+
+	c, _ := sessionContext(httptest.NewRequest("GET", "/api/me/sessions", nil), nil, nil)
+	is.Equal(httpCode(h(c)), http.StatusUnauthorized)
+
+	c, rec := sessionContext(httptest.NewRequest("GET", "/api/me/sessions", nil), &auth.Claims{UUID: user}, sessions[1])
+	is.NoErr(h(c))
+	var infos []SessionInfo
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&infos))
+	is.Equal(len(infos), 3)
+	var current int
+	for _, info := range infos {
+		is.Equal(len(info.ID), 16)
+		if info.Current {
+			current++
+			is.Equal(info.ID, sessionHandle(sessions[1].ID()))
+		}
+	}
+	is.Equal(current, 1)
+}
+
+func TestDeleteMySession(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	m := testSessionManager()
+	user := uuid.New()
+	sessions := userSessions(t, m, user, 2)
+	other := userSessions(t, m, uuid.New(), 1)
+	h := DeleteMySession(m)
+
+	// can't delete another user's session
+	c, _ := sessionContext(httptest.NewRequest("DELETE", "/", nil), &auth.Claims{UUID: user}, nil)
+	c.SetParamNames("id")
+	c.SetParamValues(sessionHandle(other[0].ID()))
+	is.Equal(httpCode(h(c)), http.StatusNotFound)
+
+	c, rec := sessionContext(httptest.NewRequest("DELETE", "/", nil), &auth.Claims{UUID: user}, nil)
+	c.SetParamNames("id")
+	c.SetParamValues(sessionHandle(sessions[0].ID()))
+	is.NoErr(h(c))
+	is.Equal(rec.Code, http.StatusNoContent)
+	left, err := m.ListByOwner(ctx, user.String())
+	is.NoErr(err)
+	is.Equal(len(left), 1)
+	is.Equal(left[0].ID(), sessions[1].ID())
+}
+
+func TestDeleteMySessions(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	m := testSessionManager()
+	user := uuid.New()
+	sessions := userSessions(t, m, user, 3)
+	c, rec := sessionContext(httptest.NewRequest("DELETE", "/", nil), &auth.Claims{UUID: user}, sessions[2])
+	is.NoErr(DeleteMySessions(m)(c))
+	is.Equal(rec.Code, http.StatusNoContent)
+	left, err := m.ListByOwner(ctx, user.String())
+	is.NoErr(err)
+	is.Equal(len(left), 1)
+	is.Equal(left[0].ID(), sessions[2].ID())
+}
+
+func TestUserSessions(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	m := testSessionManager()
+	user := uuid.New()
+	userSessions(t, m, user, 2)
+
+	c, _ := sessionContext(httptest.NewRequest("GET", "/", nil), nil, nil)
+	c.SetParamNames("id")
+	c.SetParamValues("not-a-uuid")
+	is.Equal(httpCode(ListUserSessions(m)(c)), http.StatusBadRequest)
+
+	c, rec := sessionContext(httptest.NewRequest("GET", "/", nil), nil, nil)
+	c.SetParamNames("id")
+	c.SetParamValues(user.String())
+	is.NoErr(ListUserSessions(m)(c))
+	var infos []SessionInfo
+	is.NoErr(json.NewDecoder(rec.Body).Decode(&infos))
+	is.Equal(len(infos), 2)
+
+	c, _ = sessionContext(httptest.NewRequest("DELETE", "/", nil), nil, nil)
+	c.SetParamNames("id")
+	c.SetParamValues(user.String())
+	is.NoErr(DeleteUserSessions(m)(c))
+	left, err := m.ListByOwner(ctx, user.String())
+	is.NoErr(err)
+	is.Equal(len(left), 0)
+}
+
+func TestLoginSession(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	m := testSessionManager()
+	anon := m.NewSession(&SessionData{Hits: 5})
+	is.NoErr(anon.Save(ctx, httptest.NewRecorder()))
+	anonID := anon.ID()
+
+	u := &User{UUID: uuid.New()}
+	req := httptest.NewRequest("POST", "/api/login", nil)
+	req.Header.Set("User-Agent", "test-agent")
+	c, rec := sessionContext(req, nil, anon)
+	is.NoErr(loginSession(c, m, u))
+	is.True(anon.ID() != anonID)
+	is.Equal(len(rec.Result().Cookies()), 1)
+
+	sessions, err := m.ListByOwner(ctx, u.UUID.String())
+	is.NoErr(err)
+	is.Equal(len(sessions), 1)
+	is.Equal(sessions[0].ID(), anon.ID())
+	is.Equal(sessions[0].Value.Hits, 5)
+	is.Equal(sessions[0].Value.UserAgent, "test-agent")
+	_, err = m.Store.Get(ctx, "session:"+anonID)
+	is.Equal(err, session.ErrSessionNotFound)
+}
+
+func TestCollectSession(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	m := testSessionManager()
+	s := m.NewSession(&SessionData{})
+	rec := httptest.NewRecorder()
+	is.NoErr(s.Save(ctx, rec))
+	cookie := rec.Result().Cookies()[0]
+
+	h := CollectSession(m)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if session.FromContext[SessionData](r.Context()) == nil {
+			t.Error("expected session in context")
+		}
+	}))
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/", nil)
+			req.AddCookie(cookie)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	wg.Wait()
+	v, err := m.Store.Get(ctx, "session:"+s.ID())
+	is.NoErr(err)
+	is.Equal(v.Hits, n)
+}
+
+func TestCollectSession_Deleted(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	m := testSessionManager()
+	s := m.NewSession(&SessionData{})
+	rec := httptest.NewRecorder()
+	is.NoErr(s.Save(ctx, rec))
+	cookie := rec.Result().Cookies()[0]
+
+	var logs bytes.Buffer
+	out := logger.Out
+	logger.SetOutput(&logs)
+	defer logger.SetOutput(out)
+	h := CollectSession(m)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		is.NoErr(session.FromContext[SessionData](r.Context()).Delete(r.Context(), w))
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	_, err := m.Store.Get(ctx, "session:"+s.ID())
+	is.Equal(err, session.ErrSessionNotFound)
+	is.Equal(logs.Len(), 0) // logging out is not an error
+}
+
+func TestCollectSession_Touch(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	store := session.NewMemStore[SessionData](session.Forever)
+	defer store.Close()
+	m := session.NewManager[SessionData](
+		"session",
+		store,
+		session.WithIdleTimeout(sessionIdleTimeout),
+		session.WithTouchInterval(sessionTouchInterval),
+	)
+	s := m.NewSession(&SessionData{})
+	rec := httptest.NewRecorder()
+	is.NoErr(s.Save(ctx, rec))
+	cookie := rec.Result().Cookies()[0]
+	h := CollectSession(m)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	// The session was just touched.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	is.Equal(len(rec.Result().Cookies()), 0)
+
+	// Move the cookie's touched time back past the touch interval, as if the
+	// browser last used the session a while ago.
+	touched := time.Now().Add(-2 * sessionTouchInterval)
+	i := strings.LastIndexByte(cookie.Value, '.')
+	cookie.Value = cookie.Value[:i+1] + strconv.FormatInt(touched.Unix(), 36)
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	cookies := rec.Result().Cookies()
+	is.Equal(len(cookies), 1)
+	is.True(cookies[0].Value != cookie.Value)
+	is.True(strings.HasPrefix(cookies[0].Value, s.ID()+"."))
+	is.True(cookies[0].Expires.After(time.Now().Add(sessionIdleTimeout - time.Minute)))
+}
+
+func TestPageSession(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	flashes, token, err := pageSession(ctx, httptest.NewRecorder())
+	is.NoErr(err)
+	is.Equal(len(flashes), 0)
+	is.Equal(token, "")
+
+	m := testSessionManager()
+	s := m.NewSession(&SessionData{})
+	is.NoErr(s.AddFlash(session.FlashSuccess, "account created"))
+	is.NoErr(s.Save(ctx, httptest.NewRecorder()))
+	rec := httptest.NewRecorder()
+	flashes, token, err = pageSession(session.StashInContext(ctx, s), rec)
+	is.NoErr(err)
+	is.Equal(flashes, []session.Flash{{Category: session.FlashSuccess, Message: "account created"}})
+	is.True(len(token) > 0)
+	is.Equal(len(rec.Result().Cookies()), 1)
+
+	stored, err := m.Store.Get(ctx, "session:"+s.ID())
+	is.NoErr(err)
+	is.Equal(len(stored.Flashes), 0)
+	is.Equal(stored.CSRFToken, token)
+
+	// nothing changed so the session isn't saved again
+	rec = httptest.NewRecorder()
+	_, again, err := pageSession(session.StashInContext(ctx, s), rec)
+	is.NoErr(err)
+	is.Equal(again, token)
+	is.Equal(len(rec.Result().Cookies()), 0)
+}
+
+func TestCheckCSRF(t *testing.T) {
+	is := is.New(t)
+	m := testSessionManager()
+	s := m.NewSession(&SessionData{})
+	token, err := s.CSRFToken()
+	is.NoErr(err)
+
+	// no session, nothing to check
+	c, _ := sessionContext(httptest.NewRequest("POST", "/", nil), nil, nil)
+	is.NoErr(checkCSRF(c))
+
+	c, _ = sessionContext(httptest.NewRequest("POST", "/", nil), nil, s)
+	is.Equal(checkCSRF(c), ErrInvalidCSRF)
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"csrf_token":"`+token+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	c, _ = sessionContext(req, nil, s)
+	is.Equal(checkCSRF(c), ErrInvalidCSRF) // json bodies need the header
+
+	req = httptest.NewRequest("POST", "/", nil)
+	req.Header.Set(CSRFHeader, token)
+	c, _ = sessionContext(req, nil, s)
+	is.NoErr(checkCSRF(c))
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader(CSRFField+"="+token))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	c, _ = sessionContext(req, nil, s)
+	is.NoErr(checkCSRF(c))
+
+	req = httptest.NewRequest("POST", "/", nil)
+	req.Header.Set(CSRFHeader, token[1:])
+	c, _ = sessionContext(req, nil, s)
+	is.Equal(checkCSRF(c), ErrInvalidCSRF)
+}
@@ -3,6 +3,7 @@ package app
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
@@ -13,6 +14,7 @@ import (
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.hrry.dev/homelab/pkg/auth"
 	"gopkg.hrry.dev/homelab/pkg/db"
+	"gopkg.hrry.dev/homelab/pkg/email"
 )
 
 type User struct {
@@ -47,8 +49,51 @@ var (
 	ErrEmptyPassword = errors.New("zero length password")
 	ErrUserNotFound  = errors.New("could not find user")
 	ErrWrongPassword = errors.New("password was incorrect")
+	ErrUserExists    = errors.New("user already exists")
 )
 
+// UserConflictError is returned when a user cannot be created or updated
+// because one of its unique fields is already used by another user.
+type UserConflictError struct {
+	// Field is the name of the column that caused the conflict.
+	Field string
+	Err   error
+}
+
+func (e *UserConflictError) Error() string {
+	return fmt.Sprintf("%s is already taken", e.Field)
+}
+
+func (e *UserConflictError) Unwrap() error { return e.Err }
+
+func (e *UserConflictError) Is(err error) bool { return err == ErrUserExists }
+
+// postgres error code for unique_violation
+const pqUniqueViolation = "23505"
+
+// uniqueConstraints maps unique indexes on the user table to the field that
+// they constrain.
+var uniqueConstraints = map[string]string{
+	"ux_user_email_lower":    "email",
+	"ux_user_username_lower": "username",
+	"unique_email":           "email",
+	"user_uuid_key":          "uuid",
+}
+
+// conflictError will convert unique constraint violations into a
+// UserConflictError and leave all other errors untouched.
+func conflictError(err error) error {
+	var pqerr *pq.Error
+	if !errors.As(err, &pqerr) || pqerr.Code != pqUniqueViolation {
+		return err
+	}
+	field, ok := uniqueConstraints[pqerr.Constraint]
+	if !ok {
+		field = "user"
+	}
+	return &UserConflictError{Field: field, Err: err}
+}
+
 type UserStore interface {
 	Login(context.Context, *Login) (*User, error)
 	Get(context.Context, uuid.UUID) (*User, error)
@@ -130,10 +175,10 @@ func (s *userStore) Login(ctx context.Context, l *Login) (*User, error) {
 		u   *User
 	)
 	if len(l.Email) > 0 {
-		const query = selectQueryHead + `WHERE email = $1`
-		u, err = s.get(ctx, query, l.Email)
+		const query = selectQueryHead + `WHERE lower(email) = lower($1)`
+		u, err = s.get(ctx, query, email.Normalize(l.Email))
 	} else if len(l.Username) > 0 {
-		const query = selectQueryHead + `WHERE username = $1`
+		const query = selectQueryHead + `WHERE lower(username) = lower($1)`
 		u, err = s.get(ctx, query, l.Username)
 	} else {
 		return nil, ErrUserNotFound
@@ -176,7 +221,10 @@ func (s *userStore) Create(ctx context.Context, password string, u *User) (*User
 	if err != nil {
 		return nil, err
 	}
-	u.UUID = uuid.New()
+	if u.UUID == uuid.Nil {
+		u.UUID = uuid.New()
+	}
+	u.Email = email.Normalize(u.Email)
 	if len(u.Roles) == 0 {
 		u.Roles = []auth.Role{auth.RoleDefault}
 	}
@@ -191,9 +239,9 @@ func (s *userStore) Create(ctx context.Context, password string, u *User) (*User
 		u.TOTPSecret,
 	)
 	if err != nil {
-		return nil, err
+		return nil, conflictError(err)
 	}
-	return u, db.ScanOne(rows, &u.ID, &u.CreatedAt, &u.UpdatedAt)
+	return u, conflictError(db.ScanOne(rows, &u.ID, &u.CreatedAt, &u.UpdatedAt))
 }
 
 func (s *userStore) Update(ctx context.Context, u *User) error {
@@ -206,6 +254,7 @@ func (s *userStore) Update(ctx context.Context, u *User) error {
 		updated_at = CURRENT_TIMESTAMP
 	WHERE id = $1 AND uuid = $2
 	RETURNING updated_at`
+	u.Email = email.Normalize(u.Email)
 	rows, err := s.db.QueryContext(
 		ctx, query,
 		u.ID,
@@ -216,9 +265,9 @@ func (s *userStore) Update(ctx context.Context, u *User) error {
 		pq.Array(u.Roles),
 	)
 	if err != nil {
-		return err
+		return conflictError(err)
 	}
-	return db.ScanOne(rows, &u.UpdatedAt)
+	return conflictError(db.ScanOne(rows, &u.UpdatedAt))
 }
 
 func (s *userStore) UpdateWithPassword(ctx context.Context, password string, u *User) error {
@@ -237,6 +286,7 @@ func (s *userStore) UpdateWithPassword(ctx context.Context, password string, u *
 		updated_at = CURRENT_TIMESTAMP
 	WHERE id = $1 AND uuid = $2
 	RETURNING updated_at`
+	u.Email = email.Normalize(u.Email)
 	rows, err := s.db.QueryContext(
 		ctx, query,
 		u.ID,
@@ -248,9 +298,9 @@ func (s *userStore) UpdateWithPassword(ctx context.Context, password string, u *
 		pq.Array(u.Roles),
 	)
 	if err != nil {
-		return err
+		return conflictError(err)
 	}
-	return db.ScanOne(rows, &u.UpdatedAt)
+	return conflictError(db.ScanOne(rows, &u.UpdatedAt))
 }
 
 func (s *userStore) Find(ctx context.Context, identifier interface{}) (*User, error) {
@@ -260,7 +310,7 @@ func (s *userStore) Find(ctx context.Context, identifier interface{}) (*User, er
 	case int:
 		return s.get(ctx, selectQueryHead+`WHERE id = $1`, id)
 	default:
-		const query = selectQueryHead + `WHERE email = $1 OR username = $1`
+		const query = selectQueryHead + `WHERE lower(email) = lower($1) OR lower(username) = lower($1)`
 		return s.get(ctx, query, identifier)
 	}
 }
@@ -3,13 +3,13 @@ package auth
 import (
 	"context"
 	"fmt"
-	"sync"
+	"io"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 	"gopkg.hrry.dev/homelab/pkg/log"
+	"gopkg.hrry.dev/homelab/pkg/lru"
 )
 
 var (
@@ -17,7 +17,10 @@ var (
 	logger           = log.GetLogger()
 )
 
+// TokenStore holds refresh tokens. Close stops any background work the
+// store started and does not close clients that were passed in.
 type TokenStore interface {
+	io.Closer
 	Set(ctx context.Context, id int, token string) error
 	Get(ctx context.Context, id int) (string, error)
 	Del(ctx context.Context, id int) error
@@ -28,13 +31,12 @@ func NewRedisTokenStore(timeout time.Duration, client *redis.Client) TokenStore
 }
 
 func NewInMemoryTokenStore(timeout time.Duration) TokenStore {
-	store := &memoryTokenStore{
-		tokens:   make(map[int]timeoutToken),
-		timeout:  timeout,
-		timeouts: make(chan int),
+	return &memoryTokenStore{
+		tokens: lru.New[int, string](lru.Options{
+			TTL:             timeout,
+			CleanupInterval: time.Minute,
+		}),
 	}
-	go store.tidy(context.Background()) // background process to handle ttl
-	return store
 }
 
 type redisTokenStore struct {
@@ -61,68 +63,29 @@ func (rs *redisTokenStore) Del(ctx context.Context, id int) error {
 	return rs.client.Del(ctx, key).Err()
 }
 
-type timeoutToken struct {
-	expires time.Time
-	token   string
-}
+func (rs *redisTokenStore) Close() error { return nil }
 
 type memoryTokenStore struct {
-	tokens   map[int]timeoutToken
-	timeout  time.Duration
-	mu       sync.RWMutex
-	timeouts chan int
+	tokens *lru.Cache[int, string]
 }
 
 func (ms *memoryTokenStore) Set(ctx context.Context, id int, token string) error {
-	ms.mu.Lock()
-	ms.tokens[id] = timeoutToken{
-		expires: time.Now().Add(ms.timeout),
-		token:   token,
-	}
-	ms.mu.Unlock()
-	timer := time.NewTimer(ms.timeout)
-	go func() {
-		defer timer.Stop()
-		<-timer.C
-		ms.timeouts <- id
-	}()
+	ms.tokens.Set(id, token)
 	return nil
 }
 
 func (ms *memoryTokenStore) Get(ctx context.Context, id int) (string, error) {
-	ms.mu.RLock()
-	tmTok, ok := ms.tokens[id]
+	token, ok := ms.tokens.Get(id)
 	if !ok {
-		ms.mu.RUnlock()
-		return "", ErrTokenNotFound
-	}
-	ms.mu.RUnlock()
-	if time.Now().After(tmTok.expires) {
-		_ = ms.Del(ctx, id)
 		return "", ErrTokenNotFound
 	}
-	return tmTok.token, nil
+	return token, nil
 }
 
 func (ms *memoryTokenStore) Del(ctx context.Context, id int) error {
-	ms.mu.Lock()
-	delete(ms.tokens, id)
-	ms.mu.Unlock()
+	ms.tokens.Del(id)
 	return nil
 }
 
-func (ms *memoryTokenStore) tidy(ctx context.Context) {
-	for {
-		id, ok := <-ms.timeouts
-		if !ok {
-			return
-		}
-		err := ms.Del(ctx, id)
-		if err != nil {
-			logger.WithFields(logrus.Fields{
-				"error": err,
-				"id":    id,
-			}).Warn("could not clear from in-memory token store")
-		}
-	}
-}
+// Close stops removing expired tokens in the background.
+func (ms *memoryTokenStore) Close() error { return ms.tokens.Close() }
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestMemoryTokenStore(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	store := NewInMemoryTokenStore(time.Minute)
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			_ = store.Set(ctx, id, "token")
+			_, _ = store.Get(ctx, id)
+		}(i)
+	}
+	wg.Wait()
+
+	tok, err := store.Get(ctx, 1)
+	is.NoErr(err)
+	is.Equal(tok, "token")
+	is.NoErr(store.Del(ctx, 1))
+	_, err = store.Get(ctx, 1)
+	is.Equal(err, ErrTokenNotFound)
+
+	short := NewInMemoryTokenStore(time.Millisecond)
+	defer short.Close()
+	is.NoErr(short.Set(ctx, 1, "token"))
+	time.Sleep(2 * time.Millisecond)
+	_, err = short.Get(ctx, 1)
+	is.Equal(err, ErrTokenNotFound)
+}
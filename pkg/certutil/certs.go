@@ -38,6 +38,9 @@ func OpenKey(filename string) (crypto.Signer, error) {
 		return nil, err
 	}
 	block, _ := pem.Decode(bytes)
+	if block == nil {
+		return nil, errors.New("no pem data found")
+	}
 	switch block.Type {
 	case "RSA PRIVATE KEY":
 		return x509.ParsePKCS1PrivateKey(block.Bytes)
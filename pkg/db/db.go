@@ -86,9 +86,86 @@ type database struct {
 }
 
 func (db *database) QueryContext(ctx context.Context, query string, v ...interface{}) (Rows, error) {
+	if tx, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return tx.QueryContext(ctx, query, v...)
+	}
 	return db.DB.QueryContext(ctx, query, v...)
 }
 
+func (db *database) ExecContext(ctx context.Context, query string, v ...interface{}) (sql.Result, error) {
+	if tx, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return tx.ExecContext(ctx, query, v...)
+	}
+	return db.DB.ExecContext(ctx, query, v...)
+}
+
+// Transactor is a DB that supports transactions.
+type Transactor interface {
+	// Transaction runs fn inside a transaction. Queries that use the context
+	// passed to fn are part of the transaction which is committed if fn
+	// returns nil and rolled back otherwise.
+	Transaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+type (
+	txKey          struct{}
+	afterCommitKey struct{}
+)
+
+// AfterCommit runs fn once the transaction held by ctx has been committed. If
+// ctx is not part of a transaction then fn is called right away. Functions
+// registered in a transaction that is rolled back are never called.
+func AfterCommit(ctx context.Context, fn func()) {
+	hooks, ok := ctx.Value(afterCommitKey{}).(*[]func())
+	if !ok {
+		fn()
+		return
+	}
+	*hooks = append(*hooks, fn)
+}
+
+// InTx runs fn inside a transaction if the database supports them, otherwise
+// fn is called with the original context.
+func InTx(ctx context.Context, d DB, fn func(ctx context.Context) error) error {
+	if t, ok := d.(Transactor); ok {
+		return t.Transaction(ctx, fn)
+	}
+	return fn(ctx)
+}
+
+func (db *database) Transaction(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	if _, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		// Nested transactions are part of the outer transaction.
+		return fn(ctx)
+	}
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+	var hooks []func()
+	ctx = context.WithValue(ctx, txKey{}, tx)
+	ctx = context.WithValue(ctx, afterCommitKey{}, &hooks)
+	if err = fn(ctx); err != nil {
+		if e := tx.Rollback(); e != nil {
+			db.logger.WithError(e).Error("failed to rollback transaction")
+		}
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	for _, h := range hooks {
+		h()
+	}
+	return nil
+}
+
 type waitOpts struct {
 	interval time.Duration
 	timeout  time.Duration
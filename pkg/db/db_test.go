@@ -1,7 +1,9 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"testing"
 
@@ -84,3 +86,50 @@ func TestScanOne(t *testing.T) {
 		is.True(errors.Is(err, errTestError))
 	})
 }
+
+func TestAfterCommit(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	called := 0
+	AfterCommit(ctx, func() { called++ })
+	is.Equal(called, 1) // should run right away outside of a transaction
+
+	sql.Register("db-test-txdriver", txDriver{})
+	pool, err := sql.Open("db-test-txdriver", "")
+	is.NoErr(err)
+	defer pool.Close()
+	d := New(pool)
+
+	called = 0
+	err = InTx(ctx, d, func(ctx context.Context) error {
+		AfterCommit(ctx, func() { called++ })
+		is.Equal(called, 0) // should wait for the commit
+		return InTx(ctx, d, func(ctx context.Context) error {
+			AfterCommit(ctx, func() { called++ })
+			return nil
+		})
+	})
+	is.NoErr(err)
+	is.Equal(called, 2)
+
+	called = 0
+	errTestError := errors.New("test error")
+	err = InTx(ctx, d, func(ctx context.Context) error {
+		AfterCommit(ctx, func() { called++ })
+		return errTestError
+	})
+	is.True(errors.Is(err, errTestError))
+	is.Equal(called, 0) // should not run after a rollback
+}
+
+type txDriver struct{}
+
+func (txDriver) Open(string) (driver.Conn, error) { return txConn{}, nil }
+
+type txConn struct{}
+
+func (txConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not implemented") }
+func (txConn) Close() error                        { return nil }
+func (txConn) Begin() (driver.Tx, error)           { return txConn{}, nil }
+func (txConn) Commit() error                       { return nil }
+func (txConn) Rollback() error                     { return nil }
@@ -0,0 +1,264 @@
+package email
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SendGridSignatureHeader holds the base64 encoded ECDSA signature of a
+	// SendGrid event webhook.
+	SendGridSignatureHeader = "X-Twilio-Email-Event-Webhook-Signature"
+	SendGridTimestampHeader = "X-Twilio-Email-Event-Webhook-Timestamp"
+)
+
+// SendGridMaxAge is how far a SendGrid webhook's timestamp can be from the
+// current time. Older deliveries are rejected so that they can't be replayed.
+const SendGridMaxAge = 5 * time.Minute
+
+var (
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrStaleTimestamp   = errors.New("webhook timestamp is too old")
+)
+
+// ParseSendGridVerificationKey parses the base64 encoded public key used to
+// verify SendGrid's signed event webhooks.
+func ParseSendGridVerificationKey(key string) (*ecdsa.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	k, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an ecdsa key, got %T", pub)
+	}
+	return k, nil
+}
+
+// VerifySendGridSignature checks the signature of a SendGrid event webhook.
+// The signature covers the timestamp header followed by the raw body. The
+// timestamp must be within SendGridMaxAge of now.
+func VerifySendGridSignature(key *ecdsa.PublicKey, signature, timestamp string, body []byte, now time.Time) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(timestamp) == 0 {
+		return ErrInvalidSignature
+	}
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	h := sha256.New()
+	h.Write([]byte(timestamp))
+	h.Write(body)
+	if !ecdsa.VerifyASN1(key, h.Sum(nil), sig) {
+		return ErrInvalidSignature
+	}
+	age := now.Sub(time.Unix(sent, 0))
+	if age > SendGridMaxAge || age < -SendGridMaxAge {
+		return ErrStaleTimestamp
+	}
+	return nil
+}
+
+type sendGridEvent struct {
+	// EventID stays the same when SendGrid sends an event again.
+	EventID   string `json:"sg_event_id"`
+	Email     string `json:"email"`
+	Timestamp int64  `json:"timestamp"`
+	Event     string `json:"event"`
+	// Type is "bounce" or "blocked" for bounce events.
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+	Status string `json:"status"`
+}
+
+// ParseSendGridEvents reads the bounces and complaints from a SendGrid event
+// webhook body. Other events are ignored.
+func ParseSendGridEvents(body []byte) ([]*DeliveryEvent, error) {
+	var raw []sendGridEvent
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	events := make([]*DeliveryEvent, 0, len(raw))
+	for _, e := range raw {
+		ev := DeliveryEvent{
+			ID:      e.EventID,
+			Address: e.Email,
+			Status:  e.Status,
+			Reason:  e.Reason,
+			Source:  "sendgrid",
+			Time:    time.Unix(e.Timestamp, 0),
+		}
+		switch e.Event {
+		case "bounce":
+			ev.Type = EventBounce
+			// Blocked messages were rejected for reasons that may be
+			// temporary like reputation or content filtering.
+			ev.Permanent = e.Type != "blocked"
+		case "spamreport":
+			ev.Type = EventComplaint
+		default:
+			continue
+		}
+		events = append(events, &ev)
+	}
+	return events, nil
+}
+
+// ParseDSN reads the bounces from a delivery status notification (RFC 3464)
+// and the complaints from an abuse feedback report (RFC 5965).
+func ParseDSN(r io.Reader) ([]*DeliveryEvent, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != "multipart/report" {
+		return nil, fmt.Errorf("expected a multipart/report message, got %q", mediaType)
+	}
+	var t time.Time
+	if date, err := msg.Header.Date(); err == nil {
+		t = date
+	}
+
+	var (
+		events   []*DeliveryEvent
+		feedback textproto.MIMEHeader
+		original string
+		parts    = multipart.NewReader(msg.Body, params["boundary"])
+	)
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "message/delivery-status":
+			groups, err := readFieldGroups(part)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, deliveryStatusEvents(groups, t)...)
+		case "message/feedback-report":
+			groups, err := readFieldGroups(part)
+			if err != nil {
+				return nil, err
+			}
+			if len(groups) > 0 {
+				feedback = groups[0]
+			}
+		case "message/rfc822", "text/rfc822-headers":
+			// The original message is used to find the recipient of a
+			// complaint.
+			h, err := textproto.NewReader(bufio.NewReader(part)).ReadMIMEHeader()
+			if err != nil && !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			if to, err := mail.ParseAddress(h.Get("To")); err == nil {
+				original = to.Address
+			}
+		}
+	}
+	if feedback != nil {
+		address := typedField(feedback.Get("Original-Rcpt-To"))
+		if len(address) == 0 {
+			address = original
+		}
+		if len(address) == 0 {
+			return nil, errors.New("could not find the recipient of a feedback report")
+		}
+		events = append(events, &DeliveryEvent{
+			Type:    EventComplaint,
+			Address: address,
+			Reason:  feedback.Get("Feedback-Type"),
+			Source:  "dsn",
+			Time:    t,
+		})
+	}
+	return events, nil
+}
+
+func deliveryStatusEvents(groups []textproto.MIMEHeader, t time.Time) []*DeliveryEvent {
+	var events []*DeliveryEvent
+	if len(groups) < 2 {
+		return nil
+	}
+	// The first group holds the per-message fields.
+	for _, g := range groups[1:] {
+		if !strings.EqualFold(g.Get("Action"), "failed") {
+			continue
+		}
+		address := typedField(g.Get("Final-Recipient"))
+		if len(address) == 0 {
+			address = typedField(g.Get("Original-Recipient"))
+		}
+		if len(address) == 0 {
+			continue
+		}
+		status := strings.TrimSpace(g.Get("Status"))
+		events = append(events, &DeliveryEvent{
+			Type:      EventBounce,
+			Address:   address,
+			Permanent: strings.HasPrefix(status, "5"),
+			Status:    status,
+			Reason:    typedField(g.Get("Diagnostic-Code")),
+			Source:    "dsn",
+			Time:      t,
+		})
+	}
+	return events
+}
+
+// readFieldGroups reads blocks of header fields separated by blank lines.
+func readFieldGroups(r io.Reader) ([]textproto.MIMEHeader, error) {
+	var (
+		groups []textproto.MIMEHeader
+		tp     = textproto.NewReader(bufio.NewReader(r))
+	)
+	for {
+		h, err := tp.ReadMIMEHeader()
+		if len(h) > 0 {
+			groups = append(groups, h)
+		}
+		if errors.Is(err, io.EOF) {
+			return groups, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// typedField strips the type from fields like "rfc822; user@example.com"
+// or "smtp; 550 5.1.1 unknown user".
+func typedField(v string) string {
+	if i := strings.IndexByte(v, ';'); i >= 0 {
+		v = v[i+1:]
+	}
+	return strings.Trim(strings.TrimSpace(v), "<>")
+}
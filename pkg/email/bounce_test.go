@@ -0,0 +1,283 @@
+package email
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockdb"
+)
+
+func TestSendGridEvents(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ParseSendGridVerificationKey(base64.StdEncoding.EncodeToString(der))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`[
+		{"email":"a@example.com","timestamp":1000,"event":"bounce","type":"bounce","status":"5.1.1","reason":"550 unknown user","sg_event_id":"ev1"},
+		{"email":"b@example.com","timestamp":1000,"event":"bounce","type":"blocked","status":"4.0.0"},
+		{"email":"c@example.com","timestamp":1000,"event":"spamreport"},
+		{"email":"d@example.com","timestamp":1000,"event":"delivered"}
+	]`)
+	timestamp := "1000"
+	h := sha256.Sum256(append([]byte(timestamp), body...))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := base64.StdEncoding.EncodeToString(sig)
+	now := time.Unix(1000, 0).Add(time.Minute)
+	if err = VerifySendGridSignature(pub, signature, timestamp, body, now); err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifySendGridSignature(pub, signature, "1001", body, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected invalid signature, got %v", err)
+	}
+	if err = VerifySendGridSignature(pub, "", timestamp, body, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected invalid signature, got %v", err)
+	}
+	// Replayed later
+	stale := time.Unix(1000, 0).Add(SendGridMaxAge + time.Second)
+	if err = VerifySendGridSignature(pub, signature, timestamp, body, stale); !errors.Is(err, ErrStaleTimestamp) {
+		t.Errorf("expected stale timestamp, got %v", err)
+	}
+	// From the future
+	early := time.Unix(1000, 0).Add(-SendGridMaxAge - time.Second)
+	if err = VerifySendGridSignature(pub, signature, timestamp, body, early); !errors.Is(err, ErrStaleTimestamp) {
+		t.Errorf("expected stale timestamp, got %v", err)
+	}
+
+	events, err := ParseSendGridEvents(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	for i, exp := range []DeliveryEvent{
+		{ID: "ev1", Type: EventBounce, Address: "a@example.com", Permanent: true, Status: "5.1.1", Reason: "550 unknown user"},
+		{Type: EventBounce, Address: "b@example.com", Status: "4.0.0"},
+		{Type: EventComplaint, Address: "c@example.com"},
+	} {
+		exp.Source = "sendgrid"
+		exp.Time = time.Unix(1000, 0)
+		if *events[i] != exp {
+			t.Errorf("event %d: expected %+v, got %+v", i, exp, *events[i])
+		}
+	}
+	if !events[0].Suppresses() || events[1].Suppresses() || !events[2].Suppresses() {
+		t.Error("wrong suppression rules")
+	}
+}
+
+const testDSN = "From: MAILER-DAEMON@mx.example.com\r\n" +
+	"To: admin@hrry.me\r\n" +
+	"Date: Mon, 02 Jan 2023 15:04:05 +0000\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your message could not be delivered.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.com\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; gone@example.com\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 user unknown\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; <full@example.com>\r\n" +
+	"Action: failed\r\n" +
+	"Status: 4.2.2\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; slow@example.com\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.4.1\r\n" +
+	"--b1--\r\n"
+
+const testARF = "From: abuse@mail.example.com\r\n" +
+	"To: admin@hrry.me\r\n" +
+	"Subject: FW: invite\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=feedback-report; boundary=\"b2\"\r\n" +
+	"\r\n" +
+	"--b2\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"This is an email abuse report.\r\n" +
+	"--b2\r\n" +
+	"Content-Type: message/feedback-report\r\n" +
+	"\r\n" +
+	"Feedback-Type: abuse\r\n" +
+	"Version: 1\r\n" +
+	"--b2\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"From: admin@hrry.me\r\n" +
+	"To: Jane <jane@example.com>\r\n" +
+	"Subject: You're Invited!\r\n" +
+	"--b2--\r\n"
+
+func TestParseDSN(t *testing.T) {
+	events, err := ParseDSN(strings.NewReader(testDSN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	date := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	for i, exp := range []DeliveryEvent{
+		{Type: EventBounce, Address: "gone@example.com", Permanent: true, Status: "5.1.1", Reason: "550 5.1.1 user unknown"},
+		{Type: EventBounce, Address: "full@example.com", Status: "4.2.2"},
+	} {
+		exp.Source = "dsn"
+		if !events[i].Time.Equal(date) {
+			t.Errorf("wrong time %v", events[i].Time)
+		}
+		events[i].Time = time.Time{}
+		if *events[i] != exp {
+			t.Errorf("event %d: expected %+v, got %+v", i, exp, *events[i])
+		}
+	}
+
+	events, err = ParseDSN(strings.NewReader(testARF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	exp := DeliveryEvent{Type: EventComplaint, Address: "jane@example.com", Reason: "abuse", Source: "dsn"}
+	if *events[0] != exp {
+		t.Errorf("expected %+v, got %+v", exp, *events[0])
+	}
+
+	_, err = ParseDSN(strings.NewReader("Content-Type: text/plain\r\n\r\nhello"))
+	if err == nil {
+		t.Error("expected an error for a message that is not a report")
+	}
+}
+
+type testSuppressions map[string]bool
+
+func (ts testSuppressions) Record(_ context.Context, e *DeliveryEvent) error {
+	ts[e.Address] = ts[e.Address] || e.Suppresses()
+	return nil
+}
+
+func (ts testSuppressions) Suppressed(_ context.Context, address string) (bool, error) {
+	return ts[address], nil
+}
+
+func TestOutboxSuppressions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	rows := mockdb.NewMockRows(ctrl)
+	sender := &testSender{}
+	now := time.Unix(1000, 0)
+	list := testSuppressions{}
+	o := NewOutbox(d, sender)
+	o.Now = func() time.Time { return now }
+	o.Suppressions = list
+	ctx := context.Background()
+
+	d.EXPECT().ExecContext(ctx, enqueueOutboxQuery, gomock.Any()).Return(testResult(1), nil)
+	if err := o.Send(ctx, testMessage()); err != nil {
+		t.Fatal(err)
+	}
+	// The address bounces while the message is queued.
+	list.Record(ctx, &DeliveryEvent{Type: EventBounce, Address: "ann@example.com", Permanent: true})
+	if err := o.Send(ctx, testMessage()); !errors.Is(err, ErrSuppressed) || !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expected suppressed error, got %v", err)
+	}
+	mockClaim(t, d, rows, now, o, 1, 0)
+	d.EXPECT().ExecContext(ctx, markFailedQuery, int64(1), OutboxDead, 1, gomock.Any(), "", gomock.Any()).
+		Return(testResult(1), nil)
+	if _, err := o.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.sent) != 0 {
+		t.Error("should not send to a suppressed address")
+	}
+}
+
+func TestPGSuppressionList(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	rows := mockdb.NewMockRows(ctrl)
+	list := NewPGSuppressionList(d)
+	ctx := context.Background()
+	at := time.Unix(1000, 0)
+
+	d.EXPECT().ExecContext(ctx, recordDeliveryEventQuery,
+		"jim@example.com", 0, 1, true, EventComplaint, "", "abuse", "dsn", at,
+	).Return(testResult(1), nil)
+	err := list.Record(ctx, &DeliveryEvent{
+		Type:    EventComplaint,
+		Address: "Jim@Example.com",
+		Reason:  "abuse",
+		Source:  "dsn",
+		Time:    at,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = list.Record(ctx, &DeliveryEvent{Type: EventBounce, Address: "nope"}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected invalid address error, got %v", err)
+	}
+
+	// Events with an id are only counted the first time they are sent.
+	bounce := DeliveryEvent{ID: "ev1", Type: EventBounce, Address: "ann@example.com", Permanent: true, Source: "sendgrid", Time: at}
+	gomock.InOrder(
+		d.EXPECT().ExecContext(ctx, recordDeliveryEventIDQuery, "sendgrid", "ev1").Return(testResult(1), nil),
+		d.EXPECT().ExecContext(ctx, recordDeliveryEventQuery,
+			"ann@example.com", 1, 0, true, EventBounce, "", "", "sendgrid", at,
+		).Return(testResult(1), nil),
+		d.EXPECT().ExecContext(ctx, recordDeliveryEventIDQuery, "sendgrid", "ev1").Return(testResult(0), nil),
+	)
+	if err = list.Record(ctx, &bounce); err != nil {
+		t.Fatal(err)
+	}
+	if err = list.Record(ctx, &bounce); err != nil {
+		t.Fatal(err)
+	}
+
+	gomock.InOrder(
+		d.EXPECT().QueryContext(ctx, gomock.Any(), "jim@example.com").Return(rows, nil),
+		rows.EXPECT().Next().Return(false),
+		rows.EXPECT().Err().Return(nil),
+		rows.EXPECT().Close().Return(nil),
+	)
+	suppressed, err := list.Suppressed(ctx, "JIM@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suppressed {
+		t.Error("unknown addresses should not be suppressed")
+	}
+}
@@ -0,0 +1,295 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DKIMHeader is the name of the header holding a DKIM signature.
+const DKIMHeader = "DKIM-Signature"
+
+// defaultDKIMHeaders are the headers that get signed when they are present
+// in a message.
+var defaultDKIMHeaders = []string{
+	"From",
+	"Reply-To",
+	"Subject",
+	"Date",
+	"To",
+	"Cc",
+	"Message-Id",
+	"Mime-Version",
+	"Content-Type",
+}
+
+// DKIM signs messages using DomainKeys Identified Mail (RFC 6376). Messages
+// are signed with relaxed header and body canonicalization using either
+// rsa-sha256 or ed25519-sha256 (RFC 8463) depending on the key.
+type DKIM struct {
+	// Domain is the signing domain. The domain of the From address is used
+	// when empty.
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+	// Headers is the list of headers to sign, defaults to the From, To,
+	// Subject, Date and content headers.
+	Headers []string
+	Now     func() time.Time
+}
+
+// NewDKIM creates a DKIM signer. The key must be an RSA or Ed25519 private
+// key.
+func NewDKIM(domain, selector string, key crypto.Signer) (*DKIM, error) {
+	if _, err := dkimKeyType(key.Public()); err != nil {
+		return nil, err
+	}
+	if len(selector) == 0 {
+		return nil, fmt.Errorf("dkim: no selector")
+	}
+	return &DKIM{Domain: domain, Selector: selector, Key: key, Now: time.Now}, nil
+}
+
+// Sign returns the message with a DKIM-Signature header added to the top.
+func (d *DKIM) Sign(msg []byte) ([]byte, error) {
+	msg = toCRLF(msg)
+	header, body := splitMessage(msg)
+	fields := parseHeader(header)
+
+	keyType, err := dkimKeyType(d.Key.Public())
+	if err != nil {
+		return nil, err
+	}
+	domain := d.Domain
+	if len(domain) == 0 {
+		domain, err = fromDomain(fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now
+	if d.Now != nil {
+		now = d.Now
+	}
+	names := d.Headers
+	if len(names) == 0 {
+		names = defaultDKIMHeaders
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	signed, hashed := selectHeaders(fields, names)
+	sig := fmt.Sprintf("%s: v=1; a=%s-sha256; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		DKIMHeader,
+		keyType,
+		domain,
+		d.Selector,
+		now().Unix(),
+		strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]),
+	)
+	h := sha256.New()
+	for _, f := range hashed {
+		h.Write([]byte(relaxedHeader(f)))
+		h.Write([]byte("\r\n"))
+	}
+	// The signature header is hashed without its trailing CRLF.
+	h.Write([]byte(relaxedHeader(sig)))
+
+	var b []byte
+	switch keyType {
+	case "rsa":
+		b, err = d.Key.Sign(rand.Reader, h.Sum(nil), crypto.SHA256)
+	case "ed25519":
+		b, err = d.Key.Sign(rand.Reader, h.Sum(nil), crypto.Hash(0))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(sig) + len(msg) + 512)
+	out.WriteString(sig)
+	out.WriteString(foldBase64(base64.StdEncoding.EncodeToString(b)))
+	out.WriteString("\r\n")
+	out.Write(msg)
+	return out.Bytes(), nil
+}
+
+// RecordName is the DNS name that holds the public key for a domain.
+func (d *DKIM) RecordName(domain string) string {
+	return d.Selector + "._domainkey." + domain
+}
+
+// DKIMRecord returns the DNS TXT record value that publishes a DKIM public
+// key.
+func DKIMRecord(pub crypto.PublicKey) (string, error) {
+	keyType, err := dkimKeyType(pub)
+	if err != nil {
+		return "", err
+	}
+	var raw []byte
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		// RFC 8463 publishes the raw key instead of a SubjectPublicKeyInfo.
+		raw = k
+	default:
+		raw, err = x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+	}
+	return "v=DKIM1; k=" + keyType + "; p=" + base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func dkimKeyType(pub crypto.PublicKey) (string, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return "rsa", nil
+	case ed25519.PublicKey:
+		return "ed25519", nil
+	default:
+		return "", fmt.Errorf("dkim: unsupported key type %T", pub)
+	}
+}
+
+func toCRLF(msg []byte) []byte {
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(msg, []byte("\n"), []byte("\r\n"))
+}
+
+func splitMessage(msg []byte) (header, body []byte) {
+	i := bytes.Index(msg, []byte("\r\n\r\n"))
+	if i < 0 {
+		return msg, nil
+	}
+	return msg[:i+2], msg[i+4:]
+}
+
+// parseHeader splits a header into its fields. Each field keeps its folding
+// whitespace but not the trailing CRLF.
+func parseHeader(header []byte) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if len(line) == 0 {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	for i, f := range fields {
+		fields[i] = strings.TrimSuffix(f, "\r\n")
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimRight(field[:i], " \t")
+}
+
+// selectHeaders picks the fields to sign. Repeated headers are signed from
+// the bottom up.
+func selectHeaders(fields, names []string) (signed, hashed []string) {
+	used := make(map[int]bool)
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			signed = append(signed, strings.ToLower(name))
+			hashed = append(hashed, fields[i])
+			break
+		}
+	}
+	return signed, hashed
+}
+
+func fromDomain(fields []string) (string, error) {
+	for _, f := range fields {
+		if !strings.EqualFold(fieldName(f), "From") {
+			continue
+		}
+		v := strings.TrimSpace(f[strings.IndexByte(f, ':')+1:])
+		v = strings.TrimSuffix(v, ">")
+		if i := strings.LastIndexByte(v, '@'); i >= 0 {
+			return strings.ToLower(v[i+1:]), nil
+		}
+	}
+	return "", fmt.Errorf("dkim: could not find the from address domain")
+}
+
+// relaxedHeader canonicalizes a header field using the "relaxed" algorithm
+// without the trailing CRLF.
+func relaxedHeader(field string) string {
+	i := strings.IndexByte(field, ':')
+	name := strings.ToLower(strings.TrimRight(field[:i], " \t"))
+	value := strings.NewReplacer("\r\n", "").Replace(field[i+1:])
+	return name + ":" + strings.TrimSpace(collapseWSP(value))
+}
+
+// relaxedBody canonicalizes a message body using the "relaxed" algorithm.
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	var b strings.Builder
+	b.Grow(len(body))
+	for _, line := range lines {
+		b.WriteString(strings.TrimRight(collapseWSP(line), " "))
+		b.WriteString("\r\n")
+	}
+	out := strings.TrimRight(b.String(), "\r\n")
+	if len(out) == 0 {
+		return nil
+	}
+	return []byte(out + "\r\n")
+}
+
+func collapseWSP(s string) string {
+	var (
+		b   strings.Builder
+		wsp bool
+	)
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			wsp = true
+			continue
+		}
+		if wsp {
+			b.WriteByte(' ')
+			wsp = false
+		}
+		b.WriteByte(s[i])
+	}
+	if wsp {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// foldBase64 breaks up long signatures to keep header lines short.
+func foldBase64(s string) string {
+	const width = 72
+	var b strings.Builder
+	for len(s) > width {
+		b.WriteString(s[:width])
+		b.WriteString("\r\n\t")
+		s = s[width:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
@@ -0,0 +1,159 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDKIMCanonicalization(t *testing.T) {
+	// Examples from RFC 6376 section 3.4.5
+	fields := parseHeader([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n"))
+	if len(fields) != 2 {
+		t.Fatalf("expected 2 fields, got %q", fields)
+	}
+	for i, exp := range []string{"a:X", "b:Y Z"} {
+		if got := relaxedHeader(fields[i]); got != exp {
+			t.Errorf("expected %q, got %q", exp, got)
+		}
+	}
+	body := relaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n"))
+	if string(body) != " C\r\nD E\r\n" {
+		t.Errorf("wrong body canonicalization %q", body)
+	}
+	if body = relaxedBody([]byte("\r\n\r\n")); len(body) != 0 {
+		t.Errorf("expected empty body, got %q", body)
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("From: Jim <jim@Example.com>\n" +
+		"To: joe@example.com\n" +
+		"Subject: hello\n" +
+		"  there\n" +
+		"X-Unsigned: yes\n" +
+		"\n" +
+		"Hi Joe,  \n" +
+		"\n" +
+		"\n")
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		d, err := NewDKIM("", "mail", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Now = func() time.Time { return time.Unix(100, 0) }
+		signed, err := d.Sign(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, _ := splitMessage(signed)
+		fields := parseHeader(header)
+		sig := fields[0]
+		if !strings.HasPrefix(sig, DKIMHeader+":") {
+			t.Fatalf("expected signature to be the first header, got %q", sig)
+		}
+		tags := dkimTags(sig)
+		if tags["d"] != "example.com" || tags["s"] != "mail" || tags["t"] != "100" {
+			t.Errorf("wrong tags: %v", tags)
+		}
+		if tags["h"] != "from:subject:to" {
+			t.Errorf("wrong signed headers %q", tags["h"])
+		}
+		bh := sha256.Sum256([]byte("Hi Joe,\r\n"))
+		if tags["bh"] != base64.StdEncoding.EncodeToString(bh[:]) {
+			t.Errorf("wrong body hash %q", tags["bh"])
+		}
+
+		// Verify the signature the way a receiver would.
+		h := sha256.New()
+		for _, name := range strings.Split(tags["h"], ":") {
+			for _, f := range fields[1:] {
+				if strings.EqualFold(fieldName(f), name) {
+					h.Write([]byte(relaxedHeader(f) + "\r\n"))
+				}
+			}
+		}
+		unsigned := regexp.MustCompile(`b=[^;]*$`).ReplaceAllString(sig, "b=")
+		h.Write([]byte(relaxedHeader(unsigned)))
+		b, err := base64.StdEncoding.DecodeString(tags["b"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			if tags["a"] != "rsa-sha256" {
+				t.Errorf("wrong algorithm %q", tags["a"])
+			}
+			err = rsa.VerifyPKCS1v15(&k.PublicKey, crypto.SHA256, h.Sum(nil), b)
+		case ed25519.PrivateKey:
+			if tags["a"] != "ed25519-sha256" {
+				t.Errorf("wrong algorithm %q", tags["a"])
+			}
+			if !ed25519.Verify(k.Public().(ed25519.PublicKey), h.Sum(nil), b) {
+				err = ErrInvalid
+			}
+		}
+		if err != nil {
+			t.Errorf("%T signature did not verify: %v", key, err)
+		}
+	}
+}
+
+func TestDKIMRecord(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := DKIMRecord(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec != "v=DKIM1; k=ed25519; p="+base64.StdEncoding.EncodeToString(pub) {
+		t.Errorf("wrong record %q", rec)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, err = DKIMRecord(rsaKey.Public()); err != nil || !strings.HasPrefix(rec, "v=DKIM1; k=rsa; p=MI") {
+		t.Errorf("wrong record %q: %v", rec, err)
+	}
+	if _, err = NewDKIM("example.com", "", rsaKey); err == nil {
+		t.Error("expected an error without a selector")
+	}
+	d, err := NewDKIM("example.com", "s1", rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := d.RecordName("hrry.me"); name != "s1._domainkey.hrry.me" {
+		t.Errorf("wrong record name %q", name)
+	}
+}
+
+// dkimTags parses the tags of a DKIM-Signature header.
+func dkimTags(field string) map[string]string {
+	value := field[strings.IndexByte(field, ':')+1:]
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		k, v, _ := strings.Cut(tag, "=")
+		v = string(bytes.Join(bytes.Fields([]byte(v)), nil))
+		tags[strings.TrimSpace(k)] = v
+	}
+	return tags
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"regexp"
+	"strings"
 
 	"github.com/sendgrid/rest"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
@@ -26,3 +27,14 @@ func Valid(address string) bool {
 	}
 	return emailRegexp.MatchString(address)
 }
+
+// Normalize will trim whitespace from an email address and lowercase the
+// domain. The local part is left as is since it is technically case sensitive.
+func Normalize(address string) string {
+	address = strings.TrimSpace(address)
+	ix := strings.LastIndexByte(address, '@')
+	if ix < 0 {
+		return address
+	}
+	return address[:ix] + strings.ToLower(address[ix:])
+}
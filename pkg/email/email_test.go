@@ -52,3 +52,20 @@ func TestIsEmail(t *testing.T) {
 		}
 	}
 }
+
+func TestNormalize(t *testing.T) {
+	for _, tt := range []struct {
+		in, exp string
+	}{
+		{"test@example.com", "test@example.com"},
+		{"  test@example.com\n", "test@example.com"},
+		{"Test@Example.COM", "Test@example.com"},
+		{"a@b@EXAMPLE.com", "a@b@example.com"},
+		{"not-an-email", "not-an-email"},
+		{"", ""},
+	} {
+		if got := Normalize(tt.in); got != tt.exp {
+			t.Errorf("Normalize(%q): got %q, want %q", tt.in, got, tt.exp)
+		}
+	}
+}
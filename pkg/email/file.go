@@ -0,0 +1,60 @@
+package email
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileSink writes messages to a directory as .eml files instead of sending
+// them. It is meant for development and tests.
+type FileSink struct {
+	Dir string
+	Now func() time.Time
+}
+
+var _ Sender = (*FileSink)(nil)
+
+func NewFileSink(dir string) *FileSink {
+	return &FileSink{Dir: dir, Now: time.Now}
+}
+
+func (fs *FileSink) Send(ctx context.Context, msg *Message) error {
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(fs.Dir, 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so that readers never see a partial
+	// message.
+	tmp, err := os.CreateTemp(fs.Dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = msg.mime().WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	var b [4]byte
+	if _, err = rand.Read(b[:]); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", fs.now().UnixNano(), hex.EncodeToString(b[:]))
+	return os.Rename(tmp.Name(), filepath.Join(fs.Dir, name))
+}
+
+func (fs *FileSink) now() time.Time {
+	if fs.Now == nil {
+		return time.Now()
+	}
+	return fs.Now()
+}
@@ -0,0 +1,97 @@
+package email
+
+import (
+	"context"
+	"fmt"
+
+	"gopkg.in/gomail.v2"
+)
+
+// Message is an email that can be delivered by any Sender.
+type Message struct {
+	From    Email   `json:"from"`
+	To      []Email `json:"to"`
+	ReplyTo *Email  `json:"reply_to,omitempty"`
+	Subject string  `json:"subject"`
+	// Text is the plain text body.
+	Text string `json:"text,omitempty"`
+	// HTML is the html body. When both Text and HTML are set the html body is
+	// sent as an alternative to the plain text.
+	HTML string `json:"html,omitempty"`
+	// Headers are extra headers added to the message.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Sender delivers email messages.
+type Sender interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// Responder is implemented by senders that can report the email provider's
+// response for a delivered message.
+type Responder interface {
+	SendResponse(ctx context.Context, msg *Message) (string, error)
+}
+
+// NewMessage creates a message for a single recipient.
+func NewMessage(from, to *Email, subject, text, html string) *Message {
+	return &Message{
+		From:    *from,
+		To:      []Email{*to},
+		Subject: subject,
+		Text:    text,
+		HTML:    html,
+	}
+}
+
+// Validate checks that the message has a sender, at least one recipient, and
+// a body.
+func (m *Message) Validate() error {
+	if !Valid(m.From.Address) {
+		return fmt.Errorf("%w: bad sender %q", ErrInvalid, m.From.Address)
+	}
+	if len(m.To) == 0 {
+		return fmt.Errorf("%w: no recipients", ErrInvalid)
+	}
+	for _, to := range m.To {
+		if !Valid(to.Address) {
+			return fmt.Errorf("%w: bad recipient %q", ErrInvalid, to.Address)
+		}
+	}
+	if m.ReplyTo != nil && !Valid(m.ReplyTo.Address) {
+		return fmt.Errorf("%w: bad reply-to %q", ErrInvalid, m.ReplyTo.Address)
+	}
+	if len(m.Text) == 0 && len(m.HTML) == 0 {
+		return fmt.Errorf("%w: empty body", ErrInvalid)
+	}
+	return nil
+}
+
+// mime converts the message to a MIME message that can be written out in
+// RFC 5322 format.
+func (m *Message) mime() *gomail.Message {
+	msg := gomail.NewMessage()
+	msg.SetAddressHeader("From", m.From.Address, m.From.Name)
+	to := make([]string, len(m.To))
+	for i, addr := range m.To {
+		to[i] = msg.FormatAddress(addr.Address, addr.Name)
+	}
+	msg.SetHeader("To", to...)
+	if m.ReplyTo != nil {
+		msg.SetAddressHeader("Reply-To", m.ReplyTo.Address, m.ReplyTo.Name)
+	}
+	msg.SetHeader("Subject", m.Subject)
+	for k, v := range m.Headers {
+		msg.SetHeader(k, v)
+	}
+	switch {
+	case len(m.Text) > 0 && len(m.HTML) > 0:
+		msg.SetBody("text/plain", m.Text)
+		msg.AddAlternative("text/html", m.HTML)
+	case len(m.HTML) > 0:
+		msg.SetBody("text/html", m.HTML)
+	default:
+		msg.SetBody("text/plain", m.Text)
+	}
+	return msg
+}
@@ -0,0 +1,443 @@
+package email
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.hrry.dev/homelab/pkg/db"
+	"gopkg.hrry.dev/homelab/pkg/log"
+)
+
+var (
+	logger      = log.GetLogger()
+	errNoSender = errors.New("no email sender configured")
+)
+
+// OutboxStatus is the delivery state of a message in the outbox.
+type OutboxStatus string
+
+const (
+	OutboxPending OutboxStatus = "pending"
+	OutboxSent    OutboxStatus = "sent"
+	// OutboxDead is for messages that failed too many times.
+	OutboxDead OutboxStatus = "dead"
+)
+
+const (
+	defaultOutboxAttempts = 8
+	defaultOutboxBackoff  = time.Minute
+	defaultOutboxMaxWait  = time.Hour * 6
+	defaultOutboxLease    = time.Minute * 5
+	defaultOutboxBatch    = 20
+)
+
+// KindEmail is the kind of outbox entries that are emails. Other kinds are
+// delivered by the handler registered with Outbox.Handle.
+const KindEmail = "email"
+
+// ErrUndeliverable is returned by handlers for entries that will never be
+// delivered. Those entries are marked as dead without more attempts.
+var ErrUndeliverable = errors.New("outbox entry cannot be delivered")
+
+// OutboxHandler delivers outbox entries that are not emails.
+type OutboxHandler interface {
+	Deliver(ctx context.Context, payload []byte) error
+}
+
+// OutboxEntry is a message stored in the outbox.
+type OutboxEntry struct {
+	ID      int64   `json:"id"`
+	Kind    string  `json:"kind"`
+	Message Message `json:"message"`
+	// Payload is the raw entry for kinds other than email.
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	Status        OutboxStatus    `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	LastError     string          `json:"last_error,omitempty"`
+	Response      string          `json:"response,omitempty"`
+	SentAt        *time.Time      `json:"sent_at,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+// NewOutbox creates an outbox that stores messages in postgres and delivers
+// them using sender.
+func NewOutbox(d db.DB, sender Sender) *Outbox {
+	return &Outbox{
+		DB:          d,
+		Sender:      sender,
+		MaxAttempts: defaultOutboxAttempts,
+		Backoff:     defaultOutboxBackoff,
+		MaxBackoff:  defaultOutboxMaxWait,
+		Lease:       defaultOutboxLease,
+		BatchSize:   defaultOutboxBatch,
+		Now:         time.Now,
+	}
+}
+
+// Outbox is a durable queue of emails. Send only saves the message, Run will
+// deliver saved messages and retry them with exponential backoff until they
+// are sent or have failed MaxAttempts times.
+type Outbox struct {
+	DB db.DB
+	// Sender delivers messages taken out of the outbox.
+	Sender Sender
+	// MaxAttempts is the number of failed attempts before a message is marked
+	// as dead.
+	MaxAttempts int
+	// Backoff is the delay before the first retry.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Lease is how long a worker has to send a message before another worker
+	// will pick it up.
+	Lease     time.Duration
+	BatchSize int
+	Now       func() time.Time
+	// Suppressions stops messages to addresses that bounced or complained
+	// from being queued or sent. Optional.
+	Suppressions SuppressionList
+
+	handlers map[string]OutboxHandler
+}
+
+var _ Sender = (*Outbox)(nil)
+
+const (
+	enqueueOutboxQuery = `INSERT INTO email_outbox (message) VALUES ($1)`
+	enqueueKindQuery   = `INSERT INTO email_outbox (kind, message) VALUES ($1, $2)`
+
+	claimOutboxQuery = `
+	UPDATE email_outbox
+	SET next_attempt_at = $2,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id IN (
+		SELECT id FROM email_outbox
+		WHERE status = 'pending' AND next_attempt_at <= $1
+		ORDER BY next_attempt_at
+		LIMIT $3
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING id, kind, message, attempts`
+
+	markSentQuery = `
+	UPDATE email_outbox
+	SET status = 'sent',
+		attempts = $2,
+		response = $3,
+		last_error = NULL,
+		sent_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = $1`
+
+	markFailedQuery = `
+	UPDATE email_outbox
+	SET status = $2,
+		attempts = $3,
+		last_error = $4,
+		response = $5,
+		next_attempt_at = $6,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = $1`
+
+	retryOutboxQuery = `
+	UPDATE email_outbox
+	SET status = 'pending',
+		attempts = 0,
+		next_attempt_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND status <> 'pending'`
+
+	listOutboxQuery = `
+	SELECT
+		id,
+		kind,
+		message,
+		status,
+		attempts,
+		next_attempt_at,
+		COALESCE(last_error, ''),
+		COALESCE(response, ''),
+		sent_at,
+		created_at
+	FROM email_outbox
+	WHERE status = $1
+	ORDER BY created_at DESC
+	LIMIT $2 OFFSET $3`
+)
+
+// Send saves the message in the outbox. When ctx comes from db.InTx the
+// message is only queued if the transaction is committed.
+func (o *Outbox) Send(ctx context.Context, msg *Message) error {
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+	if o.Suppressions != nil {
+		if err := deliverable(ctx, o.Suppressions, msg); err != nil {
+			return err
+		}
+	}
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = o.DB.ExecContext(ctx, enqueueOutboxQuery, raw)
+	return err
+}
+
+// Handle registers the handler for outbox entries of one kind.
+func (o *Outbox) Handle(kind string, h OutboxHandler) {
+	if o.handlers == nil {
+		o.handlers = make(map[string]OutboxHandler)
+	}
+	o.handlers[kind] = h
+}
+
+// Enqueue saves an entry that is delivered by the handler for its kind. Like
+// Send, the entry is only queued if the transaction in ctx is committed.
+func (o *Outbox) Enqueue(ctx context.Context, kind string, payload interface{}) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = o.DB.ExecContext(ctx, enqueueKindQuery, kind, raw)
+	return err
+}
+
+// Run delivers messages every interval until the context is cancelled.
+func (o *Outbox) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := o.Process(ctx)
+		if err != nil {
+			logger.WithError(err).Error("failed to process email outbox")
+		}
+		// Keep going if there is a backlog.
+		if err == nil && n >= o.batchSize() {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+type claimedMessage struct {
+	id       int64
+	attempts int
+	kind     string
+	payload  []byte
+	msg      Message
+}
+
+// Process attempts to deliver one batch of messages that are due and returns
+// the number of messages attempted.
+func (o *Outbox) Process(ctx context.Context) (int, error) {
+	now := o.now()
+	rows, err := o.DB.QueryContext(ctx, claimOutboxQuery, now, now.Add(o.lease()), o.batchSize())
+	if err != nil {
+		return 0, err
+	}
+	claimed := make([]claimedMessage, 0)
+	for rows.Next() {
+		var c claimedMessage
+		if err = rows.Scan(&c.id, &c.kind, &c.payload, &c.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if c.kind == KindEmail {
+			if err = json.Unmarshal(c.payload, &c.msg); err != nil {
+				rows.Close()
+				return 0, err
+			}
+		}
+		claimed = append(claimed, c)
+	}
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	if err = rows.Close(); err != nil {
+		return 0, err
+	}
+	for i := range claimed {
+		if err = o.deliver(ctx, &claimed[i]); err != nil {
+			return i + 1, err
+		}
+	}
+	return len(claimed), nil
+}
+
+func (o *Outbox) deliver(ctx context.Context, c *claimedMessage) error {
+	var (
+		response string
+		err      error
+		attempts = c.attempts + 1
+	)
+	if c.kind != KindEmail {
+		err = o.handle(ctx, c)
+	} else {
+		if o.Suppressions != nil {
+			// The address may have bounced since the message was queued.
+			err = deliverable(ctx, o.Suppressions, &c.msg)
+		}
+		if err == nil {
+			response, err = o.send(ctx, &c.msg)
+		}
+	}
+	if err == nil {
+		_, err = o.DB.ExecContext(ctx, markSentQuery, c.id, attempts, response)
+		return err
+	}
+	var pe *ProviderError
+	if errors.As(err, &pe) {
+		response = pe.Body
+	}
+	status := OutboxPending
+	next := o.now().Add(o.backoff(attempts))
+	if attempts >= o.maxAttempts() || errors.Is(err, ErrInvalid) || errors.Is(err, ErrUndeliverable) {
+		status = OutboxDead
+	}
+	logger.WithFields(logrus.Fields{
+		"error":    err,
+		"id":       c.id,
+		"kind":     c.kind,
+		"attempts": attempts,
+		"status":   status,
+	}).Warn("failed to deliver from outbox")
+	_, err = o.DB.ExecContext(ctx, markFailedQuery, c.id, status, attempts, err.Error(), response, next)
+	return err
+}
+
+func (o *Outbox) handle(ctx context.Context, c *claimedMessage) error {
+	h, ok := o.handlers[c.kind]
+	if !ok {
+		return fmt.Errorf("%w: no handler for %q", ErrUndeliverable, c.kind)
+	}
+	return h.Deliver(ctx, c.payload)
+}
+
+func (o *Outbox) send(ctx context.Context, msg *Message) (string, error) {
+	if o.Sender == nil {
+		return "", errNoSender
+	}
+	if r, ok := o.Sender.(Responder); ok {
+		return r.SendResponse(ctx, msg)
+	}
+	return "", o.Sender.Send(ctx, msg)
+}
+
+// List returns messages with a status, newest first.
+func (o *Outbox) List(ctx context.Context, status OutboxStatus, opts db.PaginationOpts) ([]*OutboxEntry, error) {
+	rows, err := o.DB.QueryContext(ctx, listOutboxQuery, status, opts.Limit, opts.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]*OutboxEntry, 0)
+	for rows.Next() {
+		var (
+			e      OutboxEntry
+			raw    []byte
+			sentAt sql.NullTime
+		)
+		err = rows.Scan(
+			&e.ID,
+			&e.Kind,
+			&raw,
+			&e.Status,
+			&e.Attempts,
+			&e.NextAttemptAt,
+			&e.LastError,
+			&e.Response,
+			&sentAt,
+			&e.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if e.Kind == KindEmail {
+			if err = json.Unmarshal(raw, &e.Message); err != nil {
+				return nil, err
+			}
+		} else {
+			e.Payload = raw
+		}
+		if sentAt.Valid {
+			e.SentAt = &sentAt.Time
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
+
+// Retry puts a sent or dead message back into the queue to be sent again.
+// It returns sql.ErrNoRows if there is no such message or if it is already
+// pending.
+func (o *Outbox) Retry(ctx context.Context, id int64) error {
+	res, err := o.DB.ExecContext(ctx, retryOutboxQuery, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (o *Outbox) backoff(attempts int) time.Duration {
+	d := o.Backoff
+	if d <= 0 {
+		d = defaultOutboxBackoff
+	}
+	max := o.MaxBackoff
+	if max <= 0 {
+		max = defaultOutboxMaxWait
+	}
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
+func (o *Outbox) maxAttempts() int {
+	if o.MaxAttempts <= 0 {
+		return defaultOutboxAttempts
+	}
+	return o.MaxAttempts
+}
+
+func (o *Outbox) lease() time.Duration {
+	if o.Lease <= 0 {
+		return defaultOutboxLease
+	}
+	return o.Lease
+}
+
+func (o *Outbox) batchSize() int {
+	if o.BatchSize <= 0 {
+		return defaultOutboxBatch
+	}
+	return o.BatchSize
+}
+
+func (o *Outbox) now() time.Time {
+	if o.Now == nil {
+		return time.Now()
+	}
+	return o.Now()
+}
@@ -0,0 +1,214 @@
+package email
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockdb"
+)
+
+type testSender struct {
+	errs []error
+	sent []*Message
+}
+
+func (ts *testSender) Send(_ context.Context, msg *Message) error {
+	ts.sent = append(ts.sent, msg)
+	if len(ts.errs) == 0 {
+		return nil
+	}
+	err := ts.errs[0]
+	ts.errs = ts.errs[1:]
+	return err
+}
+
+type testResult int64
+
+func (r testResult) LastInsertId() (int64, error) { return 0, nil }
+func (r testResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+func mockClaim(t *testing.T, d *mockdb.MockDB, rows *mockdb.MockRows, now time.Time, o *Outbox, id int64, attempts int) {
+	t.Helper()
+	mockClaimKind(t, d, rows, now, o, id, attempts, KindEmail, testMessage())
+}
+
+func mockClaimKind(
+	t *testing.T,
+	d *mockdb.MockDB,
+	rows *mockdb.MockRows,
+	now time.Time,
+	o *Outbox,
+	id int64,
+	attempts int,
+	kind string,
+	payload interface{},
+) {
+	t.Helper()
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gomock.InOrder(
+		d.EXPECT().QueryContext(gomock.Any(), claimOutboxQuery, now, now.Add(o.Lease), o.BatchSize).Return(rows, nil),
+		rows.EXPECT().Next().Return(true),
+		rows.EXPECT().Scan(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(dest ...interface{}) error {
+			*dest[0].(*int64) = id
+			*dest[1].(*string) = kind
+			*dest[2].(*[]byte) = raw
+			*dest[3].(*int) = attempts
+			return nil
+		}),
+		rows.EXPECT().Next().Return(false),
+		rows.EXPECT().Err().Return(nil),
+		rows.EXPECT().Close().Return(nil),
+	)
+}
+
+func TestOutbox(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	rows := mockdb.NewMockRows(ctrl)
+	sender := &testSender{}
+	now := time.Unix(1000, 0)
+	o := NewOutbox(d, sender)
+	o.Now = func() time.Time { return now }
+	o.MaxAttempts = 3
+	o.Backoff = time.Minute
+	ctx := context.Background()
+
+	// Enqueue
+	d.EXPECT().ExecContext(ctx, enqueueOutboxQuery, gomock.Any()).Return(testResult(1), nil)
+	if err := o.Send(ctx, testMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Send(ctx, &Message{}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected invalid message error, got %v", err)
+	}
+
+	// Delivered
+	mockClaim(t, d, rows, now, o, 1, 0)
+	d.EXPECT().ExecContext(ctx, markSentQuery, int64(1), 1, "").Return(testResult(1), nil)
+	n, err := o.Process(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || len(sender.sent) != 1 || sender.sent[0].Subject != "hello" {
+		t.Errorf("expected one message to be sent")
+	}
+
+	// Failed, retried later with backoff
+	sender.errs = []error{&ProviderError{StatusCode: 503, Body: "unavailable"}}
+	mockClaim(t, d, rows, now, o, 2, 1)
+	d.EXPECT().ExecContext(
+		ctx, markFailedQuery, int64(2), OutboxPending, 2, gomock.Any(), "unavailable", now.Add(2*time.Minute),
+	).Return(testResult(1), nil)
+	if _, err = o.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Too many attempts
+	sender.errs = []error{errors.New("down")}
+	mockClaim(t, d, rows, now, o, 3, 2)
+	d.EXPECT().ExecContext(
+		ctx, markFailedQuery, int64(3), OutboxDead, 3, "down", "", gomock.Any(),
+	).Return(testResult(1), nil)
+	if _, err = o.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retry
+	d.EXPECT().ExecContext(ctx, retryOutboxQuery, int64(3)).Return(testResult(1), nil)
+	if err = o.Retry(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	d.EXPECT().ExecContext(ctx, retryOutboxQuery, int64(4)).Return(testResult(0), nil)
+	if err = o.Retry(ctx, 4); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+type testHandler struct {
+	err      error
+	payloads []string
+}
+
+func (th *testHandler) Deliver(_ context.Context, payload []byte) error {
+	th.payloads = append(th.payloads, string(payload))
+	return th.err
+}
+
+func TestOutboxHandlers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	rows := mockdb.NewMockRows(ctrl)
+	now := time.Unix(1000, 0)
+	o := NewOutbox(d, nil)
+	o.Now = func() time.Time { return now }
+	o.Backoff = time.Minute
+	h := &testHandler{}
+	o.Handle("hook", h)
+	ctx := context.Background()
+
+	d.EXPECT().ExecContext(ctx, enqueueKindQuery, "hook", []byte(`{"a":1}`)).Return(testResult(1), nil)
+	if err := o.Enqueue(ctx, "hook", map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delivered
+	mockClaimKind(t, d, rows, now, o, 1, 0, "hook", map[string]int{"a": 1})
+	d.EXPECT().ExecContext(ctx, markSentQuery, int64(1), 1, "").Return(testResult(1), nil)
+	if _, err := o.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.payloads) != 1 || h.payloads[0] != `{"a":1}` {
+		t.Errorf("wrong payloads delivered: %v", h.payloads)
+	}
+
+	// Failed, retried later
+	h.err = errors.New("timeout")
+	mockClaimKind(t, d, rows, now, o, 2, 0, "hook", map[string]int{"a": 2})
+	d.EXPECT().ExecContext(
+		ctx, markFailedQuery, int64(2), OutboxPending, 1, "timeout", "", now.Add(time.Minute),
+	).Return(testResult(1), nil)
+	if _, err := o.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Undeliverable entries are not retried
+	h.err = fmt.Errorf("%w: bad url", ErrUndeliverable)
+	mockClaimKind(t, d, rows, now, o, 3, 0, "hook", map[string]int{"a": 3})
+	d.EXPECT().ExecContext(
+		ctx, markFailedQuery, int64(3), OutboxDead, 1, gomock.Any(), "", gomock.Any(),
+	).Return(testResult(1), nil)
+	if _, err := o.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown kind
+	mockClaimKind(t, d, rows, now, o, 4, 0, "other", map[string]int{})
+	d.EXPECT().ExecContext(
+		ctx, markFailedQuery, int64(4), OutboxDead, 1, gomock.Any(), "", gomock.Any(),
+	).Return(testResult(1), nil)
+	if _, err := o.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	o := Outbox{Backoff: time.Second, MaxBackoff: time.Second * 10}
+	for attempts, expected := range []time.Duration{
+		time.Second, time.Second, time.Second * 2, time.Second * 4, time.Second * 8, time.Second * 10, time.Second * 10,
+	} {
+		if got := o.backoff(attempts); got != expected {
+			t.Errorf("backoff(%d) = %v, want %v", attempts, got, expected)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sendgrid/rest"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+func testMessage() *Message {
+	return &Message{
+		From:    Email{Name: "Jim", Address: "jim@example.com"},
+		To:      []Email{{Name: "Joe", Address: "joe@example.com"}, {Address: "ann@example.com"}},
+		Subject: "hello",
+		Text:    "hi there",
+		HTML:    "<p>hi there</p>",
+		Headers: map[string]string{"X-Test": "yes"},
+	}
+}
+
+func TestMessageValidate(t *testing.T) {
+	for _, msg := range []*Message{
+		{To: []Email{{Address: "a@a.com"}}, Text: "x"},
+		{From: Email{Address: "a@a.com"}, Text: "x"},
+		{From: Email{Address: "a@a.com"}, To: []Email{{Address: "not an email"}}, Text: "x"},
+		{From: Email{Address: "a@a.com"}, To: []Email{{Address: "b@b.com"}}},
+	} {
+		if err := msg.Validate(); !errors.Is(err, ErrInvalid) {
+			t.Errorf("expected ErrInvalid, got %v", err)
+		}
+	}
+	if err := testMessage().Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseSMTPURL(t *testing.T) {
+	for _, tt := range []struct {
+		url      string
+		expected SMTP
+	}{
+		{"smtp://mail.example.com", SMTP{Host: "mail.example.com", Port: 587}},
+		{"smtps://mail.example.com", SMTP{Host: "mail.example.com", Port: 465, ImplicitTLS: true}},
+		{"smtp://me:pw@mail.example.com:2525", SMTP{Host: "mail.example.com", Port: 2525, Username: "me", Password: "pw"}},
+	} {
+		s, err := ParseSMTPURL(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *s != tt.expected {
+			t.Errorf("%s: got %+v, want %+v", tt.url, *s, tt.expected)
+		}
+	}
+	for _, bad := range []string{"http://mail.example.com", "smtp://", "smtp://host:port"} {
+		if _, err := ParseSMTPURL(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir := t.TempDir()
+	sink := NewFileSink(dir)
+	sink.Now = func() time.Time { return time.Unix(10, 0) }
+	if err := sink.Send(context.Background(), testMessage()); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !strings.HasSuffix(files[0], ".eml") {
+		t.Fatalf("expected one .eml file, got %v", files)
+	}
+	raw, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`From: "Jim" <jim@example.com>`,
+		`To: "Joe" <joe@example.com>, ann@example.com`,
+		"Subject: hello",
+		"X-Test: yes",
+		"text/plain",
+		"text/html",
+	} {
+		if !strings.Contains(string(raw), want) {
+			t.Errorf("message missing %q:\n%s", want, raw)
+		}
+	}
+	if err = sink.Send(context.Background(), &Message{}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected ErrInvalid, got %v", err)
+	}
+}
+
+type testClient struct {
+	msg      *mail.SGMailV3
+	response *rest.Response
+}
+
+func (tc *testClient) SendWithContext(_ context.Context, msg *mail.SGMailV3) (*rest.Response, error) {
+	tc.msg = msg
+	return tc.response, nil
+}
+
+func TestSendGrid(t *testing.T) {
+	client := &testClient{response: &rest.Response{StatusCode: 202}}
+	sender := NewSendGrid(client)
+	if err := sender.Send(context.Background(), testMessage()); err != nil {
+		t.Fatal(err)
+	}
+	m := client.msg
+	if m.From.Address != "jim@example.com" || m.Subject != "hello" {
+		t.Errorf("wrong sender or subject: %+v", m)
+	}
+	if len(m.Personalizations) != 1 || len(m.Personalizations[0].To) != 2 {
+		t.Errorf("expected two recipients")
+	}
+	if len(m.Content) != 2 || m.Content[0].Type != "text/plain" || m.Content[1].Type != "text/html" {
+		t.Errorf("wrong content: %+v", m.Content)
+	}
+	if m.Headers["X-Test"] != "yes" {
+		t.Errorf("missing header")
+	}
+
+	client.response = &rest.Response{StatusCode: 400, Body: "bad"}
+	var pe *ProviderError
+	if err := sender.Send(context.Background(), testMessage()); !errors.As(err, &pe) || pe.StatusCode != 400 {
+		t.Errorf("expected a provider error, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/sendgrid/sendgrid-go"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+// NewSendGrid creates a Sender that uses the SendGrid api.
+func NewSendGrid(client Client) Sender {
+	return &sendgridSender{client: client}
+}
+
+// NewSendGridKey creates a SendGrid Sender from an api key.
+func NewSendGridKey(key string) Sender {
+	return NewSendGrid(sendgrid.NewSendClient(key))
+}
+
+type sendgridSender struct {
+	client Client
+}
+
+// ProviderError is returned when an email provider rejects a message.
+type ProviderError struct {
+	StatusCode int
+	Body       string
+}
+
+func (pe *ProviderError) Error() string {
+	return fmt.Sprintf("email provider responded with status %d: %s", pe.StatusCode, pe.Body)
+}
+
+func (ss *sendgridSender) Send(ctx context.Context, msg *Message) error {
+	_, err := ss.SendResponse(ctx, msg)
+	return err
+}
+
+// SendResponse sends the message and returns the status and message id
+// returned by SendGrid.
+func (ss *sendgridSender) SendResponse(ctx context.Context, msg *Message) (string, error) {
+	if err := msg.Validate(); err != nil {
+		return "", err
+	}
+	response, err := ss.client.SendWithContext(ctx, toSendGrid(msg))
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode >= 300 {
+		return "", &ProviderError{StatusCode: response.StatusCode, Body: response.Body}
+	}
+	res := strconv.Itoa(response.StatusCode)
+	if ids := response.Headers["X-Message-Id"]; len(ids) > 0 {
+		res += " " + ids[0]
+	}
+	return res, nil
+}
+
+func toSendGrid(msg *Message) *mail.SGMailV3 {
+	m := mail.NewV3Mail()
+	from := msg.From
+	m.SetFrom(&from)
+	m.Subject = msg.Subject
+	p := mail.NewPersonalization()
+	for i := range msg.To {
+		to := msg.To[i]
+		p.AddTos(&to)
+	}
+	m.AddPersonalizations(p)
+	if msg.ReplyTo != nil {
+		replyTo := *msg.ReplyTo
+		m.SetReplyTo(&replyTo)
+	}
+	// SendGrid requires the plain text content to come first.
+	if len(msg.Text) > 0 {
+		m.AddContent(mail.NewContent("text/plain", msg.Text))
+	}
+	if len(msg.HTML) > 0 {
+		m.AddContent(mail.NewContent("text/html", msg.HTML))
+	}
+	for k, v := range msg.Headers {
+		m.SetHeader(k, v)
+	}
+	return m
+}
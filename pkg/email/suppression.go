@@ -0,0 +1,201 @@
+package email
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.hrry.dev/homelab/pkg/db"
+)
+
+// ErrSuppressed is returned when sending to an address that bounced or
+// complained. It wraps ErrInvalid so that these messages are not retried.
+var ErrSuppressed = fmt.Errorf("%w: address is suppressed", ErrInvalid)
+
+// DeliveryEventType is the kind of delivery problem reported for an address.
+type DeliveryEventType string
+
+const (
+	EventBounce    DeliveryEventType = "bounce"
+	EventComplaint DeliveryEventType = "complaint"
+)
+
+// DeliveryEvent is a bounce or complaint reported by an email provider or a
+// mail server.
+type DeliveryEvent struct {
+	// ID is the provider's id for the event. Events with an ID are only
+	// recorded once even if the provider sends them again.
+	ID      string
+	Type    DeliveryEventType
+	Address string
+	// Permanent is true for hard bounces. Soft bounces are recorded but do
+	// not suppress the address.
+	Permanent bool
+	// Status is the enhanced SMTP status code if there is one.
+	Status string
+	Reason string
+	// Source is where the event came from, "sendgrid" or "dsn".
+	Source string
+	Time   time.Time
+}
+
+// Suppresses returns true if the event should stop all future emails to the
+// address.
+func (e *DeliveryEvent) Suppresses() bool {
+	return e.Type == EventComplaint || e.Permanent
+}
+
+// SuppressionList records bounces and complaints.
+type SuppressionList interface {
+	Record(ctx context.Context, event *DeliveryEvent) error
+	Suppressed(ctx context.Context, address string) (bool, error)
+}
+
+// Deliverable checks that an address is valid and has not been suppressed.
+func Deliverable(ctx context.Context, list SuppressionList, address string) error {
+	if !Valid(address) {
+		return ErrInvalid
+	}
+	suppressed, err := list.Suppressed(ctx, address)
+	if err != nil {
+		return err
+	}
+	if suppressed {
+		return fmt.Errorf("%w: %s", ErrSuppressed, address)
+	}
+	return nil
+}
+
+// deliverable checks every recipient of a message.
+func deliverable(ctx context.Context, list SuppressionList, msg *Message) error {
+	for _, to := range msg.To {
+		if err := Deliverable(ctx, list, to.Address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewPGSuppressionList creates a SuppressionList stored in postgres.
+func NewPGSuppressionList(d db.DB) SuppressionList {
+	return &pgSuppressionList{db: d}
+}
+
+type pgSuppressionList struct {
+	db db.DB
+}
+
+const recordDeliveryEventQuery = `
+	INSERT INTO email_suppression (
+		address, bounces, complaints, suppressed,
+		last_event, last_status, last_reason, source, last_event_at
+	)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	ON CONFLICT (address) DO UPDATE SET
+		bounces       = email_suppression.bounces + EXCLUDED.bounces,
+		complaints    = email_suppression.complaints + EXCLUDED.complaints,
+		suppressed    = email_suppression.suppressed OR EXCLUDED.suppressed,
+		last_event    = EXCLUDED.last_event,
+		last_status   = EXCLUDED.last_status,
+		last_reason   = EXCLUDED.last_reason,
+		source        = EXCLUDED.source,
+		last_event_at = EXCLUDED.last_event_at,
+		updated_at    = CURRENT_TIMESTAMP`
+
+const recordDeliveryEventIDQuery = `
+	INSERT INTO email_delivery_event (source, id)
+	VALUES ($1, $2)
+	ON CONFLICT (source, id) DO NOTHING`
+
+func (ps *pgSuppressionList) Record(ctx context.Context, event *DeliveryEvent) error {
+	if !Valid(event.Address) {
+		return ErrInvalid
+	}
+	var bounces, complaints int
+	switch event.Type {
+	case EventBounce:
+		bounces = 1
+	case EventComplaint:
+		complaints = 1
+	default:
+		return fmt.Errorf("unknown delivery event type %q", event.Type)
+	}
+	at := event.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+	var duplicate bool
+	err := db.InTx(ctx, ps.db, func(ctx context.Context) error {
+		if len(event.ID) > 0 {
+			res, err := ps.db.ExecContext(ctx, recordDeliveryEventIDQuery, event.Source, event.ID)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if duplicate = n == 0; duplicate {
+				return nil
+			}
+		}
+		_, err := ps.db.ExecContext(
+			ctx,
+			recordDeliveryEventQuery,
+			suppressionKey(event.Address),
+			bounces,
+			complaints,
+			event.Suppresses(),
+			event.Type,
+			event.Status,
+			event.Reason,
+			event.Source,
+			at,
+		)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if duplicate {
+		logger.WithFields(logrus.Fields{
+			"id":     event.ID,
+			"source": event.Source,
+		}).Info("skipping delivery event that was already recorded")
+		return nil
+	}
+	logger.WithFields(logrus.Fields{
+		"type":       event.Type,
+		"permanent":  event.Permanent,
+		"status":     event.Status,
+		"source":     event.Source,
+		"suppressed": event.Suppresses(),
+	}).Info("recorded email delivery event")
+	return nil
+}
+
+func (ps *pgSuppressionList) Suppressed(ctx context.Context, address string) (bool, error) {
+	var suppressed bool
+	rows, err := ps.db.QueryContext(
+		ctx,
+		`SELECT suppressed FROM email_suppression WHERE address = $1`,
+		suppressionKey(address),
+	)
+	if err != nil {
+		return false, err
+	}
+	err = db.ScanOne(rows, &suppressed)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return suppressed, err
+}
+
+// suppressionKey is the address used to look up suppressions. Providers don't
+// preserve the case of the local part so the whole address is lowercased.
+func suppressionKey(address string) string {
+	return strings.ToLower(Normalize(address))
+}
@@ -0,0 +1,224 @@
+// Package templates is a registry of email templates.
+//
+// Each template is a set of files named after the template: "<name>.html",
+// "<name>.txt" and "<name>.subject.txt". The html and text parts define a
+// "content" template that is rendered inside of "layout.html" and
+// "layout.txt". The html part also defines a "title". An optional
+// "<name>.sample.json" holds example data for previews.
+package templates
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/pkg/errors"
+	"gopkg.hrry.dev/homelab/pkg/email"
+)
+
+var ErrNotFound = errors.New("email template not found")
+
+//go:embed defaults
+var defaults embed.FS
+
+const (
+	htmlLayout = "layout.html"
+	textLayout = "layout.txt"
+)
+
+// Registry holds named email templates.
+type Registry struct {
+	templates map[string]*Template
+}
+
+// Template renders the parts of an email.
+type Template struct {
+	Name    string
+	subject *texttemplate.Template
+	html    *htmltemplate.Template
+	text    *texttemplate.Template
+	sample  []byte
+}
+
+// Rendered is an executed template.
+type Rendered struct {
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text"`
+}
+
+// Default returns a registry with the embedded default templates.
+func Default() (*Registry, error) {
+	return Load("")
+}
+
+// Load reads the default templates and replaces any of their files with the
+// files found in dir. New templates can also be added to dir. An empty dir
+// only loads the defaults.
+func Load(dir string) (*Registry, error) {
+	base, err := fs.Sub(defaults, "defaults")
+	if err != nil {
+		return nil, err
+	}
+	if len(dir) == 0 {
+		return New(base)
+	}
+	return New(&overlay{top: os.DirFS(dir), base: base})
+}
+
+// New creates a registry from the template files in fsys.
+func New(fsys fs.FS) (*Registry, error) {
+	htmlBase, err := htmltemplate.ParseFS(fsys, htmlLayout)
+	if err != nil {
+		return nil, err
+	}
+	textBase, err := texttemplate.ParseFS(fsys, textLayout)
+	if err != nil {
+		return nil, err
+	}
+	names, err := templateNames(fsys)
+	if err != nil {
+		return nil, err
+	}
+	r := Registry{templates: make(map[string]*Template, len(names))}
+	for _, name := range names {
+		t := Template{Name: name}
+		t.subject, err = texttemplate.ParseFS(fsys, name+".subject.txt")
+		if err != nil {
+			return nil, err
+		}
+		if t.html, err = htmlBase.Clone(); err != nil {
+			return nil, err
+		}
+		if t.html, err = t.html.ParseFS(fsys, name+".html"); err != nil {
+			return nil, err
+		}
+		if t.text, err = textBase.Clone(); err != nil {
+			return nil, err
+		}
+		if t.text, err = t.text.ParseFS(fsys, name+".txt"); err != nil {
+			return nil, err
+		}
+		t.sample, err = fs.ReadFile(fsys, name+".sample.json")
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		r.templates[name] = &t
+	}
+	return &r, nil
+}
+
+// templateNames finds every template with a subject file.
+func templateNames(fsys fs.FS) ([]string, error) {
+	files, err := fs.Glob(fsys, "*.subject.txt")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = strings.TrimSuffix(f, ".subject.txt")
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Get returns a template by name.
+func (r *Registry) Get(name string) (*Template, error) {
+	t, ok := r.templates[name]
+	if !ok {
+		return nil, errors.Wrap(ErrNotFound, name)
+	}
+	return t, nil
+}
+
+// Names returns the names of all the templates in sorted order.
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.templates))
+	for name := range r.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Render executes every part of the template.
+func (t *Template) Render(data interface{}) (*Rendered, error) {
+	var (
+		r   Rendered
+		buf bytes.Buffer
+	)
+	if err := t.subject.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	r.Subject = strings.TrimSpace(buf.String())
+	buf.Reset()
+	if err := t.html.ExecuteTemplate(&buf, htmlLayout, data); err != nil {
+		return nil, err
+	}
+	r.HTML = buf.String()
+	buf.Reset()
+	if err := t.text.ExecuteTemplate(&buf, textLayout, data); err != nil {
+		return nil, err
+	}
+	r.Text = strings.TrimSpace(buf.String()) + "\n"
+	return &r, nil
+}
+
+// Message renders the template into an email.
+func (t *Template) Message(from, to *email.Email, data interface{}) (*email.Message, error) {
+	r, err := t.Render(data)
+	if err != nil {
+		return nil, err
+	}
+	return email.NewMessage(from, to, r.Subject, r.Text, r.HTML), nil
+}
+
+// Sample decodes the template's sample data into v. It does nothing if the
+// template has no sample data.
+func (t *Template) Sample(v interface{}) error {
+	if len(t.sample) == 0 {
+		return nil
+	}
+	return json.Unmarshal(t.sample, v)
+}
+
+// overlay is a file system where files in top replace files in base.
+type overlay struct {
+	top, base fs.FS
+}
+
+func (o *overlay) Open(name string) (fs.File, error) {
+	f, err := o.top.Open(name)
+	if err == nil {
+		return f, nil
+	}
+	return o.base.Open(name)
+}
+
+// Glob merges the matches from both file systems.
+func (o *overlay) Glob(pattern string) ([]string, error) {
+	top, err := fs.Glob(o.top, pattern)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	base, err := fs.Glob(o.base, pattern)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{}, len(top)+len(base))
+	matches := make([]string, 0, len(top)+len(base))
+	for _, m := range append(top, base...) {
+		if _, ok := seen[m]; ok {
+			continue
+		}
+		seen[m] = struct{}{}
+		matches = append(matches, m)
+	}
+	return matches, nil
+}
@@ -0,0 +1,145 @@
+package templates
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.hrry.dev/homelab/pkg/email"
+)
+
+func TestDefaults(t *testing.T) {
+	r, err := Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := r.Names(); !reflect.DeepEqual(names, []string{"invite", "invite_redeemed"}) {
+		t.Fatalf("wrong template names: %v", names)
+	}
+	for _, name := range r.Names() {
+		tmpl, err := r.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data map[string]interface{}
+		if err = tmpl.Sample(&data); err != nil {
+			t.Fatal(err)
+		}
+		if len(data) == 0 {
+			t.Errorf("%s: expected sample data", name)
+		}
+	}
+
+	tmpl, err := r.Get("invite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := tmpl.Render(map[string]string{
+		"Domain":       "example.com",
+		"Path":         "/invite/abc",
+		"ReceiverName": "<Jane>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Subject != "You're Invited!" {
+		t.Errorf("wrong subject %q", out.Subject)
+	}
+	for _, s := range []string{"<title>You're Invited!</title>", "https://example.com/invite/abc", "&lt;Jane&gt;"} {
+		if !strings.Contains(out.HTML, s) {
+			t.Errorf("expected html to contain %q", s)
+		}
+	}
+	for _, s := range []string{"Hi <Jane>,", "https://example.com/invite/abc", "Harry Brown"} {
+		if !strings.Contains(out.Text, s) {
+			t.Errorf("expected text to contain %q", s)
+		}
+	}
+}
+
+func TestGetNotFound(t *testing.T) {
+	r, err := Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Get("nope"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestLoadOverrides(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		// replace a default part
+		"invite.subject.txt": "Join {{ .Domain }}",
+		// add a new template
+		"welcome.subject.txt": "Welcome",
+		"welcome.html":        `{{ define "title" }}Welcome{{ end }}{{ define "content" }}<p>hi {{ .Name }}</p>{{ end }}`,
+		"welcome.txt":         `{{ define "content" }}hi {{ .Name }}{{ end }}`,
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := r.Names(); !reflect.DeepEqual(names, []string{"invite", "invite_redeemed", "welcome"}) {
+		t.Fatalf("wrong template names: %v", names)
+	}
+
+	tmpl, err := r.Get("invite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := tmpl.Render(map[string]string{"Domain": "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Subject != "Join example.com" {
+		t.Errorf("wrong subject %q", out.Subject)
+	}
+
+	tmpl, err = r.Get("welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := tmpl.Message(
+		&email.Email{Address: "from@example.com"},
+		&email.Email{Address: "to@example.com"},
+		map[string]string{"Name": "joe"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Welcome" {
+		t.Errorf("wrong subject %q", msg.Subject)
+	}
+	if !strings.Contains(msg.HTML, "<p>hi joe</p>") {
+		t.Errorf("html not rendered with layout: %q", msg.HTML)
+	}
+	if !strings.HasPrefix(msg.Text, "hi joe") || !strings.Contains(msg.Text, "Harry Brown") {
+		t.Errorf("text not rendered with layout: %q", msg.Text)
+	}
+	// No sample data is not an error
+	var v map[string]interface{}
+	if err = tmpl.Sample(&v); err != nil || v != nil {
+		t.Errorf("expected no sample data, got %v %v", v, err)
+	}
+}
+
+func TestLoadMissingPart(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "broken.subject.txt"), []byte("hi"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load(dir); err == nil {
+		t.Fatal("expected an error for a template without html and text parts")
+	}
+}
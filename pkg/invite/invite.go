@@ -7,7 +7,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -27,7 +27,25 @@ const (
 
 var (
 	ErrInviteTTL        = errors.New("session ttl limit reached")
+	ErrInviteClosed     = errors.New("invite is no longer pending")
+	ErrInviteNotFound   = errors.New("invite not found")
 	ErrSessionOwnership = errors.New("cannot access session created by someone else")
+	ErrInvalidCursor    = errors.New("invalid invite list cursor")
+	ErrUpdateConflict   = errors.New("invite was changed by too many requests at once")
+)
+
+// maxUpdateRetries is the number of times a redis invite is read again after
+// someone else changed it.
+const maxUpdateRetries = 10
+
+// Status is the lifecycle state of an invite.
+type Status string
+
+const (
+	StatusPending  Status = "pending"
+	StatusRedeemed Status = "redeemed"
+	StatusExpired  Status = "expired"
+	StatusRevoked  Status = "revoked"
 )
 
 type Session struct {
@@ -43,8 +61,23 @@ type Session struct {
 	// Roles is an array of roles used when creating the new user. Only Admin
 	// should be able to set roles.
 	Roles []auth.Role `json:"r,omitempty"`
+	// ReceiverName is the name of the person being invited.
+	ReceiverName string `json:"rn,omitempty"`
+	// MaxUses is the number of accounts that can be created with the invite.
+	// Zero is the same as one.
+	MaxUses int `json:"mu,omitempty"`
+	// Uses is the number of accounts created with the invite so far.
+	Uses int `json:"u,omitempty"`
+	// Rooms are chat room IDs that new users are added to.
+	Rooms []int `json:"rm,omitempty"`
 	// Not actually stored in session, used as metadata
 	ID string `json:"-"`
+
+	// Metadata only tracked by stores that keep invite history.
+	Status     Status    `json:"-"`
+	RedeemedBy uuid.UUID `json:"-"`
+	CreatedAt  time.Time `json:"-"`
+	RedeemedAt time.Time `json:"-"`
 }
 
 type Invitation struct {
@@ -55,16 +88,59 @@ type Invitation struct {
 	ReceiverName string      `json:"receiver_name,omitempty"`
 	Roles        []auth.Role `json:"roles"`
 	TTL          int         `json:"ttl"`
+	MaxUses      int         `json:"max_uses"`
+	Uses         int         `json:"uses"`
+	Rooms        []int       `json:"rooms,omitempty"`
+	Status       Status      `json:"status,omitempty"`
+	RedeemedBy   *uuid.UUID  `json:"redeemed_by,omitempty"`
+	RedeemedAt   *time.Time  `json:"redeemed_at,omitempty"`
 
 	Domain string `json:"-"`
 }
 
+// usesLeft returns the number of accounts that can still be created with the
+// invite.
+func (s *Session) usesLeft() int {
+	max := s.MaxUses
+	if max <= 0 {
+		max = 1
+	}
+	return max - s.Uses
+}
+
 type CreateInviteRequest struct {
-	Timeout      time.Duration `json:"timeout,omitempty"`
-	TTL          int           `json:"ttl,omitempty"`
-	Email        string        `json:"email,omitempty"`
-	ReceiverName string        `json:"receiver_name,omitempty"`
-	Roles        []string      `json:"roles"`
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// TTL is the number of sign-up attempts.
+	TTL          int      `json:"ttl,omitempty"`
+	Email        string   `json:"email,omitempty"`
+	ReceiverName string   `json:"receiver_name,omitempty"`
+	Roles        []string `json:"roles"`
+	// Uses is the number of accounts that can be created with the invite.
+	Uses int `json:"uses,omitempty"`
+	// Rooms are chat room IDs that new users will join.
+	Rooms []int `json:"rooms,omitempty"`
+}
+
+func (req *CreateInviteRequest) timeout() time.Duration {
+	if req.Timeout == 0 {
+		return defaultInviteTimeout
+	}
+	return req.Timeout
+}
+
+func (req *CreateInviteRequest) maxUses() int {
+	if req.Uses <= 0 {
+		return 1
+	}
+	return req.Uses
+}
+
+// ttl defaults to enough sign-up attempts for every use of the invite.
+func (req *CreateInviteRequest) ttl() int {
+	if req.TTL == 0 {
+		return defaultInviteTTL * req.maxUses()
+	}
+	return req.TTL
 }
 
 type Store interface {
@@ -73,7 +149,61 @@ type Store interface {
 	View(context.Context, string) (*Session, error)
 	OwnerDel(context.Context, string, uuid.UUID) error
 	Del(context.Context, string) error
-	List(ctx context.Context) ([]*Session, error)
+	// Redeem marks the invite as used by the newly created user.
+	Redeem(ctx context.Context, id string, redeemer uuid.UUID) error
+	// List returns a page of invites and the cursor for the next page. The
+	// cursor is empty when there are no more pages.
+	List(ctx context.Context, opts *ListOptions) ([]*Session, string, error)
+	// ListByCreator returns a page of invites created by one user.
+	ListByCreator(ctx context.Context, creator uuid.UUID, opts *ListOptions) ([]*Session, string, error)
+}
+
+// Releaser is implemented by stores that cannot be part of a database
+// transaction. Release gives back a use taken by Redeem when the account
+// could not be created.
+type Releaser interface {
+	Release(ctx context.Context, id string) error
+}
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 100
+)
+
+// ListOptions controls pagination when listing invites.
+type ListOptions struct {
+	// Cursor is the opaque value returned by a previous call to List. An empty
+	// cursor starts from the beginning.
+	Cursor string
+	// Limit is a hint for the page size. It is capped at 100.
+	Limit int
+	// Status only lists invites in this state. It is applied before paging
+	// so pages are only short when the listing is done.
+	Status Status
+}
+
+func (lo *ListOptions) cursor() string {
+	if lo == nil {
+		return ""
+	}
+	return lo.Cursor
+}
+
+func (lo *ListOptions) limit() int {
+	if lo == nil || lo.Limit <= 0 {
+		return defaultListLimit
+	}
+	if lo.Limit > maxListLimit {
+		return maxListLimit
+	}
+	return lo.Limit
+}
+
+func (lo *ListOptions) status() Status {
+	if lo == nil {
+		return ""
+	}
+	return lo.Status
 }
 
 func NewStore(rdb redis.Cmdable, prefix string) Store {
@@ -92,31 +222,37 @@ type SessionStore struct {
 	KeyGen func() (string, error)
 }
 
+var _ Releaser = (*SessionStore)(nil)
+
 func (ss *SessionStore) key(id string) string {
 	return fmt.Sprintf("%s:%s", ss.Prefix, id)
 }
 
+// indexKey is the set of all invite ids.
+func (ss *SessionStore) indexKey() string {
+	return fmt.Sprintf("%s-index", ss.Prefix)
+}
+
+// creatorIndexKey is the set of invite ids created by one user.
+func (ss *SessionStore) creatorIndexKey(creator uuid.UUID) string {
+	return fmt.Sprintf("%s-index:%s", ss.Prefix, creator)
+}
+
 func (ss *SessionStore) Create(ctx context.Context, creator uuid.UUID, req *CreateInviteRequest) (*Session, string, error) {
-	var (
-		timeout = req.Timeout
-		ttl     = req.TTL
-	)
-	if req.Timeout == 0 {
-		timeout = defaultInviteTimeout
-	}
-	if req.TTL == 0 {
-		ttl = defaultInviteTTL
-	}
+	timeout := req.timeout()
 	if ss.Now == nil {
 		ss.Now = time.Now
 	}
 
 	s := Session{
-		CreatedBy: creator,
-		ExpiresAt: ss.Now().Add(timeout).UnixMilli(),
-		TTL:       ttl,
-		Email:     req.Email,
-		Roles:     asAuthRoles(req.Roles),
+		CreatedBy:    creator,
+		ExpiresAt:    ss.Now().Add(timeout).UnixMilli(),
+		TTL:          req.ttl(),
+		Email:        req.Email,
+		Roles:        asAuthRoles(req.Roles),
+		ReceiverName: req.ReceiverName,
+		MaxUses:      req.maxUses(),
+		Rooms:        req.Rooms,
 	}
 	raw, err := json.Marshal(&s)
 	if err != nil {
@@ -126,13 +262,36 @@ func (ss *SessionStore) Create(ctx context.Context, creator uuid.UUID, req *Crea
 	if err != nil {
 		return nil, "", err
 	}
-	err = ss.RDB.Set(ctx, ss.key(id), raw, timeout).Err()
+	// Index entries are not removed when invites expire, they get cleaned up
+	// while listing.
+	err = ss.RDB.Eval(
+		ctx,
+		createInviteScript,
+		[]string{ss.key(id), ss.indexKey(), ss.creatorIndexKey(creator)},
+		raw, timeout.Milliseconds(), id,
+	).Err()
 	if err != nil {
 		return nil, "", err
 	}
 	return &s, id, nil
 }
 
+// createInviteScript stores an invite and adds it to both indexes at once so
+// that an invite is never left out of the listings.
+//
+//	KEYS: invite, index, creator index
+//	ARGV: invite json, timeout in milliseconds, invite id
+const createInviteScript = `
+local timeout = tonumber(ARGV[2])
+if timeout > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', timeout)
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+redis.call('SADD', KEYS[2], ARGV[3])
+redis.call('SADD', KEYS[3], ARGV[3])
+return 1`
+
 func DefaultKeyGen() (string, error) {
 	var b [32]byte
 	_, err := rand.Read(b[:])
@@ -143,19 +302,34 @@ func DefaultKeyGen() (string, error) {
 	return id, nil
 }
 
+// Get returns an invite and counts one view against its TTL. The count is
+// saved with the same compare-and-swap as Redeem so that it never overwrites
+// a concurrent redemption.
 func (ss *SessionStore) Get(ctx context.Context, key string) (*Session, error) {
-	s, err := ss.View(ctx, key)
-	if err != nil {
-		return nil, err
-	}
-	if s.TTL > 0 {
-		s.TTL--
-		err = ss.put(ctx, key, s)
-		if err != nil {
-			return nil, err
+	var session *Session
+	err := ss.update(ctx, key, func(s *Session) error {
+		if s.TTL == 0 {
+			return ErrInviteTTL
+		}
+		if s.usesLeft() <= 0 {
+			return ErrInviteClosed
 		}
+		if s.TTL > 0 {
+			s.TTL--
+		}
+		session = s
+		return nil
+	})
+	switch err {
+	case nil:
+		return session, nil
+	case ErrInviteTTL:
+		if err = ss.Del(ctx, key); err != nil {
+			logger.WithError(err).Error("could not delete invite expired session")
+		}
+		return nil, ErrInviteTTL
 	}
-	return s, nil
+	return nil, err
 }
 
 func (ss *SessionStore) View(ctx context.Context, key string) (*Session, error) {
@@ -170,15 +344,10 @@ func (ss *SessionStore) View(ctx context.Context, key string) (*Session, error)
 		}
 		return nil, ErrInviteTTL
 	}
-	return s, nil
-}
-
-func (ss *SessionStore) put(ctx context.Context, key string, session *Session) error {
-	raw, err := json.Marshal(session)
-	if err != nil {
-		return err
+	if s.usesLeft() <= 0 {
+		return nil, ErrInviteClosed
 	}
-	return ss.RDB.Set(ctx, ss.key(key), raw, redis.KeepTTL).Err()
+	return s, nil
 }
 
 func (ss *SessionStore) OwnerDel(ctx context.Context, key string, uid uuid.UUID) error {
@@ -203,6 +372,82 @@ func (ss *SessionStore) Del(ctx context.Context, key string) error {
 	return ss.RDB.Del(ctx, ss.key(key)).Err()
 }
 
+// Redeem will count one use of the invite. Used up invites are kept until
+// they expire so that a use can still be given back with Release.
+func (ss *SessionStore) Redeem(ctx context.Context, key string, _ uuid.UUID) error {
+	err := ss.update(ctx, key, func(s *Session) error {
+		if s.usesLeft() <= 0 {
+			return ErrInviteClosed
+		}
+		s.Uses++
+		return nil
+	})
+	if err == redis.Nil {
+		return ErrInviteClosed
+	}
+	return err
+}
+
+// Release gives back a use taken by Redeem.
+func (ss *SessionStore) Release(ctx context.Context, key string) error {
+	err := ss.update(ctx, key, func(s *Session) error {
+		if s.Uses > 0 {
+			s.Uses--
+		}
+		return nil
+	})
+	if err == redis.Nil {
+		// Expired while the account was being created.
+		return nil
+	}
+	return err
+}
+
+// update reads an invite, changes it with fn, and only saves it if nobody
+// else changed the invite in the meantime. Missing invites return redis.Nil.
+func (ss *SessionStore) update(ctx context.Context, key string, fn func(*Session) error) error {
+	for i := 0; i < maxUpdateRetries; i++ {
+		raw, err := ss.RDB.Get(ctx, ss.key(key)).Result()
+		if err != nil {
+			return err
+		}
+		var s Session
+		if err = json.Unmarshal([]byte(raw), &s); err != nil {
+			return err
+		}
+		if err = fn(&s); err != nil {
+			return err
+		}
+		b, err := json.Marshal(&s)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(b, []byte(raw)) {
+			return nil
+		}
+		n, err := ss.RDB.Eval(ctx, swapInviteScript, []string{ss.key(key)}, raw, b).Int()
+		if err != nil {
+			return err
+		}
+		if n == 1 {
+			return nil
+		}
+	}
+	return ErrUpdateConflict
+}
+
+// swapInviteScript replaces an invite only if it still holds the value that
+// was read.
+//
+//	KEYS: invite
+//	ARGV: invite json that was read, new invite json
+const swapInviteScript = `
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'KEEPTTL')
+return 1`
+
 func (ss *SessionStore) get(ctx context.Context, key string) (*Session, error) {
 	raw, err := ss.RDB.Get(ctx, ss.key(key)).Bytes()
 	if err != nil {
@@ -215,33 +460,77 @@ func (ss *SessionStore) get(ctx context.Context, key string) (*Session, error) {
 	return &s, nil
 }
 
-func (ss *SessionStore) List(ctx context.Context) ([]*Session, error) {
-	keys, err := ss.RDB.Keys(ctx, fmt.Sprintf("%s:*", ss.Prefix)).Result()
+func (ss *SessionStore) List(ctx context.Context, opts *ListOptions) ([]*Session, string, error) {
+	return ss.scan(ctx, ss.indexKey(), opts)
+}
+
+func (ss *SessionStore) ListByCreator(ctx context.Context, creator uuid.UUID, opts *ListOptions) ([]*Session, string, error) {
+	return ss.scan(ctx, ss.creatorIndexKey(creator), opts)
+}
+
+// scan will iterate over an index set and fetch the invites that it points
+// to. Ids of invites that have expired or been deleted are removed from the
+// index.
+func (ss *SessionStore) scan(ctx context.Context, index string, opts *ListOptions) ([]*Session, string, error) {
+	if st := opts.status(); len(st) > 0 && st != StatusPending {
+		// Redis only holds pending invites.
+		return []*Session{}, "", nil
+	}
+	var cursor uint64
+	if c := opts.cursor(); len(c) > 0 {
+		var err error
+		cursor, err = strconv.ParseUint(c, 10, 64)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+	ids, next, err := ss.RDB.SScan(ctx, index, cursor, "", int64(opts.limit())).Result()
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	var nextCursor string
+	if next != 0 {
+		nextCursor = strconv.FormatUint(next, 10)
+	}
+	if len(ids) == 0 {
+		return []*Session{}, nextCursor, nil
 	}
-	l := len(keys)
-	if l == 0 {
-		return []*Session{}, nil
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = ss.key(id)
 	}
-	sessions := make([]*Session, l)
-	rawsessions, err := ss.RDB.MGet(ctx, keys...).Result()
+	raw, err := ss.RDB.MGet(ctx, keys...).Result()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	for i, raw := range rawsessions {
-		s := raw.(string)
-		sessions[i] = new(Session)
-		err = json.Unmarshal([]byte(s), sessions[i])
-		if err != nil {
-			return nil, err
+	var (
+		stale    = make([]interface{}, 0)
+		sessions = make([]*Session, 0, len(raw))
+	)
+	for i, r := range raw {
+		str, ok := r.(string)
+		if !ok {
+			// Key expired or was deleted after the index was read.
+			stale = append(stale, ids[i])
+			continue
+		}
+		s := Session{ID: ids[i]}
+		if err = json.Unmarshal([]byte(str), &s); err != nil {
+			return nil, "", err
 		}
-		ix := strings.LastIndex(keys[i], ":")
-		if ix >= 0 {
-			sessions[i].ID = keys[i][ix+1:]
+		if s.usesLeft() <= 0 {
+			// Used up invites are only kept until they expire.
+			continue
+		}
+		sessions = append(sessions, &s)
+	}
+	if len(stale) > 0 {
+		err = ss.RDB.SRem(ctx, index, stale...).Err()
+		if err != nil {
+			logger.WithError(err).Warn("could not remove stale invite index entries")
 		}
 	}
-	return sessions, nil
+	return sessions, nextCursor, nil
 }
 
 func asAuthRoles(ss []string) []auth.Role {
@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,7 +18,6 @@ import (
 	"github.com/pkg/errors"
 	"gopkg.hrry.dev/homelab/pkg/auth"
 	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockredis"
-	"gopkg.hrry.dev/homelab/pkg/internal/mockutil"
 )
 
 func init() {
@@ -23,46 +25,57 @@ func init() {
 }
 
 func TestInviteSessionStore_Get(t *testing.T) {
-	// logger.SetOutput(io.Discard)
 	is := is.New(t)
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	rdb := mockredis.NewMockCmdable(ctrl)
-	s := SessionStore{RDB: rdb, Prefix: "inv", KeyGen: DefaultKeyGen}
+	s := SessionStore{RDB: rdb, Prefix: "i", KeyGen: DefaultKeyGen}
 	ctx := context.Background()
 
 	// Decrement TTL
 	expectedSession := Session{CreatedBy: uuid.New(), Roles: []auth.Role{auth.RoleFamily}, TTL: 10}
-	mockSessionGet(t, rdb, gomock.Eq("inv:123"), &expectedSession)
 	updated := Session{CreatedBy: expectedSession.CreatedBy, Roles: expectedSession.Roles, TTL: 9}
-	mockSessionSet(t, rdb, gomock.Eq("inv:123"), gomock.Eq(time.Duration(redis.KeepTTL)), &updated).Return(redis.NewStatusResult("", nil))
-	session, err := s.Get(ctx, "123")
+	mockSessionSwap(t, rdb, &expectedSession, &updated, 1)
+	session, err := s.Get(ctx, "abc")
 	is.NoErr(err)
 	is.Equal(*session, updated)
 	is.Equal(session.TTL, expectedSession.TTL-1)
 
+	// Redeemed by someone else between reading and saving
+	expectedSession = Session{CreatedBy: uuid.New(), TTL: 2, MaxUses: 1}
+	mockSessionSwap(t, rdb, &expectedSession, &Session{CreatedBy: expectedSession.CreatedBy, TTL: 1, MaxUses: 1}, 0)
+	mockSessionGet(t, rdb, gomock.Eq("i:abc"), &Session{CreatedBy: expectedSession.CreatedBy, TTL: 2, MaxUses: 1, Uses: 1})
+	session, err = s.Get(ctx, "abc")
+	is.Equal(err, ErrInviteClosed)
+	is.Equal(session, nil)
+
 	// Delete because of expired TTL
 	expectedSession = Session{CreatedBy: uuid.New(), Roles: []auth.Role{auth.RoleFamily}, TTL: 0}
-	mockSessionGet(t, rdb, gomock.Eq("inv:123"), &expectedSession)
-	rdb.EXPECT().Del(ctx, "inv:123").Return(redis.NewIntResult(0, nil))
-	session, err = s.Get(ctx, "123")
+	mockSessionGet(t, rdb, gomock.Eq("i:abc"), &expectedSession)
+	rdb.EXPECT().Del(ctx, "i:abc").Return(redis.NewIntResult(0, nil))
+	session, err = s.Get(ctx, "abc")
 	is.Equal(err, ErrInviteTTL)
 	is.Equal(session, nil)
 
 	// Delete because of expired TTL: failed delete
 	expectedSession = Session{CreatedBy: uuid.New(), Roles: []auth.Role{auth.RoleFamily}, TTL: 0}
-	mockSessionGet(t, rdb, gomock.Eq("inv:123"), &expectedSession)
-	rdb.EXPECT().Del(ctx, "inv:123").Return(redis.NewIntResult(0, errors.New("this is some random error")))
-	session, err = s.Get(ctx, "123")
+	mockSessionGet(t, rdb, gomock.Eq("i:abc"), &expectedSession)
+	rdb.EXPECT().Del(ctx, "i:abc").Return(redis.NewIntResult(0, errors.New("this is some random error")))
+	session, err = s.Get(ctx, "abc")
 	is.Equal(err, ErrInviteTTL)
 	is.Equal(session, nil)
 
 	// Ignore negative TTL
 	expectedSession = Session{CreatedBy: uuid.New(), Roles: []auth.Role{auth.RoleFamily}, TTL: -1}
-	mockSessionGet(t, rdb, gomock.Eq("inv:123"), &expectedSession)
-	session, err = s.Get(ctx, "123")
+	mockSessionGet(t, rdb, gomock.Eq("i:abc"), &expectedSession)
+	session, err = s.Get(ctx, "abc")
 	is.NoErr(err)
 	is.Equal(*session, expectedSession)
+
+	// Missing
+	rdb.EXPECT().Get(ctx, "i:abc").Return(redis.NewStringResult("", redis.Nil))
+	_, err = s.Get(ctx, "abc")
+	is.Equal(err, redis.Nil)
 }
 
 func TestInviteSessionStore_Create(t *testing.T) {
@@ -82,11 +95,10 @@ func TestInviteSessionStore_Create(t *testing.T) {
 			expected: tmpErr,
 			mock: func(t *testing.T, tt *table, rd *mockredis.MockCmdable) {
 				now = func() time.Time { return time.Unix(100, 0) }
-				mockSessionSet(
-					t, rd, mockutil.HasPrefix("iss_create:"),
-					gomock.Eq(defaultInviteTimeout),
-					&Session{TTL: defaultInviteTTL, ExpiresAt: now().Add(defaultInviteTimeout).UnixMilli(), CreatedBy: tt.uuid},
-				).Return(redis.NewStatusResult("", tmpErr))
+				mockSessionCreate(
+					t, rd, "iss_create", tt.uuid, defaultInviteTimeout,
+					&Session{TTL: defaultInviteTTL, ExpiresAt: now().Add(defaultInviteTimeout).UnixMilli(), CreatedBy: tt.uuid, MaxUses: 1},
+				).Return(redis.NewCmdResult(int64(1), tmpErr))
 			},
 		},
 		{
@@ -94,11 +106,10 @@ func TestInviteSessionStore_Create(t *testing.T) {
 			req:  &CreateInviteRequest{},
 			mock: func(t *testing.T, tt *table, rd *mockredis.MockCmdable) {
 				now = func() time.Time { return time.Unix(100, 0) }
-				mockSessionSet(
-					t, rd, mockutil.HasPrefix("iss_create:"),
-					gomock.Eq(defaultInviteTimeout),
-					&Session{TTL: defaultInviteTTL, ExpiresAt: now().Add(defaultInviteTimeout).UnixMilli(), CreatedBy: tt.uuid},
-				).Return(redis.NewStatusResult("", nil))
+				mockSessionCreate(
+					t, rd, "iss_create", tt.uuid, defaultInviteTimeout,
+					&Session{TTL: defaultInviteTTL, ExpiresAt: now().Add(defaultInviteTimeout).UnixMilli(), CreatedBy: tt.uuid, MaxUses: 1},
+				).Return(redis.NewCmdResult(int64(1), nil))
 			},
 		},
 		{
@@ -106,11 +117,27 @@ func TestInviteSessionStore_Create(t *testing.T) {
 			req:  &CreateInviteRequest{TTL: 53, Timeout: time.Hour * 9},
 			mock: func(t *testing.T, tt *table, rd *mockredis.MockCmdable) {
 				now = func() time.Time { return time.Unix(1010, 0) }
-				mockSessionSet(
-					t, rd, mockutil.HasPrefix("iss_create:"),
-					gomock.Eq(time.Hour*9),
-					&Session{TTL: 53, ExpiresAt: now().Add(time.Hour * 9).UnixMilli(), CreatedBy: tt.uuid},
-				).Return(redis.NewStatusResult("", nil))
+				mockSessionCreate(
+					t, rd, "iss_create", tt.uuid, time.Hour*9,
+					&Session{TTL: 53, ExpiresAt: now().Add(time.Hour * 9).UnixMilli(), CreatedBy: tt.uuid, MaxUses: 1},
+				).Return(redis.NewCmdResult(int64(1), nil))
+			},
+		},
+		{
+			name: "group invite",
+			req:  &CreateInviteRequest{Uses: 3, Rooms: []int{1, 2}},
+			mock: func(t *testing.T, tt *table, rd *mockredis.MockCmdable) {
+				now = func() time.Time { return time.Unix(100, 0) }
+				mockSessionCreate(
+					t, rd, "iss_create", tt.uuid, defaultInviteTimeout,
+					&Session{
+						TTL:       defaultInviteTTL * 3,
+						ExpiresAt: now().Add(defaultInviteTimeout).UnixMilli(),
+						CreatedBy: tt.uuid,
+						MaxUses:   3,
+						Rooms:     []int{1, 2},
+					},
+				).Return(redis.NewCmdResult(int64(1), nil))
 			},
 		},
 	} {
@@ -154,6 +181,130 @@ func TestInviteSessionStore_Del(t *testing.T) {
 	is.True(errors.Is(err, ErrSessionOwnership))
 }
 
+func TestInviteSessionStore_Redeem(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rd := mockredis.NewMockCmdable(ctrl)
+	ctx := context.Background()
+	store := SessionStore{RDB: rd, Prefix: "i", KeyGen: DefaultKeyGen}
+
+	// Uses left
+	mockSessionSwap(t, rd, &Session{TTL: 4, MaxUses: 3, Uses: 1}, &Session{TTL: 4, MaxUses: 3, Uses: 2}, 1)
+	is.NoErr(store.Redeem(ctx, "abc", uuid.New()))
+
+	// Last use is kept until the invite expires
+	mockSessionSwap(t, rd, &Session{TTL: 4, MaxUses: 3, Uses: 2}, &Session{TTL: 4, MaxUses: 3, Uses: 3}, 1)
+	is.NoErr(store.Redeem(ctx, "abc", uuid.New()))
+
+	// Changed by someone else between reading and saving
+	mockSessionSwap(t, rd, &Session{MaxUses: 2}, &Session{MaxUses: 2, Uses: 1}, 0)
+	mockSessionSwap(t, rd, &Session{MaxUses: 2, Uses: 1}, &Session{MaxUses: 2, Uses: 2}, 1)
+	is.NoErr(store.Redeem(ctx, "abc", uuid.New()))
+
+	// Used up
+	mockSessionGet(t, rd, gomock.Eq("i:abc"), &Session{TTL: 4, Uses: 1})
+	is.Equal(store.Redeem(ctx, "abc", uuid.New()), ErrInviteClosed)
+
+	rd.EXPECT().Get(ctx, "i:abc").Return(redis.NewStringResult("", redis.Nil))
+	is.Equal(store.Redeem(ctx, "abc", uuid.New()), ErrInviteClosed)
+
+	// Too many conflicts
+	mockSessionSwap(t, rd, &Session{MaxUses: 2}, &Session{MaxUses: 2, Uses: 1}, 0).Times(maxUpdateRetries)
+	is.Equal(store.Redeem(ctx, "abc", uuid.New()), ErrUpdateConflict)
+}
+
+func TestInviteSessionStore_Release(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rd := mockredis.NewMockCmdable(ctrl)
+	ctx := context.Background()
+	store := SessionStore{RDB: rd, Prefix: "i", KeyGen: DefaultKeyGen}
+
+	mockSessionSwap(t, rd, &Session{TTL: 4, Uses: 1}, &Session{TTL: 4}, 1)
+	is.NoErr(store.Release(ctx, "abc"))
+
+	// Expired invites have nothing to give back
+	rd.EXPECT().Get(ctx, "i:abc").Return(redis.NewStringResult("", redis.Nil))
+	is.NoErr(store.Release(ctx, "abc"))
+}
+
+func TestInviteSessionStore_ConcurrentRedeem(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rd := mockredis.NewMockCmdable(ctrl)
+	ctx := context.Background()
+	store := SessionStore{RDB: rd, Prefix: "i", KeyGen: DefaultKeyGen}
+
+	// Back the mock with a single value so that the swap script behaves
+	// like it does in redis.
+	var mu sync.Mutex
+	raw, err := json.Marshal(&Session{TTL: 5, MaxUses: 1})
+	is.NoErr(err)
+	value := string(raw)
+	rd.EXPECT().Get(ctx, "i:abc").AnyTimes().DoAndReturn(func(context.Context, string) *redis.StringCmd {
+		mu.Lock()
+		defer mu.Unlock()
+		return redis.NewStringResult(value, nil)
+	})
+	rd.EXPECT().Eval(ctx, swapInviteScript, []string{"i:abc"}, gomock.Any(), gomock.Any()).AnyTimes().
+		DoAndReturn(func(_ context.Context, _ string, _ []string, args ...interface{}) *redis.Cmd {
+			mu.Lock()
+			defer mu.Unlock()
+			if value != args[0].(string) {
+				return redis.NewCmdResult(int64(0), nil)
+			}
+			value = string(args[1].([]byte))
+			return redis.NewCmdResult(int64(1), nil)
+		})
+
+	const signups = 8
+	var (
+		wg       sync.WaitGroup
+		redeemed int32
+	)
+	for i := 0; i < signups; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.Get(ctx, "abc"); err != nil {
+				return
+			}
+			if err := store.Redeem(ctx, "abc", uuid.New()); err == nil {
+				atomic.AddInt32(&redeemed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	is.Equal(redeemed, int32(1))
+	var s Session
+	is.NoErr(json.Unmarshal([]byte(value), &s))
+	is.Equal(s.Uses, 1)
+}
+
+// mockSessionSwap expects the invite "i:abc" to be read and then replaced.
+// The returned call is the read.
+func mockSessionSwap(t *testing.T, rd *mockredis.MockCmdable, old, updated *Session, swapped int64) *gomock.Call {
+	t.Helper()
+	raw, err := json.Marshal(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := rd.EXPECT().Get(context.Background(), "i:abc").Return(redis.NewStringResult(string(raw), nil))
+	swap := rd.EXPECT().Eval(context.Background(), swapInviteScript, []string{"i:abc"}, string(raw), b).
+		Return(redis.NewCmdResult(swapped, nil))
+	if swapped == 0 {
+		swap.AnyTimes()
+	}
+	return get
+}
+
 func TestInviteSessionStore_List(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -162,6 +313,7 @@ func TestInviteSessionStore_List(t *testing.T) {
 	rdb := mockredis.NewMockCmdable(ctrl)
 	s := SessionStore{RDB: rdb, Prefix: "inv", KeyGen: DefaultKeyGen}
 	ctx := context.Background()
+	ids := []string{"1", "2", "3"}
 	keys := []string{"inv:1", "inv:2", "inv:3"}
 	expected := []*Session{
 		{ID: "1", CreatedBy: uuid.New(), ExpiresAt: 1000, Roles: []auth.Role{auth.RoleAdmin}},
@@ -175,27 +327,66 @@ func TestInviteSessionStore_List(t *testing.T) {
 		expectedJSON[i] = string(raw)
 	}
 
-	rdb.EXPECT().Keys(ctx, "inv:*").Return(redis.NewStringSliceResult(keys, nil))
+	rdb.EXPECT().SScan(ctx, "inv-index", uint64(0), "", int64(defaultListLimit)).
+		Return(redis.NewScanCmdResult(ids, 0, nil))
 	rdb.EXPECT().MGet(ctx, keys).Return(redis.NewSliceResult(expectedJSON, nil))
-	sessions, err := s.List(ctx)
+	sessions, next, err := s.List(ctx, nil)
 	is.NoErr(err)
+	is.Equal(next, "")
 	is.Equal(len(sessions), len(expected))
 	is.Equal(sessions, expected)
 
+	// Keys that expire between SSCAN and MGET are skipped and removed from
+	// the index.
+	rdb.EXPECT().SScan(ctx, "inv-index", uint64(12), "", int64(3)).
+		Return(redis.NewScanCmdResult(ids, 45, nil))
+	rdb.EXPECT().MGet(ctx, keys).Return(redis.NewSliceResult(
+		[]interface{}{expectedJSON[0], nil, expectedJSON[2]}, nil,
+	))
+	rdb.EXPECT().SRem(ctx, "inv-index", "2").Return(redis.NewIntResult(1, nil))
+	sessions, next, err = s.List(ctx, &ListOptions{Cursor: "12", Limit: 3})
+	is.NoErr(err)
+	is.Equal(next, "45")
+	is.Equal(sessions, []*Session{expected[0], expected[2]})
+
+	// List by creator uses the creator's index
+	rdb.EXPECT().SScan(ctx, "inv-index:"+expected[0].CreatedBy.String(), uint64(0), "", int64(defaultListLimit)).
+		Return(redis.NewScanCmdResult(ids[:1], 0, nil))
+	rdb.EXPECT().MGet(ctx, keys[:1]).Return(redis.NewSliceResult(expectedJSON[:1], nil))
+	sessions, _, err = s.ListByCreator(ctx, expected[0].CreatedBy, nil)
+	is.NoErr(err)
+	is.Equal(sessions, expected[:1])
+
 	someErr := errors.New("some error")
-	rdb.EXPECT().Keys(ctx, "inv:*").Return(redis.NewStringSliceResult(keys, nil))
+	rdb.EXPECT().SScan(ctx, "inv-index", uint64(0), "", int64(defaultListLimit)).
+		Return(redis.NewScanCmdResult(ids, 0, nil))
 	rdb.EXPECT().MGet(ctx, keys).Return(redis.NewSliceResult(nil, someErr))
-	_, err = s.List(ctx)
+	_, _, err = s.List(ctx, nil)
 	is.Equal(err, someErr)
 
-	rdb.EXPECT().Keys(ctx, "inv:*").Return(redis.NewStringSliceResult([]string{}, nil))
-	sessions, err = s.List(ctx)
+	rdb.EXPECT().SScan(ctx, "inv-index", uint64(0), "", int64(defaultListLimit)).
+		Return(redis.NewScanCmdResult([]string{}, 0, nil))
+	sessions, _, err = s.List(ctx, nil)
 	is.NoErr(err)
 	is.Equal(len(sessions), 0)
 
-	rdb.EXPECT().Keys(ctx, "inv:*").Return(redis.NewStringSliceResult(nil, someErr))
-	_, err = s.List(ctx)
+	rdb.EXPECT().SScan(ctx, "inv-index", uint64(0), "", int64(defaultListLimit)).
+		Return(redis.NewScanCmdResult(nil, 0, someErr))
+	_, _, err = s.List(ctx, nil)
 	is.Equal(err, someErr)
+
+	_, _, err = s.List(ctx, &ListOptions{Cursor: "not-a-number"})
+	is.Equal(err, ErrInvalidCursor)
+
+	// Only pending invites are kept in redis.
+	sessions, next, err = s.List(ctx, &ListOptions{Status: StatusRedeemed})
+	is.NoErr(err)
+	is.Equal(len(sessions), 0)
+	is.Equal(next, "")
+	rdb.EXPECT().SScan(ctx, "inv-index", uint64(0), "", int64(maxListLimit)).
+		Return(redis.NewScanCmdResult(nil, 0, nil))
+	_, _, err = s.List(ctx, &ListOptions{Limit: maxListLimit + 1, Status: StatusPending})
+	is.NoErr(err)
 }
 
 func mockSessionGet(t *testing.T, rdb *mockredis.MockCmdable, key gomock.Matcher, s *Session) *gomock.Call {
@@ -209,11 +400,13 @@ func mockSessionGet(t *testing.T, rdb *mockredis.MockCmdable, key gomock.Matcher
 	).Return(redis.NewStringResult(string(raw), nil))
 }
 
-func mockSessionSet(
+// mockSessionCreate expects an invite to be stored and indexed.
+func mockSessionCreate(
 	t *testing.T,
 	rd *mockredis.MockCmdable,
-	key gomock.Matcher,
-	timeout gomock.Matcher,
+	prefix string,
+	creator uuid.UUID,
+	timeout time.Duration,
 	s *Session,
 ) *gomock.Call {
 	t.Helper()
@@ -221,5 +414,16 @@ func mockSessionSet(
 	if err != nil {
 		t.Fatal(err)
 	}
-	return rd.EXPECT().Set(context.Background(), key, raw, timeout)
+	return rd.EXPECT().
+		Eval(context.Background(), createInviteScript, gomock.Any(), raw, timeout.Milliseconds(), gomock.Any()).
+		Do(func(_ context.Context, _ string, keys []string, args ...interface{}) {
+			expected := []string{
+				prefix + ":" + args[2].(string),
+				prefix + "-index",
+				prefix + "-index:" + creator.String(),
+			}
+			if !reflect.DeepEqual(keys, expected) {
+				t.Errorf("wrong keys: got %v, want %v", keys, expected)
+			}
+		})
 }
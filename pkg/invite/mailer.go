@@ -1,65 +1,47 @@
 package invite
 
 import (
-	"bytes"
 	"context"
-	"html/template"
 
-	"github.com/sendgrid/sendgrid-go/helpers/mail"
-	"github.com/sirupsen/logrus"
 	"gopkg.hrry.dev/homelab/pkg/email"
+	"gopkg.hrry.dev/homelab/pkg/email/templates"
 )
 
 type Mailer interface {
 	Send(ctx context.Context, invitation *Invitation) error
 }
 
-func NewMailer(from email.Email, subject string, t *template.Template, client email.Client) (Mailer, error) {
+func NewMailer(from email.Email, t *templates.Template, sender email.Sender) (Mailer, error) {
 	if !email.Valid(from.Address) {
 		return nil, email.ErrInvalid
 	}
 	return &mailer{
-		sender:   from,
-		subject:  subject,
+		from:     from,
 		template: t,
-		client:   client,
+		sender:   sender,
 	}, nil
 }
 
 type mailer struct {
-	sender   email.Email
-	subject  string
-	template *template.Template
-	client   email.Client
+	from     email.Email
+	template *templates.Template
+	sender   email.Sender
 }
 
 func (m *mailer) Send(ctx context.Context, invitation *Invitation) error {
 	if !email.Valid(invitation.Email) {
 		return email.ErrInvalid
 	}
-	var buf bytes.Buffer
-	err := m.template.Execute(&buf, invitation)
-	if err != nil {
-		return err
-	}
-	message := mail.NewSingleEmail(
-		&m.sender,
-		m.subject,
+	message, err := m.template.Message(
+		&m.from,
 		&email.Email{
 			Name:    invitation.ReceiverName,
 			Address: invitation.Email,
 		},
-		"",
-		buf.String(),
+		invitation,
 	)
-	response, err := m.client.SendWithContext(ctx, message)
 	if err != nil {
 		return err
 	}
-	logger.WithFields(logrus.Fields{
-		"status":  response.StatusCode,
-		"headers": response.Headers,
-		"body":    response.Body,
-	}).Info("email response")
-	return nil
+	return m.sender.Send(ctx, message)
 }
@@ -2,64 +2,77 @@ package invite
 
 import (
 	"context"
-	"html/template"
 	"testing"
-	texttemplate "text/template"
+	"testing/fstest"
 
 	"github.com/golang/mock/gomock"
 	"github.com/matryer/is"
 	"github.com/pkg/errors"
-	"github.com/sendgrid/rest"
-	"github.com/sendgrid/sendgrid-go/helpers/mail"
 	"gopkg.hrry.dev/homelab/pkg/email"
+	"gopkg.hrry.dev/homelab/pkg/email/templates"
 	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockemail"
 )
 
+func testTemplate(t *testing.T, subject, html, text string) *templates.Template {
+	t.Helper()
+	r, err := templates.New(fstest.MapFS{
+		"layout.html":   {Data: []byte(`{{ template "content" . }}`)},
+		"layout.txt":    {Data: []byte(`{{ template "content" . }}`)},
+		"t.subject.txt": {Data: []byte(subject)},
+		"t.html":        {Data: []byte(`{{ define "content" }}` + html + `{{ end }}`)},
+		"t.txt":         {Data: []byte(`{{ define "content" }}` + text + `{{ end }}`)},
+		"t.sample.json": {Data: []byte(`{}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := r.Get("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmpl
+}
+
 func TestNewMailer(t *testing.T) {
 	is := is.New(t)
-	m, err := NewMailer(email.Email{Address: ""}, "", nil, nil)
+	m, err := NewMailer(email.Email{Address: ""}, nil, nil)
 	is.True(errors.Is(err, email.ErrInvalid))
 	is.True(m == nil)
 
-	m, err = NewMailer(email.Email{Address: "kerry@stones.com"}, "subject", nil, nil)
+	tmpl := testTemplate(t, "subject", "", "")
+	m, err = NewMailer(email.Email{Address: "kerry@stones.com"}, tmpl, nil)
 	is.NoErr(err)
 	ml := m.(*mailer)
-	is.Equal(ml.subject, "subject")
-	is.True(ml.client == nil)
+	is.Equal(ml.template, tmpl)
+	is.True(ml.sender == nil)
 }
 
 func TestMailer_Send(t *testing.T) {
 	is := is.New(t)
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
-	client := mockemail.NewMockClient(ctrl)
+	sender := mockemail.NewMockSender(ctrl)
 	mailer := mailer{
-		sender:   email.Email{Name: "Jim", Address: "jim@jim.com"},
-		subject:  "test email",
-		template: template.Must(template.New("t").Parse("<p>{{ .TTL }}</p>")),
-		client:   client,
+		from:     email.Email{Name: "Jim", Address: "jim@jim.com"},
+		template: testTemplate(t, "test email", "<p>{{ .TTL }}</p>", "ttl {{ .TTL }}"),
+		sender:   sender,
 	}
 	ctx := context.Background()
+	expected := email.Message{
+		From:    mailer.from,
+		To:      []email.Email{{Address: "joe@joe.com"}},
+		Subject: "test email",
+		Text:    "ttl 3\n",
+		HTML:    "<p>3</p>",
+	}
 
 	// Basic success
-	client.EXPECT().SendWithContext(ctx, mail.NewV3MailInit(
-		&mailer.sender,
-		"test email",
-		&email.Email{Address: "joe@joe.com"},
-		mail.NewContent("text/html", "<p>3</p>")),
-	).
-		Return(&rest.Response{StatusCode: 200}, nil)
+	sender.EXPECT().Send(ctx, &expected).Return(nil)
 	err := mailer.Send(ctx, &Invitation{TTL: 3, Email: "joe@joe.com"})
 	is.NoErr(err)
 
-	// error from sendgrid
-	client.EXPECT().SendWithContext(ctx, mail.NewV3MailInit(
-		&mailer.sender,
-		"test email",
-		&email.Email{Address: "joe@joe.com"},
-		mail.NewContent("text/html", "<p>3</p>")),
-	).
-		Return(nil, ErrSessionOwnership)
+	// error from email provider
+	sender.EXPECT().Send(ctx, &expected).Return(ErrSessionOwnership)
 	err = mailer.Send(ctx, &Invitation{TTL: 3, Email: "joe@joe.com"})
 	is.True(errors.Is(err, ErrSessionOwnership))
 
@@ -68,9 +81,7 @@ func TestMailer_Send(t *testing.T) {
 	is.True(errors.Is(err, email.ErrInvalid))
 
 	// Bad template
-	mailer.template = template.Must(template.New("t").Parse("{{.NoneExistantTemplateVariable}}"))
+	mailer.template = testTemplate(t, "", "{{ .NoneExistantTemplateVariable }}", "")
 	err = mailer.Send(ctx, &Invitation{Email: "1@one.com"})
 	is.True(err != nil)
-	_, ok := err.(texttemplate.ExecError)
-	is.True(ok)
 }
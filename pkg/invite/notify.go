@@ -0,0 +1,415 @@
+package invite
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.hrry.dev/homelab/pkg/db"
+	"gopkg.hrry.dev/homelab/pkg/email"
+	"gopkg.hrry.dev/homelab/pkg/email/templates"
+)
+
+const (
+	EventRedeemed = "invite.redeemed"
+
+	// SignatureHeader holds the hex encoded HMAC-SHA256 of the timestamp
+	// header, a ".", and the webhook body, prefixed with "sha256=".
+	SignatureHeader = "X-Invite-Signature-256"
+	// TimestampHeader is the unix time that the webhook was sent at. Receivers
+	// should reject old timestamps so that deliveries cannot be replayed.
+	TimestampHeader = "X-Invite-Timestamp"
+	EventHeader     = "X-Invite-Event"
+
+	// WebhookKind is the outbox kind used to queue webhook deliveries.
+	WebhookKind = "invite.webhook"
+	// MailKind is the outbox kind used to queue notification emails.
+	MailKind = "invite.mail"
+)
+
+// Event is emitted when something happens to an invite.
+type Event struct {
+	Type      string    `json:"type"`
+	CreatedBy uuid.UUID `json:"created_by"`
+	// Redeemer is the user that was created using the invite.
+	Redeemer uuid.UUID `json:"redeemer"`
+	Email    string    `json:"email"`
+	Username string    `json:"username,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Notifier sends notifications about invite events.
+type Notifier interface {
+	Notify(ctx context.Context, event *Event) error
+}
+
+// Preferences are a user's notification settings.
+type Preferences struct {
+	// Email is the address notified about invite events. Notification emails
+	// are disabled when empty.
+	Email string
+	// WebhookURL receives a POST request for every invite event. Webhooks are
+	// disabled when empty.
+	WebhookURL    string
+	WebhookSecret string
+}
+
+type PreferenceStore interface {
+	Preferences(ctx context.Context, user uuid.UUID) (*Preferences, error)
+}
+
+// EventMailer sends an email notification about an invite event.
+type EventMailer interface {
+	Send(ctx context.Context, to string, event *Event) error
+}
+
+// Queue stores deliveries so that they are retried even if the server
+// restarts.
+type Queue interface {
+	Enqueue(ctx context.Context, kind string, payload interface{}) error
+}
+
+// RedemptionNotifier emails and calls webhooks for the creator of an invite
+// when it gets redeemed. Failed deliveries are retried with exponential
+// backoff.
+type RedemptionNotifier struct {
+	Prefs  PreferenceStore
+	Mailer EventMailer
+	// Client sends webhooks. Defaults to a client that will not connect to
+	// internal addresses.
+	Client *http.Client
+	// Queue is optional. When set, emails and webhooks are queued and sent by
+	// the queue's worker using MailHandler and Deliver instead of being
+	// retried in memory while Notify blocks.
+	Queue Queue
+	// Attempts is the number of times each delivery is tried.
+	Attempts int
+	// Backoff is the delay before the first retry.
+	Backoff time.Duration
+	Now     func() time.Time
+}
+
+var (
+	_ Notifier            = (*RedemptionNotifier)(nil)
+	_ email.OutboxHandler = (*RedemptionNotifier)(nil)
+)
+
+const (
+	defaultNotifyAttempts = 5
+	defaultNotifyBackoff  = time.Second
+)
+
+func (rn *RedemptionNotifier) Notify(ctx context.Context, event *Event) error {
+	prefs, err := rn.Prefs.Preferences(ctx, event.CreatedBy)
+	if err != nil {
+		return errors.Wrap(err, "could not get notification preferences")
+	}
+	var mailErr, hookErr error
+	if len(prefs.Email) > 0 && rn.Mailer != nil {
+		if rn.Queue != nil {
+			mailErr = rn.Queue.Enqueue(ctx, MailKind, event)
+		} else {
+			mailErr = rn.retry(ctx, func() error {
+				return rn.Mailer.Send(ctx, prefs.Email, event)
+			})
+		}
+	}
+	if len(prefs.WebhookURL) > 0 {
+		if rn.Queue != nil {
+			hookErr = rn.Queue.Enqueue(ctx, WebhookKind, event)
+		} else {
+			hookErr = rn.retry(ctx, func() error {
+				return rn.post(ctx, prefs, event)
+			})
+		}
+	}
+	if mailErr != nil {
+		return errors.Wrap(mailErr, "failed to send notification email")
+	}
+	if hookErr != nil {
+		return errors.Wrap(hookErr, "failed to deliver webhook")
+	}
+	return nil
+}
+
+// Deliver sends a webhook that was queued by Notify. The creator's current
+// webhook settings are used.
+func (rn *RedemptionNotifier) Deliver(ctx context.Context, payload []byte) error {
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return permanent{err}
+	}
+	prefs, err := rn.Prefs.Preferences(ctx, event.CreatedBy)
+	if err != nil {
+		return errors.Wrap(err, "could not get notification preferences")
+	}
+	if len(prefs.WebhookURL) == 0 {
+		// Turned off since the webhook was queued.
+		return nil
+	}
+	return rn.post(ctx, prefs, &event)
+}
+
+// MailHandler returns the outbox handler that sends emails queued by Notify.
+// The creator's current email settings are used.
+func (rn *RedemptionNotifier) MailHandler() email.OutboxHandler {
+	return mailDelivery{rn}
+}
+
+type mailDelivery struct{ rn *RedemptionNotifier }
+
+func (md mailDelivery) Deliver(ctx context.Context, payload []byte) error {
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return permanent{err}
+	}
+	prefs, err := md.rn.Prefs.Preferences(ctx, event.CreatedBy)
+	if err != nil {
+		return errors.Wrap(err, "could not get notification preferences")
+	}
+	if len(prefs.Email) == 0 || md.rn.Mailer == nil {
+		// Turned off since the email was queued.
+		return nil
+	}
+	return md.rn.Mailer.Send(ctx, prefs.Email, &event)
+}
+
+func (rn *RedemptionNotifier) post(ctx context.Context, prefs *Preferences, event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return permanent{err}
+	}
+	u, err := url.Parse(prefs.WebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return permanent{fmt.Errorf("invalid webhook url %q", prefs.WebhookURL)}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return permanent{err}
+	}
+	timestamp := rn.now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event.Type)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, "sha256="+Sign([]byte(prefs.WebhookSecret), timestamp, body))
+	client := rn.Client
+	if client == nil {
+		client = webhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	default:
+		// Client errors will not go away by retrying.
+		return permanent{fmt.Errorf("webhook responded with %s", resp.Status)}
+	}
+}
+
+func (rn *RedemptionNotifier) retry(ctx context.Context, fn func() error) (err error) {
+	attempts, backoff := rn.Attempts, rn.Backoff
+	if attempts <= 0 {
+		attempts = defaultNotifyAttempts
+	}
+	if backoff <= 0 {
+		backoff = defaultNotifyBackoff
+	}
+	for i := 0; i < attempts; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		var p permanent
+		if errors.As(err, &p) {
+			return p.err
+		}
+		logger.WithFields(logrus.Fields{
+			"error":   err,
+			"attempt": i + 1,
+		}).Warn("notification delivery failed")
+		if i == attempts-1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+func (rn *RedemptionNotifier) now() time.Time {
+	if rn.Now == nil {
+		return time.Now()
+	}
+	return rn.Now()
+}
+
+// permanent is an error that should not be retried.
+type permanent struct{ err error }
+
+func (p permanent) Error() string { return p.err.Error() }
+
+// Is tells the outbox to stop retrying.
+func (p permanent) Is(target error) bool { return target == email.ErrUndeliverable }
+
+// Sign returns the hex encoded HMAC-SHA256 of a webhook's timestamp and body.
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+const webhookTimeout = 10 * time.Second
+
+var (
+	webhookClient = NewWebhookClient()
+
+	// ErrInternalAddress is returned when a webhook points at the server's
+	// own network.
+	ErrInternalAddress = errors.New("webhook address is not public")
+)
+
+// NewWebhookClient creates an http client for user supplied urls. It times
+// out and refuses to connect to loopback, private, and link-local addresses,
+// including ones that a public host name resolves to.
+func NewWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !publicIP(ip) {
+				return permanent{errors.Wrap(ErrInternalAddress, host)}
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			// Proxies from the environment would be dialed instead of the
+			// webhook's host.
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     time.Minute,
+		},
+	}
+}
+
+// carrierNAT is the shared address space from RFC 6598.
+var carrierNAT = net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		carrierNAT.Contains(ip))
+}
+
+// NewEventMailer creates an EventMailer that renders a template with the
+// event.
+func NewEventMailer(from email.Email, t *templates.Template, sender email.Sender) (EventMailer, error) {
+	if !email.Valid(from.Address) {
+		return nil, email.ErrInvalid
+	}
+	return &eventMailer{
+		from:     from,
+		template: t,
+		sender:   sender,
+	}, nil
+}
+
+type eventMailer struct {
+	from     email.Email
+	template *templates.Template
+	sender   email.Sender
+}
+
+func (m *eventMailer) Send(ctx context.Context, to string, event *Event) error {
+	if !email.Valid(to) {
+		return permanent{email.ErrInvalid}
+	}
+	message, err := m.template.Message(&m.from, &email.Email{Address: to}, event)
+	if err != nil {
+		return permanent{err}
+	}
+	return m.sender.Send(ctx, message)
+}
+
+// NewPGPreferenceStore creates a PreferenceStore backed by postgres. Users
+// without saved preferences get notification emails at their account's
+// address.
+//
+// The store is read only on purpose. Rows in notification_preferences are
+// managed by an admin in the database until there is a settings page to put
+// the webhook secret behind.
+func NewPGPreferenceStore(d db.DB) PreferenceStore {
+	return &pgPreferenceStore{db: d}
+}
+
+type pgPreferenceStore struct {
+	db db.DB
+}
+
+const selectPreferencesQuery = `
+	SELECT
+		u.email,
+		COALESCE(p.invite_email, TRUE),
+		COALESCE(p.webhook_url, ''),
+		COALESCE(p.webhook_secret, '')
+	FROM "user" u
+	LEFT JOIN notification_preferences p ON p.user_id = u.uuid
+	WHERE u.uuid = $1`
+
+func (ps *pgPreferenceStore) Preferences(ctx context.Context, user uuid.UUID) (*Preferences, error) {
+	var (
+		p         Preferences
+		address   sql.NullString
+		sendEmail bool
+	)
+	rows, err := ps.db.QueryContext(ctx, selectPreferencesQuery, user)
+	if err != nil {
+		return nil, err
+	}
+	err = db.ScanOne(rows, &address, &sendEmail, &p.WebhookURL, &p.WebhookSecret)
+	if err != nil {
+		return nil, err
+	}
+	if sendEmail {
+		p.Email = address.String
+	}
+	return &p, nil
+}
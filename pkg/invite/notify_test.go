@@ -0,0 +1,258 @@
+package invite
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/uuid"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+	"gopkg.hrry.dev/homelab/pkg/email"
+	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockemail"
+)
+
+type testPrefs map[uuid.UUID]*Preferences
+
+func (tp testPrefs) Preferences(_ context.Context, user uuid.UUID) (*Preferences, error) {
+	p, ok := tp[user]
+	if !ok {
+		return nil, errors.New("no preferences")
+	}
+	return p, nil
+}
+
+func TestRedemptionNotifier_Webhook(t *testing.T) {
+	is := is.New(t)
+	var (
+		calls   int32
+		creator = uuid.New()
+		secret  = "shhh"
+		event   = Event{
+			Type:      EventRedeemed,
+			CreatedBy: creator,
+			Redeemer:  uuid.New(),
+			Email:     "new@user.com",
+			Time:      time.Unix(1000, 0).UTC(),
+		}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first delivery to test retries
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		is.NoErr(err)
+		is.Equal(r.Header.Get(EventHeader), EventRedeemed)
+		is.Equal(r.Header.Get(TimestampHeader), "1700000000")
+		is.Equal(r.Header.Get(SignatureHeader), "sha256="+Sign([]byte(secret), 1700000000, body))
+		var got Event
+		is.NoErr(json.Unmarshal(body, &got))
+		is.Equal(got, event)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	n := RedemptionNotifier{
+		Prefs:   testPrefs{creator: {WebhookURL: srv.URL, WebhookSecret: secret}},
+		Client:  srv.Client(),
+		Backoff: time.Millisecond,
+		Now:     func() time.Time { return time.Unix(1700000000, 0) },
+	}
+	is.NoErr(n.Notify(context.Background(), &event))
+	is.Equal(atomic.LoadInt32(&calls), int32(2))
+}
+
+func TestSign(t *testing.T) {
+	is := is.New(t)
+	body := []byte(`{"type":"invite.redeemed"}`)
+	sig := Sign([]byte("secret"), 1700000000, body)
+	is.Equal(len(sig), 64)
+	// The timestamp is signed so it cannot be changed to replay a delivery.
+	is.True(sig != Sign([]byte("secret"), 1700000001, body))
+	is.True(sig != Sign([]byte("other"), 1700000000, body))
+}
+
+type testQueue struct {
+	kinds    []string
+	payloads []interface{}
+}
+
+func (tq *testQueue) Enqueue(_ context.Context, kind string, payload interface{}) error {
+	tq.kinds = append(tq.kinds, kind)
+	tq.payloads = append(tq.payloads, payload)
+	return nil
+}
+
+func TestRedemptionNotifier_Queue(t *testing.T) {
+	is := is.New(t)
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	creator := uuid.New()
+	queue := testQueue{}
+	n := RedemptionNotifier{
+		Prefs:  testPrefs{creator: {WebhookURL: srv.URL}},
+		Client: srv.Client(),
+		Queue:  &queue,
+	}
+	event := Event{Type: EventRedeemed, CreatedBy: creator}
+	is.NoErr(n.Notify(context.Background(), &event))
+	// Only queued
+	is.Equal(atomic.LoadInt32(&calls), int32(0))
+	is.Equal(queue.kinds, []string{WebhookKind})
+	is.Equal(len(queue.payloads), 1)
+
+	payload, err := json.Marshal(queue.payloads[0])
+	is.NoErr(err)
+	is.NoErr(n.Deliver(context.Background(), payload))
+	is.Equal(atomic.LoadInt32(&calls), int32(1))
+
+	// Bad payloads and urls are not retried by the outbox
+	is.True(errors.Is(n.Deliver(context.Background(), []byte("{")), email.ErrUndeliverable))
+	n.Prefs = testPrefs{creator: {WebhookURL: "file:///etc/passwd"}}
+	is.True(errors.Is(n.Deliver(context.Background(), payload), email.ErrUndeliverable))
+}
+
+func TestRedemptionNotifier_QueueEmail(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := context.Background()
+	sender := mockemail.NewMockSender(ctrl)
+	m, err := NewEventMailer(
+		email.Email{Address: "admin@example.com"},
+		testTemplate(t, "accepted", "<p>{{ .Username }}</p>", "{{ .Username }}"),
+		sender,
+	)
+	is.NoErr(err)
+	creator := uuid.New()
+	queue := testQueue{}
+	prefs := testPrefs{creator: {Email: "creator@example.com"}}
+	n := RedemptionNotifier{Prefs: prefs, Mailer: m, Queue: &queue}
+	// Nothing is sent until the queue delivers it
+	is.NoErr(n.Notify(ctx, &Event{CreatedBy: creator, Username: "jim"}))
+	is.Equal(queue.kinds, []string{MailKind})
+
+	payload, err := json.Marshal(queue.payloads[0])
+	is.NoErr(err)
+	sender.EXPECT().Send(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, msg *email.Message) error {
+		is.Equal(msg.To[0].Address, "creator@example.com")
+		is.Equal(msg.HTML, "<p>jim</p>")
+		return nil
+	})
+	is.NoErr(n.MailHandler().Deliver(ctx, payload))
+
+	// Turned off after being queued
+	prefs[creator] = &Preferences{}
+	is.NoErr(n.MailHandler().Deliver(ctx, payload))
+	is.True(errors.Is(n.MailHandler().Deliver(ctx, []byte("{")), email.ErrUndeliverable))
+}
+
+func TestWebhookClient(t *testing.T) {
+	is := is.New(t)
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer srv.Close()
+	creator := uuid.New()
+	n := RedemptionNotifier{
+		Prefs:    testPrefs{creator: {WebhookURL: srv.URL}},
+		Attempts: 3,
+		Backoff:  time.Millisecond,
+	}
+	// The default client will not connect to the loopback test server.
+	err := n.Notify(context.Background(), &Event{CreatedBy: creator})
+	is.True(errors.Is(err, ErrInternalAddress))
+	is.Equal(atomic.LoadInt32(&calls), int32(0))
+
+	for _, ip := range []string{"127.0.0.1", "10.0.0.4", "192.168.1.1", "169.254.169.254", "100.64.0.1", "::1", "fd00::1", "0.0.0.0"} {
+		is.True(!publicIP(net.ParseIP(ip))) // should not be public
+	}
+	for _, ip := range []string{"1.1.1.1", "140.82.112.3", "2606:4700:4700::1111"} {
+		is.True(publicIP(net.ParseIP(ip)))
+	}
+}
+
+func TestRedemptionNotifier_WebhookErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		status   int
+		attempts int32
+	}{
+		{"client error is not retried", http.StatusNotFound, 1},
+		{"server error is retried", http.StatusInternalServerError, 3},
+		{"rate limit is retried", http.StatusTooManyRequests, 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			var calls int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			creator := uuid.New()
+			n := RedemptionNotifier{
+				Prefs:    testPrefs{creator: {WebhookURL: srv.URL}},
+				Client:   srv.Client(),
+				Attempts: 3,
+				Backoff:  time.Millisecond,
+			}
+			err := n.Notify(context.Background(), &Event{CreatedBy: creator})
+			is.True(err != nil)
+			is.Equal(atomic.LoadInt32(&calls), tt.attempts)
+		})
+	}
+}
+
+func TestRedemptionNotifier_Email(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := context.Background()
+	sender := mockemail.NewMockSender(ctrl)
+	m, err := NewEventMailer(
+		email.Email{Address: "admin@example.com"},
+		testTemplate(t, "accepted", "<p>{{ .Username }}</p>", "{{ .Username }}"),
+		sender,
+	)
+	is.NoErr(err)
+	creator := uuid.New()
+	n := RedemptionNotifier{
+		Prefs: testPrefs{
+			creator: {Email: "creator@example.com"},
+			// Emails turned off
+			uuid.Nil: {},
+		},
+		Mailer:  m,
+		Backoff: time.Millisecond,
+	}
+
+	gomock.InOrder(
+		sender.EXPECT().Send(ctx, gomock.Any()).Return(&email.ProviderError{StatusCode: 500}),
+		sender.EXPECT().Send(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, msg *email.Message) error {
+			is.Equal(msg.Subject, "accepted")
+			is.Equal(msg.To[0].Address, "creator@example.com")
+			is.Equal(msg.HTML, "<p>jim</p>")
+			return nil
+		}),
+	)
+	is.NoErr(n.Notify(ctx, &Event{CreatedBy: creator, Username: "jim"}))
+	is.NoErr(n.Notify(ctx, &Event{CreatedBy: uuid.Nil}))
+
+	// Unknown user
+	is.True(n.Notify(ctx, &Event{CreatedBy: uuid.New()}) != nil)
+}
@@ -0,0 +1,448 @@
+package invite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"gopkg.hrry.dev/homelab/pkg/db"
+)
+
+// NewPGStore creates a postgres backed invite store that keeps a history of
+// every invite. The redis client is optional and only used as a read cache.
+func NewPGStore(d db.DB, cache redis.Cmdable) *PGStore {
+	return &PGStore{
+		DB:     d,
+		Cache:  cache,
+		Prefix: "invite",
+		KeyGen: DefaultKeyGen,
+		Now:    time.Now,
+	}
+}
+
+// PGStore stores invites in postgres. Invites are never deleted, instead their
+// status is updated so that there is a record of who invited whom.
+type PGStore struct {
+	DB db.DB
+	// Cache is an optional cache for pending invites.
+	Cache  redis.Cmdable
+	Prefix string
+	Now    func() time.Time
+	KeyGen func() (string, error)
+}
+
+var _ Store = (*PGStore)(nil)
+
+const (
+	createInviteQuery = `
+	INSERT INTO invite (id, created_by, email, receiver_name, roles, ttl, status, expires_at, max_uses, rooms)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	RETURNING created_at`
+
+	selectInviteQueryHead = `SELECT
+	id,
+	created_by,
+	email,
+	receiver_name,
+	roles,
+	ttl,
+	status,
+	redeemed_by,
+	expires_at,
+	redeemed_at,
+	created_at,
+	max_uses,
+	uses,
+	rooms
+FROM invite `
+
+	decrementInviteQuery = `
+	UPDATE invite
+	SET ttl = ttl - 1,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND status = 'pending' AND ttl > 0
+	RETURNING ttl`
+
+	setInviteStatusQuery = `
+	UPDATE invite
+	SET status = $2,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND status = 'pending'`
+
+	// Pending invites that have passed their expiration are listed as
+	// expired.
+	listInvitesStatusFilter = `
+	  AND ($4 = '' OR $4 = CASE
+		WHEN status = 'pending' AND expires_at <= $5 THEN 'expired'
+		ELSE status
+	  END)`
+
+	listInvitesQuery = selectInviteQueryHead + `
+	WHERE ($1::TIMESTAMPTZ IS NULL OR (created_at, id) < ($1, $2))` +
+		listInvitesStatusFilter + `
+	ORDER BY created_at DESC, id DESC
+	LIMIT $3`
+
+	listCreatorInvitesQuery = selectInviteQueryHead + `
+	WHERE created_by = $6
+	  AND ($1::TIMESTAMPTZ IS NULL OR (created_at, id) < ($1, $2))` +
+		listInvitesStatusFilter + `
+	ORDER BY created_at DESC, id DESC
+	LIMIT $3`
+
+	// The invite is only closed once every use has been taken.
+	redeemInviteQuery = `
+	WITH redeemed AS (
+		UPDATE invite
+		SET uses = uses + 1,
+			status = CASE WHEN uses + 1 >= max_uses THEN 'redeemed' ELSE status END,
+			redeemed_by = $2,
+			redeemed_at = CURRENT_TIMESTAMP,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'pending' AND uses < max_uses
+		RETURNING id, redeemed_at
+	)
+	INSERT INTO invite_redeemer (invite_id, user_id, redeemed_at)
+	SELECT id, $2, redeemed_at FROM redeemed
+	RETURNING redeemed_at`
+)
+
+func (ps *PGStore) Create(ctx context.Context, creator uuid.UUID, req *CreateInviteRequest) (*Session, string, error) {
+	expires := ps.now().Add(req.timeout())
+	s := Session{
+		CreatedBy:    creator,
+		ExpiresAt:    expires.UnixMilli(),
+		TTL:          req.ttl(),
+		Email:        req.Email,
+		Roles:        asAuthRoles(req.Roles),
+		ReceiverName: req.ReceiverName,
+		MaxUses:      req.maxUses(),
+		Rooms:        req.Rooms,
+		Status:       StatusPending,
+	}
+	id, err := ps.KeyGen()
+	if err != nil {
+		return nil, "", err
+	}
+	rows, err := ps.DB.QueryContext(
+		ctx,
+		createInviteQuery,
+		id,
+		s.CreatedBy,
+		s.Email,
+		s.ReceiverName,
+		pq.Array(s.Roles),
+		s.TTL,
+		s.Status,
+		expires,
+		s.MaxUses,
+		pq.Array(s.Rooms),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = db.ScanOne(rows, &s.CreatedAt); err != nil {
+		return nil, "", err
+	}
+	s.ID = id
+	return &s, id, nil
+}
+
+// Get will fetch a pending invite and use up one of its sign-up attempts.
+func (ps *PGStore) Get(ctx context.Context, id string) (*Session, error) {
+	s, err := ps.View(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if s.TTL > 0 {
+		rows, err := ps.DB.QueryContext(ctx, decrementInviteQuery, id)
+		if err != nil {
+			return nil, err
+		}
+		if err = db.ScanOne(rows, &s.TTL); err != nil {
+			if err == sql.ErrNoRows {
+				// Someone else used the last attempt or the invite was closed
+				// between reading and updating.
+				return nil, ErrInviteTTL
+			}
+			return nil, err
+		}
+		ps.uncache(ctx, id)
+	}
+	return s, nil
+}
+
+// View will fetch a pending invite without changing it.
+func (ps *PGStore) View(ctx context.Context, id string) (*Session, error) {
+	s, err := ps.cached(ctx, id)
+	if err == nil {
+		return s, nil
+	}
+	s, err = ps.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if s.Status != StatusPending {
+		return nil, ErrInviteClosed
+	}
+	if s.TTL == 0 {
+		ps.close(ctx, id, StatusExpired)
+		return nil, ErrInviteTTL
+	}
+	if ps.now().UnixMilli() >= s.ExpiresAt {
+		ps.close(ctx, id, StatusExpired)
+		return nil, ErrInviteClosed
+	}
+	ps.cache(ctx, s)
+	return s, nil
+}
+
+func (ps *PGStore) OwnerDel(ctx context.Context, id string, uid uuid.UUID) error {
+	s, err := ps.get(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return echo.ErrNotFound
+		}
+		return echo.ErrInternalServerError.SetInternal(err)
+	}
+	if !bytes.Equal(s.CreatedBy[:], uid[:]) {
+		return echo.ErrForbidden.SetInternal(ErrSessionOwnership)
+	}
+	if err = ps.Del(ctx, id); err != nil {
+		return echo.ErrInternalServerError.SetInternal(err)
+	}
+	return nil
+}
+
+// Del will revoke a pending invite. The invite is kept for history.
+func (ps *PGStore) Del(ctx context.Context, id string) error {
+	_, err := ps.DB.ExecContext(ctx, setInviteStatusQuery, id, StatusRevoked)
+	if err != nil {
+		return err
+	}
+	ps.uncache(ctx, id)
+	return nil
+}
+
+func (ps *PGStore) Redeem(ctx context.Context, id string, redeemer uuid.UUID) error {
+	var redeemedAt time.Time
+	rows, err := ps.DB.QueryContext(ctx, redeemInviteQuery, id, redeemer)
+	if err != nil {
+		return err
+	}
+	if err = db.ScanOne(rows, &redeemedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrInviteClosed
+		}
+		return err
+	}
+	ps.uncache(ctx, id)
+	return nil
+}
+
+// List returns every invite ever created, newest first. Pending invites that
+// have passed their expiration are reported as expired.
+func (ps *PGStore) List(ctx context.Context, opts *ListOptions) ([]*Session, string, error) {
+	return ps.list(ctx, listInvitesQuery, opts)
+}
+
+func (ps *PGStore) ListByCreator(ctx context.Context, creator uuid.UUID, opts *ListOptions) ([]*Session, string, error) {
+	return ps.list(ctx, listCreatorInvitesQuery, opts, creator)
+}
+
+func (ps *PGStore) list(ctx context.Context, query string, opts *ListOptions, args ...interface{}) ([]*Session, string, error) {
+	var (
+		after   sql.NullTime
+		afterID string
+		limit   = opts.limit()
+	)
+	if c := opts.cursor(); len(c) > 0 {
+		var err error
+		after.Time, afterID, err = parsePGCursor(c)
+		if err != nil {
+			return nil, "", err
+		}
+		after.Valid = true
+	}
+	// Fetch one extra row to find out if there is another page.
+	now := ps.now()
+	args = append([]interface{}{after, afterID, limit + 1, string(opts.status()), now}, args...)
+	rows, err := ps.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	nowMilli := now.UnixMilli()
+	sessions := make([]*Session, 0)
+	for rows.Next() {
+		var s Session
+		if err = scanSession(rows, &s); err != nil {
+			return nil, "", err
+		}
+		if s.Status == StatusPending && nowMilli >= s.ExpiresAt {
+			s.Status = StatusExpired
+		}
+		sessions = append(sessions, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(sessions) > limit {
+		sessions = sessions[:limit]
+		last := sessions[limit-1]
+		next = fmt.Sprintf("%d.%s", last.CreatedAt.UnixMicro(), last.ID)
+	}
+	return sessions, next, nil
+}
+
+func parsePGCursor(cursor string) (time.Time, string, error) {
+	ts, id, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	micro, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	return time.UnixMicro(micro), id, nil
+}
+
+func (ps *PGStore) get(ctx context.Context, id string) (*Session, error) {
+	var s Session
+	rows, err := ps.DB.QueryContext(ctx, selectInviteQueryHead+`WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	if err = scanSession(rows, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (ps *PGStore) close(ctx context.Context, id string, status Status) {
+	_, err := ps.DB.ExecContext(ctx, setInviteStatusQuery, id, status)
+	if err != nil {
+		logger.WithError(err).Error("could not update invite status")
+	}
+	ps.uncache(ctx, id)
+}
+
+func (ps *PGStore) now() time.Time {
+	if ps.Now == nil {
+		return time.Now()
+	}
+	return ps.Now()
+}
+
+func (ps *PGStore) key(id string) string {
+	return fmt.Sprintf("%s:%s", ps.Prefix, id)
+}
+
+func (ps *PGStore) cached(ctx context.Context, id string) (*Session, error) {
+	if ps.Cache == nil {
+		return nil, redis.Nil
+	}
+	raw, err := ps.Cache.Get(ctx, ps.key(id)).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	var s Session
+	if err = json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	// Only pending invites are cached.
+	s.ID = id
+	s.Status = StatusPending
+	return &s, nil
+}
+
+func (ps *PGStore) cache(ctx context.Context, s *Session) {
+	if ps.Cache == nil {
+		return
+	}
+	timeout := time.UnixMilli(s.ExpiresAt).Sub(ps.now())
+	if timeout <= 0 {
+		return
+	}
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	err = ps.Cache.Set(ctx, ps.key(s.ID), raw, timeout).Err()
+	if err != nil {
+		logger.WithError(err).Warn("could not cache invite")
+	}
+}
+
+// uncache removes an invite from the cache. When ctx holds a transaction the
+// entry is only removed once it commits so that a concurrent View cannot
+// cache the row as it was before the commit.
+func (ps *PGStore) uncache(ctx context.Context, id string) {
+	if ps.Cache == nil {
+		return
+	}
+	db.AfterCommit(ctx, func() {
+		err := ps.Cache.Del(ctx, ps.key(id)).Err()
+		if err != nil {
+			logger.WithError(err).Warn("could not remove invite from cache")
+		}
+	})
+}
+
+func scanSession(rows db.Scanner, s *Session) error {
+	var (
+		email, name sql.NullString
+		redeemedBy  uuid.NullUUID
+		redeemedAt  sql.NullTime
+		expiresAt   time.Time
+		rooms       pq.Int64Array
+	)
+	err := rows.Scan(
+		&s.ID,
+		&s.CreatedBy,
+		&email,
+		&name,
+		pq.Array(&s.Roles),
+		&s.TTL,
+		&s.Status,
+		&redeemedBy,
+		&expiresAt,
+		&redeemedAt,
+		&s.CreatedAt,
+		&s.MaxUses,
+		&s.Uses,
+		&rooms,
+	)
+	if err != nil {
+		return err
+	}
+	s.Email = email.String
+	s.ReceiverName = name.String
+	s.RedeemedBy = redeemedBy.UUID
+	s.RedeemedAt = redeemedAt.Time
+	s.ExpiresAt = expiresAt.UnixMilli()
+	if len(rooms) > 0 {
+		s.Rooms = make([]int, len(rooms))
+		for i, r := range rooms {
+			s.Rooms[i] = int(r)
+		}
+	}
+	return nil
+}
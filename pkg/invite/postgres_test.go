@@ -0,0 +1,283 @@
+package invite
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang/mock/gomock"
+	"github.com/google/uuid"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockdb"
+	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockredis"
+	"gopkg.hrry.dev/homelab/pkg/internal/mockutil"
+)
+
+func TestPGStore_Create(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	rows := mockdb.NewMockRows(ctrl)
+	now := time.Unix(1000, 0)
+	store := PGStore{
+		DB:     d,
+		Now:    func() time.Time { return now },
+		KeyGen: func() (string, error) { return "abc", nil },
+	}
+	ctx := context.Background()
+	creator := uuid.New()
+	gomock.InOrder(
+		d.EXPECT().QueryContext(
+			ctx, createInviteQuery,
+			"abc", creator, "a@b.com", "Jim", gomock.Any(), 3, StatusPending, now.Add(time.Hour), 4, gomock.Any(),
+		).Return(rows, nil),
+		rows.EXPECT().Next().Return(true),
+		rows.EXPECT().Scan(gomock.AssignableToTypeOf(&time.Time{})).Return(nil),
+		rows.EXPECT().Close().Return(nil),
+	)
+	s, id, err := store.Create(ctx, creator, &CreateInviteRequest{
+		Email:        "a@b.com",
+		ReceiverName: "Jim",
+		TTL:          3,
+		Timeout:      time.Hour,
+		Uses:         4,
+		Rooms:        []int{1},
+	})
+	is.NoErr(err)
+	is.Equal(id, "abc")
+	is.Equal(s.ID, "abc")
+	is.Equal(s.Status, StatusPending)
+	is.Equal(s.MaxUses, 4)
+	is.Equal(s.Rooms, []int{1})
+	is.Equal(s.ExpiresAt, now.Add(time.Hour).UnixMilli())
+}
+
+func TestPGStore_Get(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	run := func(name string, fn func(t *testing.T, store *PGStore, d *mockdb.MockDB, rows *mockdb.MockRows)) {
+		t.Run(name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			d := mockdb.NewMockDB(ctrl)
+			rows := mockdb.NewMockRows(ctrl)
+			store := PGStore{DB: d, Now: func() time.Time { return now }}
+			fn(t, &store, d, rows)
+		})
+	}
+
+	run("decrement ttl", func(t *testing.T, store *PGStore, d *mockdb.MockDB, rows *mockdb.MockRows) {
+		is := is.New(t)
+		s := Session{TTL: 5, Status: StatusPending, ExpiresAt: now.Add(time.Minute).UnixMilli()}
+		gomock.InOrder(
+			mockSelectInvite(d, rows, "1", &s),
+			d.EXPECT().QueryContext(ctx, decrementInviteQuery, "1").Return(rows, nil),
+			rows.EXPECT().Next().Return(true),
+			rows.EXPECT().Scan(gomock.Any()).DoAndReturn(func(dest ...interface{}) error {
+				*dest[0].(*int) = 4
+				return nil
+			}),
+			rows.EXPECT().Close().Return(nil),
+		)
+		session, err := store.Get(ctx, "1")
+		is.NoErr(err)
+		is.Equal(session.TTL, 4)
+	})
+
+	run("ttl used up by someone else", func(t *testing.T, store *PGStore, d *mockdb.MockDB, rows *mockdb.MockRows) {
+		is := is.New(t)
+		s := Session{TTL: 1, Status: StatusPending, ExpiresAt: now.Add(time.Minute).UnixMilli()}
+		gomock.InOrder(
+			mockSelectInvite(d, rows, "1", &s),
+			d.EXPECT().QueryContext(ctx, decrementInviteQuery, "1").Return(rows, nil),
+			rows.EXPECT().Next().Return(false),
+			rows.EXPECT().Err().Return(nil),
+			rows.EXPECT().Close().Return(nil),
+		)
+		_, err := store.Get(ctx, "1")
+		is.Equal(err, ErrInviteTTL)
+	})
+
+	run("not found", func(t *testing.T, store *PGStore, d *mockdb.MockDB, rows *mockdb.MockRows) {
+		is := is.New(t)
+		gomock.InOrder(
+			d.EXPECT().QueryContext(ctx, mockutil.HasPrefix(selectInviteQueryHead), "1").Return(rows, nil),
+			rows.EXPECT().Next().Return(false),
+			rows.EXPECT().Err().Return(nil),
+			rows.EXPECT().Close().Return(nil),
+		)
+		_, err := store.Get(ctx, "1")
+		is.Equal(err, sql.ErrNoRows)
+	})
+
+	run("already redeemed", func(t *testing.T, store *PGStore, d *mockdb.MockDB, rows *mockdb.MockRows) {
+		is := is.New(t)
+		s := Session{TTL: 1, Status: StatusRedeemed, ExpiresAt: now.Add(time.Minute).UnixMilli()}
+		mockSelectInvite(d, rows, "1", &s)
+		_, err := store.Get(ctx, "1")
+		is.Equal(err, ErrInviteClosed)
+	})
+
+	run("past expiration", func(t *testing.T, store *PGStore, d *mockdb.MockDB, rows *mockdb.MockRows) {
+		is := is.New(t)
+		s := Session{TTL: 1, Status: StatusPending, ExpiresAt: now.Add(-time.Minute).UnixMilli()}
+		gomock.InOrder(
+			mockSelectInvite(d, rows, "1", &s),
+			d.EXPECT().ExecContext(ctx, setInviteStatusQuery, "1", StatusExpired).Return(nil, nil),
+		)
+		_, err := store.Get(ctx, "1")
+		is.Equal(err, ErrInviteClosed)
+	})
+
+	run("no attempts left", func(t *testing.T, store *PGStore, d *mockdb.MockDB, rows *mockdb.MockRows) {
+		is := is.New(t)
+		s := Session{TTL: 0, Status: StatusPending, ExpiresAt: now.Add(time.Minute).UnixMilli()}
+		gomock.InOrder(
+			mockSelectInvite(d, rows, "1", &s),
+			d.EXPECT().ExecContext(ctx, setInviteStatusQuery, "1", StatusExpired).Return(nil, nil),
+		)
+		_, err := store.Get(ctx, "1")
+		is.Equal(err, ErrInviteTTL)
+	})
+}
+
+func TestPGStore_Redeem(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	rows := mockdb.NewMockRows(ctrl)
+	rd := mockredis.NewMockCmdable(ctrl)
+	store := PGStore{DB: d, Cache: rd, Prefix: "invite"}
+	ctx := context.Background()
+	redeemer := uuid.New()
+
+	gomock.InOrder(
+		d.EXPECT().QueryContext(ctx, redeemInviteQuery, "1", redeemer).Return(rows, nil),
+		rows.EXPECT().Next().Return(true),
+		rows.EXPECT().Scan(gomock.AssignableToTypeOf(&time.Time{})).Return(nil),
+		rows.EXPECT().Close().Return(nil),
+		rd.EXPECT().Del(ctx, "invite:1").Return(redis.NewIntResult(1, nil)),
+	)
+	is.NoErr(store.Redeem(ctx, "1", redeemer))
+
+	// The cache should be left alone when nothing was redeemed.
+
+	gomock.InOrder(
+		d.EXPECT().QueryContext(ctx, redeemInviteQuery, "1", redeemer).Return(rows, nil),
+		rows.EXPECT().Next().Return(false),
+		rows.EXPECT().Err().Return(nil),
+		rows.EXPECT().Close().Return(nil),
+	)
+	is.Equal(store.Redeem(ctx, "1", redeemer), ErrInviteClosed)
+
+	someErr := errors.New("some error")
+	d.EXPECT().QueryContext(ctx, redeemInviteQuery, "1", redeemer).Return(nil, someErr)
+	is.Equal(store.Redeem(ctx, "1", redeemer), someErr)
+}
+
+func TestPGStore_List(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	rows := mockdb.NewMockRows(ctrl)
+	now := time.Unix(1000, 0)
+	store := PGStore{DB: d, Now: func() time.Time { return now }}
+	ctx := context.Background()
+	expected := []Session{
+		{ID: "1", Status: StatusPending, ExpiresAt: now.Add(time.Minute).UnixMilli(), CreatedAt: now},
+		{ID: "2", Status: StatusPending, ExpiresAt: now.Add(-time.Minute).UnixMilli(), CreatedAt: now.Add(-time.Second)},
+		{ID: "3", Status: StatusRedeemed, RedeemedBy: uuid.New(), RedeemedAt: now, CreatedAt: now.Add(-time.Hour)},
+		{ID: "4", Status: StatusRevoked, CreatedAt: now.Add(-time.Hour * 2)},
+	}
+	d.EXPECT().QueryContext(ctx, listInvitesQuery, sql.NullTime{}, "", 4, "", now).Return(rows, nil)
+	for i := range expected {
+		rows.EXPECT().Next().Return(true)
+		mockScanSession(rows, &expected[i])
+	}
+	rows.EXPECT().Next().Return(false)
+	rows.EXPECT().Err().Return(nil)
+	rows.EXPECT().Close().Return(nil)
+	sessions, next, err := store.List(ctx, &ListOptions{Limit: 3})
+	is.NoErr(err)
+	is.Equal(len(sessions), 3)
+	is.Equal(sessions[0].Status, StatusPending)
+	is.Equal(sessions[1].Status, StatusExpired)
+	is.Equal(sessions[2].Status, StatusRedeemed)
+	is.Equal(sessions[2].RedeemedBy, expected[2].RedeemedBy)
+	is.True(sessions[2].RedeemedAt.Equal(now))
+	is.True(len(next) > 0)
+
+	// Next page by creator
+	creator := uuid.New()
+	after, afterID, err := parsePGCursor(next)
+	is.NoErr(err)
+	is.Equal(afterID, "3")
+	is.True(after.Equal(expected[2].CreatedAt))
+	d.EXPECT().QueryContext(
+		ctx, listCreatorInvitesQuery,
+		sql.NullTime{Time: after, Valid: true}, "3", 4, "", now, creator,
+	).Return(rows, nil)
+	rows.EXPECT().Next().Return(true)
+	mockScanSession(rows, &expected[3])
+	rows.EXPECT().Next().Return(false)
+	rows.EXPECT().Err().Return(nil)
+	rows.EXPECT().Close().Return(nil)
+	sessions, next, err = store.ListByCreator(ctx, creator, &ListOptions{Cursor: next, Limit: 3})
+	is.NoErr(err)
+	is.Equal(len(sessions), 1)
+	is.Equal(next, "")
+
+	// The status filter and the page size limit are applied in the query.
+	d.EXPECT().QueryContext(ctx, listInvitesQuery, sql.NullTime{}, "", maxListLimit+1, "expired", now).Return(rows, nil)
+	rows.EXPECT().Next().Return(false)
+	rows.EXPECT().Err().Return(nil)
+	rows.EXPECT().Close().Return(nil)
+	_, _, err = store.List(ctx, &ListOptions{Limit: 5000, Status: StatusExpired})
+	is.NoErr(err)
+
+	_, _, err = store.List(ctx, &ListOptions{Cursor: "bad"})
+	is.Equal(err, ErrInvalidCursor)
+}
+
+// mockSelectInvite will mock a single invite lookup and return the last call.
+func mockSelectInvite(d *mockdb.MockDB, rows *mockdb.MockRows, id string, s *Session) *gomock.Call {
+	last := rows.EXPECT().Close().Return(nil)
+	gomock.InOrder(
+		d.EXPECT().QueryContext(
+			context.Background(),
+			mockutil.HasPrefix(selectInviteQueryHead),
+			id,
+		).Return(rows, nil),
+		rows.EXPECT().Next().Return(true),
+		mockScanSession(rows, s),
+		last,
+	)
+	return last
+}
+
+func mockScanSession(rows *mockdb.MockRows, s *Session) *gomock.Call {
+	return rows.EXPECT().Scan(
+		gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any(), gomock.Any(),
+	).DoAndReturn(func(dest ...interface{}) error {
+		*dest[0].(*string) = s.ID
+		*dest[1].(*uuid.UUID) = s.CreatedBy
+		*dest[2].(*sql.NullString) = sql.NullString{String: s.Email, Valid: len(s.Email) > 0}
+		*dest[5].(*int) = s.TTL
+		*dest[6].(*Status) = s.Status
+		*dest[7].(*uuid.NullUUID) = uuid.NullUUID{UUID: s.RedeemedBy, Valid: s.RedeemedBy != uuid.Nil}
+		*dest[8].(*time.Time) = time.UnixMilli(s.ExpiresAt)
+		*dest[9].(*sql.NullTime) = sql.NullTime{Time: s.RedeemedAt, Valid: !s.RedeemedAt.IsZero()}
+		*dest[10].(*time.Time) = s.CreatedAt
+		*dest[11].(*int) = s.MaxUses
+		*dest[12].(*int) = s.Uses
+		return nil
+	})
+}
@@ -0,0 +1,319 @@
+package invite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"gopkg.hrry.dev/homelab/pkg/auth"
+	"gopkg.hrry.dev/homelab/pkg/db"
+)
+
+const tokenAudience = "invite"
+
+// Ledger counts how many times stateless invites have been used so that a
+// signed invite link cannot be redeemed more times than it allows.
+type Ledger interface {
+	// Redeem counts one use of an invite. It returns false if the invite has
+	// been revoked or has already been used max times.
+	Redeem(ctx context.Context, id string, max int, expires time.Time) (bool, error)
+	// Revoke closes an invite.
+	Revoke(ctx context.Context, id string, expires time.Time) error
+	// Uses returns the number of times an invite has been used and whether or
+	// not it has been revoked.
+	Uses(ctx context.Context, id string) (int, bool, error)
+}
+
+// Pruner is a ledger that can remove the entries of expired invites.
+type Pruner interface {
+	Prune(ctx context.Context) (int64, error)
+}
+
+// RunPruner prunes a ledger every interval until the context is cancelled.
+func RunPruner(ctx context.Context, p Pruner, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := p.Prune(ctx)
+		if err != nil && ctx.Err() == nil {
+			logger.WithError(err).Warn("could not prune invite redemption ledger")
+		} else if n > 0 {
+			logger.WithField("count", n).Info("pruned invite redemption ledger")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// NewTokenStore creates an invite store where the invite id is a signed token
+// that holds all of the invite's data.
+func NewTokenStore(conf auth.TokenConfig, ledger Ledger) *TokenStore {
+	return &TokenStore{
+		Config: conf,
+		Ledger: ledger,
+		KeyGen: DefaultKeyGen,
+		Now:    time.Now,
+	}
+}
+
+// TokenStore is a stateless invite store. Invites are signed, expiring tokens
+// so nothing is saved until an invite is redeemed or revoked. Since invites
+// are not stored they cannot be listed and sign-up attempts are not counted.
+type TokenStore struct {
+	Config auth.TokenConfig
+	Ledger Ledger
+	Now    func() time.Time
+	KeyGen func() (string, error)
+}
+
+var _ Store = (*TokenStore)(nil)
+
+type inviteClaims struct {
+	Email        string      `json:"email,omitempty"`
+	ReceiverName string      `json:"name,omitempty"`
+	Roles        []auth.Role `json:"roles,omitempty"`
+	MaxUses      int         `json:"uses,omitempty"`
+	Rooms        []int       `json:"rooms,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (ts *TokenStore) Create(ctx context.Context, creator uuid.UUID, req *CreateInviteRequest) (*Session, string, error) {
+	timeout := req.timeout()
+	jti, err := ts.KeyGen()
+	if err != nil {
+		return nil, "", err
+	}
+	now := ts.now()
+	claims := inviteClaims{
+		Email:        req.Email,
+		ReceiverName: req.ReceiverName,
+		Roles:        asAuthRoles(req.Roles),
+		MaxUses:      req.maxUses(),
+		Rooms:        req.Rooms,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   creator.String(),
+			Issuer:    auth.Issuer,
+			Audience:  []string{tokenAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(timeout)),
+		},
+	}
+	token, err := jwt.NewWithClaims(ts.Config.Type(), &claims).SignedString(ts.Config.Private())
+	if err != nil {
+		return nil, "", err
+	}
+	s := sessionFromClaims(&claims)
+	s.ID = token
+	return s, token, nil
+}
+
+// Get is the same as View because stateless invites do not keep track of
+// sign-up attempts.
+func (ts *TokenStore) Get(ctx context.Context, token string) (*Session, error) {
+	return ts.View(ctx, token)
+}
+
+func (ts *TokenStore) View(ctx context.Context, token string) (*Session, error) {
+	claims, err := ts.parse(token)
+	if err != nil {
+		return nil, err
+	}
+	uses, revoked, err := ts.Ledger.Uses(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	s := sessionFromClaims(claims)
+	s.ID = token
+	s.Uses = uses
+	if revoked || s.usesLeft() <= 0 {
+		return nil, ErrInviteClosed
+	}
+	return s, nil
+}
+
+func (ts *TokenStore) OwnerDel(ctx context.Context, token string, uid uuid.UUID) error {
+	claims, err := ts.parse(token)
+	if err != nil {
+		return echo.ErrNotFound.SetInternal(err)
+	}
+	creator, err := uuid.Parse(claims.Subject)
+	if err != nil || !bytes.Equal(creator[:], uid[:]) {
+		return echo.ErrForbidden.SetInternal(ErrSessionOwnership)
+	}
+	if err = ts.revoke(ctx, claims); err != nil {
+		return echo.ErrInternalServerError.SetInternal(err)
+	}
+	return nil
+}
+
+// Del will revoke the invite by adding it to the ledger.
+func (ts *TokenStore) Del(ctx context.Context, token string) error {
+	claims, err := ts.parse(token)
+	if err != nil {
+		return err
+	}
+	return ts.revoke(ctx, claims)
+}
+
+func (ts *TokenStore) Redeem(ctx context.Context, token string, _ uuid.UUID) error {
+	claims, err := ts.parse(token)
+	if err != nil {
+		return err
+	}
+	max := claims.MaxUses
+	if max <= 0 {
+		max = 1
+	}
+	ok, err := ts.Ledger.Redeem(ctx, claims.ID, max, claims.ExpiresAt.Time)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInviteClosed
+	}
+	return nil
+}
+
+// List always returns an empty list since stateless invites are not stored.
+func (ts *TokenStore) List(context.Context, *ListOptions) ([]*Session, string, error) {
+	return []*Session{}, "", nil
+}
+
+// ListByCreator always returns an empty list since stateless invites are not
+// stored.
+func (ts *TokenStore) ListByCreator(context.Context, uuid.UUID, *ListOptions) ([]*Session, string, error) {
+	return []*Session{}, "", nil
+}
+
+func (ts *TokenStore) revoke(ctx context.Context, claims *inviteClaims) error {
+	return ts.Ledger.Revoke(ctx, claims.ID, claims.ExpiresAt.Time)
+}
+
+func (ts *TokenStore) parse(token string) (*inviteClaims, error) {
+	var claims inviteClaims
+	parser := jwt.Parser{
+		ValidMethods:         []string{ts.Config.Type().Alg()},
+		SkipClaimsValidation: true,
+	}
+	tok, err := parser.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return ts.Config.Public(), nil
+	})
+	if err != nil || !tok.Valid {
+		return nil, errors.Wrap(ErrInviteNotFound, "invalid invite token")
+	}
+	if claims.Issuer != auth.Issuer || !claims.VerifyAudience(tokenAudience, true) || len(claims.ID) == 0 {
+		return nil, errors.Wrap(ErrInviteNotFound, "invalid invite token claims")
+	}
+	if claims.ExpiresAt == nil || !ts.now().Before(claims.ExpiresAt.Time) {
+		return nil, ErrInviteClosed
+	}
+	return &claims, nil
+}
+
+func (ts *TokenStore) now() time.Time {
+	if ts.Now == nil {
+		return time.Now()
+	}
+	return ts.Now()
+}
+
+func sessionFromClaims(claims *inviteClaims) *Session {
+	creator, _ := uuid.Parse(claims.Subject)
+	s := Session{
+		CreatedBy:    creator,
+		Email:        claims.Email,
+		ReceiverName: claims.ReceiverName,
+		Roles:        claims.Roles,
+		MaxUses:      claims.MaxUses,
+		Rooms:        claims.Rooms,
+		// Sign-up attempts are not tracked
+		TTL:    -1,
+		Status: StatusPending,
+	}
+	if claims.ExpiresAt != nil {
+		s.ExpiresAt = claims.ExpiresAt.UnixMilli()
+	}
+	if claims.IssuedAt != nil {
+		s.CreatedAt = claims.IssuedAt.Time
+	}
+	return &s
+}
+
+// NewPGLedger creates a redemption ledger backed by postgres.
+func NewPGLedger(d db.DB) Ledger {
+	return &pgLedger{db: d}
+}
+
+type pgLedger struct {
+	db db.DB
+}
+
+const (
+	redeemTokenQuery = `
+	INSERT INTO invite_redemption (id, expires_at)
+	VALUES ($1, $2)
+	ON CONFLICT (id) DO UPDATE
+	SET uses = invite_redemption.uses + 1
+	WHERE NOT invite_redemption.revoked AND invite_redemption.uses < $3`
+	revokeTokenQuery = `
+	INSERT INTO invite_redemption (id, expires_at, uses, revoked)
+	VALUES ($1, $2, 0, TRUE)
+	ON CONFLICT (id) DO UPDATE SET revoked = TRUE`
+	tokenUsesQuery   = `SELECT uses, revoked FROM invite_redemption WHERE id = $1`
+	pruneLedgerQuery = `DELETE FROM invite_redemption WHERE expires_at < CURRENT_TIMESTAMP`
+)
+
+func (l *pgLedger) Redeem(ctx context.Context, id string, max int, expires time.Time) (bool, error) {
+	res, err := l.db.ExecContext(ctx, redeemTokenQuery, id, expires, max)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Prune removes the ledger entries of expired invites. Expired invites can't
+// be used anyway so there is no reason to keep them around. It runs outside
+// of Redeem so that sign-ups never wait on or fail because of it.
+func (l *pgLedger) Prune(ctx context.Context) (int64, error) {
+	res, err := l.db.ExecContext(ctx, pruneLedgerQuery)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (l *pgLedger) Revoke(ctx context.Context, id string, expires time.Time) error {
+	_, err := l.db.ExecContext(ctx, revokeTokenQuery, id, expires)
+	return err
+}
+
+func (l *pgLedger) Uses(ctx context.Context, id string) (int, bool, error) {
+	var (
+		uses    int
+		revoked bool
+	)
+	rows, err := l.db.QueryContext(ctx, tokenUsesQuery, id)
+	if err != nil {
+		return 0, false, err
+	}
+	err = db.ScanOne(rows, &uses, &revoked)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return uses, revoked, nil
+}
@@ -0,0 +1,166 @@
+package invite
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/uuid"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+	"gopkg.hrry.dev/homelab/pkg/auth"
+	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockdb"
+)
+
+type testLedger struct {
+	mu sync.Mutex
+	m  map[string]int
+}
+
+// revoked is stored as a negative use count
+const revoked = -1
+
+func (tl *testLedger) Redeem(_ context.Context, id string, max int, _ time.Time) (bool, error) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	uses := tl.m[id]
+	if uses == revoked || uses >= max {
+		return false, nil
+	}
+	tl.m[id] = uses + 1
+	return true, nil
+}
+
+func (tl *testLedger) Revoke(_ context.Context, id string, _ time.Time) error {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	tl.m[id] = revoked
+	return nil
+}
+
+func (tl *testLedger) Uses(_ context.Context, id string) (int, bool, error) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	uses := tl.m[id]
+	if uses == revoked {
+		return 0, true, nil
+	}
+	return uses, false, nil
+}
+
+func TestTokenStore(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	now := time.Now()
+	ledger := &testLedger{m: make(map[string]int)}
+	store := NewTokenStore(auth.GenEdDSATokenConfig(), ledger)
+	store.Now = func() time.Time { return now }
+	creator := uuid.New()
+
+	s, token, err := store.Create(ctx, creator, &CreateInviteRequest{
+		Email:   "t@t.com",
+		Roles:   []string{"family"},
+		Timeout: time.Minute,
+	})
+	is.NoErr(err)
+	is.Equal(s.ID, token)
+	is.Equal(s.CreatedBy, creator)
+
+	s, err = store.Get(ctx, token)
+	is.NoErr(err)
+	is.Equal(s.Email, "t@t.com")
+	is.Equal(s.Roles, []auth.Role{auth.RoleFamily})
+	is.Equal(s.CreatedBy, creator)
+	is.Equal(s.TTL, -1)
+	is.Equal(s.ExpiresAt, now.Add(time.Minute).Truncate(time.Second).UnixMilli())
+
+	// Single use
+	is.NoErr(store.Redeem(ctx, token, uuid.New()))
+	is.Equal(store.Redeem(ctx, token, uuid.New()), ErrInviteClosed)
+	_, err = store.View(ctx, token)
+	is.Equal(err, ErrInviteClosed)
+
+	// Group invite
+	_, token, err = store.Create(ctx, creator, &CreateInviteRequest{Uses: 2, Rooms: []int{3}})
+	is.NoErr(err)
+	is.NoErr(store.Redeem(ctx, token, uuid.New()))
+	s, err = store.View(ctx, token)
+	is.NoErr(err)
+	is.Equal(s.Uses, 1)
+	is.Equal(s.MaxUses, 2)
+	is.Equal(s.Rooms, []int{3})
+	is.NoErr(store.Redeem(ctx, token, uuid.New()))
+	is.Equal(store.Redeem(ctx, token, uuid.New()), ErrInviteClosed)
+	_, err = store.View(ctx, token)
+	is.Equal(err, ErrInviteClosed)
+
+	// Only the creator can revoke
+	_, token, err = store.Create(ctx, creator, &CreateInviteRequest{})
+	is.NoErr(err)
+	err = store.OwnerDel(ctx, token, uuid.New())
+	is.True(errors.Is(err, ErrSessionOwnership))
+	is.NoErr(store.OwnerDel(ctx, token, creator))
+	_, err = store.Get(ctx, token)
+	is.Equal(err, ErrInviteClosed)
+
+	// Expired
+	_, token, err = store.Create(ctx, creator, &CreateInviteRequest{Timeout: time.Minute})
+	is.NoErr(err)
+	store.Now = func() time.Time { return now.Add(time.Hour) }
+	_, err = store.View(ctx, token)
+	is.Equal(err, ErrInviteClosed)
+	store.Now = func() time.Time { return now }
+
+	// Tampered or signed by someone else
+	other := NewTokenStore(auth.GenEdDSATokenConfig(), ledger)
+	_, token, err = other.Create(ctx, creator, &CreateInviteRequest{})
+	is.NoErr(err)
+	_, err = store.View(ctx, token)
+	is.True(errors.Is(err, ErrInviteNotFound))
+	_, err = store.View(ctx, "not-a-token")
+	is.True(errors.Is(err, ErrInviteNotFound))
+}
+
+type testResult int64
+
+func (r testResult) LastInsertId() (int64, error) { return 0, nil }
+func (r testResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+func TestPGLedger(t *testing.T) {
+	is := is.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d := mockdb.NewMockDB(ctrl)
+	ctx := context.Background()
+	ledger := NewPGLedger(d)
+	expires := time.Unix(1000, 0)
+
+	// redeeming doesn't prune, a failed prune would abort the sign-up's
+	// transaction
+	d.EXPECT().ExecContext(ctx, redeemTokenQuery, "abc", expires, 2).Return(testResult(1), nil)
+	ok, err := ledger.Redeem(ctx, "abc", 2, expires)
+	is.NoErr(err)
+	is.True(ok)
+	d.EXPECT().ExecContext(ctx, redeemTokenQuery, "abc", expires, 2).Return(testResult(0), nil)
+	ok, err = ledger.Redeem(ctx, "abc", 2, expires)
+	is.NoErr(err)
+	is.True(!ok)
+
+	p, ok := ledger.(Pruner)
+	is.True(ok)
+	d.EXPECT().ExecContext(ctx, pruneLedgerQuery).Return(testResult(3), nil)
+	n, err := p.Prune(ctx)
+	is.NoErr(err)
+	is.Equal(n, int64(3))
+
+	// the pruner runs once right away and stops with its context
+	cancelled, cancel := context.WithCancel(ctx)
+	d.EXPECT().ExecContext(cancelled, pruneLedgerQuery).DoAndReturn(func(context.Context, string, ...interface{}) (sql.Result, error) {
+		cancel()
+		return testResult(0), nil
+	})
+	is.Equal(RunPruner(cancelled, p, time.Hour), context.Canceled)
+}
@@ -0,0 +1,290 @@
+// Package lru implements a size bounded least recently used cache with per
+// entry expiration.
+package lru
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultCapacity is used when a cache is created without a capacity.
+const DefaultCapacity = 10_000
+
+// Options configure a Cache.
+type Options struct {
+	// Capacity is the maximum number of entries. The least recently used
+	// entry is evicted to make room for new ones.
+	Capacity int
+	// TTL is the default lifetime of an entry. Entries don't expire when the
+	// TTL is zero or negative.
+	TTL time.Duration
+	// CleanupInterval is how often expired entries are removed in the
+	// background. Expired entries are only removed when they are accessed if
+	// the interval is zero.
+	CleanupInterval time.Duration
+	// Now is the clock used for expiration, defaults to time.Now.
+	Now func() time.Time
+}
+
+// Cache is a least recently used cache that is safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	mu    sync.Mutex
+	ll    *list.List
+	items map[K]*list.Element
+	cap   int
+	ttl   time.Duration
+	now   func() time.Time
+	stats Stats
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Stats counts cache activity.
+type Stats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+}
+
+type entry[K comparable, V any] struct {
+	key     K
+	val     V
+	expires time.Time
+}
+
+// New creates a cache. A background janitor is started when the cleanup
+// interval is set and it runs until the cache is closed.
+func New[K comparable, V any](opts Options) *Cache[K, V] {
+	c := Cache[K, V]{
+		ll:    list.New(),
+		items: make(map[K]*list.Element),
+		cap:   opts.Capacity,
+		ttl:   opts.TTL,
+		now:   opts.Now,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if c.cap <= 0 {
+		c.cap = DefaultCapacity
+	}
+	if c.now == nil {
+		c.now = time.Now
+	}
+	if opts.CleanupInterval > 0 {
+		go c.janitor(opts.CleanupInterval)
+	} else {
+		close(c.done)
+	}
+	return &c
+}
+
+// Get returns the value for a key. Expired entries are treated as missing.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		var zero V
+		return zero, false
+	}
+	e := el.Value.(*entry[K, V])
+	if c.expired(e, c.now()) {
+		c.remove(el)
+		c.stats.Expirations++
+		c.stats.Misses++
+		var zero V
+		return zero, false
+	}
+	c.ll.MoveToFront(el)
+	c.stats.Hits++
+	return e.val, true
+}
+
+// Set adds a value with the default TTL.
+func (c *Cache[K, V]) Set(key K, val V) {
+	c.SetWithTTL(key, val, c.ttl)
+}
+
+// SetWithTTL adds a value that expires after the given TTL. The value doesn't
+// expire if the TTL is zero or negative.
+func (c *Cache[K, V]) SetWithTTL(key K, val V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.expiration(ttl)
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry[K, V])
+		e.val, e.expires = val, expires
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&entry[K, V]{key: key, val: val, expires: expires})
+	for c.ll.Len() > c.cap {
+		c.remove(c.ll.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Replace changes the value of an entry without changing when it expires. It
+// returns false if the key is not in the cache.
+func (c *Cache[K, V]) Replace(key K, val V) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	e := el.Value.(*entry[K, V])
+	if c.expired(e, c.now()) {
+		c.remove(el)
+		c.stats.Expirations++
+		return false
+	}
+	e.val = val
+	c.ll.MoveToFront(el)
+	return true
+}
+
+// Expire changes the TTL of an entry. It returns false if the key is not in
+// the cache.
+func (c *Cache[K, V]) Expire(key K, ttl time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	e := el.Value.(*entry[K, V])
+	if c.expired(e, c.now()) {
+		c.remove(el)
+		c.stats.Expirations++
+		return false
+	}
+	e.expires = c.expiration(ttl)
+	return true
+}
+
+// Del removes a key and returns true if it was in the cache.
+func (c *Cache[K, V]) Del(key K) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if ok {
+		c.remove(el)
+	}
+	return ok
+}
+
+// Len is the number of entries including ones that have expired but have
+// not been removed yet.
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Stats returns a snapshot of the cache's counters.
+func (c *Cache[K, V]) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Close stops the background janitor and waits for it to exit. It is safe to
+// call more than once.
+func (c *Cache[K, V]) Close() error {
+	c.closeOnce.Do(func() { close(c.stop) })
+	<-c.done
+	return nil
+}
+
+// RemoveExpired removes all the entries that have expired.
+func (c *Cache[K, V]) RemoveExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.now()
+	for el := c.ll.Back(); el != nil; {
+		prev := el.Prev()
+		if c.expired(el.Value.(*entry[K, V]), n) {
+			c.remove(el)
+			c.stats.Expirations++
+		}
+		el = prev
+	}
+}
+
+func (c *Cache[K, V]) janitor(interval time.Duration) {
+	defer close(c.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.RemoveExpired()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *Cache[K, V]) expiration(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return c.now().Add(ttl)
+}
+
+func (c *Cache[K, V]) expired(e *entry[K, V], now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+func (c *Cache[K, V]) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*entry[K, V]).key)
+}
+
+// Collector exports the cache's stats as prometheus metrics.
+func (c *Cache[K, V]) Collector(namespace, subsystem string) prometheus.Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, nil, nil)
+	}
+	return &collector{
+		stats:       c.Stats,
+		size:        c.Len,
+		hits:        desc("hits_total", "Number of cache hits."),
+		misses:      desc("misses_total", "Number of cache misses."),
+		evictions:   desc("evictions_total", "Number of entries evicted to make room for new ones."),
+		expirations: desc("expirations_total", "Number of entries removed after they expired."),
+		entries:     desc("entries", "Number of entries in the cache."),
+	}
+}
+
+type collector struct {
+	stats func() Stats
+	size  func() int
+
+	hits, misses, evictions, expirations, entries *prometheus.Desc
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.evictions
+	ch <- c.expirations
+	ch <- c.entries
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.stats()
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(s.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(s.Misses))
+	ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(s.Evictions))
+	ch <- prometheus.MustNewConstMetric(c.expirations, prometheus.CounterValue, float64(s.Expirations))
+	ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(c.size()))
+}
@@ -0,0 +1,177 @@
+package lru
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) add(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+func TestCache_Evict(t *testing.T) {
+	is := is.New(t)
+	c := New[string, int](Options{Capacity: 2})
+	defer c.Close()
+	c.Set("a", 1)
+	c.Set("b", 2)
+	_, ok := c.Get("a")
+	is.True(ok)
+	// b is the least recently used
+	c.Set("c", 3)
+	_, ok = c.Get("b")
+	is.True(!ok)
+	v, ok := c.Get("a")
+	is.True(ok)
+	is.Equal(v, 1)
+	is.Equal(c.Len(), 2)
+
+	// updating a key doesn't evict anything
+	c.Set("a", 10)
+	v, _ = c.Get("a")
+	is.Equal(v, 10)
+	is.Equal(c.Len(), 2)
+	is.True(c.Del("a"))
+	is.True(!c.Del("a"))
+	is.Equal(c.Stats(), Stats{Hits: 3, Misses: 1, Evictions: 1})
+}
+
+func TestCache_TTL(t *testing.T) {
+	is := is.New(t)
+	clk := &clock{t: time.Unix(1000, 0)}
+	c := New[string, int](Options{TTL: time.Minute, Now: clk.now})
+	defer c.Close()
+	c.Set("a", 1)
+	c.SetWithTTL("b", 2, time.Hour)
+	c.SetWithTTL("forever", 3, -1)
+
+	clk.add(2 * time.Minute)
+	_, ok := c.Get("a")
+	is.True(!ok)
+	_, ok = c.Get("b")
+	is.True(ok)
+
+	is.True(c.Expire("b", time.Minute))
+	is.True(!c.Expire("a", time.Minute))
+	clk.add(2 * time.Minute)
+	c.RemoveExpired()
+	is.Equal(c.Len(), 1)
+	_, ok = c.Get("forever")
+	is.True(ok)
+	is.Equal(c.Stats().Expirations, uint64(2))
+}
+
+func TestCache_Replace(t *testing.T) {
+	is := is.New(t)
+	clk := &clock{t: time.Unix(1000, 0)}
+	c := New[string, int](Options{TTL: time.Hour, Now: clk.now})
+	defer c.Close()
+	c.SetWithTTL("a", 1, time.Minute)
+	is.True(c.Replace("a", 2))
+	v, ok := c.Get("a")
+	is.True(ok)
+	is.Equal(v, 2)
+	is.True(!c.Replace("b", 1))
+
+	// the entry still expires when it was going to
+	clk.add(2 * time.Minute)
+	is.True(!c.Replace("a", 3))
+	_, ok = c.Get("a")
+	is.True(!ok)
+}
+
+func TestCache_Janitor(t *testing.T) {
+	is := is.New(t)
+	clk := &clock{t: time.Unix(1000, 0)}
+	c := New[int, int](Options{TTL: time.Second, CleanupInterval: time.Millisecond, Now: clk.now})
+	for i := 0; i < 10; i++ {
+		c.Set(i, i)
+	}
+	clk.add(time.Minute)
+	deadline := time.Now().Add(time.Second)
+	for c.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	is.Equal(c.Len(), 0)
+	is.NoErr(c.Close())
+	is.NoErr(c.Close())
+	select {
+	case <-c.done:
+	default:
+		t.Fatal("janitor should have stopped")
+	}
+}
+
+func TestCache_Concurrent(t *testing.T) {
+	c := New[string, int](Options{Capacity: 64, TTL: time.Millisecond, CleanupInterval: time.Millisecond})
+	defer c.Close()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := strconv.Itoa((g * i) % 100)
+				switch i % 4 {
+				case 0:
+					c.Set(key, i)
+				case 1:
+					c.Get(key)
+				case 2:
+					c.Expire(key, time.Second)
+				case 3:
+					c.Del(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := c.Len(); n > 64 {
+		t.Errorf("cache grew past its capacity: %d", n)
+	}
+}
+
+func TestCache_Collector(t *testing.T) {
+	is := is.New(t)
+	c := New[string, int](Options{Capacity: 1})
+	defer c.Close()
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a")
+	c.Get("b")
+	reg := prometheus.NewPedanticRegistry()
+	is.NoErr(reg.Register(c.Collector("test", "cache")))
+	families, err := reg.Gather()
+	is.NoErr(err)
+	values := make(map[string]float64)
+	for _, f := range families {
+		m := f.GetMetric()[0]
+		if m.GetGauge() != nil {
+			values[f.GetName()] = m.GetGauge().GetValue()
+		} else {
+			values[f.GetName()] = m.GetCounter().GetValue()
+		}
+	}
+	is.Equal(values["test_cache_entries"], 1.0)
+	is.Equal(values["test_cache_evictions_total"], 1.0)
+	is.Equal(values["test_cache_hits_total"], 1.0)
+	is.Equal(values["test_cache_misses_total"], 1.0)
+}
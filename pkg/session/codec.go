@@ -0,0 +1,142 @@
+package session
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec serializes session values.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+	// Version is written in front of every value so that it can be decoded
+	// with the same codec.
+	Version() byte
+}
+
+var (
+	// GobCodec encodes values with encoding/gob. Interface values must be
+	// registered with RegisterSerializable.
+	GobCodec Codec = gobCodec{}
+	// JSONCodec encodes values with encoding/json.
+	JSONCodec Codec = jsonCodec{}
+	// MsgpackCodec encodes values with MessagePack.
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (gobCodec) Version() byte { return CodecVersionGob }
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Version() byte                      { return CodecVersionJSON }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error)      { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(data []byte, v any) error { return msgpack.Unmarshal(data, v) }
+func (msgpackCodec) Version() byte                      { return CodecVersionMsgpack }
+
+// Codec versions written in front of every encoded session value.
+const (
+	CodecVersionGob     byte = 1
+	CodecVersionJSON    byte = 2
+	CodecVersionMsgpack byte = 3
+)
+
+// versionMarker starts every versioned value. A gob stream never starts with
+// a zero byte so values written before versioning are still read as gob.
+const versionMarker byte = 0
+
+var (
+	ErrUnknownCodec = errors.New("unknown session codec")
+
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{
+		CodecVersionGob:     GobCodec,
+		CodecVersionJSON:    JSONCodec,
+		CodecVersionMsgpack: MsgpackCodec,
+	}
+)
+
+// RegisterCodec makes a custom codec available to the session stores under
+// its version. Versions below 16 are reserved.
+func RegisterCodec(c Codec) {
+	version := c.Version()
+	if version < 16 {
+		panic(fmt.Sprintf("session: codec version %d is reserved", version))
+	}
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, ok := codecs[version]; ok {
+		panic(fmt.Sprintf("session: codec version %d already registered", version))
+	}
+	codecs[version] = c
+}
+
+// codecVersion returns the codec's version if values written with it can be
+// decoded.
+func codecVersion(c Codec) (byte, error) {
+	version := c.Version()
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	if _, ok := codecs[version]; !ok {
+		return 0, ErrUnknownCodec
+	}
+	return version, nil
+}
+
+// encode serializes a value with a prefix that records the codec used.
+func encode(c Codec, v any) ([]byte, error) {
+	version, err := codecVersion(c)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 2, 2+len(raw))
+	b[0], b[1] = versionMarker, version
+	return append(b, raw...), nil
+}
+
+// decode deserializes a value using the codec recorded by encode so that
+// values written with a previous codec can still be read after the store's
+// codec is changed.
+func decode(data []byte, v any) error {
+	if len(data) == 0 || data[0] != versionMarker {
+		return GobCodec.Unmarshal(data, v)
+	}
+	if len(data) < 2 {
+		return ErrUnknownCodec
+	}
+	codecsMu.RLock()
+	c, ok := codecs[data[1]]
+	codecsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: version %d", ErrUnknownCodec, data[1])
+	}
+	return c.Unmarshal(data[2:], v)
+}
@@ -0,0 +1,128 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/matryer/is"
+	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockredis"
+)
+
+func TestCodecs(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		codec   Codec
+		version byte
+	}{
+		{"gob", GobCodec, CodecVersionGob},
+		{"json", JSONCodec, CodecVersionJSON},
+		{"msgpack", MsgpackCodec, CodecVersionMsgpack},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			b, err := encode(tt.codec, &data{ID: 3, Name: "three"})
+			is.NoErr(err)
+			is.Equal(b[0], versionMarker)
+			is.Equal(b[1], tt.version)
+			var v data
+			is.NoErr(decode(b, &v))
+			is.Equal(v, data{ID: 3, Name: "three"})
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	is := is.New(t)
+	var v data
+	// values written before versioning are plain gob
+	is.NoErr(decode([]byte(gobit(&data{ID: 1, Name: "legacy"})), &v))
+	is.Equal(v, data{ID: 1, Name: "legacy"})
+
+	err := decode([]byte{versionMarker, 200, '{', '}'}, &v)
+	is.True(errors.Is(err, ErrUnknownCodec))
+	err = decode([]byte{versionMarker}, &v)
+	is.True(errors.Is(err, ErrUnknownCodec))
+
+	_, err = encode(unregisteredCodec{}, &v)
+	is.Equal(err, ErrUnknownCodec)
+}
+
+func TestRegisterCodec(t *testing.T) {
+	is := is.New(t)
+	// Codecs do not have to be comparable.
+	RegisterCodec(taggedCodec{tags: []string{"a"}})
+	b, err := encode(taggedCodec{tags: []string{"b"}}, &data{ID: 4})
+	is.NoErr(err)
+	is.Equal(b[1], byte(42))
+	var v data
+	is.NoErr(decode(b, &v))
+	is.Equal(v.ID, 4)
+
+	defer func() { is.True(recover() != nil) }()
+	RegisterCodec(taggedCodec{})
+}
+
+func TestRegisterCodec_Reserved(t *testing.T) {
+	is := is.New(t)
+	defer func() { is.True(recover() != nil) }()
+	RegisterCodec(JSONCodec)
+}
+
+func TestMemStore_Codec(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	ms := NewMemStore[data](Forever, WithCodec(MsgpackCodec))
+	in := &data{ID: 1, Name: "one"}
+	is.NoErr(ms.Set(ctx, "one", in))
+	in.Name = "changed"
+	v, err := ms.Get(ctx, "one")
+	is.NoErr(err)
+	// the store keeps a copy of the value
+	is.Equal(v.Name, "one")
+
+	// values written with the old codec can be read after switching
+	ms.codec = JSONCodec
+	v, err = ms.Get(ctx, "one")
+	is.NoErr(err)
+	is.Equal(v.ID, 1)
+}
+
+func TestRedisStore_SwitchCodec(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	is := is.New(t)
+	ctx := context.Background()
+	rd := mockredis.NewMockUniversalClient(ctrl)
+	old := NewRedisStore[data](rd, time.Second)
+	rs := NewRedisStore[data](rd, time.Second, WithCodec(JSONCodec))
+
+	in := &data{ID: 1, Name: "one"}
+	b, err := encode(GobCodec, in)
+	is.NoErr(err)
+	rd.EXPECT().Set(ctx, "one", string(b), time.Second).Return(statusCmd(ctx, nil))
+	is.NoErr(old.Set(ctx, "one", in))
+
+	rd.EXPECT().Get(ctx, "one").Return(strCmd(ctx, string(b), nil))
+	v, err := rs.Get(ctx, "one")
+	is.NoErr(err)
+	is.Equal(*v, *in)
+
+	rd.EXPECT().
+		Set(ctx, "one", "\x00\x02"+`{"Name":"one","ID":1}`, time.Second).
+		Return(statusCmd(ctx, nil))
+	is.NoErr(rs.Set(ctx, "one", in))
+}
+
+type unregisteredCodec struct{ jsonCodec }
+
+func (unregisteredCodec) Version() byte { return 200 }
+
+type taggedCodec struct {
+	jsonCodec
+	tags []string
+}
+
+func (taggedCodec) Version() byte { return 42 }
@@ -15,6 +15,25 @@ func WithHTTPOnly(v bool) CookieOpt            { return func(co *CookieOptions)
 func WithSameSite(v http.SameSite) CookieOpt   { return func(co *CookieOptions) { co.SameSite = v } }
 func WithSecure(v bool) CookieOpt              { return func(co *CookieOptions) { co.Secure = v } }
 
+// WithIdleTimeout expires sessions that have not been accessed for the given
+// duration. The timeout is extended every time a session is saved or touched.
+// Server side stores must implement Expirer.
+func WithIdleTimeout(d time.Duration) CookieOpt {
+	return func(co *CookieOptions) { co.IdleTimeout = d }
+}
+
+// WithAbsoluteTimeout expires sessions the given duration after they were
+// created regardless of activity.
+func WithAbsoluteTimeout(d time.Duration) CookieOpt {
+	return func(co *CookieOptions) { co.AbsoluteTimeout = d }
+}
+
+// WithTouchInterval limits how often touching a session writes to the store
+// and refreshes the cookie.
+func WithTouchInterval(d time.Duration) CookieOpt {
+	return func(co *CookieOptions) { co.TouchInterval = d }
+}
+
 type CookieOptions struct {
 	Path       string
 	Domain     string
@@ -23,6 +42,10 @@ type CookieOptions struct {
 	HTTPOnly   bool
 	SameSite   http.SameSite
 	Secure     bool
+
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+	TouchInterval   time.Duration
 }
 
 func (co *CookieOptions) newCookie(name, value string) *http.Cookie {
@@ -42,6 +65,49 @@ func (co *CookieOptions) newCookie(name, value string) *http.Cookie {
 	return c
 }
 
+// timeouts returns true if sessions expire on their own instead of when the
+// store or the cookie's expiration removes them.
+func (co *CookieOptions) timeouts() bool {
+	return co.IdleTimeout > 0 || co.AbsoluteTimeout > 0
+}
+
+// lifetime is how much longer a session created at the given time can live
+// if it is not accessed again.
+func (co *CookieOptions) lifetime(created time.Time) time.Duration {
+	d := co.IdleTimeout
+	if co.AbsoluteTimeout > 0 && !created.IsZero() {
+		remaining := created.Add(co.AbsoluteTimeout).Sub(now())
+		if d == 0 || remaining < d {
+			d = remaining
+		}
+	}
+	return d
+}
+
+// expired returns true if a session has passed its idle or absolute
+// timeout. Sessions created before the timeouts were enabled have no
+// timestamps and are only removed by the store.
+func (co *CookieOptions) expired(created, touched time.Time) bool {
+	n := now()
+	if co.AbsoluteTimeout > 0 && !created.IsZero() && n.After(created.Add(co.AbsoluteTimeout)) {
+		return true
+	}
+	if co.IdleTimeout > 0 && !touched.IsZero() && n.After(touched.Add(co.IdleTimeout)) {
+		return true
+	}
+	return false
+}
+
+// sessionCookie creates a cookie that expires with the session when timeouts
+// are enabled.
+func (co *CookieOptions) sessionCookie(name, value string, created time.Time) *http.Cookie {
+	c := co.newCookie(name, value)
+	if co.timeouts() {
+		c.Expires = now().Add(co.lifetime(created))
+	}
+	return c
+}
+
 func unsetCookie(w http.ResponseWriter, c *http.Cookie) {
 	c.Expires = time.Unix(0, 0)
 	c.Value = ""
@@ -0,0 +1,169 @@
+package session
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	ErrInvalidCookie  = errors.New("invalid session cookie")
+	ErrCookieTooLarge = errors.New("session cookie too large")
+)
+
+// DefaultMaxCookieSize leaves room for the cookie's name and attributes
+// within the 4096 bytes that browsers allow.
+const DefaultMaxCookieSize = 3840
+
+// KeySize is the length of a CookieStore key.
+const KeySize = chacha20poly1305.KeySize
+
+// CookieStore keeps session values in the cookie itself instead of on the
+// server. Values are encrypted and authenticated with XChaCha20-Poly1305
+// using the cookie name as additional data so that a value can't be moved to
+// another cookie.
+//
+// The store is used through a Manager which puts the sealed value in the
+// cookie when a session is saved.
+type CookieStore[T any] struct {
+	// Codec encodes new values. Values are prefixed with the codec's
+	// version so cookies sealed with a previous codec can still be opened.
+	Codec Codec
+	// MaxSize is the size limit of the encoded cookie value.
+	MaxSize int
+	// TTL rejects cookies that were sealed more than TTL ago. Cookies don't
+	// expire when TTL is zero.
+	TTL   time.Duration
+	aeads []cipher.AEAD
+}
+
+var _ Store[struct{}] = (*CookieStore[struct{}])(nil)
+
+// NewCookieStore creates a CookieStore. Values are sealed with the first key
+// and any of the keys can open them, old keys should be passed after the
+// current key while they are being rotated out.
+func NewCookieStore[T any](keys ...[]byte) (*CookieStore[T], error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no cookie store keys")
+	}
+	cs := CookieStore[T]{
+		Codec:   GobCodec,
+		MaxSize: DefaultMaxCookieSize,
+		aeads:   make([]cipher.AEAD, len(keys)),
+	}
+	for i, key := range keys {
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, fmt.Errorf("cookie store key %d: %w", i, err)
+		}
+		cs.aeads[i] = aead
+	}
+	return &cs, nil
+}
+
+// Seal encrypts a value for the cookie with the given name.
+func (cs *CookieStore[T]) Seal(name string, v *T) (string, error) {
+	return cs.seal(name, v, time.Time{})
+}
+
+// Open decrypts the value of the cookie with the given name.
+func (cs *CookieStore[T]) Open(name, value string) (*T, error) {
+	v, _, err := cs.open(name, value)
+	return v, err
+}
+
+// cookieHeaderSize is the size of the timestamps sealed in front of the
+// encoded value.
+const cookieHeaderSize = 16
+
+// seal encrypts a value along with the time it was sealed and the time its
+// session was created.
+func (cs *CookieStore[T]) seal(name string, v *T, created time.Time) (string, error) {
+	raw, err := encode(cs.Codec, v)
+	if err != nil {
+		return "", err
+	}
+	sealedAt := now()
+	if created.IsZero() {
+		created = sealedAt
+	}
+	aead := cs.aeads[0]
+	plain := make([]byte, cookieHeaderSize, cookieHeaderSize+len(raw))
+	binary.BigEndian.PutUint64(plain, uint64(sealedAt.Unix()))
+	binary.BigEndian.PutUint64(plain[8:], uint64(created.Unix()))
+	plain = append(plain, raw...)
+
+	buf := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err = rand.Read(buf); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(buf, buf, plain, []byte(name))
+	value := base64.RawURLEncoding.EncodeToString(sealed)
+	if cs.MaxSize > 0 && len(value) > cs.MaxSize {
+		return "", ErrCookieTooLarge
+	}
+	return value, nil
+}
+
+func (cs *CookieStore[T]) open(name, value string) (*T, meta, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, meta{}, ErrInvalidCookie
+	}
+	for _, aead := range cs.aeads {
+		n := aead.NonceSize()
+		if len(sealed) < n+aead.Overhead() {
+			return nil, meta{}, ErrInvalidCookie
+		}
+		plain, err := aead.Open(nil, sealed[:n], sealed[n:], []byte(name))
+		if err != nil {
+			// try the next key
+			continue
+		}
+		if len(plain) < cookieHeaderSize {
+			return nil, meta{}, ErrInvalidCookie
+		}
+		md := meta{
+			touched: time.Unix(int64(binary.BigEndian.Uint64(plain)), 0),
+			created: time.Unix(int64(binary.BigEndian.Uint64(plain[8:])), 0),
+		}
+		if cs.TTL > 0 && now().After(md.touched.Add(cs.TTL)) {
+			return nil, meta{}, ErrSessionNotFound
+		}
+		v := new(T)
+		if err = decode(plain[cookieHeaderSize:], v); err != nil {
+			return nil, meta{}, err
+		}
+		return v, md, nil
+	}
+	return nil, meta{}, ErrInvalidCookie
+}
+
+// Get opens a key made by a Manager which has the form "<name>:<value>".
+func (cs *CookieStore[T]) Get(_ context.Context, key string) (*T, error) {
+	name, value, ok := strings.Cut(key, ":")
+	if !ok {
+		return nil, ErrInvalidCookie
+	}
+	return cs.Open(name, value)
+}
+
+// Set does nothing, the value is saved to the cookie by the Manager.
+func (cs *CookieStore[T]) Set(context.Context, string, *T) error { return nil }
+
+// Del does nothing, there is nothing stored on the server.
+func (cs *CookieStore[T]) Del(context.Context, string) error { return nil }
+
+// sealer is a store that keeps session values in the cookie.
+type sealer[T any] interface {
+	seal(name string, v *T, created time.Time) (string, error)
+	open(name, value string) (*T, meta, error)
+}
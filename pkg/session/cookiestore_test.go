@@ -0,0 +1,170 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func testKey(b byte) []byte { return bytes.Repeat([]byte{b}, KeySize) }
+
+func TestCookieStore(t *testing.T) {
+	is := is.New(t)
+	store, err := NewCookieStore[data](testKey(1))
+	is.NoErr(err)
+	m := NewManager[data]("sess", store, WithHTTPOnly(true))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	is.NoErr(m.SetValue(rec, req, &data{ID: 1, Name: "jimmy"}))
+	cookie := rec.Result().Cookies()[0]
+	is.Equal(cookie.Name, "sess")
+	is.True(!strings.Contains(cookie.Value, "jimmy")) // value should be encrypted
+
+	req.AddCookie(cookie)
+	s, err := m.Get(req)
+	is.NoErr(err)
+	is.Equal(*s.Value, data{ID: 1, Name: "jimmy"})
+
+	// Saving the session writes the new value to the cookie
+	s.Value.ID = 2
+	rec = httptest.NewRecorder()
+	is.NoErr(s.Save(context.Background(), rec))
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	v, err := m.GetValue(req)
+	is.NoErr(err)
+	is.Equal(v.ID, 2)
+
+	// New sessions work the same way
+	rec = httptest.NewRecorder()
+	is.NoErr(m.NewSession(&data{ID: 3}).Save(context.Background(), rec))
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	v, err = m.GetValue(req)
+	is.NoErr(err)
+	is.Equal(v.ID, 3)
+	is.NoErr(m.Delete(httptest.NewRecorder(), req))
+}
+
+func TestCookieStore_Invalid(t *testing.T) {
+	is := is.New(t)
+	store, err := NewCookieStore[data](testKey(1))
+	is.NoErr(err)
+	value, err := store.Seal("a", &data{ID: 1})
+	is.NoErr(err)
+
+	// Cookies can't be moved to another name
+	_, err = store.Open("b", value)
+	is.Equal(err, ErrInvalidCookie)
+	// Tampered
+	b := []byte(value)
+	b[len(b)-3] ^= 'x'
+	_, err = store.Open("a", string(b))
+	is.Equal(err, ErrInvalidCookie)
+	_, err = store.Open("a", "not base64!")
+	is.Equal(err, ErrInvalidCookie)
+	_, err = store.Open("a", "")
+	is.Equal(err, ErrInvalidCookie)
+
+	// Wrong key
+	other, err := NewCookieStore[data](testKey(2))
+	is.NoErr(err)
+	_, err = other.Open("a", value)
+	is.Equal(err, ErrInvalidCookie)
+
+	_, err = NewCookieStore[data]([]byte("short"))
+	is.True(err != nil)
+	_, err = NewCookieStore[data]()
+	is.True(err != nil)
+}
+
+func TestCookieStore_KeyRotation(t *testing.T) {
+	is := is.New(t)
+	old, err := NewCookieStore[data](testKey(1))
+	is.NoErr(err)
+	value, err := old.Seal("a", &data{ID: 5})
+	is.NoErr(err)
+
+	rotated, err := NewCookieStore[data](testKey(2), testKey(1))
+	is.NoErr(err)
+	v, err := rotated.Open("a", value)
+	is.NoErr(err)
+	is.Equal(v.ID, 5)
+
+	// New cookies use the new key
+	value, err = rotated.Seal("a", v)
+	is.NoErr(err)
+	_, err = old.Open("a", value)
+	is.Equal(err, ErrInvalidCookie)
+}
+
+func TestCookieStore_Limits(t *testing.T) {
+	defer func() { now = time.Now }()
+	is := is.New(t)
+	store, err := NewCookieStore[data](testKey(1))
+	is.NoErr(err)
+	store.Codec = JSONCodec
+
+	_, err = store.Seal("a", &data{Name: strings.Repeat("x", DefaultMaxCookieSize)})
+	is.Equal(err, ErrCookieTooLarge)
+
+	store.TTL = time.Hour
+	tm := time.Unix(1000, 0)
+	now = func() time.Time { return tm }
+	value, err := store.Seal("a", &data{ID: 1})
+	is.NoErr(err)
+	tm = tm.Add(time.Minute)
+	_, err = store.Get(context.Background(), "a:"+value)
+	is.NoErr(err)
+	tm = tm.Add(time.Hour)
+	_, err = store.Open("a", value)
+	is.Equal(err, ErrSessionNotFound)
+}
+
+func TestCookieStore_Manager(t *testing.T) {
+	is := is.New(t)
+	store, err := NewCookieStore[data](testKey(1))
+	is.NoErr(err)
+	m := NewManager[data]("sess", store)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "sess", Value: "garbage"})
+	_, err = m.Get(req)
+	is.Equal(err, ErrInvalidCookie)
+}
+
+func TestCookieStore_Timeouts(t *testing.T) {
+	defer func() { now = time.Now }()
+	tm := time.Unix(1000, 0)
+	now = func() time.Time { return tm }
+	is := is.New(t)
+	ctx := context.Background()
+	store, err := NewCookieStore[data](testKey(1))
+	is.NoErr(err)
+	m := NewManager[data]("s", store, WithIdleTimeout(time.Hour), WithAbsoluteTimeout(90*time.Minute))
+	rec := httptest.NewRecorder()
+	is.NoErr(m.NewSession(&data{ID: 1}).Save(ctx, rec))
+
+	tm = tm.Add(50 * time.Minute)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	s, err := m.Get(req)
+	is.NoErr(err)
+	is.Equal(s.Created(), time.Unix(1000, 0))
+	rec = httptest.NewRecorder()
+	is.NoErr(s.Touch(ctx, rec))
+	cookie := rec.Result().Cookies()[0]
+	is.Equal(cookie.Expires.Unix(), time.Unix(1000, 0).Add(90*time.Minute).Unix())
+
+	tm = tm.Add(41 * time.Minute)
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	_, err = m.Get(req)
+	is.Equal(err, ErrSessionNotFound)
+}
@@ -0,0 +1,126 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+)
+
+// ErrNoExtras is returned when a session value doesn't embed Extras.
+var ErrNoExtras = errors.New("session value does not embed session.Extras")
+
+// FlashCategory groups flash messages so that pages can style them or only
+// show some of them.
+type FlashCategory string
+
+const (
+	FlashInfo    FlashCategory = "info"
+	FlashSuccess FlashCategory = "success"
+	FlashWarning FlashCategory = "warning"
+	FlashError   FlashCategory = "error"
+)
+
+// Flash is a message that is shown once, usually on the page a user is
+// redirected to.
+type Flash struct {
+	Category FlashCategory `json:"category"`
+	Message  string        `json:"message"`
+}
+
+// Extras is session data managed by this package. Embed it in a session value
+// to use flash messages and CSRF tokens. Changes are only kept once the
+// session is saved.
+type Extras struct {
+	Flashes   []Flash `json:"flashes,omitempty"`
+	CSRFToken string  `json:"csrf_token,omitempty"`
+}
+
+func (e *Extras) sessionExtras() *Extras { return e }
+
+type extrasHolder interface {
+	sessionExtras() *Extras
+}
+
+func (s *Session[T]) extras() (*Extras, error) {
+	if s.Value == nil {
+		return nil, ErrNoExtras
+	}
+	h, ok := any(s.Value).(extrasHolder)
+	if !ok {
+		return nil, ErrNoExtras
+	}
+	return h.sessionExtras(), nil
+}
+
+// AddFlash queues a message to be shown the next time flashes are popped.
+func (s *Session[T]) AddFlash(category FlashCategory, message string) error {
+	e, err := s.extras()
+	if err != nil {
+		return err
+	}
+	e.Flashes = append(e.Flashes, Flash{Category: category, Message: message})
+	return nil
+}
+
+// PopFlashes removes and returns the queued flash messages in the order they
+// were added. Only messages in the given categories are removed when any
+// categories are given.
+func (s *Session[T]) PopFlashes(categories ...FlashCategory) []Flash {
+	e, err := s.extras()
+	if err != nil || len(e.Flashes) == 0 {
+		return nil
+	}
+	if len(categories) == 0 {
+		flashes := e.Flashes
+		e.Flashes = nil
+		return flashes
+	}
+	var popped, kept []Flash
+	for _, f := range e.Flashes {
+		if hasCategory(categories, f.Category) {
+			popped = append(popped, f)
+		} else {
+			kept = append(kept, f)
+		}
+	}
+	e.Flashes = kept
+	return popped
+}
+
+func hasCategory(categories []FlashCategory, c FlashCategory) bool {
+	for _, cat := range categories {
+		if cat == c {
+			return true
+		}
+	}
+	return false
+}
+
+// CSRFToken returns the session's CSRF token, generating one the first time
+// it is called. Templates should put the token in a hidden form field or a
+// meta tag. The token is replaced when the session is rotated.
+func (s *Session[T]) CSRFToken() (string, error) {
+	e, err := s.extras()
+	if err != nil {
+		return "", err
+	}
+	if len(e.CSRFToken) == 0 {
+		var b [32]byte
+		if _, err = rand.Read(b[:]); err != nil {
+			return "", err
+		}
+		e.CSRFToken = base64.RawURLEncoding.EncodeToString(b[:])
+	}
+	return e.CSRFToken, nil
+}
+
+// ValidCSRFToken reports whether a token sent with a request matches the
+// session's CSRF token.
+func (s *Session[T]) ValidCSRFToken(token string) bool {
+	e, err := s.extras()
+	if err != nil || len(e.CSRFToken) == 0 || len(token) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(e.CSRFToken), []byte(token)) == 1
+}
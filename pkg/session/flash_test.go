@@ -0,0 +1,96 @@
+package session
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+type pageData struct {
+	Extras
+	Name string
+}
+
+func TestSession_Flashes(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	m := NewManager[pageData]("s", NewMemStore[pageData](Forever, WithCodec(JSONCodec)))
+	s := m.NewSession(nil)
+	is.NoErr(s.AddFlash(FlashInfo, "one"))
+	is.NoErr(s.AddFlash(FlashError, "two"))
+	is.NoErr(s.AddFlash(FlashInfo, "three"))
+	rec := httptest.NewRecorder()
+	is.NoErr(s.Save(ctx, rec))
+
+	// flashes survive the redirect
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	s, err := m.Get(req)
+	is.NoErr(err)
+	is.Equal(s.PopFlashes(FlashError), []Flash{{Category: FlashError, Message: "two"}})
+	is.Equal(s.PopFlashes(FlashError), nil)
+	is.NoErr(s.Save(ctx, httptest.NewRecorder()))
+
+	s, err = m.Get(req)
+	is.NoErr(err)
+	is.Equal(s.PopFlashes(), []Flash{
+		{Category: FlashInfo, Message: "one"},
+		{Category: FlashInfo, Message: "three"},
+	})
+	is.Equal(len(s.PopFlashes()), 0)
+}
+
+func TestSession_CSRFToken(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	m := NewManager[pageData]("s", NewMemStore[pageData](Forever))
+	s := m.NewSession(nil)
+	is.True(!s.ValidCSRFToken(""))
+	token, err := s.CSRFToken()
+	is.NoErr(err)
+	is.Equal(len(token), 43)
+	again, err := s.CSRFToken()
+	is.NoErr(err)
+	is.Equal(again, token)
+	is.True(s.ValidCSRFToken(token))
+	is.True(!s.ValidCSRFToken(token[1:]))
+	is.True(!s.ValidCSRFToken(""))
+
+	is.NoErr(s.Save(ctx, httptest.NewRecorder()))
+	is.NoErr(s.Rotate(ctx, httptest.NewRecorder()))
+	is.True(!s.ValidCSRFToken(token))
+	rotated, err := s.CSRFToken()
+	is.NoErr(err)
+	is.True(rotated != token)
+}
+
+func TestSession_NoExtras(t *testing.T) {
+	is := is.New(t)
+	s := NewManager[data]("s", NewMemStore[data](Forever)).NewSession(nil)
+	is.Equal(s.AddFlash(FlashInfo, "hi"), ErrNoExtras)
+	is.Equal(s.PopFlashes(), nil)
+	_, err := s.CSRFToken()
+	is.Equal(err, ErrNoExtras)
+	is.True(!s.ValidCSRFToken("token"))
+}
+
+func TestMemStore_UpdateCopiesFlashes(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	store := NewMemStore[pageData](Forever)
+	defer store.Close()
+	before := &pageData{Extras: Extras{Flashes: []Flash{{Category: FlashInfo, Message: "one"}}}}
+	is.NoErr(store.Set(ctx, "s", before))
+	after, err := store.Update(ctx, "s", func(d *pageData) error {
+		d.Flashes[0].Message = "changed"
+		d.Flashes = append(d.Flashes, Flash{Category: FlashInfo, Message: "two"})
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(len(after.Flashes), 2)
+	is.Equal(after.Flashes[0].Message, "changed")
+	// readers of the old value don't see the update
+	is.Equal(before.Flashes, []Flash{{Category: FlashInfo, Message: "one"}})
+}
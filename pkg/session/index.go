@@ -0,0 +1,117 @@
+package session
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Index keeps track of the sessions that belong to each owner so that they
+// can be listed and deleted together.
+type Index interface {
+	// Add puts a session id in the owner's index. Sessions that don't expire
+	// have a zero expiration time.
+	Add(ctx context.Context, owner, id string, expires time.Time) error
+	Remove(ctx context.Context, owner string, ids ...string) error
+	// List returns the ids in the owner's index that have not expired.
+	List(ctx context.Context, owner string) ([]string, error)
+}
+
+// NewRedisIndex creates an index that keeps a sorted set of session ids for
+// each owner scored by expiration time.
+func NewRedisIndex(client redis.UniversalClient, prefix string) *RedisIndex {
+	return &RedisIndex{c: client, prefix: prefix}
+}
+
+type RedisIndex struct {
+	c      redis.UniversalClient
+	prefix string
+}
+
+func (ri *RedisIndex) Add(ctx context.Context, owner, id string, expires time.Time) error {
+	score := float64(expires.Unix())
+	if expires.IsZero() {
+		score = float64(1<<53 - 1)
+	}
+	return ri.c.ZAdd(ctx, ri.key(owner), &redis.Z{Score: score, Member: id}).Err()
+}
+
+func (ri *RedisIndex) Remove(ctx context.Context, owner string, ids ...string) error {
+	if len(ids) == 0 {
+		return ri.c.Del(ctx, ri.key(owner)).Err()
+	}
+	members := make([]any, len(ids))
+	for i, id := range ids {
+		members[i] = id
+	}
+	return ri.c.ZRem(ctx, ri.key(owner), members...).Err()
+}
+
+func (ri *RedisIndex) List(ctx context.Context, owner string) ([]string, error) {
+	key := ri.key(owner)
+	n := strconv.FormatInt(now().Unix(), 10)
+	if err := ri.c.ZRemRangeByScore(ctx, key, "-inf", "("+n).Err(); err != nil {
+		return nil, err
+	}
+	return ri.c.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: n, Max: "+inf"}).Result()
+}
+
+func (ri *RedisIndex) key(owner string) string { return ri.prefix + owner }
+
+// NewMemIndex creates an in-memory index.
+func NewMemIndex() *MemIndex {
+	return &MemIndex{m: make(map[string]map[string]time.Time)}
+}
+
+type MemIndex struct {
+	mu sync.Mutex
+	m  map[string]map[string]time.Time
+}
+
+func (mi *MemIndex) Add(_ context.Context, owner, id string, expires time.Time) error {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	ids, ok := mi.m[owner]
+	if !ok {
+		ids = make(map[string]time.Time)
+		mi.m[owner] = ids
+	}
+	ids[id] = expires
+	return nil
+}
+
+func (mi *MemIndex) Remove(_ context.Context, owner string, ids ...string) error {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	if len(ids) == 0 {
+		delete(mi.m, owner)
+		return nil
+	}
+	for _, id := range ids {
+		delete(mi.m[owner], id)
+	}
+	if len(mi.m[owner]) == 0 {
+		delete(mi.m, owner)
+	}
+	return nil
+}
+
+func (mi *MemIndex) List(_ context.Context, owner string) ([]string, error) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	n := now()
+	ids := make([]string, 0, len(mi.m[owner]))
+	for id, expires := range mi.m[owner] {
+		if !expires.IsZero() && n.After(expires) {
+			delete(mi.m[owner], id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
@@ -0,0 +1,159 @@
+package session
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang/mock/gomock"
+	"github.com/matryer/is"
+	"gopkg.hrry.dev/homelab/pkg/internal/mocks/mockredis"
+)
+
+func ownerIndexedManager() *Manager[data] {
+	m := NewManager[data]("s", NewMemStore[data](Forever))
+	m.Index = NewMemIndex()
+	m.Owner = func(d *data) string { return d.Name }
+	return m
+}
+
+func TestManager_ListByOwner(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	m := ownerIndexedManager()
+	var ids []string
+	for _, d := range []*data{
+		{ID: 1, Name: "jim"},
+		{ID: 2, Name: "jim"},
+		{ID: 3, Name: "pam"},
+		{ID: 4},
+	} {
+		s := m.NewSession(d)
+		is.NoErr(s.Save(ctx, httptest.NewRecorder()))
+		ids = append(ids, s.ID())
+	}
+	sessions, err := m.ListByOwner(ctx, "jim")
+	is.NoErr(err)
+	is.Equal(len(sessions), 2)
+	for _, s := range sessions {
+		is.Equal(s.Value.Name, "jim")
+	}
+
+	// sessions removed from the store are removed from the index
+	is.NoErr(m.Store.Del(ctx, m.key(ids[0])))
+	sessions, err = m.ListByOwner(ctx, "jim")
+	is.NoErr(err)
+	is.Equal(len(sessions), 1)
+	is.Equal(sessions[0].ID(), ids[1])
+	left, err := m.Index.List(ctx, "jim")
+	is.NoErr(err)
+	is.Equal(left, []string{ids[1]})
+
+	m.Index = nil
+	_, err = m.ListByOwner(ctx, "jim")
+	is.Equal(err, ErrNoIndex)
+}
+
+func TestManager_DeleteByOwner(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	m := ownerIndexedManager()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		s := m.NewSession(&data{ID: i, Name: "jim"})
+		is.NoErr(s.Save(ctx, httptest.NewRecorder()))
+		ids = append(ids, s.ID())
+	}
+	pam := m.NewSession(&data{Name: "pam"})
+	is.NoErr(pam.Save(ctx, httptest.NewRecorder()))
+
+	is.NoErr(m.DeleteByOwner(ctx, "jim", ids[0]))
+	_, err := m.Store.Get(ctx, m.key(ids[0]))
+	is.Equal(err, ErrSessionNotFound)
+	sessions, err := m.ListByOwner(ctx, "jim")
+	is.NoErr(err)
+	is.Equal(len(sessions), 2)
+
+	is.NoErr(m.DeleteByOwner(ctx, "jim"))
+	for _, id := range ids {
+		_, err = m.Store.Get(ctx, m.key(id))
+		is.Equal(err, ErrSessionNotFound)
+	}
+	sessions, err = m.ListByOwner(ctx, "pam")
+	is.NoErr(err)
+	is.Equal(len(sessions), 1)
+}
+
+func TestManager_IndexRotateDelete(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	m := ownerIndexedManager()
+	rec := httptest.NewRecorder()
+	is.NoErr(m.NewSession(&data{Name: "jim"}).Save(ctx, rec))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+
+	rec = httptest.NewRecorder()
+	s, err := m.Rotate(rec, req)
+	is.NoErr(err)
+	ids, err := m.Index.List(ctx, "jim")
+	is.NoErr(err)
+	is.Equal(ids, []string{s.ID()})
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	is.NoErr(m.Delete(httptest.NewRecorder(), req))
+	ids, err = m.Index.List(ctx, "jim")
+	is.NoErr(err)
+	is.Equal(len(ids), 0)
+}
+
+func TestMemIndex_Expires(t *testing.T) {
+	defer func() { now = time.Now }()
+	tm := time.Unix(1000, 0)
+	now = func() time.Time { return tm }
+	is := is.New(t)
+	ctx := context.Background()
+	mi := NewMemIndex()
+	is.NoErr(mi.Add(ctx, "a", "1", tm.Add(time.Minute)))
+	is.NoErr(mi.Add(ctx, "a", "2", time.Time{}))
+	tm = tm.Add(2 * time.Minute)
+	ids, err := mi.List(ctx, "a")
+	is.NoErr(err)
+	is.Equal(ids, []string{"2"})
+}
+
+func TestRedisIndex(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Unix(1000, 0) }
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	is := is.New(t)
+	ctx := context.Background()
+	rd := mockredis.NewMockUniversalClient(ctrl)
+	ri := NewRedisIndex(rd, "s:owner:")
+
+	rd.EXPECT().
+		ZAdd(ctx, "s:owner:jim", &redis.Z{Score: 1060, Member: "abc"}).
+		Return(intCmd(ctx, nil))
+	is.NoErr(ri.Add(ctx, "jim", "abc", time.Unix(1060, 0)))
+
+	rd.EXPECT().
+		ZRemRangeByScore(ctx, "s:owner:jim", "-inf", "(1000").
+		Return(intCmd(ctx, nil))
+	cmd := redis.NewStringSliceCmd(ctx)
+	cmd.SetVal([]string{"abc"})
+	rd.EXPECT().
+		ZRangeByScore(ctx, "s:owner:jim", &redis.ZRangeBy{Min: "1000", Max: "+inf"}).
+		Return(cmd)
+	ids, err := ri.List(ctx, "jim")
+	is.NoErr(err)
+	is.Equal(ids, []string{"abc"})
+
+	rd.EXPECT().ZRem(ctx, "s:owner:jim", "abc").Return(intCmd(ctx, nil))
+	is.NoErr(ri.Remove(ctx, "jim", "abc"))
+	rd.EXPECT().Del(ctx, "s:owner:jim").Return(intCmd(ctx, nil))
+	is.NoErr(ri.Remove(ctx, "jim"))
+}
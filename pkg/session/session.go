@@ -6,6 +6,9 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func NewManager[T any](name string, store Store[T], opts ...CookieOpt) *Manager[T] {
@@ -28,6 +31,11 @@ type Manager[T any] struct {
 	Store Store[T]
 	GenID func() string
 	Name  string
+	// Owner returns the owner of a session value or an empty string if the
+	// session isn't owned by anyone. Sessions are indexed by owner when both
+	// Owner and Index are set. Only server side sessions can be indexed.
+	Owner func(*T) string
+	Index Index
 	opts  *CookieOptions
 }
 
@@ -35,8 +43,10 @@ func (m *Manager[T]) NewSession(v *T, opts ...CookieOpt) *Session[T] {
 	if v == nil {
 		v = new(T)
 	}
-	id := m.GenID()
-	return m.newSession(id, v, opts...)
+	s := m.newSession("", v, opts...)
+	s.created = now()
+	s.id = s.newID()
+	return s
 }
 
 func (m *Manager[T]) Get(r *http.Request) (*Session[T], error) {
@@ -44,11 +54,13 @@ func (m *Manager[T]) Get(r *http.Request) (*Session[T], error) {
 	if err != nil {
 		return nil, err
 	}
-	val, err := m.Store.Get(r.Context(), m.key(c.Value))
+	id, md, val, err := m.load(r.Context(), c.Value)
 	if err != nil {
 		return nil, err
 	}
-	return m.newSession(c.Value, val), nil
+	s := m.newSession(id, val)
+	s.meta = md
+	return s, nil
 }
 
 func (m *Manager[T]) Delete(w http.ResponseWriter, r *http.Request) error {
@@ -56,7 +68,16 @@ func (m *Manager[T]) Delete(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
-	if err = m.Store.Del(r.Context(), m.key(c.Value)); err != nil {
+	ctx := r.Context()
+	id, _ := m.parseCookie(c.Value)
+	if m.Index != nil {
+		if val, err := m.Store.Get(ctx, m.key(id)); err == nil {
+			if err = m.unindex(ctx, id, val); err != nil {
+				return err
+			}
+		}
+	}
+	if err = m.Store.Del(ctx, m.key(id)); err != nil {
 		return err
 	}
 	unsetCookie(w, c)
@@ -64,8 +85,7 @@ func (m *Manager[T]) Delete(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (m *Manager[T]) SetValue(w http.ResponseWriter, r *http.Request, value *T) error {
-	id := m.GenID()
-	return m.set(r.Context(), w, id, value)
+	return m.NewSession(value).Save(r.Context(), w)
 }
 
 func (m *Manager[T]) UpdateValue(w http.ResponseWriter, r *http.Request, value *T) error {
@@ -73,7 +93,10 @@ func (m *Manager[T]) UpdateValue(w http.ResponseWriter, r *http.Request, value *
 	if err != nil {
 		return err
 	}
-	return m.set(r.Context(), w, c.Value, value)
+	id, md := m.parseCookie(c.Value)
+	s := m.newSession(id, value)
+	s.meta = md
+	return s.Save(r.Context(), w)
 }
 
 func (m *Manager[T]) GetValue(r *http.Request) (*T, error) {
@@ -81,7 +104,93 @@ func (m *Manager[T]) GetValue(r *http.Request) (*T, error) {
 	if err != nil {
 		return nil, err
 	}
-	return m.Store.Get(r.Context(), m.key(c.Value))
+	_, _, val, err := m.load(r.Context(), c.Value)
+	return val, err
+}
+
+// Rotate moves the request's session to a new ID and deletes the old one.
+// Sessions should be rotated whenever a user logs in so that an ID planted
+// before login can't be used afterwards. The rotated session counts as newly
+// created for the absolute timeout.
+func (m *Manager[T]) Rotate(w http.ResponseWriter, r *http.Request) (*Session[T], error) {
+	old, err := m.Get(r)
+	if err != nil {
+		return nil, err
+	}
+	if err = old.Rotate(r.Context(), w); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// Update atomically changes the value of the request's session. The update
+// function may be called more than once when other requests change the
+// session at the same time. The store must implement Updater.
+func (m *Manager[T]) Update(ctx context.Context, r *http.Request, fn func(*T) error) error {
+	s, err := m.Get(r)
+	if err != nil {
+		return err
+	}
+	return s.Update(ctx, fn)
+}
+
+// ListByOwner returns all the sessions that belong to an owner. Sessions that
+// no longer exist are removed from the index.
+func (m *Manager[T]) ListByOwner(ctx context.Context, owner string) ([]*Session[T], error) {
+	if m.Index == nil {
+		return nil, ErrNoIndex
+	}
+	ids, err := m.Index.List(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		sessions = make([]*Session[T], 0, len(ids))
+		stale    []string
+	)
+	for _, id := range ids {
+		val, err := m.Store.Get(ctx, m.key(id))
+		if err == ErrSessionNotFound {
+			stale = append(stale, id)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		s := m.newSession(id, val)
+		s.created, _ = m.parseID(id)
+		sessions = append(sessions, s)
+	}
+	if len(stale) > 0 {
+		if err = m.Index.Remove(ctx, owner, stale...); err != nil {
+			return nil, err
+		}
+	}
+	return sessions, nil
+}
+
+// DeleteByOwner deletes the sessions that belong to an owner. All of the
+// owner's sessions are deleted when no ids are given.
+func (m *Manager[T]) DeleteByOwner(ctx context.Context, owner string, ids ...string) error {
+	if m.Index == nil {
+		return ErrNoIndex
+	}
+	all := len(ids) == 0
+	if all {
+		var err error
+		if ids, err = m.Index.List(ctx, owner); err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		err := m.Store.Del(ctx, m.key(id))
+		if err != nil && err != ErrSessionNotFound {
+			return err
+		}
+	}
+	if all {
+		return m.Index.Remove(ctx, owner)
+	}
+	return m.Index.Remove(ctx, owner, ids...)
 }
 
 func (m *Manager[T]) newSession(id string, val *T, opts ...CookieOpt) *Session[T] {
@@ -91,6 +200,7 @@ func (m *Manager[T]) newSession(id string, val *T, opts ...CookieOpt) *Session[T
 		name:  m.Name,
 		id:    id,
 		store: m.Store,
+		m:     m,
 	}
 	for _, o := range opts {
 		o(&s.Opts)
@@ -98,13 +208,103 @@ func (m *Manager[T]) newSession(id string, val *T, opts ...CookieOpt) *Session[T
 	return &s
 }
 
-func (m *Manager[T]) set(ctx context.Context, w http.ResponseWriter, id string, value *T) error {
-	err := m.Store.Set(ctx, m.key(id), value)
+// load gets the session id, timestamps, and value for a cookie.
+func (m *Manager[T]) load(ctx context.Context, cookieValue string) (string, meta, *T, error) {
+	var (
+		id  = cookieValue
+		md  meta
+		val *T
+		err error
+	)
+	touched := md.touched
+	if s, ok := m.Store.(sealer[T]); ok {
+		val, md, err = s.open(m.Name, cookieValue)
+		touched = md.touched
+	} else {
+		// The touched time is not signed so the store enforces the idle
+		// timeout by expiring the session.
+		id, md = m.parseCookie(cookieValue)
+		val, err = m.Store.Get(ctx, m.key(id))
+	}
 	if err != nil {
-		return err
+		return "", meta{}, nil, err
 	}
-	http.SetCookie(w, m.opts.newCookie(m.Name, id))
-	return nil
+	if m.opts.expired(md.created, touched) {
+		return "", meta{}, nil, ErrSessionNotFound
+	}
+	return id, md, val, nil
+}
+
+// parseCookie splits the cookie of a server side session into the session ID
+// and its timestamps. When timeouts are enabled the ID ends with the time the
+// session was created so that it can't be changed, and the cookie ends with
+// the time the session was last touched. The client can change the touched
+// time so it only decides when the session is touched again.
+func (m *Manager[T]) parseCookie(v string) (string, meta) {
+	var md meta
+	if !m.opts.timeouts() {
+		return v, md
+	}
+	i := strings.LastIndexByte(v, '.')
+	if i < 0 {
+		return v, md
+	}
+	touched, err := strconv.ParseInt(v[i+1:], 36, 64)
+	if err != nil {
+		return v, md
+	}
+	id := v[:i]
+	md.touched = time.Unix(touched, 0)
+	md.created, _ = m.parseID(id)
+	return id, md
+}
+
+// parseID gets the creation time from a session ID.
+func (m *Manager[T]) parseID(id string) (time.Time, bool) {
+	if !m.opts.timeouts() {
+		return time.Time{}, false
+	}
+	i := strings.LastIndexByte(id, '.')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	created, err := strconv.ParseInt(id[i+1:], 36, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(created, 0), true
+}
+
+// index adds a session to its owner's index.
+func (m *Manager[T]) index(ctx context.Context, s *Session[T]) error {
+	owner := m.owner(s.Value)
+	if len(owner) == 0 {
+		return nil
+	}
+	var expires time.Time
+	if s.Opts.timeouts() {
+		expires = now().Add(s.Opts.lifetime(s.created))
+	}
+	return m.Index.Add(ctx, owner, s.id, expires)
+}
+
+// unindex removes a session id from the index of the session value's owner.
+func (m *Manager[T]) unindex(ctx context.Context, id string, value *T) error {
+	owner := m.owner(value)
+	if len(owner) == 0 {
+		return nil
+	}
+	return m.Index.Remove(ctx, owner, id)
+}
+
+func (m *Manager[T]) owner(value *T) string {
+	if m.Owner == nil || m.Index == nil || value == nil {
+		return ""
+	}
+	if _, ok := m.Store.(sealer[T]); ok {
+		return ""
+	}
+	return m.Owner(value)
 }
 
 func (m *Manager[T]) key(v string) string {
@@ -117,12 +317,20 @@ func defaultIDGenerator() string {
 	return hex.EncodeToString(b[:])
 }
 
+// meta tracks when a session was created and last touched.
+type meta struct {
+	created time.Time
+	touched time.Time
+}
+
 type Session[T any] struct {
 	Value *T
 	Opts  CookieOptions
 	store Store[T]
 	id    string
 	name  string
+	m     *Manager[T]
+	meta
 }
 
 func (s *Session[T]) ID() string   { return s.id }
@@ -130,24 +338,134 @@ func (s *Session[T]) Name() string { return s.name }
 func (s *Session[T]) Set(value *T) { s.Value = value }
 func (s *Session[T]) key() string  { return fmt.Sprintf("%s:%s", s.name, s.id) }
 
+// Created is the time the session was created. It is only tracked when the
+// session has an idle or absolute timeout.
+func (s *Session[T]) Created() time.Time { return s.created }
+
+// Save stores the session value and sets the cookie. Stores that keep the
+// session in the cookie set the sealed value instead of the id.
 func (s *Session[T]) Save(ctx context.Context, w http.ResponseWriter) error {
-	err := s.store.Set(ctx, s.key(), s.Value)
+	var (
+		value string
+		err   error
+	)
+	if sl, ok := s.store.(sealer[T]); ok {
+		value, err = sl.seal(s.name, s.Value, s.created)
+		if err != nil {
+			return err
+		}
+	} else {
+		if _, ok := s.store.(Expirer); !ok && s.Opts.IdleTimeout > 0 {
+			return ErrIdleTimeoutNotSupported
+		}
+		if err = s.store.Set(ctx, s.key(), s.Value); err != nil {
+			return err
+		}
+		if e, ok := s.store.(Expirer); ok && s.Opts.timeouts() {
+			if err = e.Expire(ctx, s.key(), s.Opts.lifetime(s.created)); err != nil {
+				return err
+			}
+		}
+		if err = s.m.index(ctx, s); err != nil {
+			return err
+		}
+	}
+	s.touched = now()
+	if len(value) == 0 {
+		value = s.cookieValue()
+	}
+	http.SetCookie(w, s.Opts.sessionCookie(s.name, value, s.created))
+	return nil
+}
+
+// Touch extends the idle timeout of a session that is being used. Sessions
+// are only touched once every touch interval to avoid writing to the store
+// on every request.
+func (s *Session[T]) Touch(ctx context.Context, w http.ResponseWriter) error {
+	if !s.Opts.timeouts() || now().Sub(s.touched) < s.Opts.TouchInterval {
+		return nil
+	}
+	e, ok := s.store.(Expirer)
+	if !ok {
+		return s.Save(ctx, w)
+	}
+	if err := e.Expire(ctx, s.key(), s.Opts.lifetime(s.created)); err != nil {
+		return err
+	}
+	if err := s.m.index(ctx, s); err != nil {
+		return err
+	}
+	s.touched = now()
+	http.SetCookie(w, s.Opts.sessionCookie(s.name, s.cookieValue(), s.created))
+	return nil
+}
+
+// Update atomically changes the stored session value and replaces Value with
+// the result. The update function may be called more than once. The expiry
+// and owner index are left alone, they are refreshed by Touch and Save, so
+// use Save when the update changes the session's owner.
+func (s *Session[T]) Update(ctx context.Context, fn func(*T) error) error {
+	u, ok := s.store.(Updater[T])
+	if !ok {
+		return ErrUpdateNotSupported
+	}
+	v, err := u.Update(ctx, s.key(), fn)
 	if err != nil {
 		return err
 	}
-	http.SetCookie(w, s.Opts.newCookie(s.name, s.id))
+	s.Value = v
 	return nil
 }
 
+// Rotate moves the session to a new ID and deletes the old one. The session
+// counts as newly created for the absolute timeout and gets a new CSRF token.
+func (s *Session[T]) Rotate(ctx context.Context, w http.ResponseWriter) error {
+	oldID, oldKey := s.id, s.key()
+	if e, err := s.extras(); err == nil {
+		e.CSRFToken = ""
+	}
+	s.created = now()
+	s.id = s.newID()
+	if err := s.Save(ctx, w); err != nil {
+		return err
+	}
+	if err := s.store.Del(ctx, oldKey); err != nil {
+		return err
+	}
+	return s.m.unindex(ctx, oldID, s.Value)
+}
+
 func (s *Session[T]) Delete(ctx context.Context, w http.ResponseWriter) error {
 	err := s.store.Del(ctx, s.key())
 	if err != nil {
 		return err
 	}
+	if err = s.m.unindex(ctx, s.id, s.Value); err != nil {
+		return err
+	}
 	http.SetCookie(w, s.Opts.newCookie(s.name, ""))
 	return nil
 }
 
+// newID generates a session ID that includes the creation time when the
+// session has timeouts.
+func (s *Session[T]) newID() string {
+	id := s.m.GenID()
+	if s.Opts.timeouts() {
+		id += "." + strconv.FormatInt(s.created.Unix(), 36)
+	}
+	return id
+}
+
+// cookieValue is the session ID followed by the time the session was last
+// touched when the session has timeouts.
+func (s *Session[T]) cookieValue() string {
+	if !s.Opts.timeouts() {
+		return s.id
+	}
+	return s.id + "." + strconv.FormatInt(s.touched.Unix(), 36)
+}
+
 type sessionContextKeyType struct{}
 
 var sessionContextKey sessionContextKeyType
@@ -8,6 +8,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -83,7 +86,7 @@ func TestManager_Get(t *testing.T) {
 	is := is.New(t)
 	rec := httptest.NewRecorder()
 	req := httptest.NewRequest("GET", "/", nil)
-	m := NewManager[data]("test-cookie", NewMemStore[data](time.Microsecond))
+	m := NewManager[data]("test-cookie", NewMemStore[data](time.Second))
 
 	err := m.SetValue(rec, req, &data{ID: 3, Name: "johnny"})
 	is.NoErr(err)
@@ -114,13 +117,14 @@ func TestManager_Get_timeout(t *testing.T) {
 	}()
 	tidyTime = time.Millisecond
 	now = func() time.Time {
-		now := time.Now()
-		return time.Unix(now.Unix()+1000, 0)
+		return time.Now().Add(1000 * time.Second)
 	}
 	is := is.New(t)
 	rec := httptest.NewRecorder()
 	req := httptest.NewRequest("GET", "/", nil)
-	m := NewManager[data]("test-cookie", NewMemStore[data](time.Microsecond))
+	store := NewMemStore[data](time.Microsecond)
+	defer store.Close()
+	m := NewManager[data]("test-cookie", store)
 
 	err := m.SetValue(rec, req, &data{ID: 3, Name: "johnny"})
 	is.NoErr(err)
@@ -254,14 +258,14 @@ func TestRedisStore(t *testing.T) {
 		is := is.New(t)
 		in := &data{ID: 1, Name: "one"}
 		rd.EXPECT().
-			Set(ctx, "one", gobit(in), time.Second).
+			Set(ctx, "one", "\x00\x01"+gobit(in), time.Second).
 			Return(statusCmd(ctx, nil))
 		err := rs.Set(ctx, "one", in)
 		is.NoErr(err)
 
 		in = &data{ID: 2, Name: "two"}
 		rd.EXPECT().
-			Set(ctx, "two", gobit(in), time.Second).
+			Set(ctx, "two", "\x00\x01"+gobit(in), time.Second).
 			Return(statusCmd(ctx, redis.Nil))
 		err = rs.Set(ctx, "two", in)
 		is.Equal(err, redis.Nil)
@@ -316,3 +320,257 @@ func TestRedisStore(t *testing.T) {
 		is.Equal(err, demoErr)
 	})
 }
+
+func TestManager_Timeouts(t *testing.T) {
+	defer func() { now = time.Now }()
+	tm := time.Unix(1000, 0)
+	now = func() time.Time { return tm }
+	is := is.New(t)
+	ctx := context.Background()
+	store := NewMemStore[data](Forever)
+	defer store.Close()
+	m := NewManager[data](
+		"s",
+		store,
+		WithIdleTimeout(time.Hour),
+		WithAbsoluteTimeout(3*time.Hour),
+		WithTouchInterval(time.Minute),
+	)
+	rec := httptest.NewRecorder()
+	s := m.NewSession(&data{ID: 1})
+	is.NoErr(s.Save(ctx, rec))
+	is.Equal(s.Created(), tm)
+	cookie := rec.Result().Cookies()[0]
+	is.Equal(cookie.Expires.Unix(), tm.Add(time.Hour).Unix())
+
+	get := func(c *http.Cookie) (*Session[data], error) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(c)
+		return m.Get(req)
+	}
+	// touches are throttled
+	tm = tm.Add(30 * time.Second)
+	s, err := get(cookie)
+	is.NoErr(err)
+	rec = httptest.NewRecorder()
+	is.NoErr(s.Touch(ctx, rec))
+	is.Equal(len(rec.Result().Cookies()), 0)
+
+	// sliding expiration
+	for i := 0; i < 2; i++ {
+		tm = tm.Add(50 * time.Minute)
+		s, err = get(cookie)
+		is.NoErr(err)
+		rec = httptest.NewRecorder()
+		is.NoErr(s.Touch(ctx, rec))
+		cookie = rec.Result().Cookies()[0]
+		is.Equal(cookie.Expires.Unix(), tm.Add(time.Hour).Unix())
+	}
+
+	// the cookie expires with the absolute timeout
+	tm = tm.Add(50 * time.Minute)
+	s, err = get(cookie)
+	is.NoErr(err)
+	rec = httptest.NewRecorder()
+	is.NoErr(s.Touch(ctx, rec))
+	cookie = rec.Result().Cookies()[0]
+	is.Equal(cookie.Expires.Unix(), time.Unix(1000, 0).Add(3*time.Hour).Unix())
+	tm = tm.Add(30 * time.Minute)
+	_, err = get(cookie)
+	is.Equal(err, ErrSessionNotFound)
+
+	// idle sessions expire
+	rec = httptest.NewRecorder()
+	s = m.NewSession(&data{ID: 2})
+	is.NoErr(s.Save(ctx, rec))
+	cookie = rec.Result().Cookies()[0]
+	tm = tm.Add(time.Hour + time.Second)
+	_, err = get(cookie)
+	is.Equal(err, ErrSessionNotFound)
+	// the store expires the session with the idle timeout
+	_, err = store.Get(ctx, s.key())
+	is.Equal(err, ErrSessionNotFound)
+	// so changing the touched time in the cookie does not bring it back
+	id, _ := m.parseCookie(cookie.Value)
+	forged := *cookie
+	forged.Value = id + "." + strconv.FormatInt(tm.Unix(), 36)
+	_, err = get(&forged)
+	is.Equal(err, ErrSessionNotFound)
+
+	// the creation time can't be changed
+	id, md := m.parseCookie(cookie.Value)
+	is.Equal(md.created, s.Created())
+	forged.Value = strings.TrimSuffix(id, strconv.FormatInt(md.created.Unix(), 36)) +
+		strconv.FormatInt(tm.Unix(), 36) + "." + strconv.FormatInt(tm.Unix(), 36)
+	_, err = get(&forged)
+	is.Equal(err, ErrSessionNotFound)
+}
+
+// noExpireStore hides the Expire method of the store it wraps.
+type noExpireStore struct{ Store[data] }
+
+func TestManager_IdleTimeoutNeedsExpirer(t *testing.T) {
+	is := is.New(t)
+	store := NewMemStore[data](Forever)
+	defer store.Close()
+	m := NewManager[data]("s", noExpireStore{store}, WithIdleTimeout(time.Hour))
+	err := m.NewSession(&data{ID: 1}).Save(context.Background(), httptest.NewRecorder())
+	is.Equal(err, ErrIdleTimeoutNotSupported)
+
+	// only an absolute timeout is fine since the creation time can't be changed
+	m = NewManager[data]("s", noExpireStore{store}, WithAbsoluteTimeout(time.Hour))
+	is.NoErr(m.NewSession(&data{ID: 1}).Save(context.Background(), httptest.NewRecorder()))
+}
+
+func TestManager_Rotate(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	m := NewManager[data]("s", NewMemStore[data](time.Minute), WithIdleTimeout(time.Minute))
+	rec := httptest.NewRecorder()
+	s := m.NewSession(&data{ID: 1, Name: "anon"})
+	is.NoErr(s.Save(ctx, rec))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	rec = httptest.NewRecorder()
+	rotated, err := m.Rotate(rec, req)
+	is.NoErr(err)
+	is.True(rotated.ID() != s.ID())
+	is.Equal(*rotated.Value, data{ID: 1, Name: "anon"})
+	_, err = m.Get(req)
+	is.Equal(err, ErrSessionNotFound)
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	v, err := m.GetValue(req)
+	is.NoErr(err)
+	is.Equal(v.Name, "anon")
+}
+
+func TestManager_Update(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		store *MemStore[data]
+	}{
+		{"no codec", NewMemStore[data](Forever)},
+		{"codec", NewMemStore[data](Forever, WithCodec(MsgpackCodec))},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer tt.store.Close()
+			is := is.New(t)
+			ctx := context.Background()
+			m := NewManager[data]("s", tt.store)
+			rec := httptest.NewRecorder()
+			is.NoErr(m.NewSession(&data{Name: "counter"}).Save(ctx, rec))
+			cookie := rec.Result().Cookies()[0]
+
+			const n = 50
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req := httptest.NewRequest("GET", "/", nil)
+					req.AddCookie(cookie)
+					err := m.Update(ctx, req, func(d *data) error {
+						d.ID++
+						return nil
+					})
+					if err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+			req := httptest.NewRequest("GET", "/", nil)
+			req.AddCookie(cookie)
+			v, err := m.GetValue(req)
+			is.NoErr(err)
+			is.Equal(v.ID, n)
+
+			// errors from the update function abort the update
+			demoErr := errors.New("demo error")
+			err = m.Update(ctx, req, func(d *data) error {
+				d.ID = 0
+				return demoErr
+			})
+			is.Equal(err, demoErr)
+			v, err = m.GetValue(req)
+			is.NoErr(err)
+			is.Equal(v.ID, n)
+		})
+	}
+}
+
+func TestManager_Update_notSupported(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	store, err := NewCookieStore[data](bytes.Repeat([]byte{1}, KeySize))
+	is.NoErr(err)
+	m := NewManager[data]("s", store)
+	rec := httptest.NewRecorder()
+	is.NoErr(m.NewSession(&data{}).Save(ctx, rec))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	err = m.Update(ctx, req, func(*data) error { return nil })
+	is.Equal(err, ErrUpdateNotSupported)
+}
+
+// addCounter counts how many times sessions are added to an index.
+type addCounter struct {
+	Index
+	mu   sync.Mutex
+	adds int
+}
+
+func (ac *addCounter) Add(ctx context.Context, owner, id string, expires time.Time) error {
+	ac.mu.Lock()
+	ac.adds++
+	ac.mu.Unlock()
+	return ac.Index.Add(ctx, owner, id, expires)
+}
+
+func TestSession_Update_keepsExpiry(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	store := NewMemStore[data](Forever)
+	defer store.Close()
+	index := &addCounter{Index: NewMemIndex()}
+	m := NewManager[data]("s", store, WithIdleTimeout(time.Hour))
+	m.Index = index
+	m.Owner = func(d *data) string { return d.Name }
+	s := m.NewSession(&data{Name: "owner"})
+	is.NoErr(s.Save(ctx, httptest.NewRecorder()))
+	is.Equal(index.adds, 1)
+
+	// updates only write the value, Touch and Save refresh the rest
+	is.NoErr(s.Update(ctx, func(d *data) error { d.ID++; return nil }))
+	is.Equal(s.Value.ID, 1)
+	is.Equal(index.adds, 1)
+}
+
+func TestRedisStore_Update(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	is := is.New(t)
+	ctx := context.Background()
+	rd := mockredis.NewMockUniversalClient(ctrl)
+	rs := NewRedisStore[data](rd, time.Second)
+	fn := func(d *data) error { d.ID++; return nil }
+
+	// conflicts are retried
+	gomock.InOrder(
+		rd.EXPECT().Watch(ctx, gomock.Any(), "one").Return(redis.TxFailedErr),
+		rd.EXPECT().Watch(ctx, gomock.Any(), "one").Return(nil),
+	)
+	_, err := rs.Update(ctx, "one", fn)
+	is.NoErr(err)
+
+	rd.EXPECT().Watch(ctx, gomock.Any(), "two").Return(redis.TxFailedErr).Times(maxUpdateRetries)
+	_, err = rs.Update(ctx, "two", fn)
+	is.Equal(err, ErrUpdateConflict)
+
+	rd.EXPECT().Watch(ctx, gomock.Any(), "three").Return(ErrSessionNotFound)
+	_, err = rs.Update(ctx, "three", fn)
+	is.Equal(err, ErrSessionNotFound)
+}
@@ -1,7 +1,6 @@
 package session
 
 import (
-	"bytes"
 	"context"
 	"encoding/gob"
 	"errors"
@@ -9,6 +8,8 @@ import (
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.hrry.dev/homelab/pkg/lru"
 )
 
 // RegisterSerializable will register a type for most session store's default
@@ -35,41 +36,102 @@ type Store[T any] interface {
 	Deleter
 }
 
-var ErrSessionNotFound = errors.New("session not found")
+// Expirer is a store that can change how long a single session lives
+// without rewriting it.
+type Expirer interface {
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+}
+
+// Updater is a store that can change a session without losing concurrent
+// updates. The update function may be called more than once.
+type Updater[T any] interface {
+	Update(ctx context.Context, key string, fn func(*T) error) (*T, error)
+}
+
+var (
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrNoIndex            = errors.New("session manager has no owner index")
+	ErrUpdateNotSupported = errors.New("session store does not support atomic updates")
+	ErrUpdateConflict     = errors.New("session was changed too many times during an update")
+	// ErrIdleTimeoutNotSupported is returned when saving a session with an
+	// idle timeout in a server side store that does not implement Expirer.
+	ErrIdleTimeoutNotSupported = errors.New("session store cannot expire idle sessions")
+)
 
-func NewStore[T any](client redis.UniversalClient, ttl time.Duration) Store[T] {
-	return NewRedisStore[T](client, ttl)
+// maxUpdateRetries is how many times an update is attempted when the
+// session keeps changing underneath it.
+const maxUpdateRetries = 10
+
+func NewStore[T any](client redis.UniversalClient, ttl time.Duration, opts ...StoreOpt) Store[T] {
+	return NewRedisStore[T](client, ttl, opts...)
 }
 
 const Forever = time.Duration(-1)
 
-func NewRedisStore[T any](client redis.UniversalClient, ttl time.Duration) *RedisStore[T] {
-	return &RedisStore[T]{c: client, ttl: ttl}
+type StoreOpt func(*storeOptions)
+
+// WithCodec sets the codec used to encode new session values. Values are
+// prefixed with the codec's version so sessions written with a different
+// codec can still be read.
+func WithCodec(c Codec) StoreOpt { return func(so *storeOptions) { so.codec = c } }
+
+// WithCapacity limits the number of sessions kept by a MemStore. Defaults to
+// lru.DefaultCapacity.
+func WithCapacity(n int) StoreOpt { return func(so *storeOptions) { so.capacity = n } }
+
+type storeOptions struct {
+	codec    Codec
+	capacity int
+}
+
+func newStoreOptions(opts []StoreOpt) storeOptions {
+	var so storeOptions
+	for _, o := range opts {
+		o(&so)
+	}
+	return so
+}
+
+// NewRedisStore creates a store that keeps sessions in redis. Values are
+// encoded with gob unless another codec is given.
+func NewRedisStore[T any](client redis.UniversalClient, ttl time.Duration, opts ...StoreOpt) *RedisStore[T] {
+	so := newStoreOptions(opts)
+	if so.codec == nil {
+		so.codec = GobCodec
+	}
+	return &RedisStore[T]{c: client, ttl: ttl, codec: so.codec}
 }
 
 var tidyTime = time.Second
 
-func NewMemStore[T any](ttl time.Duration) *MemStore[T] {
-	s := MemStore[T]{
-		m:   make(map[string]*memstoreValue[T]),
-		ttl: ttl,
+// NewMemStore creates an in-memory store. Values are kept as is unless a
+// codec is given, in which case they are stored encoded. The store should be
+// closed when it is no longer used.
+func NewMemStore[T any](ttl time.Duration, opts ...StoreOpt) *MemStore[T] {
+	so := newStoreOptions(opts)
+	return &MemStore[T]{
+		cache: lru.New[string, *memstoreValue[T]](lru.Options{
+			Capacity:        so.capacity,
+			CleanupInterval: tidyTime,
+			Now:             now,
+		}),
+		ttl:   ttl,
+		codec: so.codec,
 	}
-	go s.tidy(tidyTime)
-	return &s
 }
 
 type RedisStore[T any] struct {
-	c   redis.UniversalClient
-	ttl time.Duration
+	c     redis.UniversalClient
+	ttl   time.Duration
+	codec Codec
 }
 
 func (rs *RedisStore[T]) Set(ctx context.Context, key string, val *T) error {
-	var b bytes.Buffer
-	err := gob.NewEncoder(&b).Encode(val)
+	b, err := encode(rs.codec, val)
 	if err != nil {
 		return err
 	}
-	return rs.c.Set(ctx, key, b.String(), rs.ttl).Err()
+	return rs.c.Set(ctx, key, string(b), rs.ttl).Err()
 }
 
 func (rs *RedisStore[T]) Get(ctx context.Context, key string) (v *T, err error) {
@@ -83,7 +145,51 @@ func (rs *RedisStore[T]) Get(ctx context.Context, key string) (v *T, err error)
 		return nil, err
 	}
 	v = new(T)
-	return v, gob.NewDecoder(bytes.NewBuffer(b)).Decode(v)
+	if err = decode(b, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Update watches the session's key and retries the update if the session is
+// changed before it is written. The session keeps its expiry.
+func (rs *RedisStore[T]) Update(ctx context.Context, key string, fn func(*T) error) (*T, error) {
+	var v *T
+	txf := func(tx *redis.Tx) error {
+		b, err := tx.Get(ctx, key).Bytes()
+		switch err {
+		case nil:
+		case redis.Nil:
+			return ErrSessionNotFound
+		default:
+			return err
+		}
+		v = new(T)
+		if err = decode(b, v); err != nil {
+			return err
+		}
+		if err = fn(v); err != nil {
+			return err
+		}
+		if b, err = encode(rs.codec, v); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			return p.Set(ctx, key, string(b), redis.KeepTTL).Err()
+		})
+		return err
+	}
+	for i := 0; i < maxUpdateRetries; i++ {
+		err := rs.c.Watch(ctx, txf, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	return nil, ErrUpdateConflict
 }
 
 func (rs *RedisStore[T]) Del(ctx context.Context, key string) error {
@@ -96,62 +202,139 @@ func (rs *RedisStore[T]) Del(ctx context.Context, key string) error {
 	}
 }
 
+func (rs *RedisStore[T]) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	ok, err := rs.c.Expire(ctx, key, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
 func (rs *RedisStore[T]) SetTTL(ttl time.Duration) { rs.ttl = ttl }
 
+// MemStore keeps sessions in memory. The number of sessions is bounded,
+// the least recently used session is evicted when the store is full.
 type MemStore[T any] struct {
-	mu  sync.RWMutex
-	m   map[string]*memstoreValue[T]
-	ttl time.Duration
+	// mu serializes writes so that updates are atomic.
+	mu    sync.Mutex
+	cache *lru.Cache[string, *memstoreValue[T]]
+	ttl   time.Duration
+	codec Codec
 }
 
 type memstoreValue[T any] struct {
-	v  *T
-	ts time.Time
+	v *T
+	// b is the encoded value when the store has a codec.
+	b []byte
+}
+
+func (v *memstoreValue[T]) value() (*T, error) {
+	if v.b == nil {
+		return v.v, nil
+	}
+	val := new(T)
+	if err := decode(v.b, val); err != nil {
+		return nil, err
+	}
+	return val, nil
 }
 
 func (ms *MemStore[T]) Set(ctx context.Context, key string, val *T) error {
-	v := &memstoreValue[T]{v: val, ts: time.Now()}
+	v := &memstoreValue[T]{v: val}
+	if ms.codec != nil {
+		b, err := encode(ms.codec, val)
+		if err != nil {
+			return err
+		}
+		v.v, v.b = nil, b
+	}
 	ms.mu.Lock()
-	ms.m[key] = v
+	ms.cache.SetWithTTL(key, v, ms.ttl)
 	ms.mu.Unlock()
 	return nil
 }
 
 func (ms *MemStore[T]) Get(ctx context.Context, key string) (*T, error) {
-	ms.mu.RLock()
-	defer ms.mu.RUnlock()
-	v, ok := ms.m[key]
+	v, ok := ms.cache.Get(key)
 	if !ok {
 		return nil, ErrSessionNotFound
 	}
-	return v.v, nil
+	return v.value()
+}
+
+// Update changes a session while holding the store's lock. Values stored
+// without a codec are copied before the update so that readers never see a
+// partial update.
+func (ms *MemStore[T]) Update(ctx context.Context, key string, fn func(*T) error) (*T, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	v, ok := ms.cache.Get(key)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	val, err := v.value()
+	if err != nil {
+		return nil, err
+	}
+	if v.b == nil {
+		val = clone(val)
+	}
+	if err = fn(val); err != nil {
+		return nil, err
+	}
+	next := &memstoreValue[T]{v: val}
+	if ms.codec != nil {
+		b, err := encode(ms.codec, val)
+		if err != nil {
+			return nil, err
+		}
+		next.v, next.b = nil, b
+	}
+	if !ms.cache.Replace(key, next) {
+		return nil, ErrSessionNotFound
+	}
+	return val, nil
+}
+
+// clone copies a session value along with the flash messages of its Extras
+// so that appending to or popping flashes doesn't change the original.
+func clone[T any](val *T) *T {
+	cp := *val
+	if h, ok := any(&cp).(extrasHolder); ok {
+		e := h.sessionExtras()
+		e.Flashes = append([]Flash(nil), e.Flashes...)
+	}
+	return &cp
 }
 
 func (ms *MemStore[T]) Del(ctx context.Context, key string) error {
 	ms.mu.Lock()
-	delete(ms.m, key)
+	ms.cache.Del(key)
 	ms.mu.Unlock()
 	return nil
 }
 
+func (ms *MemStore[T]) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	if !ms.cache.Expire(key, ttl) {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
 func (ms *MemStore[T]) SetTTL(ttl time.Duration) { ms.ttl = ttl }
 
-var now = time.Now
+// Stats returns the store's hit, miss, and eviction counts.
+func (ms *MemStore[T]) Stats() lru.Stats { return ms.cache.Stats() }
 
-func (ms *MemStore[T]) tidy(period time.Duration) {
-	ticker := time.NewTicker(period)
-	for {
-		<-ticker.C
-		if ms.ttl == -1 {
-			continue
-		}
-		n := now()
-		for key, val := range ms.m {
-			if n.After(val.ts.Add(ms.ttl)) {
-				ms.mu.Lock()
-				delete(ms.m, key)
-				ms.mu.Unlock()
-			}
-		}
-	}
+// Collector exports the store's stats as prometheus metrics.
+func (ms *MemStore[T]) Collector(namespace string) prometheus.Collector {
+	return ms.cache.Collector(namespace, "session_store")
 }
+
+// Close stops removing expired sessions in the background.
+func (ms *MemStore[T]) Close() error { return ms.cache.Close() }
+
+var now = time.Now
@@ -15,6 +15,6 @@ mockgen -package mockredis -destination $dest/mockredis/cmdable.go github.com/go
 mockgen -package mockusers -destination $dest/mockusers/store.go "$pkg/pkg/app" UserStore
 mockgen -package mockrows -destination $dest/mockrows/db.go "$pkg/pkg/db" Rows
 mockgen -package mockws -destination $dest/mockws/ws.go "$pkg/pkg/ws" Connection
-mockgen -package mockemail -destination $dest/mockemail/email.go "$pkg/pkg/email" Client
+mockgen -package mockemail -destination $dest/mockemail/email.go "$pkg/pkg/email" Client,Sender
 mockgen -package mockinvite -destination $dest/mockinvite/invites.go "$pkg/pkg/invite" Store,Mailer
 
@@ -78,9 +78,7 @@ def test_bootstrap_css():
 
 def private_pages():
     results = [
-        requests.get(f"{URL}/invite_email"),
         requests.get(f"{URL}/harry_y_tanya"),
-        requests.get(f"{URL}/invite_email/index.html"),
         requests.get(f"{URL}/harry_y_tanya/inex.html"),
     ]
     for res in results: